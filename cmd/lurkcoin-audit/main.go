@@ -0,0 +1,130 @@
+//
+// lurkcoin
+// Copyright © 2020 by luk3yx
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/luk3yx/lurkcoin-core/lurkcoin"
+	"github.com/luk3yx/lurkcoin-core/lurkcoin/api"
+	"log"
+	"os"
+	"text/tabwriter"
+)
+
+func optionalCurrency(c *lurkcoin.Currency) string {
+	if c == nil {
+		return "-"
+	}
+	return c.String()
+}
+
+func main() {
+	all := flag.Bool("all", false, "List every server, not only servers "+
+		"with mismatched balances.")
+	jsonOutput := flag.Bool("json", false, "Write the report as JSON.")
+	strict := flag.Bool("strict", false, "Treat warnings as problems.")
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(),
+			"Usage: lurkcoin-audit [OPTIONS] CONFIG")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	config, err := api.LoadConfig(flag.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if config.Database.Options == nil {
+		config.Database.Options = make(map[string]string)
+	}
+	if _, ok := config.Database.Options["timeout"]; !ok {
+		config.Database.Options["timeout"] = "5s"
+	}
+	db, err := api.OpenDatabase(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	j, err := api.OpenJournal(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if j == nil {
+		log.Println("Warning: The journal is not enabled, balances can " +
+			"only be checked against complete histories.")
+	}
+
+	report, err := lurkcoin.AuditDatabase(db, j)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	problems := 0
+	for _, discrepancy := range report.Discrepancies {
+		if !discrepancy.Warning || *strict {
+			problems++
+		}
+	}
+
+	if *jsonOutput {
+		if report.Servers == nil {
+			report.Servers = []lurkcoin.ServerAudit{}
+		}
+		if report.Discrepancies == nil {
+			report.Discrepancies = []lurkcoin.Discrepancy{}
+		}
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "\t")
+		encoder.Encode(report)
+	} else {
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "Server\tBalance\tHistory\tJournal\tAdmin changes")
+		for _, audit := range report.Servers {
+			if !*all && !audit.Mismatched() {
+				continue
+			}
+			adminChanged := "no"
+			if audit.AdminChanged {
+				adminChanged = "yes"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", audit.Server,
+				audit.Balance, optionalCurrency(audit.HistoryBalance),
+				optionalCurrency(audit.JournalBalance), adminChanged)
+		}
+		w.Flush()
+
+		fmt.Printf("\n%d server(s), total balance %s.\n",
+			len(report.Servers), report.TotalBalance)
+		for _, discrepancy := range report.Discrepancies {
+			fmt.Println(discrepancy)
+		}
+		if problems > 0 {
+			fmt.Fprintf(os.Stderr, "%d problem(s) found.\n", problems)
+		}
+	}
+
+	if problems > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,72 @@
+//
+// lurkcoin: WebAssembly bindings
+// Copyright © 2020 by luk3yx
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+// Loads lurkcoin.wasm and returns an object with the simulation functions.
+// Go's wasm_exec.js must be loaded first. source can be a URL or an
+// ArrayBuffer containing lurkcoin.wasm.
+//
+// Servers are objects with "name", "balance" and (optionally)
+// "target_balance" keys. Errors are thrown with the lurkcoin error code in
+// the "code" property.
+"use strict";
+
+async function loadLurkcoin(source = "lurkcoin.wasm") {
+	const go = new Go();
+	let result;
+	if (typeof source === "string") {
+		const res = await fetch(source);
+		result = await WebAssembly.instantiate(await res.arrayBuffer(),
+			go.importObject);
+	} else {
+		result = await WebAssembly.instantiate(source, go.importObject);
+	}
+	go.run(result.instance);
+
+	function call(method, params) {
+		const res = JSON.parse(lurkcoinWasm(method,
+			JSON.stringify(params || {})));
+		if (!res.success) {
+			const err = new Error(res.message);
+			err.code = res.error;
+			throw err;
+		}
+		return res.result;
+	}
+
+	return {
+		version: () => call("version"),
+		parseCurrency: amount => call("parse_currency", {amount}),
+
+		// Returns {amount, rate}.
+		exchangeRate: (server, amount, toLurkcoin = false) =>
+			call("exchange_rate", {
+				server,
+				amount,
+				to_lurkcoin: toLurkcoin,
+			}),
+
+		// Accepts the same parameters as /v3/pay, except that source_server
+		// and target_server are server objects. Returns the transaction and
+		// the updated servers.
+		pay: params => call("pay", params),
+	};
+}
+
+if (typeof module !== "undefined") {
+	module.exports = loadLurkcoin;
+}
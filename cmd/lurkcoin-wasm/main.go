@@ -0,0 +1,185 @@
+//
+// lurkcoin: WebAssembly bindings
+// Copyright © 2020 by luk3yx
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+// +build js,wasm
+
+// Exposes lurkcoin's exchange rate and payment logic to JavaScript so that
+// outcomes can be simulated without contacting a lurkcoin server. See
+// lurkcoin.js for the JavaScript side.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/luk3yx/lurkcoin-core/lurkcoin"
+	"io/ioutil"
+	"log"
+	"syscall/js"
+)
+
+// A server's state, nothing is stored between calls.
+type simServer struct {
+	Name          string            `json:"name"`
+	Balance       lurkcoin.Currency `json:"balance"`
+	TargetBalance lurkcoin.Currency `json:"target_balance"`
+}
+
+func (self *simServer) decode() (*lurkcoin.Server, error) {
+	if self.Balance.IsNil() {
+		return nil, errors.New("ERR_INVALIDAMOUNT")
+	}
+	targetBalance := self.TargetBalance
+	if targetBalance.IsNil() {
+		targetBalance = lurkcoin.GetDefaultTargetBalance()
+	}
+	encoded := lurkcoin.EncodedServer{
+		Name:          self.Name,
+		Balance:       self.Balance.Int(),
+		TargetBalance: targetBalance.Int(),
+	}
+	return encoded.Decode(), nil
+}
+
+func encodeSimServer(server *lurkcoin.Server) *simServer {
+	return &simServer{server.Name, server.GetBalance(),
+		server.GetTargetBalance()}
+}
+
+var methods = map[string]func([]byte) (interface{}, error){
+	"version": func([]byte) (interface{}, error) {
+		return lurkcoin.VERSION, nil
+	},
+
+	"parse_currency": func(raw []byte) (interface{}, error) {
+		var p struct {
+			Amount lurkcoin.Currency `json:"amount"`
+		}
+		if json.Unmarshal(raw, &p) != nil || p.Amount.IsNil() {
+			return nil, errors.New("ERR_INVALIDAMOUNT")
+		}
+		return map[string]interface{}{
+			"value":  p.Amount,
+			"string": p.Amount.String(),
+		}, nil
+	},
+
+	// Converts lurkcoins to the server's currency or the other way around.
+	"exchange_rate": func(raw []byte) (interface{}, error) {
+		var p struct {
+			Server     simServer         `json:"server"`
+			Amount     lurkcoin.Currency `json:"amount"`
+			ToLurkcoin bool              `json:"to_lurkcoin"`
+		}
+		if err := json.Unmarshal(raw, &p); err != nil {
+			return nil, errors.New("ERR_INVALIDREQUEST")
+		}
+		if p.Amount.IsNil() {
+			return nil, errors.New("ERR_INVALIDAMOUNT")
+		}
+		server, err := p.Server.decode()
+		if err != nil {
+			return nil, err
+		}
+		amount, rate := server.GetExchangeRate(p.Amount, p.ToLurkcoin)
+		return map[string]interface{}{
+			"amount": amount,
+			"rate":   json.RawMessage(rate.String()),
+		}, nil
+	},
+
+	// Simulates a payment and returns the transaction and the servers'
+	// new balances.
+	"pay": func(raw []byte) (interface{}, error) {
+		var p struct {
+			SourceServer  simServer         `json:"source_server"`
+			TargetServer  *simServer        `json:"target_server"`
+			Source        string            `json:"source"`
+			Target        string            `json:"target"`
+			Amount        lurkcoin.Currency `json:"amount"`
+			LocalCurrency bool              `json:"local_currency"`
+		}
+		if err := json.Unmarshal(raw, &p); err != nil {
+			return nil, errors.New("ERR_INVALIDREQUEST")
+		}
+		if p.Amount.IsNil() {
+			return nil, errors.New("ERR_INVALIDAMOUNT")
+		}
+		sourceServer, err := p.SourceServer.decode()
+		if err != nil {
+			return nil, err
+		}
+
+		// Payments to users on the same server don't need a target server.
+		targetServer := sourceServer
+		if p.TargetServer != nil && lurkcoin.HomogeniseUsername(
+			p.TargetServer.Name) != sourceServer.UID {
+			targetServer, err = p.TargetServer.decode()
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		transaction, err := sourceServer.Pay(p.Source, p.Target, targetServer,
+			p.Amount, p.LocalCurrency, true)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{
+			"transaction":   transaction,
+			"source_server": encodeSimServer(sourceServer),
+			"target_server": encodeSimServer(targetServer),
+		}, nil
+	},
+}
+
+// lurkcoinWasm(method, params) takes and returns JSON strings. The result is
+// in the same format as version 3 of the API.
+func call(_ js.Value, args []js.Value) interface{} {
+	var result interface{}
+	var err error
+	if len(args) != 2 || args[0].Type() != js.TypeString ||
+		args[1].Type() != js.TypeString {
+		err = errors.New("ERR_INVALIDREQUEST")
+	} else if f, ok := methods[args[0].String()]; ok {
+		result, err = f([]byte(args[1].String()))
+	} else {
+		err = errors.New("ERR_INVALIDREQUEST")
+	}
+
+	res := make(map[string]interface{})
+	if err == nil {
+		res["success"] = true
+		res["result"] = result
+	} else {
+		res["success"] = false
+		res["error"], res["message"], _ = lurkcoin.LookupError(err.Error())
+	}
+	raw, err := json.Marshal(res)
+	if err != nil {
+		raw = []byte(`{"success":false,"error":"ERR_INTERNALERROR","message":"Internal error!"}`)
+	}
+	return string(raw)
+}
+
+func main() {
+	// Pay() logs transactions, which isn't useful here.
+	log.SetOutput(ioutil.Discard)
+
+	js.Global().Set("lurkcoinWasm", js.FuncOf(call))
+	select {}
+}
@@ -0,0 +1,202 @@
+//
+// lurkcoin: Backups
+// Copyright © 2020 by luk3yx
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/luk3yx/lurkcoin-core/lurkcoin"
+	"github.com/luk3yx/lurkcoin-core/lurkcoin/api"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// Returns the passphrase in file, or $LURKCOIN_BACKUP_PASSPHRASE if file is
+// empty.
+func readPassphrase(file string) string {
+	if file == "" {
+		return os.Getenv("LURKCOIN_BACKUP_PASSPHRASE")
+	}
+	raw, err := ioutil.ReadFile(file)
+	if err != nil {
+		fatal(err)
+	}
+	return strings.TrimRight(string(raw), "\r\n")
+}
+
+// Write to a temporary file first so that an existing file is not truncated
+// if something goes wrong.
+func writeFile(outputFile string, write func(io.Writer) error) error {
+	tmpFile := outputFile + ".tmp"
+	f, err := os.OpenFile(tmpFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	err = write(f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpFile)
+		return err
+	}
+	return os.Rename(tmpFile, outputFile)
+}
+
+// Returns the output file from the first positional argument, or "" for
+// stdout. -json writes a summary to stdout, so it needs an output file.
+func (self *command) outputFile() string {
+	outputFile := self.flags.Arg(0)
+	if outputFile == "-" {
+		outputFile = ""
+	}
+	if outputFile == "" && jsonOutput {
+		fatal("-json can only be used with an output file.")
+	}
+	return outputFile
+}
+
+func init() {
+	cmd := newCommand("backup", "backup [OPTIONS] [OUTPUT-FILE]",
+		"Backs up the database. The backup is written to stdout if no "+
+			"output file is specified.")
+	ndjson := cmd.flags.Bool("ndjson", false,
+		"Write the backup as newline-delimited JSON.")
+	compress := cmd.flags.Bool("gzip", false,
+		"Compress the backup with gzip.")
+	passphraseFile := cmd.flags.String("passphrase-file", "",
+		"Encrypt the backup with the passphrase in this file. The "+
+			"LURKCOIN_BACKUP_PASSPHRASE environment variable can also be "+
+			"used.")
+	cmd.run = func(args []string) {
+		cmd.parseFlags(args, 0, 1)
+		outputFile := cmd.outputFile()
+		passphrase := readPassphrase(*passphraseFile)
+		db := openDatabase(cmd.loadConfig())
+
+		backup := func(w io.Writer) error {
+			if *compress {
+				return lurkcoin.BackupDatabaseGzip(db, w, *ndjson)
+			} else if *ndjson {
+				return lurkcoin.BackupDatabaseNDJSON(db, w)
+			}
+			return lurkcoin.BackupDatabase(db, w)
+		}
+
+		// Encrypted backups have to be created in memory.
+		if passphrase != "" {
+			var buf bytes.Buffer
+			if err := backup(&buf); err != nil {
+				fatal(err)
+			}
+			data, err := lurkcoin.EncryptBackup(buf.Bytes(), passphrase)
+			if err != nil {
+				fatal(err)
+			}
+			backup = func(w io.Writer) error {
+				_, err := w.Write(data)
+				return err
+			}
+		}
+
+		if outputFile == "" {
+			if err := backup(os.Stdout); err != nil {
+				fatal(err)
+			}
+			return
+		}
+		if err := writeFile(outputFile, backup); err != nil {
+			fatal(err)
+		}
+		if jsonOutput {
+			info, err := os.Stat(outputFile)
+			if err != nil {
+				fatal(err)
+			}
+			printJSON(map[string]interface{}{
+				"file":      outputFile,
+				"size":      info.Size(),
+				"encrypted": passphrase != "",
+			})
+		}
+	}
+}
+
+func init() {
+	cmd := newCommand("restore-backup", "restore-backup [OPTIONS] BACKUP-FILE",
+		"Restores a backup created with \"lurkcoin backup\" or downloaded "+
+			"from the admin pages. Compressed backups are detected "+
+			"automatically.")
+	passphraseFile := cmd.flags.String("passphrase-file", "",
+		"The file containing the passphrase for encrypted backups. The "+
+			"LURKCOIN_BACKUP_PASSPHRASE environment variable can also be "+
+			"used.")
+	deleteMissing := cmd.flags.Bool("delete-missing", false,
+		"Delete servers that aren't in the backup.")
+	cmd.run = func(args []string) {
+		cmd.parseFlags(args, 1, 1)
+		backupFile := cmd.flags.Arg(0)
+		data, err := ioutil.ReadFile(backupFile)
+		if err != nil {
+			fatal(err)
+		}
+
+		// Decrypt encrypted backups (created with "lurkcoin backup").
+		if lurkcoin.IsEncryptedBackup(data) {
+			data, err = lurkcoin.DecryptBackup(data,
+				readPassphrase(*passphraseFile))
+			if err != nil {
+				fatal(err)
+			}
+		}
+
+		config := cmd.loadConfig()
+		lurkcoin.SeedPRNG()
+		db := openWritableDatabase(config)
+		j, err := api.OpenJournal(config)
+		if err != nil {
+			fatal(err)
+		}
+		lurkcoin.SetJournal(j)
+
+		action := "restore_backup"
+		if *deleteMissing {
+			action = "restore_backup_full"
+			err = lurkcoin.RestoreDatabaseFull(db, bytes.NewReader(data))
+		} else {
+			err = lurkcoin.RestoreDatabase(db, bytes.NewReader(data))
+		}
+		if err != nil {
+			fatal(err)
+		}
+		journalAdminAction(action, "", backupFile)
+
+		if jsonOutput {
+			printJSON(map[string]interface{}{
+				"file":           backupFile,
+				"delete_missing": *deleteMissing,
+			})
+			return
+		}
+		fmt.Printf("Restored %s into %s.\n", backupFile,
+			config.Database.Location)
+	}
+}
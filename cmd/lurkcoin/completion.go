@@ -0,0 +1,195 @@
+//
+// lurkcoin
+// Copyright © 2020 by luk3yx
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+func init() {
+	cmd := newCommand("completion", "completion bash|zsh|fish",
+		"Prints a shell completion script.")
+	cmd.subcommands = []string{"bash", "zsh", "fish"}
+	cmd.run = func(args []string) {
+		cmd.parseFlags(args, 1, 1)
+		switch cmd.flags.Arg(0) {
+		case "bash":
+			writeBashCompletion(os.Stdout)
+		case "zsh":
+			writeZshCompletion(os.Stdout)
+		case "fish":
+			writeFishCompletion(os.Stdout)
+		default:
+			fatalf("Unsupported shell: %q", cmd.flags.Arg(0))
+		}
+	}
+}
+
+type completionFlag struct {
+	name, usage string
+	isBool      bool
+}
+
+func getCompletionFlags(cmd *command) []completionFlag {
+	var res []completionFlag
+	cmd.flags.VisitAll(func(f *flag.Flag) {
+		b, ok := f.Value.(interface{ IsBoolFlag() bool })
+		res = append(res, completionFlag{f.Name, shortDescription(f.Usage),
+			ok && b.IsBoolFlag()})
+	})
+	return res
+}
+
+// Returns the first sentence of s.
+func shortDescription(s string) string {
+	if i := strings.Index(s, ". "); i >= 0 {
+		s = s[:i]
+	}
+	return strings.TrimSuffix(s, ".")
+}
+
+// Quotes s for use in a single-quoted shell string.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func writeBashCompletion(w io.Writer) {
+	names := sortedCommandNames()
+	fmt.Fprintln(w, "# bash completion for lurkcoin")
+	fmt.Fprintln(w, "_lurkcoin() {")
+	fmt.Fprintln(w, `    local cur="${COMP_WORDS[COMP_CWORD]}"`)
+	fmt.Fprintln(w, `    local prev="${COMP_WORDS[COMP_CWORD-1]}"`)
+	fmt.Fprintln(w, `    if [ "$COMP_CWORD" -eq 1 ]; then`)
+	fmt.Fprintf(w, "        COMPREPLY=($(compgen -W %s -- \"$cur\"))\n",
+		shellQuote(strings.Join(names, " ")))
+	fmt.Fprintln(w, "        return")
+	fmt.Fprintln(w, "    fi")
+	fmt.Fprintln(w, `    if [ "$prev" = "-config" ] || [ "$prev" = "--config" ]; then`)
+	fmt.Fprintln(w, `        COMPREPLY=($(compgen -f -- "$cur"))`)
+	fmt.Fprintln(w, "        return")
+	fmt.Fprintln(w, "    fi")
+	fmt.Fprintln(w, `    case "${COMP_WORDS[1]}" in`)
+	for _, name := range names {
+		cmd := commands[name]
+		var flags []string
+		for _, f := range getCompletionFlags(cmd) {
+			flags = append(flags, "-"+f.name)
+		}
+		fmt.Fprintf(w, "        %s)\n", name)
+		if len(cmd.subcommands) > 0 {
+			fmt.Fprintln(w, `            if [ "$COMP_CWORD" -eq 2 ]; then`)
+			fmt.Fprintf(w, "                COMPREPLY=($(compgen -W %s -- \"$cur\"))\n",
+				shellQuote(strings.Join(cmd.subcommands, " ")))
+			fmt.Fprintln(w, "                return")
+			fmt.Fprintln(w, "            fi")
+		}
+		fmt.Fprintf(w, "            COMPREPLY=($(compgen -W %s -- \"$cur\"))\n",
+			shellQuote(strings.Join(flags, " ")))
+		fmt.Fprintln(w, "            ;;")
+	}
+	fmt.Fprintln(w, "    esac")
+	fmt.Fprintln(w, "}")
+	fmt.Fprintln(w, "complete -F _lurkcoin lurkcoin")
+}
+
+// Escapes characters that have special meanings in zsh's _arguments and
+// _describe specs.
+func zshEscape(s string) string {
+	return strings.NewReplacer(`[`, `\[`, `]`, `\]`, `:`, `\:`).Replace(s)
+}
+
+func writeZshCompletion(w io.Writer) {
+	names := sortedCommandNames()
+	fmt.Fprintln(w, "#compdef lurkcoin")
+	fmt.Fprintln(w, "_lurkcoin() {")
+	fmt.Fprintln(w, "    local -a commands")
+	fmt.Fprintln(w, "    commands=(")
+	for _, name := range names {
+		fmt.Fprintf(w, "        %s\n", shellQuote(name+":"+
+			zshEscape(shortDescription(commands[name].description))))
+	}
+	fmt.Fprintln(w, "    )")
+	fmt.Fprintln(w, "    if (( CURRENT == 2 )); then")
+	fmt.Fprintln(w, "        _describe 'command' commands")
+	fmt.Fprintln(w, "        return")
+	fmt.Fprintln(w, "    fi")
+	fmt.Fprintln(w, "    case $words[2] in")
+	for _, name := range names {
+		cmd := commands[name]
+		fmt.Fprintf(w, "        %s)\n", name)
+		if len(cmd.subcommands) > 0 {
+			fmt.Fprintln(w, "            if (( CURRENT == 3 )); then")
+			fmt.Fprintf(w, "                compadd %s\n",
+				strings.Join(cmd.subcommands, " "))
+			fmt.Fprintln(w, "                return")
+			fmt.Fprintln(w, "            fi")
+			fmt.Fprintln(w, "            shift words; (( CURRENT-- ))")
+		}
+		fmt.Fprintln(w, "            shift words; (( CURRENT-- ))")
+		fmt.Fprint(w, "            _arguments")
+		for _, f := range getCompletionFlags(cmd) {
+			spec := "-" + f.name + "[" + zshEscape(f.usage) + "]"
+			if f.name == "config" {
+				spec += ":file:_files"
+			} else if !f.isBool {
+				spec += ":" + f.name + ":"
+			}
+			fmt.Fprintf(w, " \\\n                %s", shellQuote(spec))
+		}
+		fmt.Fprintln(w, " \\\n                '*:argument:'")
+		fmt.Fprintln(w, "            ;;")
+	}
+	fmt.Fprintln(w, "    esac")
+	fmt.Fprintln(w, "}")
+	fmt.Fprintln(w, `_lurkcoin "$@"`)
+}
+
+func writeFishCompletion(w io.Writer) {
+	names := sortedCommandNames()
+	fmt.Fprintln(w, "# fish completion for lurkcoin")
+	fmt.Fprintln(w, "complete -c lurkcoin -f")
+	for _, name := range names {
+		fmt.Fprintf(w, "complete -c lurkcoin -n __fish_use_subcommand -a %s -d %s\n",
+			name, shellQuote(shortDescription(commands[name].description)))
+	}
+	for _, name := range names {
+		cmd := commands[name]
+		cond := "__fish_seen_subcommand_from " + name
+		if len(cmd.subcommands) > 0 {
+			fmt.Fprintf(w, "complete -c lurkcoin -n %s -a %s\n",
+				shellQuote(cond+"; and not __fish_seen_subcommand_from "+
+					strings.Join(cmd.subcommands, " ")),
+				shellQuote(strings.Join(cmd.subcommands, " ")))
+		}
+		for _, f := range getCompletionFlags(cmd) {
+			extra := ""
+			if f.name == "config" {
+				extra = " -r -F"
+			} else if !f.isBool {
+				extra = " -r"
+			}
+			fmt.Fprintf(w, "complete -c lurkcoin -n %s -o %s%s -d %s\n",
+				shellQuote(cond), f.name, extra, shellQuote(f.usage))
+		}
+	}
+}
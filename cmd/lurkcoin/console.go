@@ -0,0 +1,354 @@
+//
+// lurkcoin: Database console
+// Copyright © 2020 by luk3yx
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/luk3yx/lurkcoin-core/lurkcoin"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// A read-only console for inspecting the database. Nothing is ever written
+// to the database, so this is safer than editing database files by hand.
+type console struct {
+	db  lurkcoin.Database
+	out io.Writer
+}
+
+type consoleCommand struct {
+	usage, help string
+	f           func(*console, string)
+}
+
+var consoleCommands map[string]*consoleCommand
+
+func init() {
+	consoleCommands = map[string]*consoleCommand{
+		"help":    {"help", "Shows this message.", (*console).help},
+		"servers": {"servers", "Lists all servers.", (*console).servers},
+		"show":    {"show SERVER", "Shows a server.", (*console).show},
+		"history": {"history SERVER", "Shows a server's transaction history.",
+			(*console).history},
+		"pending": {"pending [SERVER]", "Shows pending transactions.",
+			(*console).pending},
+		"decode": {"decode TRANSACTION-ID",
+			"Decodes a transaction ID and searches for the transaction.",
+			(*console).decode},
+		"exit": {"exit", "Exits the console.", nil},
+	}
+	consoleCommands["ls"] = consoleCommands["servers"]
+	consoleCommands["quit"] = consoleCommands["exit"]
+
+	cmd := newCommand("console", "console [OPTIONS] [COMMAND [ARGS]]",
+		"Opens the database read-only and starts a console for inspecting "+
+			"it, or runs a single console command. -json can only be used "+
+			"when running a single command.")
+	cmd.subcommands = sortedConsoleCommandNames(true)
+	cmd.run = func(args []string) {
+		cmd.parseFlags(args, 0, 2)
+		c := &console{openDatabase(cmd.loadConfig()), os.Stdout}
+
+		// Run a single command if one was specified.
+		if cmd.flags.NArg() > 0 {
+			c.run(strings.Join(cmd.flags.Args(), " "))
+			return
+		}
+		if jsonOutput {
+			fatal("-json can only be used when running a single command.")
+		}
+
+		fmt.Println(`lurkcoin console, type "help" for a list of commands.`)
+		scanner := bufio.NewScanner(os.Stdin)
+		for {
+			fmt.Print("lurkcoin> ")
+			if !scanner.Scan() || !c.run(scanner.Text()) {
+				break
+			}
+		}
+		fmt.Println()
+	}
+}
+
+// Returns the names of console commands, optionally including aliases.
+func sortedConsoleCommandNames(aliases bool) []string {
+	names := make([]string, 0, len(consoleCommands))
+	for name, cmd := range consoleCommands {
+		if aliases || strings.HasPrefix(cmd.usage, name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (self *console) printf(format string, args ...interface{}) {
+	fmt.Fprintf(self.out, format, args...)
+}
+
+// Prints an error message. With -json, this exits (since -json can only be
+// used for single commands).
+func (self *console) errorf(format string, args ...interface{}) {
+	if jsonOutput {
+		fatalf(format, args...)
+	}
+	self.printf(format+"\n", args...)
+}
+
+func (self *console) help(string) {
+	names := sortedConsoleCommandNames(false)
+	if jsonOutput {
+		res := make(map[string]string, len(names))
+		for _, name := range names {
+			res[consoleCommands[name].usage] = consoleCommands[name].help
+		}
+		printJSON(res)
+		return
+	}
+
+	w := tabwriter.NewWriter(self.out, 0, 4, 2, ' ', 0)
+	for _, name := range names {
+		fmt.Fprintf(w, "  %s\t%s\n", consoleCommands[name].usage,
+			consoleCommands[name].help)
+	}
+	w.Flush()
+}
+
+// Gets a single server and frees it immediately, the returned object is only
+// used for reading.
+func (self *console) getServer(name string) (*lurkcoin.Server, bool) {
+	if name == "" {
+		self.errorf("No server specified.")
+		return nil, false
+	}
+	tr := lurkcoin.BeginDbTransaction(self.db)
+	defer tr.Abort()
+	server, ok := tr.GetOneServer(name)
+	if !ok {
+		self.errorf("The server %q does not exist.", name)
+	}
+	return server, ok
+}
+
+type consoleServer struct {
+	Name                string            `json:"name"`
+	UID                 string            `json:"uid,omitempty"`
+	Balance             lurkcoin.Currency `json:"balance"`
+	TargetBalance       lurkcoin.Currency `json:"target_balance"`
+	WebhookURL          string            `json:"webhook_url,omitempty"`
+	PendingTransactions int               `json:"pending_transactions"`
+	History             int               `json:"history,omitempty"`
+}
+
+func (self *console) servers(string) {
+	var servers []consoleServer
+	err := self.db.ForEachEncoded(func(encodedServer *lurkcoin.EncodedServer) error {
+		if encodedServer.AliasOf != "" || encodedServer.DeletedAt != 0 {
+			return nil
+		}
+		server := encodedServer.Decode()
+		servers = append(servers, consoleServer{
+			Name:                server.Name,
+			Balance:             server.GetBalance(),
+			TargetBalance:       server.GetTargetBalance(),
+			PendingTransactions: len(server.GetPendingTransactions()),
+		})
+		return nil
+	})
+	if err != nil {
+		self.errorf("Error: %s", err)
+		return
+	}
+	if jsonOutput {
+		if servers == nil {
+			servers = []consoleServer{}
+		}
+		printJSON(servers)
+		return
+	}
+
+	w := tabwriter.NewWriter(self.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tBALANCE\tTARGET BALANCE\tPENDING")
+	for _, server := range servers {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\n", server.Name, server.Balance,
+			server.TargetBalance, server.PendingTransactions)
+	}
+	w.Flush()
+	self.printf("%d server(s)\n", len(servers))
+}
+
+func (self *console) show(name string) {
+	server, ok := self.getServer(name)
+	if !ok {
+		return
+	}
+	if jsonOutput {
+		printJSON(consoleServer{
+			Name:                server.Name,
+			UID:                 server.UID,
+			Balance:             server.GetBalance(),
+			TargetBalance:       server.GetTargetBalance(),
+			WebhookURL:          server.WebhookURL,
+			PendingTransactions: len(server.GetPendingTransactions()),
+			History:             len(server.GetHistory()),
+		})
+		return
+	}
+	w := tabwriter.NewWriter(self.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "Name:\t%s\n", server.Name)
+	fmt.Fprintf(w, "UID:\t%s\n", server.UID)
+	fmt.Fprintf(w, "Balance:\t%s\n", server.GetBalance())
+	fmt.Fprintf(w, "Target balance:\t%s\n", server.GetTargetBalance())
+	fmt.Fprintf(w, "Webhook URL:\t%s\n", server.WebhookURL)
+	fmt.Fprintf(w, "Pending transactions:\t%d\n",
+		len(server.GetPendingTransactions()))
+	fmt.Fprintf(w, "Transactions in history:\t%d\n",
+		len(server.GetHistory()))
+	w.Flush()
+}
+
+func (self *console) printTransactions(transactions []lurkcoin.Transaction) {
+	if jsonOutput {
+		if transactions == nil {
+			transactions = []lurkcoin.Transaction{}
+		}
+		printJSON(transactions)
+		return
+	}
+	if len(transactions) == 0 {
+		self.printf("No transactions.\n")
+		return
+	}
+	for _, transaction := range transactions {
+		self.printf("%s %s\n",
+			transaction.GetTime().Format("2006-01-02 15:04:05"), transaction)
+	}
+}
+
+func (self *console) history(name string) {
+	if server, ok := self.getServer(name); ok {
+		self.printTransactions(server.GetHistory())
+	}
+}
+
+func (self *console) pending(name string) {
+	if name != "" {
+		if server, ok := self.getServer(name); ok {
+			self.printTransactions(server.GetPendingTransactions())
+		}
+		return
+	}
+
+	tr := lurkcoin.BeginDbTransaction(self.db)
+	defer tr.Abort()
+	var transactions []lurkcoin.Transaction
+	tr.ForEach(func(server *lurkcoin.Server) error {
+		transactions = append(transactions,
+			server.GetPendingTransactions()...)
+		return nil
+	}, false)
+	self.printTransactions(transactions)
+}
+
+func (self *console) decode(id string) {
+	t, n, ok := lurkcoin.ParseTransactionID(id)
+	if !ok {
+		self.errorf("Invalid transaction ID.")
+		return
+	}
+
+	// Search for the transaction.
+	var found *lurkcoin.Transaction
+	foundIn := []string{}
+	pendingOn := []string{}
+	tr := lurkcoin.BeginDbTransaction(self.db)
+	defer tr.Abort()
+	tr.ForEach(func(server *lurkcoin.Server) error {
+		for _, transaction := range server.GetHistory() {
+			if transaction.ID == id {
+				transaction := transaction
+				found = &transaction
+				foundIn = append(foundIn, server.Name)
+			}
+		}
+		for _, transaction := range server.GetPendingTransactions() {
+			if transaction.ID == id {
+				pendingOn = append(pendingOn, server.Name)
+			}
+		}
+		return nil
+	}, false)
+
+	legacyID := (&lurkcoin.Transaction{ID: id}).GetLegacyID()
+	if jsonOutput {
+		printJSON(map[string]interface{}{
+			"id":          id,
+			"time":        t.Unix(),
+			"random_part": n,
+			"legacy_id":   legacyID,
+			"transaction": found,
+			"found_in":    foundIn,
+			"pending_on":  pendingOn,
+		})
+		return
+	}
+
+	self.printf("Time: %s\n", t.Format(time.RFC1123))
+	self.printf("Random part: %d\n", n)
+	self.printf("Legacy (v2) ID: %d\n", legacyID)
+	for _, name := range foundIn {
+		self.printf("Found in the history of %q: %s\n", name, found)
+	}
+	for _, name := range pendingOn {
+		self.printf("Pending on %q.\n", name)
+	}
+	if found == nil {
+		self.printf("The transaction is not in any server's history.\n")
+	}
+}
+
+// Runs a command, returns false if the console should exit.
+func (self *console) run(line string) bool {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return true
+	}
+	var name, args string
+	if i := strings.IndexAny(line, " \t"); i >= 0 {
+		name, args = line[:i], strings.TrimSpace(line[i+1:])
+	} else {
+		name = line
+	}
+
+	cmd, ok := consoleCommands[strings.ToLower(name)]
+	if !ok {
+		self.errorf("Unknown command %q, type \"help\" for a list of "+
+			"commands.", name)
+	} else if cmd.f == nil {
+		return false
+	} else {
+		cmd.f(self, args)
+	}
+	return true
+}
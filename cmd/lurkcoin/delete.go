@@ -0,0 +1,111 @@
+//
+// lurkcoin: Server deletion
+// Copyright © 2020 by luk3yx
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/luk3yx/lurkcoin-core/lurkcoin"
+	"github.com/luk3yx/lurkcoin-core/lurkcoin/api"
+	"os"
+	"strings"
+)
+
+func init() {
+	cmd := newCommand("delete", "delete [OPTIONS] SERVER",
+		"Deletes a server. Deleted servers can be undeleted until the "+
+			"retention period is over.")
+	yes := cmd.flags.Bool("yes", false, "Don't ask for confirmation.")
+	permanent := cmd.flags.Bool("permanent", false, "Permanently delete "+
+		"the server and any pending transactions sent by it now.")
+	cmd.run = func(args []string) {
+		cmd.parseFlags(args, 1, 1)
+		uid := lurkcoin.HomogeniseUsername(cmd.flags.Arg(0))
+		if !*yes {
+			fmt.Fprintf(os.Stderr, "Type %q to delete the server: ", uid)
+			line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+			if err != nil {
+				fatal(err)
+			}
+			if lurkcoin.HomogeniseUsername(strings.TrimSpace(line)) != uid {
+				fatal("You didn't type the correct server UID!")
+			}
+		}
+
+		config := cmd.loadConfig()
+		db := openWritableDatabase(config)
+		j, err := api.OpenJournal(config)
+		if err != nil {
+			fatal(err)
+		}
+		lurkcoin.SetJournal(j)
+
+		action := "delete_server"
+		var removed int
+		var ok bool
+		if *permanent {
+			action = "purge_server"
+			removed, ok = lurkcoin.PurgeServer(db, uid)
+		} else {
+			removed, ok = lurkcoin.DeleteServer(db, uid)
+		}
+		if !ok {
+			fatalf("The server %q does not exist.", uid)
+		}
+		journalAdminAction(action, uid, "")
+
+		if jsonOutput {
+			printJSON(map[string]interface{}{
+				"uid":                          uid,
+				"removed_pending_transactions": removed,
+			})
+			return
+		}
+		fmt.Printf("Deleted %q and %d pending transaction(s).\n", uid,
+			removed)
+	}
+}
+
+func init() {
+	cmd := newCommand("undelete", "undelete SERVER",
+		"Restores a deleted server.")
+	cmd.run = func(args []string) {
+		cmd.parseFlags(args, 1, 1)
+		uid := lurkcoin.HomogeniseUsername(cmd.flags.Arg(0))
+
+		config := cmd.loadConfig()
+		db := openWritableDatabase(config)
+		j, err := api.OpenJournal(config)
+		if err != nil {
+			fatal(err)
+		}
+		lurkcoin.SetJournal(j)
+
+		if !lurkcoin.UndeleteServer(db, uid) {
+			fatalf("The server %q has not been deleted.", uid)
+		}
+		journalAdminAction("undelete_server", uid, "")
+
+		if jsonOutput {
+			printJSON(map[string]string{"uid": uid})
+			return
+		}
+		fmt.Printf("Restored %q.\n", uid)
+	}
+}
@@ -19,47 +19,32 @@
 package main
 
 import (
-	"fmt"
 	"github.com/luk3yx/lurkcoin-core/lurkcoin"
-	"github.com/luk3yx/lurkcoin-core/lurkcoin/api"
-	"log"
-	"os"
 )
 
-func main() {
-	if len(os.Args) != 3 {
-		fmt.Println("This command takes exactly two arguments.")
-		fmt.Println("Usage: ./restore-backup CONFIG BACKUP-FILE")
-		os.Exit(1)
-	}
-
-	config, err := api.LoadConfig(os.Args[1])
-	if err != nil {
-		log.Fatal(err)
-	}
+func init() {
+	cmd := newCommand("dump", "dump [OPTIONS] SERVER",
+		"Prints everything stored about a server as JSON (in the same "+
+			"format as backups).")
+	redactToken := cmd.flags.Bool("redact-token", false,
+		"Replace the server's token with \"[REDACTED]\".")
+	cmd.run = func(args []string) {
+		cmd.parseFlags(args, 1, 1)
+		db := openDatabase(cmd.loadConfig())
+		tr := lurkcoin.BeginDbTransaction(db)
+		defer tr.Abort()
+		server, ok := tr.GetOneServer(cmd.flags.Arg(0))
+		if !ok {
+			fatalf("The server %q does not exist.", cmd.flags.Arg(0))
+		}
+		encoded := server.Encode()
+		tr.Abort()
 
-	lurkcoin.SeedPRNG()
-	lurkcoin.PrintASCIIArt()
+		if *redactToken {
+			encoded.Token = "[REDACTED]"
+		}
 
-	db, err := api.OpenDatabase(config)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	backupFile := os.Args[2]
-	log.Printf(
-		"Restoring backup %#v into %#v...\n",
-		backupFile,
-		config.Database.Location,
-	)
-	file, err := os.Open(backupFile)
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer file.Close()
-	err = lurkcoin.RestoreDatabase(db, file)
-	if err != nil {
-		log.Fatal(err)
+		// The output is always JSON.
+		printJSON(encoded)
 	}
-	log.Println("Database backup restored!")
 }
@@ -0,0 +1,149 @@
+//
+// lurkcoin: Transaction exports
+// Copyright © 2020 by luk3yx
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package main
+
+import (
+	"bufio"
+	"github.com/luk3yx/lurkcoin-core/lurkcoin"
+	"github.com/luk3yx/lurkcoin-core/lurkcoin/api"
+	"io"
+	"log"
+	"os"
+	"strings"
+)
+
+func isStatementFormat(format string) bool {
+	for _, f := range lurkcoin.StatementExportFormats {
+		if f == strings.ToLower(format) {
+			return true
+		}
+	}
+	return false
+}
+
+func init() {
+	cmd := newCommand("export", "export [OPTIONS] [OUTPUT-FILE]",
+		"Exports transactions across all servers, or a statement of a "+
+			"single server's transactions. The export is written to stdout "+
+			"if no output file is specified.")
+	format := cmd.flags.String("format", "csv", "The output format ("+
+		strings.Join(lurkcoin.TransactionExportFormats, ", ")+", or "+
+		strings.Join(lurkcoin.StatementExportFormats, ", ")+
+		" with -server).")
+	serverName := cmd.flags.String("server", "", "Export a statement of a "+
+		"single server's transactions (required for OFX and QIF).")
+	since := cmd.flags.String("since", "",
+		"Only export transactions made on or after this time.")
+	until := cmd.flags.String("until", "",
+		"Only export transactions made on or before this time.")
+	cmd.run = func(args []string) {
+		cmd.parseFlags(args, 0, 1)
+		outputFile := cmd.outputFile()
+
+		validFormat := false
+		for _, f := range lurkcoin.TransactionExportFormats {
+			validFormat = validFormat || f == strings.ToLower(*format)
+		}
+		if isStatementFormat(*format) {
+			if *serverName == "" {
+				fatalf("-server is required for %s exports.", *format)
+			}
+		} else if !validFormat {
+			fatalf("Unknown export format: %s", *format)
+		} else if *serverName != "" {
+			fatalf("-server can only be used with %s exports.",
+				strings.Join(lurkcoin.StatementExportFormats, " and "))
+		}
+
+		sinceTime, err := api.ParseTimeFilter(*since)
+		if err != nil {
+			fatal(err)
+		}
+		untilTime, err := api.ParseTimeFilter(*until)
+		if err != nil {
+			fatal(err)
+		}
+
+		// Transactions are read from the journal if possible, otherwise the
+		// database has to be opened. Statements always need the database
+		// for the server's balance.
+		config := cmd.loadConfig()
+		j, err := api.OpenJournal(config)
+		if err != nil {
+			fatal(err)
+		}
+		if j == nil {
+			log.Println("Warning: The journal is not enabled, only the " +
+				"transactions in each server's history will be exported.")
+		}
+		var db lurkcoin.Database
+		if j == nil || *serverName != "" {
+			db = openDatabase(config)
+		}
+
+		var balance lurkcoin.Currency
+		if *serverName != "" {
+			tr := lurkcoin.BeginDbTransaction(db)
+			server, ok := tr.GetOneServer(*serverName)
+			if !ok {
+				fatalf("The server %q does not exist.", *serverName)
+			}
+			*serverName = server.Name
+			balance = server.GetBalance()
+			tr.Abort()
+		}
+
+		transactions, err := lurkcoin.CollectTransactions(db, j, sinceTime,
+			untilTime)
+		if err != nil {
+			fatal(err)
+		}
+
+		export := func(w io.Writer) error {
+			buf := bufio.NewWriter(w)
+			var err error
+			if *serverName != "" {
+				err = lurkcoin.ExportStatement(buf, *serverName, balance,
+					transactions, *format)
+			} else {
+				err = lurkcoin.ExportTransactions(buf, transactions, *format)
+			}
+			if err != nil {
+				return err
+			}
+			return buf.Flush()
+		}
+
+		if outputFile == "" {
+			err = export(os.Stdout)
+		} else {
+			err = writeFile(outputFile, export)
+		}
+		if err != nil {
+			fatal(err)
+		}
+		if jsonOutput {
+			printJSON(map[string]interface{}{
+				"file":         outputFile,
+				"format":       strings.ToLower(*format),
+				"transactions": len(transactions),
+			})
+		}
+	}
+}
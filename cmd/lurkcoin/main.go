@@ -0,0 +1,180 @@
+//
+// lurkcoin
+// Copyright © 2020 by luk3yx
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+// A command line tool for managing lurkcoin.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/luk3yx/lurkcoin-core/lurkcoin"
+	"github.com/luk3yx/lurkcoin-core/lurkcoin/api"
+	"log"
+	"os"
+	"sort"
+	"text/tabwriter"
+)
+
+type command struct {
+	name        string
+	usage       string
+	description string
+
+	// Any (second-level) subcommands, only used for shell completion.
+	subcommands []string
+
+	flags      *flag.FlagSet
+	configFile *string
+	run        func(args []string)
+}
+
+var commands = make(map[string]*command)
+
+// Set by -json.
+var jsonOutput bool
+
+// Creates and registers a subcommand with -config and -json options, this
+// should only be called from init().
+func newCommand(name, usage, description string) *command {
+	cmd := &command{name: name, usage: usage, description: description}
+	cmd.flags = flag.NewFlagSet("lurkcoin "+name, flag.ExitOnError)
+	defaultConfig := os.Getenv("LURKCOIN_CONFIG")
+	if defaultConfig == "" {
+		defaultConfig = "config.yaml"
+	}
+	cmd.configFile = cmd.flags.String("config", defaultConfig,
+		"The config file to use (defaults to $LURKCOIN_CONFIG or "+
+			"config.yaml).")
+	cmd.flags.BoolVar(&jsonOutput, "json", false,
+		"Write machine-readable JSON to stdout.")
+	cmd.flags.Usage = func() {
+		fmt.Fprintf(cmd.flags.Output(), "Usage: lurkcoin %s\n\n%s\n\n",
+			cmd.usage, cmd.description)
+		cmd.flags.PrintDefaults()
+	}
+	commands[name] = cmd
+	return cmd
+}
+
+// Parses flags and exits if the number of positional arguments is not
+// between min and max.
+func (self *command) parseFlags(args []string, min, max int) {
+	self.flags.Parse(args)
+	if self.flags.NArg() < min || self.flags.NArg() > max {
+		self.flags.Usage()
+		os.Exit(2)
+	}
+}
+
+// Writes v to stdout as JSON.
+func printJSON(v interface{}) {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "    ")
+	if err := encoder.Encode(v); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Prints an error and exits. With -json, the error is written to stdout as
+// {"error": "..."} so that it can be parsed by whatever is running lurkcoin.
+func fatal(v ...interface{}) {
+	if jsonOutput {
+		printJSON(map[string]string{"error": fmt.Sprint(v...)})
+		os.Exit(1)
+	}
+	log.Fatal(v...)
+}
+
+func fatalf(format string, v ...interface{}) {
+	fatal(fmt.Sprintf(format, v...))
+}
+
+func (self *command) loadConfig() *api.Config {
+	config, err := api.LoadConfig(*self.configFile)
+	if err != nil {
+		fatal(err)
+	}
+	return config
+}
+
+// Opens the database directly. bbolt databases can't be opened while
+// lurkcoin is running, so this gives up after 5 seconds by default.
+func openDatabase(config *api.Config) lurkcoin.Database {
+	if config.Database.Options == nil {
+		config.Database.Options = make(map[string]string)
+	}
+	if _, ok := config.Database.Options["timeout"]; !ok {
+		config.Database.Options["timeout"] = "5s"
+	}
+	db, err := api.OpenDatabase(config)
+	if err != nil {
+		fatal(err)
+	}
+	return db
+}
+
+// Like openDatabase, but exits if the database is read-only.
+func openWritableDatabase(config *api.Config) lurkcoin.Database {
+	if config.Database.ReadOnly {
+		fatal("The database is read-only.")
+	}
+	return openDatabase(config)
+}
+
+func sortedCommandNames() []string {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func printUsage() {
+	fmt.Fprintln(os.Stderr, "Usage: lurkcoin COMMAND [OPTIONS] [ARGS]")
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "Commands:")
+	w := tabwriter.NewWriter(os.Stderr, 0, 4, 2, ' ', 0)
+	for _, name := range sortedCommandNames() {
+		fmt.Fprintf(w, "  %s\t%s\n", commands[name].usage,
+			commands[name].description)
+	}
+	w.Flush()
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, `Run "lurkcoin COMMAND -h" for more information.`)
+}
+
+func main() {
+	log.SetFlags(0)
+	if len(os.Args) < 2 {
+		printUsage()
+		os.Exit(2)
+	}
+
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		if os.Args[1] != "help" && os.Args[1] != "-h" &&
+			os.Args[1] != "--help" {
+			fmt.Fprintf(os.Stderr, "Unknown command: %q\n\n", os.Args[1])
+		}
+		printUsage()
+		os.Exit(2)
+	}
+	cmd.run(os.Args[2:])
+}
@@ -0,0 +1,115 @@
+//
+// lurkcoin: Database snapshots
+// Copyright © 2020 by luk3yx
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package main
+
+import (
+	"fmt"
+	"github.com/luk3yx/lurkcoin-core/lurkcoin"
+	"github.com/luk3yx/lurkcoin-core/lurkcoin/api"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+func init() {
+	cmd := newCommand("snapshot", "snapshot list|create|rollback [OPTIONS] [SNAPSHOT]",
+		"Lists, creates or rolls back to database snapshots. lurkcoin "+
+			"must not be running.")
+	cmd.subcommands = []string{"list", "create", "rollback"}
+	cmd.run = func(args []string) {
+		if len(args) < 1 {
+			cmd.flags.Usage()
+			os.Exit(2)
+		}
+		subcommand := args[0]
+		if subcommand == "rollback" {
+			cmd.parseFlags(args[1:], 1, 1)
+		} else {
+			cmd.parseFlags(args[1:], 0, 0)
+		}
+
+		config := cmd.loadConfig()
+		dir := config.Snapshots.Directory
+		if dir == "" {
+			fatal("Snapshots are not enabled in the config file.")
+		}
+
+		switch subcommand {
+		case "list":
+			snapshots, err := api.ListSnapshots(dir)
+			if err != nil {
+				fatal(err)
+			}
+			if jsonOutput {
+				printJSON(snapshots)
+				return
+			}
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			for _, snapshot := range snapshots {
+				fmt.Fprintf(w, "%s\t%s\t%d bytes\n", snapshot.Name,
+					time.Unix(snapshot.Time, 0).Format(time.RFC3339),
+					snapshot.Size)
+			}
+			w.Flush()
+		case "create":
+			snapshot, err := api.CreateSnapshot(openDatabase(config), dir)
+			if err != nil {
+				fatal(err)
+			}
+			if jsonOutput {
+				printJSON(snapshot)
+				return
+			}
+			fmt.Printf("Created snapshot %s.\n", snapshot.Name)
+		case "rollback":
+			name := cmd.flags.Arg(0)
+			if _, err := api.GetSnapshotPath(dir, name); err != nil {
+				fatal(err)
+			}
+			db := openWritableDatabase(config)
+			j, err := api.OpenJournal(config)
+			if err != nil {
+				fatal(err)
+			}
+			lurkcoin.SetJournal(j)
+
+			// Take a snapshot first so that the rollback can be undone.
+			backup, err := api.CreateSnapshot(db, dir)
+			if err != nil {
+				fatal(err)
+			}
+			if err := api.RollbackToSnapshot(db, config, name); err != nil {
+				fatal(err)
+			}
+			journalAdminAction("rollback_snapshot", "", name)
+			if jsonOutput {
+				printJSON(map[string]string{
+					"name":   name,
+					"backup": backup.Name,
+				})
+				return
+			}
+			fmt.Printf("Rolled back to %s. The previous state was saved "+
+				"as %s.\n", name, backup.Name)
+		default:
+			cmd.flags.Usage()
+			os.Exit(2)
+		}
+	}
+}
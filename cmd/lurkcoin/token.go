@@ -0,0 +1,195 @@
+//
+// lurkcoin
+// Copyright © 2020 by luk3yx
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/luk3yx/lurkcoin-core/lurkcoin"
+	"github.com/luk3yx/lurkcoin-core/lurkcoin/api"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/user"
+	"strings"
+	"time"
+)
+
+func init() {
+	cmd := newCommand("token", "token regenerate|hash [OPTIONS] [SERVER]",
+		"Regenerates a server's token and prints the new token, or hashes "+
+			"any tokens stored in plaintext by older versions of lurkcoin.")
+	cmd.subcommands = []string{"regenerate", "hash"}
+	baseURL := cmd.flags.String("url", "", "Use the admin pages at this "+
+		"URL instead of opening the database directly.")
+	adminUser := cmd.flags.String("user", "", "The admin username to use "+
+		"with -url. The password is read from $LURKCOIN_ADMIN_PASSWORD or "+
+		"stdin.")
+	cmd.run = func(args []string) {
+		if len(args) >= 1 && args[0] == "hash" {
+			cmd.parseFlags(args[1:], 0, 0)
+			hashPlaintextTokens(cmd)
+			return
+		} else if len(args) < 1 || args[0] != "regenerate" {
+			cmd.flags.Usage()
+			os.Exit(2)
+		}
+		cmd.parseFlags(args[1:], 1, 1)
+
+		var name, token string
+		if *baseURL != "" {
+			if *adminUser == "" {
+				fatal("-user must be specified with -url.")
+			}
+			name, token = regenerateTokenWithAPI(*baseURL, *adminUser,
+				cmd.flags.Arg(0))
+		} else {
+			name, token = regenerateTokenDirectly(cmd, cmd.flags.Arg(0))
+		}
+
+		if jsonOutput {
+			printJSON(map[string]string{"name": name, "token": token})
+			return
+		}
+
+		// Only the token is written to stdout so that it can be piped
+		// elsewhere.
+		fmt.Fprintf(os.Stderr, "The token of %q has been regenerated. The "+
+			"new token will not be shown again.\n", name)
+		fmt.Println(token)
+	}
+}
+
+// Regenerates a token by opening the database directly.
+func regenerateTokenDirectly(cmd *command, serverName string) (string, string) {
+	config := cmd.loadConfig()
+	db := openWritableDatabase(config)
+
+	// Record the change in the journal (if enabled).
+	j, err := api.OpenJournal(config)
+	if err != nil {
+		fatal(err)
+	}
+	lurkcoin.SetJournal(j)
+
+	tr := lurkcoin.BeginDbTransaction(db)
+	defer tr.Abort()
+	server, ok := tr.GetOneServer(serverName)
+	if !ok {
+		fatalf("The server %q does not exist.", serverName)
+	}
+	token := server.RegenerateToken()
+	name, uid := server.Name, server.UID
+	tr.Finish()
+
+	journalAdminAction("regenerate_token", uid, "")
+	return name, token
+}
+
+// Replaces plaintext tokens in the database with hashes. The tokens
+// themselves don't change.
+func hashPlaintextTokens(cmd *command) {
+	config := cmd.loadConfig()
+	db := openWritableDatabase(config)
+	j, err := api.OpenJournal(config)
+	if err != nil {
+		fatal(err)
+	}
+	lurkcoin.SetJournal(j)
+
+	hashed, err := lurkcoin.HashPlaintextTokens(db)
+	if err != nil {
+		fatal(err)
+	}
+	if hashed > 0 {
+		journalAdminAction("hash_tokens", "", fmt.Sprint(hashed))
+	}
+
+	if jsonOutput {
+		printJSON(map[string]int{"hashed": hashed})
+		return
+	}
+	fmt.Printf("Hashed %d plaintext token(s).\n", hashed)
+}
+
+// Records an admin action made with the CLI in the journal (if it has been
+// opened with lurkcoin.SetJournal).
+func journalAdminAction(action, uid, value string) {
+	adminUser := "cli"
+	if u, err := user.Current(); err == nil {
+		adminUser = "cli:" + u.Username
+	}
+	lurkcoin.AppendToJournal(&lurkcoin.JournalEntry{
+		Type:      lurkcoin.JournalAdminAction,
+		AdminUser: adminUser,
+		Action:    action,
+		Server:    uid,
+		Value:     value,
+	}, nil)
+}
+
+// Regenerates a token with the admin pages of a running lurkcoin instance.
+func regenerateTokenWithAPI(baseURL, adminUser, serverName string) (string, string) {
+	password := os.Getenv("LURKCOIN_ADMIN_PASSWORD")
+	if password == "" {
+		fmt.Fprint(os.Stderr, "Admin password: ")
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil {
+			fatal(err)
+		}
+		password = strings.TrimRight(line, "\r\n")
+	}
+
+	req, err := http.NewRequest("POST", strings.TrimSuffix(baseURL, "/")+
+		"/admin/api/regenerate-token/"+url.PathEscape(serverName),
+		bytes.NewReader([]byte("{}")))
+	if err != nil {
+		fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.SetBasicAuth(adminUser, password)
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	res, err := client.Do(req)
+	if err != nil {
+		fatal(err)
+	}
+	defer res.Body.Close()
+	raw, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		fatal(err)
+	}
+
+	var result struct {
+		Name  string `json:"name"`
+		Token string `json:"token"`
+		Error string `json:"error"`
+	}
+	if res.StatusCode == http.StatusUnauthorized {
+		fatal("Invalid admin username or password.")
+	} else if err := json.Unmarshal(raw, &result); err != nil {
+		fatalf("Invalid response from server (HTTP %d).", res.StatusCode)
+	} else if result.Error != "" {
+		fatal(result.Error)
+	}
+	return result.Name, result.Token
+}
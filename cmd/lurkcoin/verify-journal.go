@@ -0,0 +1,66 @@
+//
+// lurkcoin: Journal verification
+// Copyright © 2020 by luk3yx
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package main
+
+import (
+	"fmt"
+	"github.com/luk3yx/lurkcoin-core/lurkcoin"
+	"github.com/luk3yx/lurkcoin-core/lurkcoin/api"
+	"os"
+)
+
+func init() {
+	cmd := newCommand("verify-journal", "verify-journal [OPTIONS]",
+		"Checks the journal's hash chain and prints the hash of the last "+
+			"entry. Exits with status 1 if the chain is broken.")
+	hash := cmd.flags.String("hash", "", "Also check that the journal "+
+		"contains an entry with this hash (from an earlier run).")
+	cmd.run = func(args []string) {
+		cmd.parseFlags(args, 0, 0)
+		config := cmd.loadConfig()
+		j, err := api.OpenJournal(config)
+		if err != nil {
+			fatal(err)
+		}
+		fj, ok := j.(*lurkcoin.FileJournal)
+		if !ok {
+			fatal("The journal is not enabled in the config file.")
+		}
+
+		report, err := fj.VerifyChain(*hash)
+		if err != nil {
+			fatal(err)
+		}
+		if jsonOutput {
+			printJSON(report)
+		} else {
+			for _, problem := range report.Problems {
+				fmt.Println(problem)
+			}
+			fmt.Printf("%d entries (%d without hashes).\n", report.Entries,
+				report.UnhashedEntries)
+			if report.LastHash != "" {
+				fmt.Println("Last hash:", report.LastHash)
+			}
+		}
+		if len(report.Problems) > 0 {
+			os.Exit(1)
+		}
+	}
+}
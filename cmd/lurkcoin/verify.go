@@ -0,0 +1,82 @@
+//
+// lurkcoin
+// Copyright © 2020 by luk3yx
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package main
+
+import (
+	"fmt"
+	"github.com/luk3yx/lurkcoin-core/lurkcoin"
+	"github.com/luk3yx/lurkcoin-core/lurkcoin/api"
+	"os"
+)
+
+func init() {
+	cmd := newCommand("verify", "verify [OPTIONS]",
+		"Checks the database (and journal) for inconsistencies. Exits "+
+			"with status 1 if any problems are found.")
+	quiet := cmd.flags.Bool("quiet", false,
+		"Don't print anything if no problems are found.")
+	strict := cmd.flags.Bool("strict", false, "Treat warnings as problems.")
+	cmd.run = func(args []string) {
+		cmd.parseFlags(args, 0, 0)
+		runVerify(cmd, *quiet, *strict)
+	}
+}
+
+func runVerify(cmd *command, quiet, strict bool) {
+	config := cmd.loadConfig()
+	db := openDatabase(config)
+	j, err := api.OpenJournal(config)
+	if err != nil {
+		fatal(err)
+	}
+
+	discrepancies, err := lurkcoin.VerifyDatabase(db, j)
+	if err != nil {
+		fatal(err)
+	}
+
+	problems := 0
+	for _, discrepancy := range discrepancies {
+		if !jsonOutput {
+			fmt.Println(discrepancy)
+		}
+		if !discrepancy.Warning || strict {
+			problems++
+		}
+	}
+
+	if jsonOutput {
+		if discrepancies == nil {
+			discrepancies = []lurkcoin.Discrepancy{}
+		}
+		printJSON(map[string]interface{}{
+			"ok":            problems == 0,
+			"problems":      problems,
+			"discrepancies": discrepancies,
+		})
+	} else if problems > 0 {
+		fmt.Fprintf(os.Stderr, "%d problem(s) found.\n", problems)
+	} else if !quiet && len(discrepancies) == 0 {
+		fmt.Println("No problems found.")
+	}
+
+	if problems > 0 {
+		os.Exit(1)
+	}
+}
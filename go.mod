@@ -3,6 +3,9 @@ module github.com/luk3yx/lurkcoin-core
 go 1.13
 
 require (
+	github.com/dgraph-io/badger/v2 v2.2007.4
+	github.com/go-ldap/ldap/v3 v3.2.4
+	github.com/gomodule/redigo v1.8.2
 	github.com/julienschmidt/httprouter v1.3.0
 	go.etcd.io/bbolt v1.3.5
 	gopkg.in/yaml.v2 v2.4.0
@@ -0,0 +1,85 @@
+//
+// lurkcoin admin issuance and withdrawals
+// Copyright © 2020 by luk3yx
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package lurkcoin
+
+import "errors"
+
+// Admins can create (issue) or destroy (withdraw) lurkcoins. Unlike editing
+// the balance, this records a transaction so that the change shows up in the
+// server's history, the journal and audits. These transactions have the admin
+// user as their source and no source server (when issuing) or target server
+// (when withdrawing).
+
+// Adds amount lurkcoins to the server with the specified UID, target is the
+// user on that server that the transaction is sent to (and may be empty).
+func IssueLurkcoins(db Database, uid, adminUser, target string,
+	amount Currency, logger *Logger) (*Transaction, error) {
+	return adminIssuance(db, uid, amount, amount, logger,
+		func(server *Server) Transaction {
+			return MakeTransaction(adminUser, "", target, server.Name,
+				amount, amount, amount)
+		})
+}
+
+// Removes amount lurkcoins from the server with the specified UID. This fails
+// with ERR_CANNOTAFFORD if it would exceed the server's credit limit.
+func WithdrawLurkcoins(db Database, uid, adminUser string, amount Currency,
+	logger *Logger) (*Transaction, error) {
+	return adminIssuance(db, uid, amount, amount.Neg(), logger,
+		func(server *Server) Transaction {
+			return MakeTransaction(adminUser, server.Name, "", "", amount,
+				amount, amount)
+		})
+}
+
+func adminIssuance(db Database, uid string, amount, change Currency,
+	logger *Logger, makeTransaction func(*Server) Transaction) (*Transaction,
+	error) {
+	if IsReadOnly(db) {
+		return nil, ErrReadOnly
+	}
+	if amount.IsNil() || !amount.GtZero() {
+		return nil, errors.New("ERR_CANNOTPAYNOTHING")
+	}
+
+	tr := BeginDbTransaction(db)
+	defer tr.Abort()
+	tr.SetLogger(logger)
+	server, ok := tr.GetOneServer(uid)
+	if !ok {
+		return nil, errors.New("ERR_SERVERNOTFOUND")
+	}
+	if !server.ChangeBal(change) {
+		return nil, errors.New("ERR_CANNOTAFFORD")
+	}
+
+	transaction := makeTransaction(server)
+	server.AddToHistory(transaction)
+	logger.Info(transaction.String(), "transaction_id", transaction.ID)
+	server.AfterCommit(func() {
+		recordTransaction(&transaction)
+	})
+	server.queueJournalEntry(&JournalEntry{
+		Time:        transaction.Time,
+		Type:        JournalTransaction,
+		Transaction: &transaction,
+	})
+	tr.Finish()
+	return &transaction, nil
+}
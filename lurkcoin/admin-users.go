@@ -0,0 +1,162 @@
+//
+// lurkcoin admin users
+// Copyright © 2020 by luk3yx
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package lurkcoin
+
+import (
+	crypto_rand "crypto/rand"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"regexp"
+	"sort"
+	"time"
+)
+
+// An admin user stored in the database (as opposed to the config file).
+// Admin users are never deleted, only disabled, so that the audit log always
+// refers to a known user.
+type AdminUser struct {
+	Username      string   `json:"username"`
+	PasswordHash  string   `json:"password_hash"`
+	PasswordSalt  string   `json:"password_salt"`
+	HashAlgorithm string   `json:"hash_algorithm"`
+	Role          string   `json:"role,omitempty"`
+	Permissions   []string `json:"permissions,omitempty"`
+	Disabled      bool     `json:"disabled,omitempty"`
+	Created       int64    `json:"created"`
+	Modified      int64    `json:"modified"`
+}
+
+func (self *AdminUser) GetCreated() time.Time {
+	return time.Unix(self.Created, 0)
+}
+
+func (self *AdminUser) GetModified() time.Time {
+	return time.Unix(self.Modified, 0)
+}
+
+// Uses the same hashing scheme as admin users in the config file.
+func hashAdminPassword(password, salt string) string {
+	rawHash := sha512.Sum512([]byte(password + salt))
+	return hex.EncodeToString(rawHash[:])
+}
+
+// Sets the user's password with a new random salt.
+func (self *AdminUser) SetPassword(password string) {
+	raw := make([]byte, 16)
+	if _, err := crypto_rand.Read(raw); err != nil {
+		panic(err)
+	}
+	self.PasswordSalt = hex.EncodeToString(raw)
+	self.HashAlgorithm = "sha512"
+	self.PasswordHash = hashAdminPassword(password, self.PasswordSalt)
+}
+
+// Returns true if password is correct. Disabled users always fail.
+func (self *AdminUser) CheckPassword(password string) bool {
+	if self.Disabled || self.HashAlgorithm != "sha512" {
+		return false
+	}
+	return ConstantTimeCompare(
+		hashAdminPassword(password, self.PasswordSalt),
+		self.PasswordHash,
+	)
+}
+
+// Databases may implement this to store admin users.
+type AdminUserDatabase interface {
+	// Returns the admin user or nil if it doesn't exist.
+	GetAdminUser(username string) (*AdminUser, error)
+
+	// Creates or replaces an admin user.
+	SetAdminUser(*AdminUser) error
+
+	// Returns every admin user in any order.
+	ListAdminUsers() ([]*AdminUser, error)
+}
+
+var ErrAdminUsersUnsupported = errors.New(
+	"The database does not support admin users.")
+
+var ErrInvalidAdminUsername = errors.New(
+	"Admin usernames must be 1-32 letters, numbers, \"_\", \".\" or \"-\".")
+
+// Colons are used by LDAP and OpenID Connect users ("ldap:user").
+var adminUsernameRegex = regexp.MustCompile(`^[A-Za-z0-9_.\-]{1,32}$`)
+
+func ValidateAdminUsername(username string) bool {
+	return adminUsernameRegex.MatchString(username)
+}
+
+func getAdminUserDatabase(db Database) (AdminUserDatabase, bool) {
+	userDb, ok := UnwrapDatabase(db).(AdminUserDatabase)
+	return userDb, ok
+}
+
+// Returns true if the database can store admin users.
+func SupportsAdminUsers(db Database) bool {
+	_, ok := getAdminUserDatabase(db)
+	return ok
+}
+
+// Returns an admin user, or nil if they don't exist or the database doesn't
+// support admin users.
+func GetAdminUser(db Database, username string) (*AdminUser, error) {
+	userDb, ok := getAdminUserDatabase(db)
+	if !ok || !ValidateAdminUsername(username) {
+		return nil, nil
+	}
+	return userDb.GetAdminUser(username)
+}
+
+// Saves an admin user and updates its modification time (and creation time
+// if it is zero).
+func SetAdminUser(db Database, user *AdminUser) error {
+	if IsReadOnly(db) {
+		return ErrReadOnly
+	}
+	userDb, ok := getAdminUserDatabase(db)
+	if !ok {
+		return ErrAdminUsersUnsupported
+	}
+	if !ValidateAdminUsername(user.Username) {
+		return ErrInvalidAdminUsername
+	}
+	user.Modified = time.Now().Unix()
+	if user.Created == 0 {
+		user.Created = user.Modified
+	}
+	return userDb.SetAdminUser(user)
+}
+
+// Returns every admin user sorted by username.
+func ListAdminUsers(db Database) ([]*AdminUser, error) {
+	userDb, ok := getAdminUserDatabase(db)
+	if !ok {
+		return nil, ErrAdminUsersUnsupported
+	}
+	users, err := userDb.ListAdminUsers()
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Username < users[j].Username
+	})
+	return users, nil
+}
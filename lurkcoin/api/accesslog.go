@@ -0,0 +1,286 @@
+//
+// lurkcoin access log
+// Copyright © 2020 by luk3yx
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package api
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	mathrand "math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Wraps http.ResponseWriter to keep track of the status code and response
+// size.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	size   int64
+}
+
+func (self *responseRecorder) WriteHeader(status int) {
+	if self.status == 0 {
+		self.status = status
+	}
+	self.ResponseWriter.WriteHeader(status)
+}
+
+func (self *responseRecorder) Write(data []byte) (int, error) {
+	if self.status == 0 {
+		self.status = http.StatusOK
+	}
+	n, err := self.ResponseWriter.Write(data)
+	self.size += int64(n)
+	return n, err
+}
+
+// Query string parameters that are never logged.
+var sensitiveParams = map[string]bool{
+	"token":     true,
+	"password":  true,
+	"csrftoken": true,
+}
+
+// Removes sensitive values (such as lurkcoinV2 tokens) from a URL.
+func scrubURL(u *url.URL) string {
+	if u.RawQuery == "" {
+		return u.Path
+	}
+	query, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return u.Path + "?[invalid query string]"
+	}
+	for key, values := range query {
+		if sensitiveParams[strings.ToLower(key)] {
+			for i := range values {
+				values[i] = "[redacted]"
+			}
+		}
+	}
+
+	// url.Values.Encode() escapes "[" and "]".
+	return u.Path + "?" + strings.NewReplacer("%5B", "[", "%5D", "]").Replace(
+		query.Encode())
+}
+
+type accessLogInfoKey struct{}
+
+// Information about a request that is filled in by handlers.
+type accessLogInfo struct {
+	server string
+}
+
+// Records the UID of the server that made a request in the access log.
+func setAccessLogServer(r *http.Request, uid string) {
+	if info, ok := r.Context().Value(accessLogInfoKey{}).(*accessLogInfo); ok {
+		info.server = uid
+	}
+}
+
+type accessLogger struct {
+	sampleRate float64
+	ipHashKey  []byte
+
+	// "text" messages are written to the application log, other formats
+	// are written to out (or the standard logger's output if out is nil).
+	format  string
+	outLock sync.Mutex
+	out     io.Writer
+}
+
+func (self *accessLogger) formatIP(r *http.Request) string {
+	ip := getClientIP(r)
+	if ip == "" || ip == "@" {
+		return "-"
+	}
+	if self.ipHashKey == nil {
+		return ip
+	}
+
+	// Hash IP addresses with HMAC so that requests from the same IP can still
+	// be correlated.
+	h := hmac.New(sha256.New, self.ipHashKey)
+	h.Write([]byte(ip))
+	return "ip-" + hex.EncodeToString(h.Sum(nil)[:8])
+}
+
+// Quotes a string in the common log format.
+func clfQuote(s string) string {
+	if s == "" {
+		return `"-"`
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+func (self *accessLogger) write(line []byte) {
+	self.outLock.Lock()
+	defer self.outLock.Unlock()
+	if self.out == nil {
+		log.Writer().Write(line)
+	} else {
+		self.out.Write(line)
+	}
+}
+
+func (self *accessLogger) log(r *http.Request, start time.Time,
+	recorder *responseRecorder, info *accessLogInfo) {
+	status := recorder.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	duration := time.Since(start)
+
+	switch self.format {
+	case "common", "combined":
+		user := info.server
+		if user == "" {
+			user = "-"
+		}
+		line := fmt.Sprintf("%s - %s [%s] %s %d %d", self.formatIP(r),
+			user, start.Format("02/Jan/2006:15:04:05 -0700"),
+			clfQuote(r.Method+" "+scrubURL(r.URL)+" "+r.Proto), status,
+			recorder.size)
+		if self.format == "combined" {
+			line += " " + clfQuote(scrubReferer(r.Referer())) + " " +
+				clfQuote(r.UserAgent())
+		}
+
+		// The request time is appended in the same way as nginx's
+		// $request_time.
+		line += fmt.Sprintf(" %.3f\n", duration.Seconds())
+		self.write([]byte(line))
+	case "json":
+		line, _ := json.Marshal(map[string]interface{}{
+			"time":       start.UTC().Format(time.RFC3339Nano),
+			"request_id": getRequestID(r),
+			"ip":         self.formatIP(r),
+			"method":     r.Method,
+			"path":       scrubURL(r.URL),
+			"status":     status,
+			"size":       recorder.size,
+			"duration":   duration.Seconds(),
+			"server":     info.server,
+			"user_agent": r.UserAgent(),
+		})
+		self.write(append(line, '\n'))
+	default:
+		kv := []interface{}{"ip", self.formatIP(r), "method", r.Method,
+			"path", scrubURL(r.URL), "status", status,
+			"size", recorder.size, "duration", duration}
+		if info.server != "" {
+			kv = append(kv, "server", info.server)
+		}
+		requestLogger(r).Info("HTTP request", kv...)
+	}
+}
+
+// Removes sensitive values from the Referer header.
+func scrubReferer(referer string) string {
+	u, err := url.Parse(referer)
+	if err != nil || referer == "" {
+		return referer
+	}
+	path := scrubURL(u)
+	u.Path, u.RawPath, u.RawQuery = "", "", ""
+	return u.String() + path
+}
+
+// Wraps handler so that requests are logged.
+func (self *accessLogger) wrap(handler http.Handler) http.Handler {
+	if self == nil {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		info := &accessLogInfo{}
+		recorder := &responseRecorder{ResponseWriter: w}
+		ctx := context.WithValue(r.Context(), accessLogInfoKey{}, info)
+		handler.ServeHTTP(recorder, r.WithContext(ctx))
+
+		// Errors are always logged.
+		if recorder.status < 400 && self.sampleRate < 1 &&
+			mathrand.Float64() >= self.sampleRate {
+			return
+		}
+		self.log(r, start, recorder, info)
+	})
+}
+
+// Creates the access logger, this returns nil if the access log is
+// disabled.
+func newAccessLogger(config *Config) (*accessLogger, error) {
+	if !config.AccessLog.Enable {
+		return nil, nil
+	}
+
+	logger := &accessLogger{sampleRate: 1}
+	if rate := config.AccessLog.SampleRate; rate > 0 && rate < 1 {
+		logger.sampleRate = rate
+	}
+
+	if config.AccessLog.HashIPs {
+		if config.AccessLog.IPHashKey != "" {
+			logger.ipHashKey = []byte(config.AccessLog.IPHashKey)
+		} else {
+			// Hashes will change whenever lurkcoin is restarted.
+			logger.ipHashKey = make([]byte, 32)
+			if _, err := rand.Read(logger.ipHashKey); err != nil {
+				panic(err)
+			}
+		}
+	}
+
+	switch strings.ToLower(config.AccessLog.Format) {
+	case "", "text":
+		logger.format = "text"
+		if config.AccessLog.File != "" {
+			return nil, errors.New("The access log can only be written to " +
+				"a separate file in the common, combined or json formats.")
+		}
+		return logger, nil
+	case "common", "combined", "json":
+		logger.format = strings.ToLower(config.AccessLog.Format)
+	default:
+		return nil, fmt.Errorf("Unknown access log format: %q",
+			config.AccessLog.Format)
+	}
+
+	if config.AccessLog.File == "" {
+		return logger, nil
+	}
+	f, err := os.OpenFile(config.AccessLog.File,
+		os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	logger.out = f
+	return logger, nil
+}
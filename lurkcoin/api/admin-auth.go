@@ -0,0 +1,258 @@
+//
+// lurkcoin external admin authentication (LDAP and OIDC)
+// Copyright © 2020 by luk3yx
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package api
+
+import (
+	"crypto/sha256"
+	"github.com/julienschmidt/httprouter"
+	"github.com/luk3yx/lurkcoin-core/lurkcoin"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Permissions granted to admin users in the config file, and to users
+// authenticated with LDAP or OpenID Connect by group. See
+// admin-permissions.go.
+type AdminPermissions struct {
+	Role        string   `yaml:"role"`
+	Permissions []string `yaml:"permissions"`
+
+	// Deprecated, these are converted to permissions by resolve().
+	AllowEditing          bool `yaml:"allow_editing"`
+	AllowDatabaseDownload bool `yaml:"allow_database_download"`
+}
+
+// Returns the combined permissions of every group in groups that is in
+// mapping, and false if none of them are.
+func mapGroupPermissions(mapping map[string]AdminPermissions,
+	groups []string) (AdminPermissions, bool) {
+	var res AdminPermissions
+	found := false
+	for _, group := range groups {
+		perms, ok := mapping[group]
+		if !ok {
+			continue
+		}
+		found = true
+		res = res.merge(perms)
+	}
+	return res, found
+}
+
+type ldapConfig struct {
+	// The LDAP server, for example "ldaps://ldap.example.com".
+	URL      string `yaml:"url"`
+	StartTLS bool   `yaml:"start_tls"`
+
+	// Users can either be bound to directly with a DN template (where %s is
+	// replaced with the escaped username), or searched for with an optional
+	// service account.
+	UserDN       string `yaml:"user_dn"`
+	BindDN       string `yaml:"bind_dn"`
+	BindPassword string `yaml:"bind_password"`
+	SearchBase   string `yaml:"search_base"`
+	SearchFilter string `yaml:"search_filter"`
+
+	// The attribute containing the user's groups, defaults to "memberOf".
+	GroupAttribute string `yaml:"group_attribute"`
+
+	// Maps group DNs to permissions. Users that aren't in any of these
+	// groups can't log in.
+	Groups map[string]AdminPermissions `yaml:"groups"`
+}
+
+// Verifies a username and password with an external service and returns
+// the user's permissions.
+type passwordAuthenticator func(username, password string) (AdminPermissions, bool)
+
+// Successful LDAP logins are cached so that the LDAP server isn't contacted
+// on every request (browsers resend credentials with every request).
+const externalLoginCacheTime = 5 * time.Minute
+
+const adminSessionCookie = "lurkcoin_admin_session"
+const adminSessionLifetime = 12 * time.Hour
+
+type externalAdminUser struct {
+	perms   AdminPermissions
+	expires time.Time
+
+	// A hash of the password for cached LDAP logins.
+	passwordHash [32]byte
+}
+
+// Keeps track of admin users that are authenticated with LDAP or OpenID
+// Connect. These users are prefixed with "ldap:" or "oidc:" so that they
+// can't be confused with users in the config file.
+type externalAdminAuth struct {
+	lock     sync.Mutex
+	ldap     passwordAuthenticator
+	oidc     *oidcProvider
+	users    map[string]*externalAdminUser
+	sessions map[string]*adminSession
+}
+
+type adminSession struct {
+	username string
+	expires  time.Time
+}
+
+func newExternalAdminAuth() *externalAdminAuth {
+	return &externalAdminAuth{
+		users:    make(map[string]*externalAdminUser),
+		sessions: make(map[string]*adminSession),
+	}
+}
+
+func (self *externalAdminAuth) setUser(username string,
+	perms AdminPermissions, lifetime time.Duration, passwordHash [32]byte) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.users[username] = &externalAdminUser{perms,
+		time.Now().Add(lifetime), passwordHash}
+}
+
+// Returns the permissions of an external user.
+func (self *externalAdminAuth) permissions(username string) AdminPermissions {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if user, ok := self.users[username]; ok {
+		return user.perms
+	}
+	return AdminPermissions{}
+}
+
+// Checks a username and password with LDAP.
+func (self *externalAdminAuth) checkLDAP(username,
+	password string) (string, bool) {
+	if self.ldap == nil || username == "" || password == "" {
+		return "", false
+	}
+	name := "ldap:" + username
+	hash := sha256.Sum256([]byte(password))
+
+	self.lock.Lock()
+	user, ok := self.users[name]
+	cached := ok && time.Now().Before(user.expires) &&
+		lurkcoin.ConstantTimeCompare(string(user.passwordHash[:]),
+			string(hash[:]))
+	self.lock.Unlock()
+	if cached {
+		return name, true
+	}
+
+	perms, ok := self.ldap(username, password)
+	if !ok {
+		return "", false
+	}
+	self.setUser(name, perms, externalLoginCacheTime, hash)
+	return name, true
+}
+
+// Creates a new session and sets the session cookie.
+func (self *externalAdminAuth) startSession(w http.ResponseWriter,
+	r *http.Request, username string, perms AdminPermissions) {
+	id := lurkcoin.GenerateToken()
+	self.setUser(username, perms, adminSessionLifetime, [32]byte{})
+
+	self.lock.Lock()
+	now := time.Now()
+	for k, session := range self.sessions {
+		if now.After(session.expires) {
+			delete(self.sessions, k)
+		}
+	}
+	self.sessions[id] = &adminSession{username, now.Add(adminSessionLifetime)}
+	self.lock.Unlock()
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     adminSessionCookie,
+		Value:    id,
+		Path:     "/",
+		MaxAge:   int(adminSessionLifetime / time.Second),
+		Secure:   isHTTPS(r),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// Returns the username of the session in the request's cookie (if any).
+func (self *externalAdminAuth) checkSession(r *http.Request) (string, bool) {
+	cookie, err := r.Cookie(adminSessionCookie)
+	if err != nil {
+		return "", false
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	session, ok := self.sessions[cookie.Value]
+	if !ok || time.Now().After(session.expires) {
+		return "", false
+	}
+	return session.username, true
+}
+
+func (self *externalAdminAuth) endSession(w http.ResponseWriter,
+	r *http.Request) {
+	if cookie, err := r.Cookie(adminSessionCookie); err == nil {
+		self.lock.Lock()
+		delete(self.sessions, cookie.Value)
+		self.lock.Unlock()
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:   adminSessionCookie,
+		Path:   "/",
+		MaxAge: -1,
+	})
+}
+
+// Returns true if the request was (probably) made over HTTPS.
+// X-Forwarded-Proto is only used if the request came from a trusted proxy.
+func isHTTPS(r *http.Request) bool {
+	return r.TLS != nil || (isFromTrustedProxy(r) &&
+		r.Header.Get("X-Forwarded-Proto") == "https")
+}
+
+func addExternalAuthPages(router *httprouter.Router,
+	external *externalAdminAuth) {
+	if external.oidc != nil {
+		router.GET("/admin/oidc/callback", func(w http.ResponseWriter,
+			r *http.Request, _ httprouter.Params) {
+			w.Header().Set("Cache-Control", "no-store")
+			username, perms, next, err := external.oidc.finishLogin(r)
+			if err != nil {
+				requestLogger(r).Warning("OpenID Connect login failed",
+					"error", err)
+				writeAdminErrorPage(w, err.Error())
+				return
+			}
+			adminLogger(r, username).Info("Logged in")
+			external.startSession(w, r, username, perms)
+			http.Redirect(w, r, next, http.StatusSeeOther)
+		})
+	}
+
+	router.GET("/admin/logout", func(w http.ResponseWriter,
+		r *http.Request, _ httprouter.Params) {
+		external.endSession(w, r)
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		io.WriteString(w, adminTemplates.wrap(
+			`<h2>You have been logged out.</h2>`))
+	})
+}
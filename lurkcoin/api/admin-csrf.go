@@ -0,0 +1,104 @@
+//
+// lurkcoin admin page CSRF tokens
+// Copyright © 2020 by luk3yx
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package api
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/luk3yx/lurkcoin-core/lurkcoin"
+)
+
+const csrfCookie = "lurkcoin_csrf"
+const csrfTokenLifetime = time.Hour
+
+type csrfToken struct {
+	username string
+	expires  time.Time
+}
+
+// CSRF tokens for the admin pages. Each browser session gets a token that is
+// sent both in a cookie and in forms, which expires after csrfTokenLifetime
+// and is replaced after every form submission so that tokens from old page
+// loads can't be reused.
+type csrfTokenManager struct {
+	lock   sync.Mutex
+	tokens map[string]csrfToken
+}
+
+func newCSRFTokenManager() *csrfTokenManager {
+	return &csrfTokenManager{tokens: make(map[string]csrfToken)}
+}
+
+// Returns the CSRF token for the request's session, generating a new one if
+// there isn't a valid token. This sets a cookie and must be called before the
+// response headers are written.
+func (self *csrfTokenManager) Get(w http.ResponseWriter, r *http.Request,
+	username string) string {
+	now := time.Now()
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if cookie, err := r.Cookie(csrfCookie); err == nil {
+		t, ok := self.tokens[cookie.Value]
+		if ok && t.username == username && now.Before(t.expires) {
+			return cookie.Value
+		}
+	}
+
+	// Remove expired tokens
+	for k, t := range self.tokens {
+		if now.After(t.expires) {
+			delete(self.tokens, k)
+		}
+	}
+
+	token := lurkcoin.GenerateToken()
+	self.tokens[token] = csrfToken{username, now.Add(csrfTokenLifetime)}
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookie,
+		Value:    token,
+		Path:     "/admin",
+		MaxAge:   int(csrfTokenLifetime / time.Second),
+		Secure:   isHTTPS(r),
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	return token
+}
+
+// Checks the CSRF token in a submitted form (r.ParseForm() must have been
+// called). The token must match the cookie, and is removed so that the next
+// page load gets a new one.
+func (self *csrfTokenManager) Check(r *http.Request, username string) bool {
+	cookie, err := r.Cookie(csrfCookie)
+	if err != nil ||
+		!lurkcoin.ConstantTimeCompare(r.Form.Get("csrfToken"), cookie.Value) {
+		return false
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	t, ok := self.tokens[cookie.Value]
+	if !ok {
+		return false
+	}
+	delete(self.tokens, cookie.Value)
+	return t.username == username && time.Now().Before(t.expires)
+}
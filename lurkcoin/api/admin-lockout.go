@@ -0,0 +1,183 @@
+//
+// lurkcoin admin login throttling
+// Copyright © 2020 by luk3yx
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package api
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/luk3yx/lurkcoin-core/lurkcoin"
+)
+
+const defaultAdminLoginMaxFailures = 10
+const defaultAdminLoginLockout = 15 * time.Minute
+
+// Usernames are never locked out, otherwise anyone could lock out an admin
+// by guessing passwords for their username. They are only delayed for up to
+// this long instead.
+const maxAdminUsernameDelay = 30 * time.Second
+
+type loginFailures struct {
+	count       int
+	lastFailure time.Time
+}
+
+// Brute-force protection for the admin pages. Failed logins are counted per
+// IP address and per username. After each failure, further attempts are
+// rejected for an exponentially increasing delay, and after maxFailures
+// failures the IP address is locked out for the lockout duration. Delays for
+// usernames are capped at maxAdminUsernameDelay. Counters are reset after a
+// successful login or once the lockout duration has passed since the last
+// failure.
+type adminLoginThrottle struct {
+	lock        sync.Mutex
+	maxFailures int
+	lockout     time.Duration
+	failures    map[string]*loginFailures
+	lastPurge   time.Time
+}
+
+func newAdminLoginThrottle(maxFailures int,
+	lockout time.Duration) *adminLoginThrottle {
+	if maxFailures <= 0 {
+		maxFailures = defaultAdminLoginMaxFailures
+	}
+	if lockout <= 0 {
+		lockout = defaultAdminLoginLockout
+	}
+	return &adminLoginThrottle{maxFailures: maxFailures, lockout: lockout,
+		failures: make(map[string]*loginFailures)}
+}
+
+func adminLoginKeys(ip, username string) [2]string {
+	return [2]string{"ip:" + ip, "user:" + username}
+}
+
+// Returns how long after its last failure a key is blocked for. Keys of
+// usernames (the second key returned by adminLoginKeys) are never locked out.
+func (self *adminLoginThrottle) delay(count int, username bool) time.Duration {
+	limit := self.lockout
+	if username && limit > maxAdminUsernameDelay {
+		limit = maxAdminUsernameDelay
+	}
+	if count >= self.maxFailures || count > 30 {
+		return limit
+	}
+	delay := time.Second << uint(count-1)
+	if delay > limit {
+		return limit
+	}
+	return delay
+}
+
+// Returns how long the client has to wait before trying to log in again, or
+// zero if the login attempt can be checked.
+func (self *adminLoginThrottle) RetryAfter(ip, username string) time.Duration {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	now := time.Now()
+	var wait time.Duration
+	for i, key := range adminLoginKeys(ip, username) {
+		f, ok := self.failures[key]
+		if !ok {
+			continue
+		}
+		delay := self.delay(f.count, i == 1)
+		if w := f.lastFailure.Add(delay).Sub(now); w > wait {
+			wait = w
+		}
+	}
+	return wait
+}
+
+// Resets the failure counters after a successful login.
+func (self *adminLoginThrottle) Succeeded(ip, username string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for _, key := range adminLoginKeys(ip, username) {
+		delete(self.failures, key)
+	}
+}
+
+// Records a failed login, logging it and sending a notification if the IP
+// address gets locked out or the username reaches maxFailures.
+func (self *adminLoginThrottle) Failed(r *http.Request, ip, username string) {
+	logger := requestLogger(r).With("component", "admin", "ip", ip,
+		"username", username)
+
+	self.lock.Lock()
+	now := time.Now()
+	if now.Sub(self.lastPurge) > self.lockout {
+		for k, f := range self.failures {
+			if now.Sub(f.lastFailure) >= self.lockout {
+				delete(self.failures, k)
+			}
+		}
+		self.lastPurge = now
+	}
+
+	var lockedOut []string
+	userThrottled := false
+	for i, key := range adminLoginKeys(ip, username) {
+		f, ok := self.failures[key]
+		if !ok || now.Sub(f.lastFailure) >= self.lockout {
+			f = &loginFailures{}
+			self.failures[key] = f
+		}
+		f.count++
+		f.lastFailure = now
+		if f.count == self.maxFailures && i == 0 {
+			lockedOut = append(lockedOut, "IP address "+ip)
+		} else if f.count == self.maxFailures {
+			userThrottled = true
+		}
+	}
+	self.lock.Unlock()
+
+	logger.Warning("Failed admin login")
+	for _, what := range lockedOut {
+		logger.Warning("Admin logins locked out for "+what,
+			"lockout", self.lockout.String())
+		lurkcoin.Notify(lurkcoin.EventAdminLoginLockout, fmt.Sprintf(
+			"Admin logins for %s have been locked for %s after %d failed "+
+				"attempts.", what, self.lockout, self.maxFailures))
+	}
+	if userThrottled {
+		logger.Warning("Admin logins throttled for user",
+			"delay", self.delay(self.maxFailures, true).String())
+		lurkcoin.Notify(lurkcoin.EventAdminLoginLockout, fmt.Sprintf(
+			"Admin logins for user %q are being throttled after %d failed "+
+				"attempts.", username, self.maxFailures))
+	}
+}
+
+// Writes a 429 response for clients that have to wait before logging in.
+func writeAdminLoginThrottled(w http.ResponseWriter, wait time.Duration) {
+	seconds := int((wait + time.Second - 1) / time.Second)
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusTooManyRequests)
+	io.WriteString(w, adminTemplates.wrap(
+		`<h1>Too many failed login attempts.</h1>`+
+			`<p>Please try again in `+strconv.Itoa(seconds)+` seconds.</p>`))
+}
@@ -21,15 +21,17 @@ package api
 import (
 	"crypto/sha512"
 	"encoding/hex"
+	"encoding/json"
 	"github.com/julienschmidt/httprouter"
 	"github.com/luk3yx/lurkcoin-core/lurkcoin"
-	"html"
 	"html/template"
 	"io"
 	"log"
 	"net/http"
-	"regexp"
+	"net/url"
+	"strconv"
 	"strings"
+	"time"
 )
 
 const adminPagesHeader = `<!DOCTYPE html>
@@ -70,14 +72,38 @@ function hideForm() {
 
 const serverListTemplate = adminPagesHeader + `
 <h2>Server list</h2>
-<i>Total: {{len .Summaries}} server(s).</i>
+<form method="get" action="/admin">
+	<input type="text" name="prefix" value="{{.Prefix}}"
+		placeholder="Server name prefix" />
+	<input type="text" name="search" value="{{.Search}}"
+		placeholder="Server name contains" />
+	<input type="hidden" name="sort" value="{{.SortBy}}" />
+	{{if .Descending}}<input type="hidden" name="order" value="desc" />{{end}}
+	<input type="submit" value="Search" />
+</form>
+<i>
+	Showing {{len .Summaries}}
+	{{- if .Total}} of {{.Total}}{{end}} server(s).
+</i>
+<span style="float: right;">
+	<a href="/admin/deleted">Deleted servers</a> |
+	{{if .Can.manage_admins}}
+		<a href="/admin/audit">Audit log</a> |
+		<a href="/admin/users">Admin users</a> |
+	{{end}}
+	<a href="/admin/runtime">Runtime statistics</a>
+</span>
 <table>
 	<thead>
 		<tr>
-			<th>Name</th>
-			<th>Balance</th>
-			<th>Target balance</th>
-			<th>Pending transactions</th>
+			{{range .Columns}}
+				<th>
+					<a href="{{.URL}}">{{.Title}}</a>
+					{{if eq .Name $.SortBy}}
+						{{if $.Descending}}&darr;{{else}}&uarr;{{end}}
+					{{end}}
+				</th>
+			{{end}}
 			<th>...</th>
 		</tr>
 	</thead>
@@ -93,16 +119,27 @@ const serverListTemplate = adminPagesHeader + `
 		{{end}}
 	</tbody>
 </table>
+{{if .PreviousPage}}
+	<a href="{{.PreviousPage}}" class="button">Previous page</a>
+{{end}}
+{{if .NextPage}}
+	<a href="{{.NextPage}}" class="button">Next page</a>
+{{end}}
 
-{{if .AllowEditing}}
+{{if .Can.download_backups}}
+	<a href="/admin/backup" class="button">Download database backup</a>
+	<a href="/admin/backup?gzip=yes" class="button">Download compressed backup</a>
+{{end}}
+{{if .Can.restore_backups}}
+	<a href="/admin/restore" class="button">Restore backup</a>
+{{end}}
+
+{{if .Can.edit_servers}}
 	<noscript>
 		<h4>JavaScript is required to edit database entries.</h4>
 	</noscript>
 
 	<button id="new-server" class="button-primary">New server</button>
-	{{if .AllowDatabaseDownload}}
-		<a href="/admin/backup" class="button">Download database backup</a>
-	{{end}}
 
 	<style>
 		html {
@@ -149,6 +186,57 @@ const serverListTemplate = adminPagesHeader + `
 {{end}}
 ` + adminPagesFooter
 
+const deletedServersTemplate = adminPagesHeader + `
+<h2>Deleted servers</h2>
+<p>
+	Deleted servers can be restored until they are purged.
+	<a href="/admin">Back to the server list</a>
+</p>
+<table>
+	<thead>
+		<tr>
+			<th>Name</th>
+			<th>Balance</th>
+			<th>Deleted</th>
+			<th>Purged after</th>
+			{{if .Can.delete_servers}}<th></th>{{end}}
+		</tr>
+	</thead>
+	<tbody>
+		{{range $server := .Servers}}
+			<tr>
+				<td>{{$server.Name}}</td>
+				<td>{{$server.Balance}}</td>
+				<td>{{$server.DeletedAt.UTC}}</td>
+				<td>{{$server.PurgeAt.UTC}}</td>
+				{{if $.Can.delete_servers}}<td>
+					<form method="post" action="/admin/undelete"
+							style="display: inline; margin: 0;">
+						<input type="hidden" name="csrfToken"
+							value="{{$.CSRFToken}}" />
+						<input type="hidden" name="server-uid"
+							value="{{$server.UID}}" />
+						<input type="submit" value="Undelete"
+							class="button-primary" style="margin: 0;" />
+					</form>
+					<form method="post" action="/admin/purge"
+							style="display: inline; margin: 0;">
+						<input type="hidden" name="csrfToken"
+							value="{{$.CSRFToken}}" />
+						<input type="hidden" name="server-uid"
+							value="{{$server.UID}}" />
+						<input type="submit" value="Purge now"
+							style="margin: 0;" />
+					</form>
+				</td>{{end}}
+			</tr>
+		{{else}}
+			<tr><td colspan="5"><i>No servers have been deleted.</i></td></tr>
+		{{end}}
+	</tbody>
+</table>
+` + adminPagesFooter
+
 const currencyInput = `type="text" pattern="¤?[0-9,_]+(\.[0-9,_]+)?"`
 const infoTemplate = adminPagesHeader + `
 <style>
@@ -199,49 +287,148 @@ const infoTemplate = adminPagesHeader + `
 <form autocomplete="off" method="post" action="{{.Server.UID}}">
 	{{if .AllowEditing}}
 		<input type="hidden" name="csrfToken" value="{{.CSRFToken}}" />
-		<input type="hidden" name="oldBalance"
-			value="{{.Server.GetBalance.RawString}}" />
-		<input type="hidden" name="oldTargetBalance"
-			value="{{.Server.GetTargetBalance.RawString}}" />
-		<input type="hidden" name="oldWebhookURL"
-			value="{{.Server.WebhookURL}}" />
+		{{if .Can.edit_balances}}
+			<input type="hidden" name="oldBalance"
+				value="{{.Server.GetBalance.RawString}}" />
+			<input type="hidden" name="oldTargetBalance"
+				value="{{.Server.GetTargetBalance.RawString}}" />
+			<input type="hidden" name="oldTransactionLimit"
+				value="{{.TransactionLimit}}" />
+			<input type="hidden" name="oldCreditLimit"
+				value="{{.Server.GetCreditLimit.RawString}}" />
+			{{range .Currencies}}
+				<input type="hidden" name="oldBalance.{{.Name}}"
+					value="{{.Balance.RawString}}" />
+				<input type="hidden" name="oldTargetBalance.{{.Name}}"
+					value="{{.TargetBalance.RawString}}" />
+			{{end}}
+		{{end}}
+		{{if .Can.edit_servers}}
+			<input type="hidden" name="oldWebhookURL"
+				value="{{.Server.WebhookURL}}" />
+			<input type="hidden" name="oldFrozen"
+				value="{{.Server.GetFrozen}}" />
+		{{end}}
 	{{end}}
 	<p id="form-inner">
 		Balance<br/>
 		<input ` + currencyInput + ` name="balance"
-			value="{{.Server.GetBalance}}" disabled="disabled" />
+			value="{{.Server.GetBalance}}" disabled="disabled"
+			{{if not .Can.edit_balances}}data-locked{{end}} />
 		<br/>
 		Target balance
 		<br/>
 		<input ` + currencyInput + ` name="targetBalance"
-			value="{{.Server.GetTargetBalance}}" disabled="disabled" />
+			value="{{.Server.GetTargetBalance}}" disabled="disabled"
+			{{if not .Can.edit_balances}}data-locked{{end}} />
 		<br/>
 		Webhook URL<br/>
 		<input type="url" value="{{.Server.WebhookURL}}" placeholder="(none)"
-		 	disabled="disabled" name="webhookURL" />
+		 	disabled="disabled" name="webhookURL" {{if not .Can.edit_servers}}data-locked{{end}} />
+		<br/>
+		Frozen<br/>
+		<select name="frozen" disabled="disabled" {{if not .Can.edit_servers}}data-locked{{end}}>
+			{{$frozen := .Server.GetFrozen}}
+			<option value="" {{if eq $frozen ""}}selected{{end}}>No</option>
+			<option value="outgoing"
+				{{if eq $frozen "outgoing"}}selected{{end}}>
+				Outgoing payments
+			</option>
+			<option value="all" {{if eq $frozen "all"}}selected{{end}}>
+				All payments
+			</option>
+		</select>
+		<br/>
+		Transaction limit<br/>
+		<input ` + currencyInput + ` name="transactionLimit"
+			value="{{.TransactionLimit}}" disabled="disabled"
+			placeholder="Default ({{.DefaultTransactionLimit}})"
+			{{if not .Can.edit_balances}}data-locked{{end}} />
+		<br/>
+		Credit limit (credit used: {{.Server.GetCreditUsed}})<br/>
+		<input ` + currencyInput + ` name="creditLimit"
+			value="{{.Server.GetCreditLimit}}" disabled="disabled"
+			{{if not .Can.edit_balances}}data-locked{{end}} />
+		{{range .Currencies}}
+			<br/>
+			Balance ({{.Name}})<br/>
+			<input ` + currencyInput + ` name="balance.{{.Name}}"
+				value="{{.Balance}}" disabled="disabled"
+				{{if not $.Can.edit_balances}}data-locked{{end}} />
+			<br/>
+			Target balance ({{.Name}})<br/>
+			<input ` + currencyInput + ` name="targetBalance.{{.Name}}"
+				value="{{.TargetBalance}}" disabled="disabled"
+				{{if not $.Can.edit_balances}}data-locked{{end}} />
+		{{end}}
 
 		{{if .AllowEditing}}
 			<br/>
-			<input type="checkbox" id="regenerate-token"
-				disabled="disabled" name="regenerateToken" />
-			<label for="regenerate-token">
-				Regenerate token
-			</label>
-			<br/>
+			{{if .Can.regenerate_tokens}}
+				<input type="checkbox" id="regenerate-token"
+					disabled="disabled" name="regenerateToken" />
+				<label for="regenerate-token">
+					Regenerate token
+				</label>
+				<br/>
+			{{end}}
 			<button type="button" id="edit-btn"
 				class="button-primary">Edit</button>
 			<input type="submit" value="Save" class="button button-primary"
 				disabled="disabled" />
-			<button type="button" id="delete-btn">Delete</button>
+			{{if .Can.delete_servers}}
+				<button type="button" id="delete-btn">Delete</button>
+			{{end}}
 			<a href="{{.Server.UID}}" class="button">Cancel</a>
 			<script>
 				document.getElementById("edit-btn").style.display = "inline";
-				document.getElementById("delete-btn").style.display = "inline";
+				{{if .Can.delete_servers}}
+					document.getElementById("delete-btn").style.display = "inline";
+				{{end}}
 			</script>
 		{{end}}
 	</p>
 </form>
 
+{{if .Can.edit_balances}}
+	<h4>Issue or withdraw lurkcoins</h4>
+	<p>
+		This creates or destroys lurkcoins with a transaction in the server's
+		history, unlike editing the balance above.
+	</p>
+	<form autocomplete="off" method="post" action="/admin/issue">
+		<input type="hidden" name="csrfToken" value="{{.CSRFToken}}" />
+		<input type="hidden" name="server-uid" value="{{.Server.UID}}" />
+		<input ` + currencyInput + ` name="amount" placeholder="Amount"
+			required="required" />
+		<input type="text" name="target" placeholder="User (optional)" />
+		<button type="submit" name="action" value="issue"
+				onclick="return confirm('Issue lurkcoins to ' +
+					{{.Server.Name}} + '?')">
+			Issue
+		</button>
+		<button type="submit" name="action" value="withdraw"
+				onclick="return confirm('Withdraw lurkcoins from ' +
+					{{.Server.Name}} + '?')">
+			Withdraw
+		</button>
+	</form>
+{{end}}
+
+{{if .Can.edit_servers}}
+	<h4>Rename server</h4>
+	<p>
+		Payments sent to the old name will still be received by this server.
+	</p>
+	<form autocomplete="off" method="post" action="/admin/rename-server">
+		<input type="hidden" name="csrfToken" value="{{.CSRFToken}}" />
+		<input type="hidden" name="server-uid" value="{{.Server.UID}}" />
+		<input type="text" name="new-name" placeholder="New name"
+			required="required" />
+		<input type="submit" value="Rename" />
+	</form>
+{{end}}
+
 <h4>History</h4>
 <table>
 	<thead>
@@ -256,6 +443,7 @@ const infoTemplate = adminPagesHeader + `
 			<th>Received amount</th>
 			<th>Time</th>
 			<th>Revertable</th>
+			{{if .Can.edit_balances}}<th></th>{{end}}
 		</tr>
 	</thead>
 	<tbody>
@@ -271,16 +459,136 @@ const infoTemplate = adminPagesHeader + `
 				<td>{{$transaction.ReceivedAmount.RawString}}</td>
 				<td>{{$transaction.GetTime}}</td>
 				<td>{{$transaction.Revertable | YesNo}}</td>
+				{{if $.Can.edit_balances}}<td>
+					{{if index $.Reverted $transaction.ID}}
+						<i>Reverted</i>
+					{{else if and $transaction.Revertable
+							(eq $transaction.TargetServer $.Server.Name)}}
+						<form method="post" action="/admin/revert-transaction"
+								style="margin: 0;" onsubmit="return confirm(
+									'Send ' + {{$transaction.ReceivedAmount.RawString}} +
+									' back to ' + {{$transaction.SourceServer}} +
+									' and revert transaction ' +
+									{{$transaction.ID}} + '?')">
+							<input type="hidden" name="csrfToken"
+								value="{{$.CSRFToken}}" />
+							<input type="hidden" name="server-uid"
+								value="{{$.Server.UID}}" />
+							<input type="hidden" name="transaction-id"
+								value="{{$transaction.ID}}" />
+							<input type="submit" value="Revert"
+								style="margin: 0;" />
+						</form>
+					{{end}}
+				</td>{{end}}
 			</tr>
 		{{end}}
 	</tbody>
 </table>
 
+<h4>Pending transactions</h4>
+{{if .PendingTransactions}}
+	<p>
+		Acknowledging a transaction removes it without sending anything
+		back, rejecting it sends the received amount back to the source
+		server (if the transaction is revertable).
+	</p>
+	<table>
+		<thead>
+			<tr>
+				<th>ID</th>
+				<th>Source</th>
+				<th>Source server</th>
+				<th>Target</th>
+				<th>Received amount</th>
+				<th>Time</th>
+				<th>Revertable</th>
+				{{if .Can.edit_balances}}<th></th>{{end}}
+			</tr>
+		</thead>
+		<tbody>
+			{{range $transaction := .PendingTransactions}}
+				<tr>
+					<td>{{$transaction.ID}}</td>
+					<td>{{$transaction.Source}}</td>
+					<td>{{$transaction.SourceServer}}</td>
+					<td>{{$transaction.Target}}</td>
+					<td>{{$transaction.ReceivedAmount.RawString}}</td>
+					<td>{{$transaction.GetTime}}</td>
+					<td>{{$transaction.Revertable | YesNo}}</td>
+					{{if $.Can.edit_balances}}<td>
+						<form method="post" action="/admin/pending-transaction"
+								style="margin: 0; white-space: nowrap;">
+							<input type="hidden" name="csrfToken"
+								value="{{$.CSRFToken}}" />
+							<input type="hidden" name="server-uid"
+								value="{{$.Server.UID}}" />
+							<input type="hidden" name="transaction-id"
+								value="{{$transaction.ID}}" />
+							<button type="submit" name="action"
+									value="acknowledge" style="margin: 0;">
+								Acknowledge
+							</button>
+							<button type="submit" name="action" value="reject"
+									style="margin: 0;" onclick="return confirm(
+										'Reject transaction ' +
+										{{$transaction.ID}} + '?')">
+								Reject
+							</button>
+						</form>
+					</td>{{end}}
+				</tr>
+			{{end}}
+		</tbody>
+	</table>
+{{else}}
+	<p>This server has no pending transactions.</p>
+{{end}}
+
+<h4>Webhook deliveries</h4>
+{{if .WebhookDeliveries}}
+	<table>
+		<thead>
+			<tr>
+				<th>Time</th>
+				<th>URL</th>
+				<th>Delivery ID</th>
+				<th>Attempt</th>
+				<th>Status</th>
+				<th>Latency</th>
+				<th>Error</th>
+			</tr>
+		</thead>
+		<tbody>
+			{{range .WebhookDeliveries}}
+				<tr>
+					<td>{{.GetTime}}</td>
+					<td>{{.URL}}</td>
+					<td>{{.DeliveryID}}</td>
+					<td>{{.Attempt}}</td>
+					<td>{{if .StatusCode}}{{.StatusCode}}{{end}}</td>
+					<td>{{printf "%.3f" .Latency}}s</td>
+					<td>{{.Error}}</td>
+				</tr>
+			{{end}}
+		</tbody>
+	</table>
+{{else}}
+	<p>No webhooks have been sent to this server recently.</p>
+{{end}}
+
+{{if .Can.edit_raw}}
+	<p><a href="/admin/raw/{{.Server.UID}}">View raw database record</a></p>
+{{end}}
+
 {{if .AllowEditing}}
+	{{if .Can.delete_servers}}
 	<form autocomplete="off" method="post" action="/admin/delete"
 			id="delete-server">
 		<h3>Delete server</h3>
-		<b>This action cannot be undone.</b><br/>
+		Deleted servers can be restored from the
+		<a href="/admin/deleted">deleted servers</a> page until they are
+		purged.<br/>
 		To confirm the server deletion, please type the server's name
 		(<code>{{.Server.Name}}</code>) below.<br/><br/>
 		<input type="hidden" name="csrfToken" value={{.CSRFToken}} />
@@ -290,6 +598,7 @@ const infoTemplate = adminPagesHeader + `
 			value="Delete server" />
 		<button type="button" onclick="hideForm()">Cancel</button>
 	</form>
+	{{end}}
 
 	<script>
 		"use strict";
@@ -304,28 +613,25 @@ const infoTemplate = adminPagesHeader + `
 				msg.style.padding = "0";
 			}
 			p.removeChild(editBtn);
-			p.removeChild(btn);
+			if (btn)
+				p.removeChild(btn);
 			for (let elem of p.children) {
-				if (elem.tagName.toLowerCase() === "input")
+				let tagName = elem.tagName.toLowerCase();
+				if ((tagName === "input" || tagName === "select") &&
+						!elem.hasAttribute("data-locked"))
 					elem.removeAttribute("disabled");
 			}
 		});
 		window.history.replaceState(null, null, "/admin/edit/{{.Server.UID}}");
 
-		const form = document.getElementById("delete-server");
-		` + popOutCode + `
+		{{if .Can.delete_servers}}
+			const form = document.getElementById("delete-server");
+			` + popOutCode + `
+		{{end}}
 	</script>
 {{end}}
 ` + adminPagesFooter
 
-type adminPagesSummary struct {
-	UID                     string
-	Name                    string
-	Balance                 lurkcoin.Currency
-	TargetBalance           lurkcoin.Currency
-	PendingTransactionCount int
-}
-
 func parseNumbers(n1, n2 string) (lurkcoin.Currency, lurkcoin.Currency, bool) {
 	n1 = strings.ReplaceAll(n1, ",", "")
 	n2 = strings.ReplaceAll(n2, ",", "")
@@ -344,11 +650,10 @@ func parseNumbers(n1, n2 string) (lurkcoin.Currency, lurkcoin.Currency, bool) {
 }
 
 type AdminLoginDetails map[string]struct {
-	PasswordHash          string `yaml:"password_hash"`
-	HashAlgorithm         string `yaml:"hash_algorithm"`
-	PasswordSalt          string `yaml:"password_salt"`
-	AllowEditing          bool   `yaml:"allow_editing"`
-	AllowDatabaseDownload bool   `yaml:"allow_database_download"`
+	PasswordHash     string `yaml:"password_hash"`
+	HashAlgorithm    string `yaml:"hash_algorithm"`
+	PasswordSalt     string `yaml:"password_salt"`
+	AdminPermissions `yaml:",inline"`
 }
 
 // TODO: Provide a more secure hashing function.
@@ -371,73 +676,164 @@ func (self AdminLoginDetails) Validate(username, password string) bool {
 	}
 }
 
-type csrfTokenManager map[string]string
+// The number of servers shown on each page of the server list.
+const adminServersPerPage = 100
 
-// Generate one CSRF token per user
-// TODO: Expiry
-func (self csrfTokenManager) Get(username string) string {
-	token, ok := self[username]
-	if !ok {
-		token = lurkcoin.GenerateToken()
-		self[username] = token
-	}
-	return token
-}
+// The maximum number of servers that can be created with
+// /admin/api/create-servers at once.
+const maxBulkServers = 1000
+
+// Tags sent with any error reports.
+var adminPagesTags = map[string]string{"component": "admin_pages"}
 
 func writeAdminErrorPage(w http.ResponseWriter, msg string) {
+	// The request ID header is set by wrapRequestID().
+	requestID := w.Header().Get("X-Request-ID")
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	w.WriteHeader(500)
-	io.WriteString(w, adminPagesHeader+
-		`<h2>An error has occurred!</h2>`+
-		`<h5>`+html.EscapeString(msg)+`</h5>`+
-		`<i>You can hurry back to the previous page, or learn to like`+
-		` this error and then eventually grow old and die.</i>`+
-		`<br/><br/>`+
-		`<a class="button button-primary" href="/admin">Go back</a>`+
-		adminPagesFooter)
+	err := adminTemplates.errorPage.Execute(w, map[string]string{
+		"Message":   msg,
+		"RequestID": requestID,
+	})
+	if err != nil {
+		lurkcoin.ReportError(err, adminPagesTags)
+	}
 }
 
 func addAdminPages(router *httprouter.Router, db lurkcoin.Database,
-	loginDetails AdminLoginDetails) {
-	// TODO: Regenerate this often
-	csrfTokens := make(csrfTokenManager)
+	config *Config) {
+	loginDetails := config.AdminPages.Users
+	csrfTokens := newCSRFTokenManager()
 
-	re, _ := regexp.Compile(`\s+`)
-	var summaryTmpl, infoTmpl *template.Template
-	var err error
-	summaryTmpl, err = template.New("summary").Parse(
-		re.ReplaceAllLiteralString(serverListTemplate, " "),
-	)
+	err := loadAdminTemplates(config.AdminPages.TemplateDirectory)
 	if err != nil {
-		panic(err)
+		log.Fatal(err)
 	}
-	infoTmpl, err = template.New("info").Funcs(template.FuncMap{
-		"YesNo": func(boolean bool) string {
-			if boolean {
-				return "Yes"
-			} else {
-				return "No"
-			}
-		},
-	}).Parse(re.ReplaceAllLiteralString(infoTemplate, " "))
+	summaryTmpl := adminTemplates.mustParse("servers", serverListTemplate,
+		nil)
+	infoTmpl := adminTemplates.mustParse("server", infoTemplate,
+		template.FuncMap{
+			"YesNo": func(boolean bool) string {
+				if boolean {
+					return "Yes"
+				} else {
+					return "No"
+				}
+			},
+		})
+	deletedTmpl := adminTemplates.mustParse("deleted", deletedServersTemplate,
+		nil)
+
+	accessDeniedPage := adminTemplates.wrap(`<h1>` +
+		`Sorry, you do not have access to this resource at this time.` +
+		`</h1>`)
+	var lockout time.Duration
+	if d := config.AdminPages.LoginLockout.Duration; d != "" {
+		lockout, err = time.ParseDuration(d)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	loginThrottle := newAdminLoginThrottle(
+		config.AdminPages.LoginLockout.MaxFailures, lockout)
+
+	roles, err := loadAdminRoles(config.AdminPages.Roles)
 	if err != nil {
-		panic(err)
+		log.Fatal(err)
+	}
+	for username, d := range loginDetails {
+		d.AdminPermissions, err = d.AdminPermissions.resolve(roles)
+		if err != nil {
+			log.Fatalf("Admin user %q: %s", username, err)
+		}
+		loginDetails[username] = d
+	}
+	err = resolveGroupPermissions(config.AdminPages.LDAP.Groups, roles)
+	if err == nil {
+		err = resolveGroupPermissions(config.AdminPages.OIDC.Groups, roles)
+	}
+	if err == nil {
+		err = resolveGroupPermissions(config.AdminPages.OIDC.Users, roles)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	external := newExternalAdminAuth()
+	external.ldap, err = newLDAPAuthenticator(&config.AdminPages.LDAP)
+	if err != nil {
+		log.Fatal(err)
+	}
+	external.oidc, err = newOIDCProvider(&config.AdminPages.OIDC)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Returns the permissions of a user. Users in the database are resolved
+	// every time so that changes apply immediately.
+	getPermissions := func(username string) AdminPermissions {
+		if d, ok := loginDetails[username]; ok {
+			return d.AdminPermissions
+		}
+		if user, _ := lurkcoin.GetAdminUser(db, username); user != nil {
+			if user.Disabled {
+				return AdminPermissions{}
+			}
+			d, err := AdminPermissions{
+				Role:        user.Role,
+				Permissions: user.Permissions,
+			}.resolve(roles)
+			if err != nil {
+				return AdminPermissions{}
+			}
+			return d
+		}
+		return external.permissions(username)
 	}
 
-	accessDeniedPage := re.ReplaceAllLiteralString(
-		adminPagesHeader+
-			`<h1>`+
-			`Sorry, you do not have access to this resource at `+
-			`this time.`+
-			`</h1>`+
-			adminPagesFooter,
-		" ",
-	)
 	authenticate := func(w http.ResponseWriter, r *http.Request) (string, bool) {
 		w.Header().Set("Cache-Control", "no-store")
 		username, password, ok := r.BasicAuth()
-		if ok && loginDetails.Validate(username, password) {
-			return username, true
+		ip := getClientIP(r)
+		if ok {
+			if wait := loginThrottle.RetryAfter(ip, username); wait > 0 {
+				writeAdminLoginThrottled(w, wait)
+				return "", false
+			}
+			if loginDetails.Validate(username, password) {
+				loginThrottle.Succeeded(ip, username)
+				return username, true
+			}
+		}
+		if _, exists := loginDetails[username]; ok && !exists {
+			user, err := lurkcoin.GetAdminUser(db, username)
+			if err != nil {
+				requestLogger(r).Error("Could not get admin user",
+					"username", username, "error", err)
+			} else if user != nil {
+				// Users in the database are never checked with LDAP.
+				if user.CheckPassword(password) {
+					loginThrottle.Succeeded(ip, username)
+					return username, true
+				}
+			} else if name, ok := external.checkLDAP(username, password); ok {
+				loginThrottle.Succeeded(ip, username)
+				return name, true
+			}
+		}
+		if name, ok := external.checkSession(r); ok {
+			return name, true
+		}
+		if ok {
+			loginThrottle.Failed(r, ip, username)
+		}
+
+		// Send browsers to the OpenID Connect provider. Basic authentication
+		// can still be used if credentials are sent without being prompted.
+		if external.oidc != nil && r.Header.Get("Authorization") == "" &&
+			r.Method == "GET" {
+			external.oidc.startLogin(w, r, r.URL.RequestURI())
+			return "", false
 		}
 		w.Header().Set(
 			"WWW-Authenticate",
@@ -448,105 +844,277 @@ func addAdminPages(router *httprouter.Router, db lurkcoin.Database,
 		io.WriteString(w, accessDeniedPage)
 		return "", false
 	}
-	authenticateWithCSRF := func(w http.ResponseWriter, r *http.Request) (string, bool) {
+	writeAccessDenied := func(w http.ResponseWriter) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(403)
+		io.WriteString(w, accessDeniedPage)
+	}
+
+	// Authenticates the user and checks that they have every permission in
+	// perms.
+	authenticateWith := func(w http.ResponseWriter, r *http.Request,
+		perms ...string) (string, bool) {
 		username, ok := authenticate(w, r)
 		if !ok {
 			return username, ok
 		}
-		if !loginDetails[username].AllowEditing {
-			w.Header().Set("Content-Type", "text/html; charset=utf-8")
-			w.WriteHeader(401)
-			io.WriteString(w, accessDeniedPage)
+		d := getPermissions(username)
+		for _, perm := range perms {
+			if !d.Has(perm) {
+				writeAccessDenied(w)
+				return username, false
+			}
+		}
+		return username, true
+	}
+	authenticateViewer := func(w http.ResponseWriter, r *http.Request) (string, bool) {
+		return authenticateWith(w, r, PermView)
+	}
+
+	// Form submissions also need a CSRF token. Handlers that change more
+	// than one thing (such as /admin/edit) can check permissions themselves
+	// instead of passing them to this.
+	authenticateWithCSRF := func(w http.ResponseWriter, r *http.Request,
+		perms ...string) (string, bool) {
+		username, ok := authenticateWith(w, r, perms...)
+		if !ok {
+			return username, ok
+		}
+		if lurkcoin.IsReadOnly(db) {
+			writeAdminErrorPage(w, "The database is read-only.")
 			return username, false
 		}
 		r.ParseForm()
-		t, ok := csrfTokens[username]
-		if !ok || !lurkcoin.ConstantTimeCompare(r.Form.Get("csrfToken"), t) {
+		if !csrfTokens.Check(r, username) {
 			w.WriteHeader(500)
-			io.WriteString(w, "Please try again.")
+			io.WriteString(w, "Please reload the page and try again.")
 			return username, false
 		}
 		return username, true
 	}
 
+	if config.AdminPages.EnablePprof {
+		addPprofPages(router, authenticateViewer)
+	}
+	addMetricsPages(router, authenticateViewer)
+	addRuntimeStatsPages(router, db, authenticateViewer)
+	addJournalPages(router, getPermissions, authenticate)
+	addAuditPages(router, db, getPermissions, authenticate)
+	addAuditLogPages(router, db, getPermissions, authenticate)
+	addAdminUserPages(router, db, config, loginDetails, roles, csrfTokens,
+		getPermissions, authenticate, authenticateWithCSRF)
+	addSnapshotPages(router, db, config, getPermissions, authenticate)
+	addRestorePages(router, db, config, csrfTokens, authenticateWith)
+	addRawServerPages(router, db, csrfTokens, authenticateWith,
+		authenticateWithCSRF)
+	addExternalAuthPages(router, external)
+
 	router.GET("/admin", func(w http.ResponseWriter, r *http.Request,
 		_ httprouter.Params) {
-		username, ok := authenticate(w, r)
+		username, ok := authenticateViewer(w, r)
 		if !ok {
 			return
 		}
 
-		w.Header().Set("Content-Type", "text/html; charset=utf-8")
-		w.WriteHeader(http.StatusOK)
+		type column struct {
+			Name  string
+			Title string
+			URL   string
+		}
+		var data struct {
+			Summaries    []lurkcoin.ServerSummary
+			Prefix       string
+			Search       string
+			SortBy       string
+			Descending   bool
+			Columns      []column
+			Total        int
+			PreviousPage string
+			NextPage     string
+			Can          map[string]bool
+			CSRFToken    string
+		}
 
-		var summaries []*adminPagesSummary
-		var totalPendingTransactions int
-
-		lurkcoin.ForEach(db, func(server *lurkcoin.Server) error {
-			pendingTransactionCount := len(server.GetPendingTransactions())
-			totalPendingTransactions += pendingTransactionCount
-			summaries = append(summaries, &adminPagesSummary{
-				server.UID,
-				server.Name,
-				server.GetBalance(),
-				server.GetTargetBalance(),
-				pendingTransactionCount,
-			})
-			return nil
-		}, false)
+		query := r.URL.Query()
+		data.Prefix = query.Get("prefix")
+		data.Search = query.Get("search")
+		data.SortBy = query.Get("sort")
+		if data.SortBy == "" {
+			data.SortBy = lurkcoin.SortServersByName
+		}
+		data.Descending = query.Get("order") == "desc"
 
-		var data struct {
-			Summaries             []*adminPagesSummary
-			AllowEditing          bool
-			AllowDatabaseDownload bool
-			CSRFToken             string
+		// Returns a link to the server list with the current filters.
+		listURL := func(sortBy string, descending bool, extra ...string) string {
+			values := url.Values{}
+			for k, v := range map[string]string{"prefix": data.Prefix,
+				"search": data.Search, "sort": sortBy} {
+				if v != "" {
+					values.Set(k, v)
+				}
+			}
+			if descending {
+				values.Set("order", "desc")
+			}
+			for i := 0; i+1 < len(extra); i += 2 {
+				values.Set(extra[i], extra[i+1])
+			}
+			return "/admin?" + values.Encode()
 		}
-		data.Summaries = summaries
-		d := loginDetails[username]
-		data.AllowEditing = d.AllowEditing
-		data.AllowDatabaseDownload = d.AllowDatabaseDownload
-		if d.AllowEditing {
-			data.CSRFToken = csrfTokens.Get(username)
+		for _, c := range [][2]string{
+			{lurkcoin.SortServersByName, "Name"},
+			{lurkcoin.SortServersByBalance, "Balance"},
+			{lurkcoin.SortServersByTargetBalance, "Target balance"},
+			{lurkcoin.SortServersByPending, "Pending transactions"},
+		} {
+			data.Columns = append(data.Columns, column{c[0], c[1],
+				listURL(c[0], c[0] == data.SortBy && !data.Descending)})
 		}
 
+		if data.Search == "" && !data.Descending &&
+			data.SortBy == lurkcoin.SortServersByName {
+			// Servers are listed one page at a time, an extra UID is
+			// requested to check if there is another page.
+			page := db.ListServersPage(query.Get("after"), data.Prefix,
+				adminServersPerPage+1)
+			if len(page) > adminServersPerPage {
+				page = page[:adminServersPerPage]
+				data.NextPage = listURL(data.SortBy, false, "after",
+					page[len(page)-1])
+			}
+
+			tr := lurkcoin.BeginDbTransaction(db)
+			defer tr.Abort()
+			for _, uid := range page {
+				server, ok := tr.GetOneServer(uid)
+
+				// Skip aliases of renamed servers.
+				if !ok || server.UID != uid {
+					tr.Abort()
+					continue
+				}
+				data.Summaries = append(data.Summaries, lurkcoin.ServerSummary{
+					UID:                     server.UID,
+					Name:                    server.Name,
+					Balance:                 server.GetBalance(),
+					TargetBalance:           server.GetTargetBalance(),
+					PendingTransactionCount: len(server.GetPendingTransactions()),
+				})
+				tr.Abort()
+			}
+		} else {
+			// Sorting by other columns or searching reads every server.
+			page, _ := strconv.Atoi(query.Get("page"))
+			if page < 1 {
+				page = 1
+			}
+			var err error
+			data.Summaries, data.Total, err = lurkcoin.ListServerSummaries(db,
+				lurkcoin.ServerListOptions{
+					Prefix:     data.Prefix,
+					Search:     data.Search,
+					SortBy:     data.SortBy,
+					Descending: data.Descending,
+					Offset:     (page - 1) * adminServersPerPage,
+					Limit:      adminServersPerPage,
+				})
+			if err != nil {
+				writeAdminErrorPage(w, err.Error())
+				return
+			}
+			if page > 1 {
+				data.PreviousPage = listURL(data.SortBy, data.Descending,
+					"page", strconv.Itoa(page-1))
+			}
+			if page*adminServersPerPage < data.Total {
+				data.NextPage = listURL(data.SortBy, data.Descending,
+					"page", strconv.Itoa(page+1))
+			}
+		}
+
+		d := getPermissions(username)
+		data.Can = d.Can()
+		if d.Has(PermEditServers) {
+			data.CSRFToken = csrfTokens.Get(w, r, username)
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
 		err := summaryTmpl.Execute(w, data)
 		if err != nil {
+			lurkcoin.ReportError(err, adminPagesTags)
 			panic(err)
 		}
 	})
 
 	serverInfo := func(w http.ResponseWriter, r *http.Request,
 		serverName, username, msg string) {
-		servers, ok, _ := db.GetServers([]string{serverName})
+		// Aliases of renamed servers show the renamed server.
+		tr := lurkcoin.BeginDbTransaction(db)
+		defer tr.Abort()
+		server, ok := tr.GetOneServer(serverName)
 		if !ok {
 			w.WriteHeader(404)
 			return
 		}
-		server := servers[0]
-		defer db.FreeServers([]*lurkcoin.Server{server}, false)
-
-		w.Header().Set("Content-Type", "text/html; charset=utf-8")
-		w.WriteHeader(http.StatusOK)
 
+		type currencyInfo struct {
+			Name          string
+			Balance       lurkcoin.Currency
+			TargetBalance lurkcoin.Currency
+		}
 		var data struct {
-			Server       *lurkcoin.Server
-			CSRFToken    string
-			Message      string
-			AllowEditing bool
+			Server                  *lurkcoin.Server
+			CSRFToken               string
+			Message                 string
+			AllowEditing            bool
+			Can                     map[string]bool
+			TransactionLimit        string
+			DefaultTransactionLimit lurkcoin.Currency
+			Currencies              []currencyInfo
+			PendingTransactions     []lurkcoin.Transaction
+			WebhookDeliveries       []lurkcoin.WebhookDelivery
+
+			// Transactions in the history that have been reverted.
+			Reverted map[string]bool
 		}
 		data.Server = server
-		data.CSRFToken = csrfTokens.Get(username)
+		data.PendingTransactions = server.GetPendingTransactions()
+		data.Reverted = make(map[string]bool)
+		for _, transaction := range server.GetHistory() {
+			if transaction.Reverts != "" {
+				data.Reverted[transaction.Reverts] = true
+			}
+		}
+		data.WebhookDeliveries = lurkcoin.GetWebhookDeliveries(server.UID)
+		for _, currency := range lurkcoin.GetCurrencies() {
+			data.Currencies = append(data.Currencies, currencyInfo{currency,
+				server.GetBalanceIn(currency),
+				server.GetTargetBalanceIn(currency)})
+		}
+		if limit, ok := server.GetTransactionLimitOverride(); ok {
+			data.TransactionLimit = limit.RawString()
+		}
+		data.DefaultTransactionLimit = lurkcoin.GetTransactionLimit()
+		data.CSRFToken = csrfTokens.Get(w, r, username)
 		data.Message = msg
-		data.AllowEditing = loginDetails[username].AllowEditing
+		d := getPermissions(username)
+		data.AllowEditing = d.HasAny(PermEditBalances, PermEditServers,
+			PermRegenerateTokens, PermDeleteServers)
+		data.Can = d.Can()
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
 		err := infoTmpl.Execute(w, data)
 		if err != nil {
+			lurkcoin.ReportError(err, adminPagesTags)
 			panic(err)
 		}
 	}
 
 	router.GET("/admin/edit/:server", func(w http.ResponseWriter,
 		r *http.Request, params httprouter.Params) {
-		username, ok := authenticate(w, r)
+		username, ok := authenticateViewer(w, r)
 		if !ok {
 			return
 		}
@@ -572,25 +1140,67 @@ func addAdminPages(router *httprouter.Router, db lurkcoin.Database,
 
 		var msgs []string
 
+		// Fields that the user can't change aren't sent by the form, this
+		// only rejects modified requests.
+		d := getPermissions(adminUser)
+		denied := make(map[string]bool)
+		permitted := func(perm string) bool {
+			if d.Has(perm) {
+				return true
+			}
+			if !denied[perm] {
+				denied[perm] = true
+				msgs = append(msgs, "You do not have the "+perm+
+					" permission!")
+			}
+			return false
+		}
+
+		// Update the credit limit
+		if r.Form.Get("creditLimit") != r.Form.Get("oldCreditLimit") &&
+			permitted(PermEditBalances) {
+			creditLimit, oldCreditLimit, ok := parseNumbers(
+				r.Form.Get("creditLimit"),
+				r.Form.Get("oldCreditLimit"),
+			)
+			if !ok || creditLimit.LtZero() {
+				msgs = append(msgs, "Invalid credit limit specified!")
+			} else if !creditLimit.Eq(oldCreditLimit) {
+				before := server.GetCreditLimit()
+				server.SetCreditLimit(creditLimit)
+				msgs = append(msgs, "Credit limit updated!")
+				adminLogger(r, adminUser).Info("Changed server credit limit",
+					"server", server.UID, "credit_limit", creditLimit)
+				journalServerAction(r, db, server, adminUser, "set_credit_limit",
+					server.UID, before.RawString(), creditLimit.RawString())
+			}
+		}
+
 		// Update the balance
 		// This preserves any transactions after the initial page load.
 		balance, oldBalance, ok := parseNumbers(
 			r.Form.Get("balance"),
 			r.Form.Get("oldBalance"),
 		)
-		if !ok {
+		if r.Form.Get("balance") == r.Form.Get("oldBalance") ||
+			!permitted(PermEditBalances) {
+			// Unchanged
+		} else if !ok {
 			msgs = append(msgs, "Invalid balance specified!")
 		} else if !balance.Eq(oldBalance) {
+			before := server.GetBalance()
+
+			// Balances below the credit limit are set to the lowest
+			// balance allowed.
 			if !server.ChangeBal(balance.Sub(oldBalance)) {
-				server.ChangeBal(server.GetBalance())
+				server.ChangeBal(server.GetBalance().Add(
+					server.GetCreditLimit()).Neg())
 			}
 			msgs = append(msgs, "Balance updated!")
-			log.Printf(
-				"[Admin] User %#v changes balance of server %#v to %s",
-				adminUser,
-				server.Name,
-				server.GetBalance(),
-			)
+			adminLogger(r, adminUser).Info("Changed server balance",
+				"server", server.UID, "balance", server.GetBalance())
+			journalServerAction(r, db, server, adminUser, "set_balance", server.UID,
+				before.RawString(), server.GetBalance().RawString())
 		}
 
 		// Update the target balance
@@ -598,44 +1208,152 @@ func addAdminPages(router *httprouter.Router, db lurkcoin.Database,
 			r.Form.Get("targetBalance"),
 			r.Form.Get("oldTargetBalance"),
 		)
-		if !ok {
+		if r.Form.Get("targetBalance") == r.Form.Get("oldTargetBalance") ||
+			!permitted(PermEditBalances) {
+			// Unchanged
+		} else if !ok {
 			msgs = append(msgs, "Invalid target balance specified!")
 		} else if !targetBalance.Eq(oldTargetBalance) {
+			before := server.GetTargetBalance()
 			server.SetTargetBalance(targetBalance)
 			msgs = append(msgs, "Target balance updated!")
-			log.Printf(
-				"[Admin] User %#v changes target balance of server %#v to %s",
-				adminUser,
-				server.Name,
-				targetBalance,
-			)
+			adminLogger(r, adminUser).Info("Changed server target balance",
+				"server", server.UID, "target_balance", targetBalance)
+			journalServerAction(r, db, server, adminUser, "set_target_balance",
+				server.UID, before.RawString(), targetBalance.RawString())
+		}
+
+		// Update balances in other currencies. These fields may be missing
+		// if currencies were added after the page was loaded.
+		for _, currency := range lurkcoin.GetCurrencies() {
+			rawBalance := r.Form.Get("balance." + currency)
+			rawOldBalance := r.Form.Get("oldBalance." + currency)
+			if rawBalance != rawOldBalance && permitted(PermEditBalances) {
+				balance, oldBalance, ok := parseNumbers(rawBalance,
+					rawOldBalance)
+				if !ok {
+					msgs = append(msgs, "Invalid "+currency+
+						" balance specified!")
+				} else if !balance.Eq(oldBalance) {
+					before := server.GetBalanceIn(currency)
+
+					// Negative balances are set to zero.
+					if !server.ChangeBalIn(currency,
+						balance.Sub(oldBalance)) {
+						server.ChangeBalIn(currency,
+							server.GetBalanceIn(currency).Neg())
+					}
+					balance = server.GetBalanceIn(currency)
+					msgs = append(msgs, "Balance ("+currency+") updated!")
+					adminLogger(r, adminUser).Info("Changed server balance",
+						"server", server.UID, "currency", currency,
+						"balance", balance)
+					journalServerAction(r, db, server, adminUser,
+						"set_currency_balance", server.UID,
+						currency+":"+before.RawString(),
+						currency+":"+balance.RawString())
+				}
+			}
+
+			rawTarget := r.Form.Get("targetBalance." + currency)
+			rawOldTarget := r.Form.Get("oldTargetBalance." + currency)
+			if rawTarget != rawOldTarget && permitted(PermEditBalances) {
+				targetBalance, oldTargetBalance, ok := parseNumbers(rawTarget,
+					rawOldTarget)
+				changed := ok && !targetBalance.Eq(oldTargetBalance)
+				before := server.GetTargetBalanceIn(currency)
+				if !ok || (changed && !server.SetTargetBalanceIn(currency,
+					targetBalance)) {
+					msgs = append(msgs, "Invalid "+currency+
+						" target balance specified!")
+				} else if changed {
+					msgs = append(msgs, "Target balance ("+currency+
+						") updated!")
+					adminLogger(r, adminUser).Info(
+						"Changed server target balance", "server",
+						server.UID, "currency", currency, "target_balance",
+						targetBalance)
+					journalServerAction(r, db, server, adminUser,
+						"set_currency_target_balance", server.UID,
+						currency+":"+before.RawString(),
+						currency+":"+targetBalance.RawString())
+				}
+			}
 		}
 
 		// Update the webhook URL
 		webhookURL := r.Form.Get("webhookURL")
-		if webhookURL != r.Form.Get("oldWebhookURL") {
+		if webhookURL != r.Form.Get("oldWebhookURL") &&
+			permitted(PermEditServers) {
+			before := server.WebhookURL
 			ok := server.SetWebhookURL(webhookURL)
 			if ok {
 				msgs = append(msgs, "Webhook URL updated!")
 			} else {
 				msgs = append(msgs, "Invalid webhook URL!")
 			}
-			log.Printf(
-				"[Admin] User %#v changes webhook URL of server %#v to %#v",
-				adminUser,
-				server.Name,
-				server.WebhookURL,
-			)
+			adminLogger(r, adminUser).Info("Changed server webhook URL",
+				"server", server.UID, "webhook_url", server.WebhookURL)
+			journalServerAction(r, db, server, adminUser, "set_webhook_url",
+				server.UID, before, server.WebhookURL)
 		}
 
-		if r.Form.Get("regenerateToken") == "on" {
+		// Freeze or unfreeze the server
+		frozen := r.Form.Get("frozen")
+		if frozen != r.Form.Get("oldFrozen") && permitted(PermEditServers) {
+			before := server.GetFrozen()
+			if server.SetFrozen(frozen) {
+				if frozen == lurkcoin.FrozenNone {
+					msgs = append(msgs, "Server unfrozen!")
+				} else {
+					msgs = append(msgs, "Server frozen!")
+				}
+				adminLogger(r, adminUser).Info("Changed server freeze mode",
+					"server", server.UID, "frozen", frozen)
+				journalServerAction(r, db, server, adminUser, "set_frozen",
+					server.UID, before, frozen)
+			} else {
+				msgs = append(msgs, "Invalid freeze mode!")
+			}
+		}
+
+		// Override the transaction limit, an empty limit uses the default.
+		transactionLimit := strings.ReplaceAll(
+			strings.TrimSpace(r.Form.Get("transactionLimit")), ",", "")
+		if transactionLimit != r.Form.Get("oldTransactionLimit") &&
+			permitted(PermEditBalances) {
+			before := ""
+			if limit, ok := server.GetTransactionLimitOverride(); ok {
+				before = limit.RawString()
+			}
+			var limit lurkcoin.Currency
+			var err error
+			if transactionLimit != "" {
+				limit, err = lurkcoin.ParseCurrency(transactionLimit)
+			}
+			if err == nil {
+				err = server.SetTransactionLimit(limit)
+			}
+			if err == nil {
+				msgs = append(msgs, "Transaction limit updated!")
+				adminLogger(r, adminUser).Info(
+					"Changed server transaction limit", "server", server.UID,
+					"transaction_limit", server.GetTransactionLimit())
+				journalServerAction(r, db, server, adminUser, "set_transaction_limit",
+					server.UID, before, transactionLimit)
+			} else {
+				msgs = append(msgs, "Invalid transaction limit!")
+			}
+		}
+
+		if r.Form.Get("regenerateToken") == "on" &&
+			permitted(PermRegenerateTokens) {
 			if len(msgs) == 0 {
 				msgs = append(msgs, "New token: "+server.RegenerateToken())
-				log.Printf(
-					"[Admin] User %#v regenerates the token of server %#v",
-					adminUser,
-					server.Name,
-				)
+				adminLogger(r, adminUser).Info("Regenerated server token",
+					"server", server.UID)
+				journalServerAction(r, db, server, adminUser, "regenerate_token",
+					server.UID, "", "")
 			} else {
 				msgs = append(msgs, "Refusing to regenerate token as other"+
 					" settings were changed.")
@@ -649,9 +1367,308 @@ func addAdminPages(router *httprouter.Router, db lurkcoin.Database,
 		serverInfo(w, r, uid, adminUser, strings.Join(msgs, "\n"))
 	})
 
+	// Checks requests to the admin API and returns the admin username.
+	// Requiring a JSON content type prevents cross-site form submissions, so
+	// no CSRF token is needed.
+	adminAPIRequest := func(w http.ResponseWriter, r *http.Request,
+		perm string) (string, bool) {
+		adminUser, ok := authenticate(w, r)
+		if !ok {
+			return "", false
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if !getPermissions(adminUser).Has(perm) {
+			w.WriteHeader(http.StatusForbidden)
+			io.WriteString(w, `{"error":"Permission denied"}`)
+			return "", false
+		}
+		if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			io.WriteString(w, `{"error":"Expected application/json"}`)
+			return "", false
+		}
+		if lurkcoin.IsReadOnly(db) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			io.WriteString(w, `{"error":"The database is read-only"}`)
+			return "", false
+		}
+		return adminUser, true
+	}
+
+	// Used by "lurkcoin token regenerate".
+	router.POST("/admin/api/regenerate-token/:server", func(w http.ResponseWriter,
+		r *http.Request, params httprouter.Params) {
+		adminUser, ok := adminAPIRequest(w, r, PermRegenerateTokens)
+		if !ok {
+			return
+		}
+
+		tr := lurkcoin.BeginDbTransaction(db)
+		defer tr.Abort()
+		server, ok := tr.GetOneServer(params.ByName("server"))
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, `{"error":"The server does not exist"}`)
+			return
+		}
+		token := server.RegenerateToken()
+		adminLogger(r, adminUser).Info("Regenerated server token",
+			"server", server.UID)
+		journalServerAction(r, db, server, adminUser, "regenerate_token",
+			server.UID, "", "")
+		name := server.Name
+		tr.Finish()
+
+		json.NewEncoder(w).Encode(map[string]string{
+			"name":  name,
+			"token": token,
+		})
+	})
+
+	// Freezes or unfreezes a server, the request body should be something
+	// like {"frozen": "outgoing"}.
+	router.POST("/admin/api/freeze/:server", func(w http.ResponseWriter,
+		r *http.Request, params httprouter.Params) {
+		adminUser, ok := adminAPIRequest(w, r, PermEditServers)
+		if !ok {
+			return
+		}
+		var p struct {
+			Frozen *string `json:"frozen"`
+		}
+		err := json.NewDecoder(r.Body).Decode(&p)
+		if err != nil || p.Frozen == nil ||
+			!lurkcoin.IsValidFreezeMode(*p.Frozen) {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, `{"error":"Invalid freeze mode"}`)
+			return
+		}
+
+		tr := lurkcoin.BeginDbTransaction(db)
+		defer tr.Abort()
+		server, ok := tr.GetOneServer(params.ByName("server"))
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, `{"error":"The server does not exist"}`)
+			return
+		}
+		before := server.GetFrozen()
+		server.SetFrozen(*p.Frozen)
+		adminLogger(r, adminUser).Info("Changed server freeze mode",
+			"server", server.UID, "frozen", *p.Frozen)
+		journalServerAction(r, db, server, adminUser, "set_frozen",
+			server.UID, before, *p.Frozen)
+		name := server.Name
+		tr.Finish()
+
+		json.NewEncoder(w).Encode(map[string]string{
+			"name":   name,
+			"frozen": *p.Frozen,
+		})
+	})
+
+	// Renames a server, the request body should be something like
+	// {"name": "new-name"}.
+	router.POST("/admin/api/rename/:server", func(w http.ResponseWriter,
+		r *http.Request, params httprouter.Params) {
+		adminUser, ok := adminAPIRequest(w, r, PermEditServers)
+		if !ok {
+			return
+		}
+		var p struct {
+			Name string `json:"name"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, `{"error":"Invalid request"}`)
+			return
+		}
+
+		serverUID := lurkcoin.HomogeniseUsername(params.ByName("server"))
+		newName := strings.TrimSpace(p.Name)
+		if err := lurkcoin.RenameServer(db, serverUID, newName); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+		adminLogger(r, adminUser).Info("Renamed server", "server", serverUID,
+			"new_name", newName)
+		journalAdminAction(r, db, adminUser, "rename_server", serverUID,
+			serverUID, newName)
+		json.NewEncoder(w).Encode(map[string]string{
+			"uid":  lurkcoin.HomogeniseUsername(newName),
+			"name": newName,
+		})
+	})
+
+	// Creates many servers at once, for example {"servers": [{"name":
+	// "server1"}, {"name": "server2", "target_balance": 1000}]}. The tokens
+	// are only returned here.
+	router.POST("/admin/api/create-servers", func(w http.ResponseWriter,
+		r *http.Request, _ httprouter.Params) {
+		adminUser, ok := adminAPIRequest(w, r, PermEditServers)
+		if !ok {
+			return
+		}
+		var p struct {
+			Servers []lurkcoin.BulkServer `json:"servers"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil ||
+			len(p.Servers) == 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, `{"error":"Invalid request"}`)
+			return
+		}
+		if len(p.Servers) > maxBulkServers {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{
+				"error": "At most " + strconv.Itoa(maxBulkServers) +
+					" servers can be created at once",
+			})
+			return
+		}
+
+		created, err := lurkcoin.CreateServers(db, p.Servers)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+		logger := adminLogger(r, adminUser)
+		for _, server := range created {
+			logger.Info("Created server", "server", server.UID)
+			journalAdminAction(r, db, adminUser, "create_server", server.UID,
+				"", server.Name)
+		}
+		json.NewEncoder(w).Encode(map[string][]lurkcoin.CreatedServer{
+			"servers": created,
+		})
+	})
+
+	router.POST("/admin/revert-transaction", func(w http.ResponseWriter,
+		r *http.Request, params httprouter.Params) {
+		adminUser, authenticated := authenticateWithCSRF(w, r, PermEditBalances)
+		if !authenticated {
+			return
+		}
+
+		// Admins can revert transactions of any age.
+		serverUID := r.Form.Get("server-uid")
+		id := r.Form.Get("transaction-id")
+		reversal, err := lurkcoin.RevertTransaction(db, serverUID, id,
+			time.Time{}, adminLogger(r, adminUser))
+		var msg string
+		if err == nil {
+			msg = "Transaction reverted! New transaction: " + reversal.ID
+			adminLogger(r, adminUser).Info("Reverted transaction",
+				"server", serverUID, "transaction_id", id,
+				"reversal_id", reversal.ID)
+			journalAdminAction(r, db, adminUser, "revert_transaction",
+				serverUID, "", id)
+		} else {
+			_, msg, _ = lurkcoin.LookupError(err.Error())
+		}
+		serverInfo(w, r, serverUID, adminUser, msg)
+	})
+
+	// Issues or withdraws lurkcoins, see lurkcoin.IssueLurkcoins().
+	router.POST("/admin/issue", func(w http.ResponseWriter,
+		r *http.Request, params httprouter.Params) {
+		adminUser, authenticated := authenticateWithCSRF(w, r, PermEditBalances)
+		if !authenticated {
+			return
+		}
+
+		serverUID := lurkcoin.HomogeniseUsername(r.Form.Get("server-uid"))
+		amount, err := lurkcoin.ParseCurrency(
+			strings.ReplaceAll(r.Form.Get("amount"), ",", ""))
+		if err != nil {
+			serverInfo(w, r, serverUID, adminUser, "Invalid amount specified!")
+			return
+		}
+
+		logger := adminLogger(r, adminUser)
+		var transaction *lurkcoin.Transaction
+		action := r.Form.Get("action")
+		switch action {
+		case "issue":
+			transaction, err = lurkcoin.IssueLurkcoins(db, serverUID,
+				adminUser, r.Form.Get("target"), amount, logger)
+		case "withdraw":
+			transaction, err = lurkcoin.WithdrawLurkcoins(db, serverUID,
+				adminUser, amount, logger)
+		default:
+			serverInfo(w, r, serverUID, adminUser, "Invalid action!")
+			return
+		}
+
+		var msg string
+		if err == nil {
+			msg = "Transaction created: " + transaction.ID
+			journalAdminAction(r, db, adminUser, action+"_lurkcoins",
+				serverUID, "", amount.RawString())
+		} else {
+			_, msg, _ = lurkcoin.LookupError(err.Error())
+		}
+		serverInfo(w, r, serverUID, adminUser, msg)
+	})
+
+	// Acknowledges (removes) or rejects a pending transaction, for example
+	// if the server it was sent to no longer exists.
+	router.POST("/admin/pending-transaction", func(w http.ResponseWriter,
+		r *http.Request, params httprouter.Params) {
+		adminUser, authenticated := authenticateWithCSRF(w, r, PermEditBalances)
+		if !authenticated {
+			return
+		}
+
+		serverUID := lurkcoin.HomogeniseUsername(r.Form.Get("server-uid"))
+		id := r.Form.Get("transaction-id")
+		logger := adminLogger(r, adminUser)
+		var msg string
+		switch r.Form.Get("action") {
+		case "acknowledge":
+			tr := lurkcoin.BeginDbTransaction(db)
+			defer tr.Abort()
+			server, ok := tr.GetOneServer(serverUID)
+			if !ok {
+				_, msg, _ = lurkcoin.LookupError("ERR_SERVERNOTFOUND")
+			} else if !server.RemovePendingTransaction(id) {
+				_, msg, _ = lurkcoin.LookupError("ERR_TRANSACTIONNOTFOUND")
+			} else {
+				tr.Finish()
+				msg = "Transaction acknowledged!"
+				logger.Info("Acknowledged pending transaction", "server",
+					serverUID, "transaction_id", id)
+				journalAdminAction(r, db, adminUser,
+					"acknowledge_pending_transaction", serverUID, "", id)
+			}
+		case "reject":
+			results, err := lurkcoin.RejectTransactions(db, serverUID,
+				[]string{id}, logger)
+			if err == nil && results[id].Rejected {
+				msg = "Transaction rejected!"
+				if reversal := results[id].Reversal; reversal != nil {
+					msg += " New transaction: " + reversal.ID
+				}
+				logger.Info("Rejected pending transaction", "server",
+					serverUID, "transaction_id", id)
+				journalAdminAction(r, db, adminUser,
+					"reject_pending_transaction", serverUID, "", id)
+			} else if err != nil {
+				_, msg, _ = lurkcoin.LookupError(err.Error())
+			} else {
+				_, msg, _ = lurkcoin.LookupError(results[id].Error)
+			}
+		default:
+			msg = "Invalid action!"
+		}
+		serverInfo(w, r, serverUID, adminUser, msg)
+	})
+
 	router.POST("/admin/delete", func(w http.ResponseWriter,
 		r *http.Request, params httprouter.Params) {
-		adminUser, authenticated := authenticateWithCSRF(w, r)
+		adminUser, authenticated := authenticateWithCSRF(w, r, PermDeleteServers)
 		if !authenticated {
 			return
 		}
@@ -662,21 +1679,112 @@ func addAdminPages(router *httprouter.Router, db lurkcoin.Database,
 			return
 		}
 
-		if db.DeleteServer(serverUID) {
-			log.Printf(
-				"[Admin] User %#v deleted server %#v",
-				adminUser,
-				serverUID,
-			)
+		if removed, ok := lurkcoin.DeleteServer(db, serverUID); ok {
+			adminLogger(r, adminUser).Info("Deleted server",
+				"server", serverUID, "removed_pending_transactions", removed)
+			journalAdminAction(r, db, adminUser, "delete_server",
+				serverUID, "", "")
 			http.Redirect(w, r, "/admin", http.StatusSeeOther)
 		} else {
 			writeAdminErrorPage(w, "Could not delete "+serverUID+"!")
 		}
 	})
 
+	router.GET("/admin/deleted", func(w http.ResponseWriter,
+		r *http.Request, params httprouter.Params) {
+		username, ok := authenticateViewer(w, r)
+		if !ok {
+			return
+		}
+
+		var data struct {
+			Servers   []lurkcoin.DeletedServer
+			Can       map[string]bool
+			CSRFToken string
+		}
+		var err error
+		data.Servers, err = lurkcoin.ListDeletedServers(db)
+		if err != nil {
+			writeAdminErrorPage(w, err.Error())
+			return
+		}
+		data.Can = getPermissions(username).Can()
+		if data.Can[PermDeleteServers] {
+			data.CSRFToken = csrfTokens.Get(w, r, username)
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		err = deletedTmpl.Execute(w, data)
+		if err != nil {
+			lurkcoin.ReportError(err, adminPagesTags)
+			panic(err)
+		}
+	})
+
+	router.POST("/admin/undelete", func(w http.ResponseWriter,
+		r *http.Request, params httprouter.Params) {
+		adminUser, authenticated := authenticateWithCSRF(w, r, PermDeleteServers)
+		if !authenticated {
+			return
+		}
+
+		serverUID := r.Form.Get("server-uid")
+		if !lurkcoin.UndeleteServer(db, serverUID) {
+			writeAdminErrorPage(w, "Could not undelete "+serverUID+"!")
+			return
+		}
+		adminLogger(r, adminUser).Info("Undeleted server", "server", serverUID)
+		journalAdminAction(r, db, adminUser, "undelete_server", serverUID,
+			"", "")
+		http.Redirect(w, r, "/admin/edit/"+serverUID, http.StatusSeeOther)
+	})
+
+	router.POST("/admin/purge", func(w http.ResponseWriter,
+		r *http.Request, params httprouter.Params) {
+		adminUser, authenticated := authenticateWithCSRF(w, r, PermDeleteServers)
+		if !authenticated {
+			return
+		}
+
+		// Only deleted servers can be purged from the admin pages.
+		serverUID := r.Form.Get("server-uid")
+		removed, ok := lurkcoin.PurgeDeletedServer(db, serverUID)
+		if !ok {
+			writeAdminErrorPage(w, "Could not purge "+serverUID+"!")
+			return
+		}
+		adminLogger(r, adminUser).Info("Purged deleted server",
+			"server", serverUID, "removed_pending_transactions", removed)
+		journalAdminAction(r, db, adminUser, "purge_server", serverUID, "",
+			"")
+		http.Redirect(w, r, "/admin/deleted", http.StatusSeeOther)
+	})
+
+	router.POST("/admin/rename-server", func(w http.ResponseWriter,
+		r *http.Request, params httprouter.Params) {
+		adminUser, authenticated := authenticateWithCSRF(w, r, PermEditServers)
+		if !authenticated {
+			return
+		}
+
+		serverUID := r.Form.Get("server-uid")
+		newName := strings.TrimSpace(r.Form.Get("new-name"))
+		if err := lurkcoin.RenameServer(db, serverUID, newName); err != nil {
+			writeAdminErrorPage(w, err.Error())
+			return
+		}
+		adminLogger(r, adminUser).Info("Renamed server", "server", serverUID,
+			"new_name", newName)
+		journalAdminAction(r, db, adminUser, "rename_server", serverUID,
+			serverUID, newName)
+		http.Redirect(w, r, "/admin/edit/"+lurkcoin.HomogeniseUsername(newName),
+			http.StatusSeeOther)
+	})
+
 	router.POST("/admin/create-server", func(w http.ResponseWriter,
 		r *http.Request, params httprouter.Params) {
-		adminUser, authenticated := authenticateWithCSRF(w, r)
+		adminUser, authenticated := authenticateWithCSRF(w, r, PermEditServers)
 		if !authenticated {
 			return
 		}
@@ -689,12 +1797,11 @@ func addAdminPages(router *httprouter.Router, db lurkcoin.Database,
 			defer tr.Abort()
 			server, ok := tr.CreateServer(serverName)
 			if ok {
-				log.Printf(
-					"[Admin] User %#v created server %#v",
-					adminUser,
-					server.Name,
-				)
-				msg = "Token: " + server.Encode().Token
+				adminLogger(r, adminUser).Info("Created server",
+					"server", server.UID)
+				journalServerAction(r, db, server, adminUser, "create_server",
+					server.UID, "", server.Name)
+				msg = "Token: " + server.GetNewToken()
 				tr.Finish()
 				serverInfo(w, r, serverName, adminUser, msg)
 				return
@@ -707,25 +1814,29 @@ func addAdminPages(router *httprouter.Router, db lurkcoin.Database,
 
 	router.GET("/admin/backup", func(w http.ResponseWriter,
 		r *http.Request, params httprouter.Params) {
-		username, ok := authenticate(w, r)
-		if !ok {
+		if _, ok := authenticateWith(w, r, PermDownloadBackups); !ok {
 			return
 		}
-		d := loginDetails[username]
-		if !d.AllowEditing || !d.AllowDatabaseDownload {
-			w.Header().Set("Content-Type", "text/html; charset=utf-8")
-			w.WriteHeader(401)
-			io.WriteString(w, accessDeniedPage)
-			return
+		var err error
+		if isYes(r.URL.Query().Get("gzip")) {
+			w.Header().Set("Content-Type", "application/gzip")
+			w.Header().Set(
+				"Content-Disposition",
+				`attachment; filename="lurkcoin backup.json.gz"`,
+			)
+			w.WriteHeader(http.StatusOK)
+			err = lurkcoin.BackupDatabaseGzip(db, w, false)
+		} else {
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.Header().Set(
+				"Content-Disposition",
+				`attachment; filename="lurkcoin backup.json"`,
+			)
+			w.WriteHeader(http.StatusOK)
+			err = lurkcoin.BackupDatabase(db, w)
 		}
-		w.Header().Set("Content-Type", "application/json; charset=utf-8")
-		w.Header().Set(
-			"Content-Disposition",
-			`attachment; filename="lurkcoin backup.json"`,
-		)
-		w.WriteHeader(http.StatusOK)
-		err := lurkcoin.BackupDatabase(db, w)
 		if err != nil {
+			lurkcoin.ReportError(err, adminPagesTags)
 			panic(err)
 		}
 	})
@@ -0,0 +1,200 @@
+//
+// lurkcoin admin permissions
+// Copyright © 2020 by luk3yx
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package api
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Admin permissions
+const (
+	// Viewing the server list, servers and runtime statistics.
+	PermView = "view"
+
+	// Changing balances, target balances, credit limits and transaction
+	// limits, and reverting transactions.
+	PermEditBalances = "edit_balances"
+
+	// Creating and renaming servers, and changing their webhook URL and
+	// whether they're frozen.
+	PermEditServers = "edit_servers"
+
+	PermRegenerateTokens = "regenerate_tokens"
+
+	// Deleting, undeleting and purging servers.
+	PermDeleteServers = "delete_servers"
+
+	// Viewing the audit log and the list of admin users and roles.
+	PermManageAdmins = "manage_admins"
+
+	// Downloading backups and the journal, and managing snapshots.
+	PermDownloadBackups = "download_backups"
+
+	// Restoring uploaded backups, which can overwrite any server.
+	PermRestoreBackups = "restore_backups"
+
+	// Viewing and editing servers' raw database records, which include
+	// their tokens.
+	PermEditRaw = "edit_raw"
+)
+
+var adminPermissionNames = []string{PermView, PermEditBalances,
+	PermEditServers, PermRegenerateTokens, PermDeleteServers,
+	PermManageAdmins, PermDownloadBackups, PermRestoreBackups, PermEditRaw}
+
+// Built-in roles, more can be added in the config file.
+var builtinAdminRoles = map[string][]string{
+	"viewer": {PermView},
+	"editor": {PermView, PermEditBalances, PermEditServers,
+		PermRegenerateTokens, PermDeleteServers},
+	"admin": adminPermissionNames,
+}
+
+func isAdminPermission(perm string) bool {
+	for _, p := range adminPermissionNames {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks custom roles and merges them with the built-in ones.
+func loadAdminRoles(custom map[string][]string) (map[string][]string,
+	error) {
+	roles := make(map[string][]string, len(builtinAdminRoles)+len(custom))
+	for name, perms := range builtinAdminRoles {
+		roles[name] = perms
+	}
+	for name, perms := range custom {
+		if _, exists := builtinAdminRoles[name]; exists {
+			return nil, fmt.Errorf("The %q admin role is built-in and "+
+				"can't be redefined.", name)
+		}
+		for _, perm := range perms {
+			if !isAdminPermission(perm) {
+				return nil, fmt.Errorf("Unknown admin permission %q in "+
+					"role %q.", perm, name)
+			}
+		}
+		roles[name] = perms
+	}
+	return roles, nil
+}
+
+// Expands the role and the deprecated allow_editing and
+// allow_database_download options into a sorted list of permissions. Users
+// and groups that don't specify anything get the "viewer" role.
+func (self AdminPermissions) resolve(roles map[string][]string) (
+	AdminPermissions, error) {
+	set := make(map[string]bool)
+	for _, perm := range self.Permissions {
+		if !isAdminPermission(perm) {
+			return self, fmt.Errorf("Unknown admin permission %q.", perm)
+		}
+		set[perm] = true
+	}
+
+	role := self.Role
+	if role == "" && len(self.Permissions) == 0 {
+		// allow_editing used to allow editing servers and downloading
+		// backups required both options. Admin users couldn't be managed
+		// at all, so allow_editing on its own is only the "editor" role.
+		if self.AllowEditing && self.AllowDatabaseDownload {
+			role = "admin"
+		} else if self.AllowEditing {
+			role = "editor"
+		} else {
+			role = "viewer"
+		}
+	}
+	if role != "" {
+		perms, ok := roles[role]
+		if !ok {
+			return self, fmt.Errorf("Unknown admin role %q.", role)
+		}
+		for _, perm := range perms {
+			set[perm] = true
+		}
+	}
+
+	res := AdminPermissions{Role: self.Role}
+	for perm := range set {
+		res.Permissions = append(res.Permissions, perm)
+	}
+	sort.Strings(res.Permissions)
+	return res, nil
+}
+
+// Resolves every entry in a map of group permissions.
+func resolveGroupPermissions(groups map[string]AdminPermissions,
+	roles map[string][]string) error {
+	for group, perms := range groups {
+		resolved, err := perms.resolve(roles)
+		if err != nil {
+			return fmt.Errorf("Group %q: %s", group, err)
+		}
+		groups[group] = resolved
+	}
+	return nil
+}
+
+// Returns true if the permissions include perm. This only works after
+// resolve() has been called.
+func (self AdminPermissions) Has(perm string) bool {
+	for _, p := range self.Permissions {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the permissions in either self or other (without a role).
+func (self AdminPermissions) merge(other AdminPermissions) AdminPermissions {
+	res := AdminPermissions{Permissions: append([]string{},
+		self.Permissions...)}
+	for _, perm := range other.Permissions {
+		if !res.Has(perm) {
+			res.Permissions = append(res.Permissions, perm)
+		}
+	}
+	return res
+}
+
+// Returns true if the permissions include any of perms.
+func (self AdminPermissions) HasAny(perms ...string) bool {
+	for _, perm := range perms {
+		if self.Has(perm) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the permissions as a map for use in templates, for example
+// {{if .Can.edit_balances}}.
+func (self AdminPermissions) Can() map[string]bool {
+	res := make(map[string]bool, len(self.Permissions))
+	for _, perm := range self.Permissions {
+		res[perm] = true
+	}
+	return res
+}
@@ -0,0 +1,162 @@
+//
+// lurkcoin raw server record pages
+// Copyright © 2020 by luk3yx
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/julienschmidt/httprouter"
+	"github.com/luk3yx/lurkcoin-core/lurkcoin"
+	"net/http"
+)
+
+const adminRawServerTemplate = adminPagesHeader + `
+<a href="/admin/edit/{{.UID}}">Go back</a>
+<h3>Raw database record: {{.UID}}</h3>
+{{if .Message}}
+	<h5 style="white-space: pre-line;">{{.Message}}</h5>
+{{end}}
+<p>
+	This is the server as it is stored in the database, including its token
+	hash and webhook secret. Editing it skips the checks made by the rest of
+	the admin pages, so it should only be used to fix broken records.
+</p>
+<form autocomplete="off" method="post" action="/admin/raw/{{.UID}}"
+		onsubmit="return confirm('Are you sure you want to overwrite this server?')">
+	<input type="hidden" name="csrfToken" value="{{.CSRFToken}}" />
+	<input type="hidden" name="oldHash" value="{{.Hash}}" />
+	<textarea name="json" spellcheck="false" readonly="readonly"
+		id="raw-json" style="width: 100%; height: 30em;
+		font-family: monospace; white-space: pre;">{{.JSON}}</textarea>
+	<br/>
+	<label>
+		<input type="checkbox" id="raw-unlock" />
+		I understand that invalid changes may break this server.
+	</label>
+	<input type="submit" value="Save" class="button-primary"
+		id="raw-save" disabled="disabled" />
+</form>
+<script>
+	"use strict";
+	document.getElementById("raw-unlock").addEventListener("change",
+		e => {
+			document.getElementById("raw-json").readOnly = !e.target.checked;
+			document.getElementById("raw-save").disabled = !e.target.checked;
+		});
+</script>
+` + adminPagesFooter
+
+// Returns the indented JSON for a server and a hash of it, which is used to
+// make sure that the server hasn't changed since the page was loaded.
+func encodeRawServer(encodedServer *lurkcoin.EncodedServer) (string, string) {
+	raw, err := json.MarshalIndent(encodedServer, "", "    ")
+	if err != nil {
+		panic(err)
+	}
+	hash := sha256.Sum256(raw)
+	return string(raw), hex.EncodeToString(hash[:])
+}
+
+// /admin/raw/:server shows the server's EncodedServer as JSON and allows it
+// to be replaced.
+func addRawServerPages(router *httprouter.Router, db lurkcoin.Database,
+	csrfTokens *csrfTokenManager,
+	authenticateWith func(http.ResponseWriter, *http.Request,
+		...string) (string, bool),
+	authenticateWithCSRF func(http.ResponseWriter, *http.Request,
+		...string) (string, bool)) {
+	tmpl := adminTemplates.mustParse("raw", adminRawServerTemplate, nil)
+
+	// The JSON is passed in separately so that rejected edits aren't lost.
+	writePage := func(w http.ResponseWriter, r *http.Request, adminUser,
+		uid, rawJSON, msg string) {
+		encodedServer, ok := lurkcoin.GetEncodedServer(db, uid)
+		if !ok {
+			writeAdminErrorPage(w, "The server does not exist.")
+			return
+		}
+		current, hash := encodeRawServer(&encodedServer)
+		if rawJSON == "" {
+			rawJSON = current
+		}
+
+		data := map[string]interface{}{
+			"UID":       uid,
+			"JSON":      rawJSON,
+			"Hash":      hash,
+			"Message":   msg,
+			"CSRFToken": csrfTokens.Get(w, r, adminUser),
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		if err := tmpl.Execute(w, data); err != nil {
+			lurkcoin.ReportError(err, adminPagesTags)
+			panic(err)
+		}
+	}
+
+	router.GET("/admin/raw/:server", func(w http.ResponseWriter,
+		r *http.Request, params httprouter.Params) {
+		adminUser, ok := authenticateWith(w, r, PermEditRaw)
+		if !ok {
+			return
+		}
+		uid := lurkcoin.HomogeniseUsername(params.ByName("server"))
+		writePage(w, r, adminUser, uid, "", "")
+	})
+
+	router.POST("/admin/raw/:server", func(w http.ResponseWriter,
+		r *http.Request, params httprouter.Params) {
+		adminUser, ok := authenticateWithCSRF(w, r, PermEditRaw)
+		if !ok {
+			return
+		}
+		uid := lurkcoin.HomogeniseUsername(params.ByName("server"))
+		rawJSON := r.Form.Get("json")
+
+		encodedServer, ok := lurkcoin.GetEncodedServer(db, uid)
+		if !ok {
+			writeAdminErrorPage(w, "The server does not exist.")
+			return
+		}
+		_, hash := encodeRawServer(&encodedServer)
+		if hash != r.Form.Get("oldHash") {
+			writePage(w, r, adminUser, uid, rawJSON, "The server has been "+
+				"modified since the page was loaded, please check your "+
+				"changes and try again.")
+			return
+		}
+
+		newServer, err := lurkcoin.ParseEncodedServer([]byte(rawJSON))
+		if err == nil {
+			err = lurkcoin.ReplaceEncodedServer(db, uid, newServer)
+		}
+		if err != nil {
+			writePage(w, r, adminUser, uid, rawJSON,
+				"Invalid server: "+err.Error())
+			return
+		}
+
+		adminLogger(r, adminUser).Info("Replaced raw server record",
+			"server", uid)
+		journalAdminAction(r, db, adminUser, "edit_raw_server", uid, "", "")
+		writePage(w, r, adminUser, uid, "", "Saved.")
+	})
+}
@@ -0,0 +1,341 @@
+//
+// lurkcoin backup restores
+// Copyright © 2020 by luk3yx
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package api
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/julienschmidt/httprouter"
+	"github.com/luk3yx/lurkcoin-core/lurkcoin"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// The maximum size of uploaded backups.
+const maxBackupUploadSize = 64 << 20
+
+// How long admins have to confirm a restore after uploading the backup.
+const pendingRestoreLifetime = 15 * time.Minute
+
+const adminRestoreTemplate = adminPagesHeader + `
+<a href="/admin">Go back</a>
+<h2>Restore backup</h2>
+{{if .Diff}}
+	<p>
+		Restoring <code>{{.Filename}}</code> will make the following changes.
+		Anything changed after this page was loaded will be overwritten.
+		{{if .Snapshots}}
+			A snapshot will be taken first so that the restore can be
+			undone.
+		{{end}}
+	</p>
+
+	{{range .Sections}}
+		<h4>{{.Title}} ({{len .Entries}})</h4>
+		{{if .Entries}}
+			<table>
+				<thead>
+					<tr>
+						<th>Name</th>
+						<th>Current balance</th>
+						<th>Restored balance</th>
+					</tr>
+				</thead>
+				<tbody>
+					{{range .Entries}}
+						<tr>
+							<td><code>{{.Name}}</code></td>
+							<td>{{if not .OldBalance.IsNil}}
+								{{.OldBalance}}
+							{{end}}</td>
+							<td>{{if not .NewBalance.IsNil}}
+								{{.NewBalance}}
+							{{end}}</td>
+						</tr>
+					{{end}}
+				</tbody>
+			</table>
+		{{end}}
+	{{end}}
+	<p>{{.Diff.Unchanged}} server(s) will not be changed.</p>
+
+	<form method="post" action="/admin/restore/confirm"
+			onsubmit="return confirm('Are you sure you want to restore this backup?')">
+		<input type="hidden" name="csrfToken" value="{{.CSRFToken}}" />
+		<input type="hidden" name="restoreID" value="{{.RestoreID}}" />
+		<input type="submit" value="Restore backup" class="button-primary" />
+		<a href="/admin/restore" class="button">Cancel</a>
+	</form>
+{{else}}
+	<p>
+		Backups created with the "Download database backup" button or
+		<code>lurkcoin backup</code> can be restored here. Compressed
+		backups are detected automatically. The changes will be shown
+		before anything is restored.
+	</p>
+	<form method="post" action="/admin/restore" enctype="multipart/form-data"
+			autocomplete="off">
+		<input type="hidden" name="csrfToken" value="{{.CSRFToken}}" />
+		Backup file<br/>
+		<input type="file" name="backup" required="required" />
+		<br/>
+		Passphrase (for encrypted backups)<br/>
+		<input type="password" name="passphrase" />
+		<br/>
+		<label>
+			<input type="checkbox" name="deleteMissing" value="yes" />
+			Delete servers that aren't in the backup
+		</label>
+		<input type="submit" value="Preview" class="button-primary" />
+	</form>
+{{end}}
+` + adminPagesFooter
+
+type pendingRestore struct {
+	username      string
+	filename      string
+	data          []byte
+	deleteMissing bool
+	expires       time.Time
+}
+
+// Uploaded backups waiting to be confirmed. Each admin can only have one
+// pending restore, uploading another backup replaces it.
+type pendingRestoreManager struct {
+	lock     sync.Mutex
+	restores map[string]pendingRestore
+}
+
+func (self *pendingRestoreManager) Add(restore pendingRestore) string {
+	now := time.Now()
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for id, p := range self.restores {
+		if p.username == restore.username || now.After(p.expires) {
+			delete(self.restores, id)
+		}
+	}
+
+	id := lurkcoin.GenerateToken()
+	restore.expires = now.Add(pendingRestoreLifetime)
+	self.restores[id] = restore
+	return id
+}
+
+// Removes and returns a pending restore if it belongs to username and hasn't
+// expired.
+func (self *pendingRestoreManager) Pop(id, username string) (pendingRestore,
+	bool) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	p, ok := self.restores[id]
+	if !ok || p.username != username {
+		return pendingRestore{}, false
+	}
+	delete(self.restores, id)
+	return p, time.Now().Before(p.expires)
+}
+
+// Reads and decrypts an uploaded backup and checks that it can be parsed.
+func readUploadedBackup(r *http.Request) (string, []byte,
+	[]lurkcoin.EncodedServer, error) {
+	f, header, err := r.FormFile("backup")
+	if err != nil {
+		return "", nil, nil, fmt.Errorf("Could not read the backup: %s", err)
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return "", nil, nil, fmt.Errorf("Could not read the backup: %s", err)
+	}
+
+	if lurkcoin.IsEncryptedBackup(data) {
+		data, err = lurkcoin.DecryptBackup(data, r.Form.Get("passphrase"))
+		if err != nil {
+			return "", nil, nil, err
+		}
+	}
+	encodedServers, err := lurkcoin.ReadBackup(bytes.NewReader(data))
+	if err != nil {
+		return "", nil, nil, fmt.Errorf("Invalid backup: %s", err)
+	}
+	return header.Filename, data, encodedServers, nil
+}
+
+// Backups are uploaded to /admin/restore, which shows the changes that would
+// be made, and are only restored once that is confirmed.
+func addRestorePages(router *httprouter.Router, db lurkcoin.Database,
+	config *Config, csrfTokens *csrfTokenManager,
+	authenticateWith func(http.ResponseWriter, *http.Request,
+		...string) (string, bool)) {
+	tmpl := adminTemplates.mustParse("restore", adminRestoreTemplate, nil)
+	pending := &pendingRestoreManager{
+		restores: make(map[string]pendingRestore),
+	}
+	snapshots := config.Snapshots.Directory != ""
+
+	type section struct {
+		Title   string
+		Entries []lurkcoin.BackupDiffEntry
+	}
+	execute := func(w http.ResponseWriter, data map[string]interface{}) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		if err := tmpl.Execute(w, data); err != nil {
+			lurkcoin.ReportError(err, adminPagesTags)
+			panic(err)
+		}
+	}
+
+	// Like authenticateWithCSRF, but the form is only parsed after the user
+	// has been authenticated so that large uploads are rejected early.
+	check := func(w http.ResponseWriter, r *http.Request) (string, bool) {
+		adminUser, ok := authenticateWith(w, r, PermRestoreBackups)
+		if !ok {
+			return "", false
+		}
+		if lurkcoin.IsReadOnly(db) {
+			writeAdminErrorPage(w, "The database is read-only.")
+			return "", false
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, maxBackupUploadSize)
+		if err := r.ParseMultipartForm(maxBackupUploadSize); err != nil &&
+			err != http.ErrNotMultipart {
+			writeAdminErrorPage(w, "Could not read the backup: "+err.Error())
+			return "", false
+		}
+		r.ParseForm()
+		if !csrfTokens.Check(r, adminUser) {
+			w.WriteHeader(500)
+			io.WriteString(w, "Please reload the page and try again.")
+			return "", false
+		}
+		return adminUser, true
+	}
+
+	router.GET("/admin/restore", func(w http.ResponseWriter,
+		r *http.Request, _ httprouter.Params) {
+		adminUser, ok := authenticateWith(w, r, PermRestoreBackups)
+		if !ok {
+			return
+		}
+		execute(w, map[string]interface{}{
+			"CSRFToken": csrfTokens.Get(w, r, adminUser),
+		})
+	})
+
+	router.POST("/admin/restore", func(w http.ResponseWriter,
+		r *http.Request, _ httprouter.Params) {
+		adminUser, ok := check(w, r)
+		if !ok {
+			return
+		}
+		if r.MultipartForm != nil {
+			defer r.MultipartForm.RemoveAll()
+		}
+
+		filename, data, encodedServers, err := readUploadedBackup(r)
+		if err != nil {
+			writeAdminErrorPage(w, err.Error())
+			return
+		}
+		deleteMissing := isYes(r.Form.Get("deleteMissing"))
+		diff, err := lurkcoin.DiffBackup(db, encodedServers, deleteMissing)
+		if err != nil {
+			lurkcoin.ReportError(err, adminPagesTags)
+			writeAdminErrorPage(w, "Could not compare the backup with the "+
+				"database.")
+			return
+		}
+
+		id := pending.Add(pendingRestore{
+			username:      adminUser,
+			filename:      filename,
+			data:          data,
+			deleteMissing: deleteMissing,
+		})
+		sections := []section{
+			{"New servers", diff.Created},
+			{"Changed servers", diff.Changed},
+		}
+		if deleteMissing {
+			sections = append(sections, section{"Deleted servers",
+				diff.Deleted})
+		}
+		execute(w, map[string]interface{}{
+			"Diff":      diff,
+			"Sections":  sections,
+			"Filename":  filename,
+			"Snapshots": snapshots,
+			"RestoreID": id,
+			"CSRFToken": csrfTokens.Get(w, r, adminUser),
+		})
+	})
+
+	router.POST("/admin/restore/confirm", func(w http.ResponseWriter,
+		r *http.Request, _ httprouter.Params) {
+		adminUser, ok := check(w, r)
+		if !ok {
+			return
+		}
+		p, ok := pending.Pop(r.Form.Get("restoreID"), adminUser)
+		if !ok {
+			writeAdminErrorPage(w, "The uploaded backup has expired, "+
+				"please upload it again.")
+			return
+		}
+
+		// Take a snapshot first so that the restore can be undone.
+		logger := adminLogger(r, adminUser)
+		if snapshots {
+			snapshot, err := CreateSnapshot(db, config.Snapshots.Directory)
+			if err != nil {
+				writeAdminErrorPage(w, "Could not create a snapshot: "+
+					err.Error())
+				return
+			}
+			logger.Info("Created snapshot", "snapshot", snapshot.Name)
+		}
+
+		var err error
+		if p.deleteMissing {
+			err = lurkcoin.RestoreDatabaseFull(db, bytes.NewReader(p.data))
+		} else {
+			err = lurkcoin.RestoreDatabase(db, bytes.NewReader(p.data))
+		}
+		if err != nil {
+			lurkcoin.ReportError(err, adminPagesTags)
+			writeAdminErrorPage(w, "Could not restore the backup: "+
+				err.Error())
+			return
+		}
+
+		logger.Info("Restored backup", "filename", p.filename,
+			"delete_missing", p.deleteMissing)
+		action := "restore_backup"
+		if p.deleteMissing {
+			action = "restore_backup_full"
+		}
+		journalAdminAction(r, db, adminUser, action, "", "", p.filename)
+		http.Redirect(w, r, "/admin", http.StatusSeeOther)
+	})
+}
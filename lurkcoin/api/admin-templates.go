@@ -0,0 +1,169 @@
+//
+// lurkcoin admin page templates
+// Copyright © 2020 by luk3yx
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package api
+
+import (
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const adminErrorTemplate = adminPagesHeader + `
+<h2>An error has occurred!</h2>
+<h5>{{.Message}}</h5>
+<p>Request ID: <code>{{.RequestID}}</code></p>
+<i>
+	You can hurry back to the previous page, or learn to like this error and
+	then eventually grow old and die.
+</i>
+<br/><br/>
+<a class="button button-primary" href="/admin">Go back</a>
+` + adminPagesFooter
+
+var adminTemplateWhitespace = regexp.MustCompile(`\s+`)
+
+// The built-in admin templates can be overridden with files in
+// admin_pages.template_directory. Each file is named after the template it
+// replaces (for example "info.html" or "error.html"). header.html and
+// footer.html replace the header and footer of the built-in templates that
+// aren't overridden.
+type adminTemplateSet struct {
+	dir    string
+	header string
+	footer string
+
+	errorPage *template.Template
+}
+
+// The templates are loaded by addAdminPages() before any other admin pages
+// are added.
+var adminTemplates = newAdminTemplateSet()
+
+func newAdminTemplateSet() *adminTemplateSet {
+	self := &adminTemplateSet{header: adminPagesHeader,
+		footer: adminPagesFooter}
+	self.errorPage = template.Must(self.parse("error", adminErrorTemplate,
+		nil))
+	return self
+}
+
+// Loads header.html, footer.html and error.html from dir.
+func loadAdminTemplates(dir string) error {
+	self := newAdminTemplateSet()
+	if dir == "" {
+		adminTemplates = self
+		return nil
+	}
+	if info, err := os.Stat(dir); err != nil {
+		return err
+	} else if !info.IsDir() {
+		return fmt.Errorf("%q is not a directory.", dir)
+	}
+	self.dir = dir
+
+	var err error
+	for _, part := range []struct {
+		name  string
+		value *string
+	}{{"header", &self.header}, {"footer", &self.footer}} {
+		if _, err = self.readFile(part.name, part.value); err != nil {
+			return err
+		}
+	}
+	self.errorPage, err = self.parse("error", adminErrorTemplate, nil)
+	if err != nil {
+		return err
+	}
+	adminTemplates = self
+	return nil
+}
+
+// Reads name.html into res if it exists.
+func (self *adminTemplateSet) readFile(name string, res *string) (bool,
+	error) {
+	if self.dir == "" {
+		return false, nil
+	}
+	raw, err := ioutil.ReadFile(filepath.Join(self.dir, name+".html"))
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	*res = string(raw)
+	return true, nil
+}
+
+// Returns the source of a template and true if it was loaded from the
+// template directory. builtin must start with adminPagesHeader and end with
+// adminPagesFooter.
+func (self *adminTemplateSet) source(name, builtin string) (string, bool,
+	error) {
+	var res string
+	if ok, err := self.readFile(name, &res); ok || err != nil {
+		return res, ok, err
+	}
+	return self.wrap(adminTemplateBody(builtin)), false, nil
+}
+
+// Removes the default header and footer from a built-in template.
+func adminTemplateBody(builtin string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(builtin, adminPagesHeader),
+		adminPagesFooter)
+}
+
+// Adds the header and footer to a page.
+func (self *adminTemplateSet) wrap(body string) string {
+	return self.header + body + self.footer
+}
+
+// Parses a template. Whitespace in the body of built-in templates is
+// collapsed, custom templates are left alone.
+func (self *adminTemplateSet) parse(name, builtin string,
+	funcs template.FuncMap) (*template.Template, error) {
+	var src string
+	custom, err := self.readFile(name, &src)
+	if err != nil {
+		return nil, err
+	} else if !custom {
+		src = self.wrap(adminTemplateWhitespace.ReplaceAllLiteralString(
+			adminTemplateBody(builtin), " "))
+	}
+	tmpl, err := template.New(name).Funcs(funcs).Parse(src)
+	if err != nil && custom {
+		err = fmt.Errorf("%s: %s", filepath.Join(self.dir, name+".html"),
+			err)
+	}
+	return tmpl, err
+}
+
+// Like parse(), but exits if the template is invalid.
+func (self *adminTemplateSet) mustParse(name, builtin string,
+	funcs template.FuncMap) *template.Template {
+	tmpl, err := self.parse(name, builtin, funcs)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return tmpl
+}
@@ -0,0 +1,488 @@
+//
+// lurkcoin admin user management pages
+// Copyright © 2020 by luk3yx
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package api
+
+import (
+	"fmt"
+	"github.com/julienschmidt/httprouter"
+	"github.com/luk3yx/lurkcoin-core/lurkcoin"
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// The minimum length of passwords set on /admin/users.
+const minAdminPasswordLength = 8
+
+// Shared by the user list and the user edit page.
+const adminUserPermissionsForm = `
+	Role<br/>
+	<select name="role">
+		<option value="" {{if not .User.Role}}selected{{end}}>
+			(none)
+		</option>
+		{{range .RoleNames}}
+			<option value="{{.}}" {{if eq . $.User.Role}}selected{{end}}>
+				{{.}}
+			</option>
+		{{end}}
+	</select>
+	<br/>
+	Extra permissions<br/>
+	{{range .PermissionNames}}
+		<label style="display: inline-block; margin-right: 1em;">
+			<input type="checkbox" name="permissions" value="{{.}}"
+				{{if index $.UserCan .}}checked{{end}} />
+			{{.}}
+		</label>
+	{{end}}
+	<br/>
+`
+
+const adminUsersTemplate = adminPagesHeader + `
+<a href="/admin">Go back</a>
+<h2>Admin users</h2>
+<p>
+	Users in the config file and group mappings can only be changed by
+	editing the config file. Permissions for LDAP and OpenID Connect users
+	are taken from all of their groups.
+</p>
+
+<h4>Database users</h4>
+{{if .Supported}}
+	<table>
+		<thead>
+			<tr>
+				<th>Name</th>
+				<th>Role</th>
+				<th>Extra permissions</th>
+				<th>Status</th>
+				<th>Last modified</th>
+				<th></th>
+			</tr>
+		</thead>
+		<tbody>
+			{{range .DatabaseUsers}}
+				<tr>
+					<td><code>{{.Username}}</code></td>
+					<td>{{.Role}}</td>
+					<td>{{range $i, $perm := .Permissions -}}
+						{{if $i}}, {{end}}{{$perm}}
+					{{- end}}</td>
+					<td>{{if .Disabled}}Disabled{{else}}Active{{end}}</td>
+					<td>{{.GetModified.UTC}}</td>
+					<td><a href="/admin/users/{{.Username}}">Edit</a></td>
+				</tr>
+			{{else}}
+				<tr><td colspan="6"><i>None</i></td></tr>
+			{{end}}
+		</tbody>
+	</table>
+
+	{{if not .ReadOnly}}
+		<form autocomplete="off" method="post" action="/admin/users">
+			<h5>Create user</h5>
+			<input type="hidden" name="csrfToken" value="{{.CSRFToken}}" />
+			Username<br/>
+			<input type="text" name="username" maxlength="32"
+				required="required" />
+			<br/>
+			Password<br/>
+			<input type="password" name="password" required="required"
+				minlength="8" autocomplete="new-password" />
+			<br/>
+			` + adminUserPermissionsForm + `
+			<input type="submit" value="Create" class="button-primary" />
+		</form>
+	{{end}}
+{{else}}
+	<p><i>The database does not support admin users.</i></p>
+{{end}}
+
+{{range .Tables}}
+	<h4>{{.Title}}</h4>
+	<table>
+		<thead>
+			<tr>
+				<th>Name</th>
+				<th>Role</th>
+				<th>Permissions</th>
+			</tr>
+		</thead>
+		<tbody>
+			{{range .Rows}}
+				<tr>
+					<td><code>{{.Name}}</code></td>
+					<td>{{.Role}}</td>
+					<td>{{range $i, $perm := .Permissions -}}
+						{{if $i}}, {{end}}{{$perm}}
+					{{- end}}</td>
+				</tr>
+			{{else}}
+				<tr><td colspan="3"><i>None</i></td></tr>
+			{{end}}
+		</tbody>
+	</table>
+{{end}}
+` + adminPagesFooter
+
+const adminUserEditTemplate = adminPagesHeader + `
+<a href="/admin/users">Go back</a>
+<h3>Admin user: {{.User.Username}}</h3>
+{{if .Message}}
+	<h5 style="white-space: pre-line;">{{.Message}}</h5>
+{{end}}
+<p>
+	Created {{.User.GetCreated.UTC}}, last modified
+	{{.User.GetModified.UTC}}.
+</p>
+<form autocomplete="off" method="post"
+		action="/admin/users/{{.User.Username}}">
+	<input type="hidden" name="csrfToken" value="{{.CSRFToken}}" />
+	` + adminUserPermissionsForm + `
+	New password<br/>
+	<input type="password" name="password" placeholder="(unchanged)"
+		autocomplete="new-password" />
+	<br/>
+	<label>
+		<input type="checkbox" name="disabled"
+			{{if .User.Disabled}}checked{{end}} />
+		Disabled
+	</label>
+	<input type="submit" value="Save" class="button-primary"
+		{{if .ReadOnly}}disabled="disabled"{{end}} />
+</form>
+` + adminPagesFooter
+
+type adminUsersRow struct {
+	Name        string
+	Role        string
+	Permissions []string
+}
+
+type adminUsersTable struct {
+	Title string
+	Rows  []adminUsersRow
+}
+
+// Sorts users or groups by name, the permissions must already be resolved.
+func newAdminUsersTable(title string,
+	perms map[string]AdminPermissions) adminUsersTable {
+	table := adminUsersTable{Title: title}
+	for name, d := range perms {
+		table.Rows = append(table.Rows,
+			adminUsersRow{name, d.Role, d.Permissions})
+	}
+	sort.Slice(table.Rows, func(i, j int) bool {
+		return table.Rows[i].Name < table.Rows[j].Name
+	})
+	return table
+}
+
+// Returns a short description of an admin user's permissions for the audit
+// log.
+func describeAdminUser(user *lurkcoin.AdminUser) string {
+	res := "role=" + user.Role + " permissions=" +
+		strings.Join(user.Permissions, ",")
+	if user.Disabled {
+		res += " disabled"
+	}
+	return res
+}
+
+// Returns an error if perms includes anything that actor doesn't have, so
+// that admins can't give anyone (including themselves) more permissions
+// than they have. Both must already be resolved.
+func checkGrantablePermissions(perms, actor AdminPermissions) error {
+	for _, perm := range perms.Permissions {
+		if !actor.Has(perm) {
+			return fmt.Errorf("You can't grant the %q permission since "+
+				"you don't have it.", perm)
+		}
+	}
+	return nil
+}
+
+// Resolves the role and permissions of an admin user stored in the
+// database.
+func resolveAdminUser(user *lurkcoin.AdminUser,
+	roles map[string][]string) (AdminPermissions, error) {
+	return AdminPermissions{
+		Role:        user.Role,
+		Permissions: user.Permissions,
+	}.resolve(roles)
+}
+
+// Reads the role and permissions from a submitted form and checks them.
+// actor is the (resolved) permissions of the admin submitting the form.
+func parseAdminUserForm(r *http.Request, user *lurkcoin.AdminUser,
+	roles map[string][]string, actor AdminPermissions) error {
+	user.Role = r.Form.Get("role")
+	user.Permissions = r.Form["permissions"]
+	perms, err := resolveAdminUser(user, roles)
+	if err != nil {
+		return err
+	}
+	return checkGrantablePermissions(perms, actor)
+}
+
+// /admin/users lists admin users, LDAP and OpenID Connect groups and roles
+// along with their permissions. Admin users stored in the database can be
+// created and edited here.
+func addAdminUserPages(router *httprouter.Router, db lurkcoin.Database,
+	config *Config, loginDetails AdminLoginDetails,
+	roles map[string][]string, csrfTokens *csrfTokenManager,
+	getPermissions func(string) AdminPermissions,
+	authenticate adminAuthenticator,
+	authenticateWithCSRF func(http.ResponseWriter, *http.Request,
+		...string) (string, bool)) {
+	tmpl := adminTemplates.mustParse("users", adminUsersTemplate, nil)
+	editTmpl := adminTemplates.mustParse("user", adminUserEditTemplate, nil)
+
+	users := make(map[string]AdminPermissions, len(loginDetails))
+	for username, d := range loginDetails {
+		users[username] = d.AdminPermissions
+	}
+	roleNames := make([]string, 0, len(roles))
+	roleTable := adminUsersTable{Title: "Roles"}
+	for name, perms := range roles {
+		roleNames = append(roleNames, name)
+		roleTable.Rows = append(roleTable.Rows,
+			adminUsersRow{name, name, perms})
+	}
+	sort.Strings(roleNames)
+	sort.Slice(roleTable.Rows, func(i, j int) bool {
+		return roleTable.Rows[i].Name < roleTable.Rows[j].Name
+	})
+
+	tables := []adminUsersTable{
+		newAdminUsersTable("Config file users", users),
+		newAdminUsersTable("LDAP groups", config.AdminPages.LDAP.Groups),
+		newAdminUsersTable("OpenID Connect groups",
+			config.AdminPages.OIDC.Groups),
+		newAdminUsersTable("OpenID Connect users",
+			config.AdminPages.OIDC.Users),
+		roleTable,
+	}
+
+	checkPermission := func(w http.ResponseWriter, r *http.Request) (string,
+		bool) {
+		username, ok := authenticate(w, r)
+		if !ok {
+			return "", false
+		}
+		if !getPermissions(username).Has(PermManageAdmins) {
+			writeAdminErrorPage(w, "You may not manage admin users.")
+			return "", false
+		}
+		return username, true
+	}
+
+	// Common template data, user is the user shown in the permissions form.
+	newPageData := func(w http.ResponseWriter, r *http.Request,
+		username string, user *lurkcoin.AdminUser) map[string]interface{} {
+		userCan := make(map[string]bool, len(user.Permissions))
+		for _, perm := range user.Permissions {
+			userCan[perm] = true
+		}
+		return map[string]interface{}{
+			"User":            user,
+			"UserCan":         userCan,
+			"RoleNames":       roleNames,
+			"PermissionNames": adminPermissionNames,
+			"ReadOnly":        lurkcoin.IsReadOnly(db),
+			"CSRFToken":       csrfTokens.Get(w, r, username),
+		}
+	}
+
+	execute := func(w http.ResponseWriter, tmpl *template.Template,
+		data map[string]interface{}) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		if err := tmpl.Execute(w, data); err != nil {
+			lurkcoin.ReportError(err, adminPagesTags)
+			panic(err)
+		}
+	}
+
+	router.GET("/admin/users", func(w http.ResponseWriter, r *http.Request,
+		_ httprouter.Params) {
+		username, ok := checkPermission(w, r)
+		if !ok {
+			return
+		}
+
+		data := newPageData(w, r, username, &lurkcoin.AdminUser{})
+		data["Tables"] = tables
+		data["Supported"] = lurkcoin.SupportsAdminUsers(db)
+		if data["Supported"].(bool) {
+			dbUsers, err := lurkcoin.ListAdminUsers(db)
+			if err != nil {
+				writeAdminErrorPage(w, err.Error())
+				return
+			}
+			data["DatabaseUsers"] = dbUsers
+		}
+		execute(w, tmpl, data)
+	})
+
+	router.POST("/admin/users", func(w http.ResponseWriter, r *http.Request,
+		_ httprouter.Params) {
+		adminUser, ok := authenticateWithCSRF(w, r, PermManageAdmins)
+		if !ok {
+			return
+		}
+
+		username := strings.TrimSpace(r.Form.Get("username"))
+		password := r.Form.Get("password")
+		if !lurkcoin.ValidateAdminUsername(username) {
+			writeAdminErrorPage(w, lurkcoin.ErrInvalidAdminUsername.Error())
+			return
+		} else if len(password) < minAdminPasswordLength {
+			writeAdminErrorPage(w, "The password is too short.")
+			return
+		}
+		existing, err := lurkcoin.GetAdminUser(db, username)
+		if err != nil {
+			writeAdminErrorPage(w, err.Error())
+			return
+		}
+		if _, exists := loginDetails[username]; exists || existing != nil {
+			writeAdminErrorPage(w, "The specified admin user already exists!")
+			return
+		}
+
+		user := &lurkcoin.AdminUser{Username: username}
+		if err := parseAdminUserForm(r, user, roles,
+			getPermissions(adminUser)); err != nil {
+			writeAdminErrorPage(w, err.Error())
+			return
+		}
+		user.SetPassword(password)
+		if err := lurkcoin.SetAdminUser(db, user); err != nil {
+			writeAdminErrorPage(w, err.Error())
+			return
+		}
+
+		adminLogger(r, adminUser).Info("Created admin user",
+			"username", username)
+		journalAdminAction(r, db, adminUser, "create_admin_user", "", "",
+			username+" "+describeAdminUser(user))
+		http.Redirect(w, r, "/admin/users/"+username, http.StatusSeeOther)
+	})
+
+	// Returns the admin user in the URL or writes an error page.
+	getUser := func(w http.ResponseWriter,
+		params httprouter.Params) (*lurkcoin.AdminUser, bool) {
+		user, err := lurkcoin.GetAdminUser(db, params.ByName("username"))
+		if err != nil {
+			writeAdminErrorPage(w, err.Error())
+			return nil, false
+		} else if user == nil {
+			writeAdminErrorPage(w, "The specified admin user does not exist!")
+			return nil, false
+		}
+		return user, true
+	}
+
+	router.GET("/admin/users/:username", func(w http.ResponseWriter,
+		r *http.Request, params httprouter.Params) {
+		username, ok := checkPermission(w, r)
+		if !ok {
+			return
+		}
+		user, ok := getUser(w, params)
+		if !ok {
+			return
+		}
+		execute(w, editTmpl, newPageData(w, r, username, user))
+	})
+
+	router.POST("/admin/users/:username", func(w http.ResponseWriter,
+		r *http.Request, params httprouter.Params) {
+		adminUser, ok := authenticateWithCSRF(w, r, PermManageAdmins)
+		if !ok {
+			return
+		}
+		user, ok := getUser(w, params)
+		if !ok {
+			return
+		}
+
+		// Admins can't edit (or change the password of) users with
+		// permissions that they don't have themselves.
+		actor := getPermissions(adminUser)
+		if current, err := resolveAdminUser(user, roles); err != nil ||
+			checkGrantablePermissions(current, actor) != nil {
+			writeAdminErrorPage(w, "You can't edit admin users that have "+
+				"permissions you don't have.")
+			return
+		}
+
+		before := describeAdminUser(user)
+		if err := parseAdminUserForm(r, user, roles, actor); err != nil {
+			writeAdminErrorPage(w, err.Error())
+			return
+		}
+		user.Disabled = r.Form.Get("disabled") == "on"
+		if user.Disabled && user.Username == adminUser {
+			writeAdminErrorPage(w, "You can't disable your own account.")
+			return
+		}
+
+		var msgs []string
+		password := r.Form.Get("password")
+		if password != "" {
+			if len(password) < minAdminPasswordLength {
+				writeAdminErrorPage(w, "The password is too short.")
+				return
+			}
+			user.SetPassword(password)
+			msgs = append(msgs, "Password changed.")
+		}
+
+		if err := lurkcoin.SetAdminUser(db, user); err != nil {
+			writeAdminErrorPage(w, err.Error())
+			return
+		}
+
+		logger := adminLogger(r, adminUser)
+		if after := describeAdminUser(user); after != before {
+			logger.Info("Changed admin user", "username", user.Username,
+				"before", before, "after", after)
+			journalAdminAction(r, db, adminUser, "set_admin_user", "",
+				user.Username+" "+before, user.Username+" "+after)
+			msgs = append(msgs, "Permissions updated.")
+		}
+		if password != "" {
+			logger.Info("Changed admin user password", "username",
+				user.Username)
+			journalAdminAction(r, db, adminUser, "set_admin_password", "",
+				"", user.Username)
+		}
+		if len(msgs) == 0 {
+			msgs = append(msgs, "No changes made.")
+		}
+
+		data := newPageData(w, r, adminUser, user)
+		data["Message"] = strings.Join(msgs, "\n")
+		execute(w, editTmpl, data)
+	})
+}
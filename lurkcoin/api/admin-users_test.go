@@ -0,0 +1,84 @@
+//
+// lurkcoin admin user permission tests
+// Copyright © 2020 by luk3yx
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package api
+
+import (
+	"github.com/luk3yx/lurkcoin-core/lurkcoin"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestAdminUserFormPermissions(t *testing.T) {
+	roles, err := loadAdminRoles(map[string][]string{
+		"user-manager": {PermView, PermEditBalances, PermManageAdmins},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	actor, err := AdminPermissions{Role: "user-manager"}.resolve(roles)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		role  string
+		perms []string
+		ok    bool
+	}{
+		{"viewer", nil, true},
+		{"user-manager", nil, true},
+		{"", []string{PermView, PermEditBalances}, true},
+		{"viewer", []string{PermManageAdmins}, true},
+		{"admin", nil, false},
+		{"editor", nil, false},
+		{"viewer", []string{PermDownloadBackups}, false},
+		{"viewer", []string{PermRestoreBackups}, false},
+		{"", []string{PermEditRaw}, false},
+		{"unknown", nil, false},
+	}
+	for _, test := range tests {
+		r := &http.Request{Form: url.Values{
+			"role":        {test.role},
+			"permissions": test.perms,
+		}}
+		user := &lurkcoin.AdminUser{Username: "test"}
+		err := parseAdminUserForm(r, user, roles, actor)
+		if (err == nil) != test.ok {
+			t.Errorf("role %q, permissions %v: got error %v", test.role,
+				test.perms, err)
+		}
+	}
+}
+
+func TestLegacyAllowEditing(t *testing.T) {
+	roles, _ := loadAdminRoles(nil)
+	perms, err := AdminPermissions{AllowEditing: true}.resolve(roles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	editor, _ := AdminPermissions{Role: "editor"}.resolve(roles)
+	if len(perms.Permissions) != len(editor.Permissions) {
+		t.Errorf("allow_editing got %v, expected %v", perms.Permissions,
+			editor.Permissions)
+	}
+	if perms.Has(PermManageAdmins) {
+		t.Error("allow_editing grants manage_admins")
+	}
+}
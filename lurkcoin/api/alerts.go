@@ -0,0 +1,232 @@
+//
+// lurkcoin: Alerts
+// Copyright © 2020 by luk3yx
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package api
+
+import (
+	"errors"
+	"fmt"
+	"github.com/luk3yx/lurkcoin-core/lurkcoin"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Webhook failure rates are only checked if at least this many webhooks
+// were delivered since the last check.
+const minAlertWebhookDeliveries = 10
+
+// An alert rule. check() returns a message if the alert should fire, or an
+// empty string if everything is fine.
+type alertRule struct {
+	event    string
+	interval time.Duration
+	check    func() string
+
+	nextCheck time.Time
+	firing    bool
+}
+
+// Notifications are only sent when an alert starts firing and when it is
+// resolved.
+func (self *alertRule) run(now time.Time) {
+	if now.Before(self.nextCheck) {
+		return
+	}
+	self.nextCheck = now.Add(self.interval)
+	defer lurkcoin.RecoverAndReport(map[string]string{"component": "alerts"})
+
+	msg := self.check()
+	if msg != "" && !self.firing {
+		self.firing = true
+		lurkcoin.Notify(self.event, msg)
+	} else if msg == "" && self.firing {
+		self.firing = false
+		lurkcoin.Notify(self.event, fmt.Sprintf("The %s alert has been "+
+			"resolved.", strings.ReplaceAll(self.event, "_", " ")))
+	}
+}
+
+func runAlertRules(rules []*alertRule, interval time.Duration) {
+	for {
+		now := time.Now()
+		for _, rule := range rules {
+			rule.run(now)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// Fires if any server has more than threshold pending transactions.
+func pendingBacklogRule(db lurkcoin.Database, threshold int) func() string {
+	return func() string {
+		var servers []string
+		db.ForEachEncoded(func(server *lurkcoin.EncodedServer) error {
+			n := len(server.PendingTransactions)
+			if n > threshold && server.DeletedAt == 0 {
+				servers = append(servers, fmt.Sprintf("%q (%d)", server.Name,
+					n))
+			}
+			return nil
+		})
+		if len(servers) == 0 {
+			return ""
+		}
+		sort.Strings(servers)
+		return fmt.Sprintf("Servers with more than %d pending "+
+			"transactions: %s", threshold, strings.Join(servers, ", "))
+	}
+}
+
+// Fires if the proportion of failed webhook deliveries since the last check
+// is at least threshold.
+func webhookFailureRateRule(threshold float64) func() string {
+	lastDeliveries, lastFailures := lurkcoin.GetWebhookDeliveryStats()
+	return func() string {
+		deliveries, failures := lurkcoin.GetWebhookDeliveryStats()
+		d := deliveries - lastDeliveries
+		f := failures - lastFailures
+		lastDeliveries, lastFailures = deliveries, failures
+		if d < minAlertWebhookDeliveries {
+			return ""
+		}
+		rate := float64(f) / float64(d)
+		if rate < threshold {
+			return ""
+		}
+		return fmt.Sprintf("%d of %d webhook deliveries (%.0f%%) have "+
+			"failed recently.", f, d, rate*100)
+	}
+}
+
+// Fires if the consistency check finds any problems. Warnings are ignored.
+func reconciliationRule(db lurkcoin.Database) func() string {
+	return func() string {
+		discrepancies, err := lurkcoin.VerifyDatabase(db,
+			lurkcoin.GetJournal())
+		if err != nil {
+			return "Could not check the database: " + err.Error()
+		}
+		var problems []string
+		for _, d := range discrepancies {
+			if !d.Warning {
+				problems = append(problems, d.String())
+			}
+		}
+		if len(problems) == 0 {
+			return ""
+		}
+		msg := fmt.Sprintf("The consistency check found %d problem(s): %s",
+			len(problems), problems[0])
+		if len(problems) > 1 {
+			msg += " (and more, run \"lurkcoin verify\" for details)"
+		}
+		return msg
+	}
+}
+
+// Fires if the total supply has changed by at least percent% since the last
+// check.
+func supplyChangeRule(percent float64) func() string {
+	var last float64
+	return func() string {
+		stats, ok := getEconomyStats()
+		if !ok || stats.TotalSupply.IsNil() {
+			return ""
+		}
+		supply, _ := stats.TotalSupply.Float().Float64()
+		old := last
+		last = supply
+		if old == 0 {
+			return ""
+		}
+		change := (supply - old) / math.Abs(old) * 100
+		if math.Abs(change) < percent {
+			return ""
+		}
+		return fmt.Sprintf("The total supply has changed by %+.1f%% "+
+			"(from ¤%.2f to ¤%.2f).", change, old, supply)
+	}
+}
+
+func parseAlertInterval(name, s string, def time.Duration) (time.Duration,
+	error) {
+	if s == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < time.Minute {
+		return 0, fmt.Errorf("Invalid alerts %s: %q", name, s)
+	}
+	return d, nil
+}
+
+func setupAlerts(config *Config, db lurkcoin.Database) error {
+	c := config.Alerts
+	interval, err := parseAlertInterval("interval", c.Interval,
+		5*time.Minute)
+	if err != nil {
+		return err
+	}
+
+	var rules []*alertRule
+	if c.PendingTransactions > 0 {
+		rules = append(rules, &alertRule{
+			event:    lurkcoin.EventPendingBacklog,
+			interval: interval,
+			check:    pendingBacklogRule(db, c.PendingTransactions),
+		})
+	}
+	if c.WebhookFailureRate > 0 {
+		if c.WebhookFailureRate > 1 {
+			return errors.New("alerts.webhook_failure_rate must be " +
+				"between 0 and 1.")
+		}
+		rules = append(rules, &alertRule{
+			event:    lurkcoin.EventWebhookFailureRate,
+			interval: interval,
+			check:    webhookFailureRateRule(c.WebhookFailureRate),
+		})
+	}
+	if c.Reconciliation != "" {
+		reconciliationInterval, err := parseAlertInterval("reconciliation",
+			c.Reconciliation, 0)
+		if err != nil {
+			return err
+		}
+		rules = append(rules, &alertRule{
+			event:    lurkcoin.EventReconciliationMismatch,
+			interval: reconciliationInterval,
+			check:    reconciliationRule(db),
+		})
+	}
+	if c.SupplyChange > 0 {
+		rules = append(rules, &alertRule{
+			event:    lurkcoin.EventSupplyChange,
+			interval: interval,
+			check:    supplyChangeRule(c.SupplyChange),
+		})
+	}
+
+	if len(rules) > 0 {
+		lurkcoin.LogInfo("Checking alert rules", "rules", len(rules))
+		go runAlertRules(rules, time.Minute)
+	}
+	return nil
+}
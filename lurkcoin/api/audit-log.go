@@ -0,0 +1,211 @@
+//
+// lurkcoin admin audit log pages
+// Copyright © 2020 by luk3yx
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package api
+
+import (
+	"encoding/csv"
+	"github.com/julienschmidt/httprouter"
+	"github.com/luk3yx/lurkcoin-core/lurkcoin"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// The number of entries shown on /admin/audit if no limit is specified.
+const defaultAuditLogLimit = 200
+
+const auditLogTemplate = adminPagesHeader + `
+<a href="/admin">Go back</a>
+<h2>Audit log</h2>
+<form method="get" action="/admin/audit">
+	<input type="text" name="admin_user" value="{{.Filter.AdminUser}}"
+		placeholder="Admin user" />
+	<input type="text" name="action" value="{{.Filter.Action}}"
+		placeholder="Action" />
+	<input type="text" name="server" value="{{.Filter.Server}}"
+		placeholder="Server" />
+	<input type="text" name="since" value="{{.Since}}"
+		placeholder="Since (YYYY-MM-DD)" />
+	<input type="text" name="until" value="{{.Until}}"
+		placeholder="Until (YYYY-MM-DD)" />
+	<input type="submit" value="Filter" />
+</form>
+<i>Showing {{len .Entries}} entries, newest first.</i>
+<span style="float: right;">
+	<a href="/admin/audit.csv?{{.Query}}">Export as CSV</a>
+</span>
+<table>
+	<thead>
+		<tr>
+			<th>Time</th>
+			<th>Admin user</th>
+			<th>Action</th>
+			<th>Server</th>
+			<th>Before</th>
+			<th>After</th>
+			<th>IP address</th>
+		</tr>
+	</thead>
+	<tbody>
+		{{range $entry := .Entries}}
+			<tr>
+				<td>{{$entry.GetTime.UTC}}</td>
+				<td>{{$entry.AdminUser}}</td>
+				<td>{{$entry.Action}}</td>
+				<td>
+					{{if $entry.Server}}
+						<a href="/admin/edit/{{$entry.Server}}">
+							{{- $entry.Server -}}
+						</a>
+					{{end}}
+				</td>
+				<td><code>{{$entry.Before}}</code></td>
+				<td><code>{{$entry.After}}</code></td>
+				<td>{{$entry.IP}}</td>
+			</tr>
+		{{else}}
+			<tr><td colspan="7"><i>No matching entries.</i></td></tr>
+		{{end}}
+	</tbody>
+</table>
+` + adminPagesFooter
+
+// Parses the audit log filter from a request's query string.
+func parseAuditLogFilter(query url.Values,
+	defaultLimit int) (lurkcoin.AuditLogFilter, error) {
+	filter := lurkcoin.AuditLogFilter{
+		AdminUser: query.Get("admin_user"),
+		Action:    query.Get("action"),
+		Server:    query.Get("server"),
+		Limit:     defaultLimit,
+	}
+	var err error
+	filter.Since, err = ParseTimeFilter(query.Get("since"))
+	if err != nil {
+		return filter, err
+	}
+	filter.Until, err = ParseTimeFilter(query.Get("until"))
+	if err != nil {
+		return filter, err
+	}
+	if limit := query.Get("limit"); limit != "" {
+		filter.Limit, err = strconv.Atoi(limit)
+		if err != nil {
+			return filter, err
+		}
+	}
+	return filter, nil
+}
+
+// /admin/audit shows the audit log of admin actions (with optional filters)
+// and /admin/audit.csv exports it.
+func addAuditLogPages(router *httprouter.Router, db lurkcoin.Database,
+	getPermissions func(string) AdminPermissions,
+	authenticate adminAuthenticator) {
+	tmpl := adminTemplates.mustParse("audit-log", auditLogTemplate, nil)
+
+	// Returns the entries that match the request's filter or writes an
+	// error page.
+	listEntries := func(w http.ResponseWriter, r *http.Request,
+		defaultLimit int) (lurkcoin.AuditLogFilter, []*lurkcoin.AuditLogEntry,
+		bool) {
+		username, ok := authenticate(w, r)
+		if !ok {
+			return lurkcoin.AuditLogFilter{}, nil, false
+		}
+		if !getPermissions(username).Has(PermManageAdmins) {
+			writeAdminErrorPage(w, "You may not view the audit log.")
+			return lurkcoin.AuditLogFilter{}, nil, false
+		}
+		filter, err := parseAuditLogFilter(r.URL.Query(), defaultLimit)
+		if err != nil {
+			writeAdminErrorPage(w, err.Error())
+			return filter, nil, false
+		}
+		entries, err := lurkcoin.ListAuditLog(db, filter)
+		if err != nil {
+			requestLogger(r).Error("Could not read the audit log",
+				"error", err)
+			writeAdminErrorPage(w, "Could not read the audit log.")
+			return filter, nil, false
+		}
+		return filter, entries, true
+	}
+
+	router.GET("/admin/audit", func(w http.ResponseWriter,
+		r *http.Request, _ httprouter.Params) {
+		filter, entries, ok := listEntries(w, r, defaultAuditLogLimit)
+		if !ok {
+			return
+		}
+
+		query := r.URL.Query()
+		var data struct {
+			Filter  lurkcoin.AuditLogFilter
+			Since   string
+			Until   string
+			Query   string
+			Entries []*lurkcoin.AuditLogEntry
+		}
+		data.Filter = filter
+		data.Since = query.Get("since")
+		data.Until = query.Get("until")
+		query.Del("limit")
+		data.Query = query.Encode()
+		data.Entries = entries
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		if err := tmpl.Execute(w, data); err != nil {
+			lurkcoin.ReportError(err, adminPagesTags)
+			panic(err)
+		}
+	})
+
+	router.GET("/admin/audit.csv", func(w http.ResponseWriter,
+		r *http.Request, _ httprouter.Params) {
+		_, entries, ok := listEntries(w, r, 0)
+		if !ok {
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition",
+			`attachment; filename="audit-log.csv"`)
+		w.WriteHeader(http.StatusOK)
+		writer := csv.NewWriter(w)
+		writer.Write([]string{"id", "time", "admin_user", "action", "server",
+			"before", "after", "ip", "request_id"})
+		for _, entry := range entries {
+			writer.Write([]string{
+				strconv.FormatUint(entry.ID, 10),
+				entry.GetTime().UTC().Format(time.RFC3339),
+				entry.AdminUser,
+				entry.Action,
+				entry.Server,
+				entry.Before,
+				entry.After,
+				entry.IP,
+				entry.RequestID,
+			})
+		}
+		writer.Flush()
+	})
+}
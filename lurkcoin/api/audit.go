@@ -0,0 +1,61 @@
+//
+// lurkcoin: Ledger audits
+// Copyright © 2020 by luk3yx
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package api
+
+import (
+	"encoding/json"
+	"github.com/julienschmidt/httprouter"
+	"github.com/luk3yx/lurkcoin-core/lurkcoin"
+	"net/http"
+)
+
+// /admin/audit.json recalculates every server's balance from its history and
+// the journal, see lurkcoin.AuditDatabase().
+func addAuditPages(router *httprouter.Router, db lurkcoin.Database,
+	getPermissions func(string) AdminPermissions,
+	authenticate adminAuthenticator) {
+	router.GET("/admin/audit.json", func(w http.ResponseWriter,
+		r *http.Request, _ httprouter.Params) {
+		username, ok := authenticate(w, r)
+		if !ok {
+			return
+		}
+		if !getPermissions(username).Has(PermView) {
+			writeAdminErrorPage(w, "You may not audit the database.")
+			return
+		}
+
+		report, err := lurkcoin.AuditDatabase(db, lurkcoin.GetJournal())
+		if err != nil {
+			requestLogger(r).Error("Could not audit the database",
+				"error", err)
+			writeAdminErrorPage(w, "Could not audit the database.")
+			return
+		}
+		if report.Servers == nil {
+			report.Servers = []lurkcoin.ServerAudit{}
+		}
+		if report.Discrepancies == nil {
+			report.Discrepancies = []lurkcoin.Discrepancy{}
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(report)
+	})
+}
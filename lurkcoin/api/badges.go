@@ -0,0 +1,156 @@
+//
+// lurkcoin: Balance badges
+// Copyright © 2020 by luk3yx
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package api
+
+import (
+	"bytes"
+	"github.com/julienschmidt/httprouter"
+	"github.com/luk3yx/lurkcoin-core/lurkcoin"
+	"html/template"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+)
+
+type badgeInfo struct {
+	Name         string
+	Balance      string
+	ExchangeRate string
+}
+
+func (self badgeInfo) Value() string {
+	return self.Balance + " | ¤1 = " + self.ExchangeRate
+}
+
+// SVG text can't be measured in advance, so this assumes that characters
+// are 7 pixels wide (which is roughly right for 11px Verdana).
+func badgeTextWidth(s string) int {
+	return utf8.RuneCountInString(s)*7 + 10
+}
+
+func (self badgeInfo) LabelWidth() int {
+	return badgeTextWidth(self.Name)
+}
+
+func (self badgeInfo) ValueWidth() int {
+	return badgeTextWidth(self.Value())
+}
+
+func getBadgeInfo(db lurkcoin.Database, name string) (badgeInfo, bool) {
+	tr := lurkcoin.BeginDbTransaction(db)
+	defer tr.Abort()
+	server, ok := tr.GetOneServer(name)
+	if !ok {
+		return badgeInfo{}, false
+	}
+	_, exchangeRate := server.GetExchangeRate(lurkcoin.CurrencyFromInt64(1),
+		false)
+	return badgeInfo{
+		Name:         server.Name,
+		Balance:      server.GetBalance().String(),
+		ExchangeRate: exchangeRate.Text('f', 2),
+	}, true
+}
+
+var badgeTemplate = template.Must(template.New("badge").Funcs(
+	template.FuncMap{
+		"Add":  func(a, b int) int { return a + b },
+		"Half": func(a int) int { return a / 2 },
+	},
+).Parse(`<svg xmlns="http://www.w3.org/2000/svg" width="{{Add .LabelWidth .ValueWidth}}" height="20" role="img" aria-label="{{.Name}}: {{.Value}}">
+<title>{{.Name}}: {{.Value}}</title>
+<rect width="{{.LabelWidth}}" height="20" fill="#555"/>
+<rect x="{{.LabelWidth}}" width="{{.ValueWidth}}" height="20" fill="#007ec6"/>
+<g fill="#fff" text-anchor="middle" font-family="Verdana,DejaVu Sans,sans-serif" font-size="11">
+<text x="{{Half .LabelWidth}}" y="14">{{.Name}}</text>
+<text x="{{Add .LabelWidth (Half .ValueWidth)}}" y="14">{{.Value}}</text>
+</g>
+</svg>
+`))
+
+// The widget is meant to be embedded with an iframe.
+var badgeWidgetTemplate = template.Must(template.New("widget").Parse(
+	`<!DOCTYPE html>
+<html>
+<head>
+	<meta charset="utf-8" />
+	<title>{{.Name}}</title>
+	<style>
+		body {
+			margin: 0;
+			padding: 0.5em;
+			font-family: sans-serif;
+			font-size: 14px;
+		}
+		table {
+			border-collapse: collapse;
+		}
+		th {
+			text-align: left;
+			padding-right: 1em;
+		}
+	</style>
+</head>
+<body>
+<table>
+	<tr><th colspan="2">{{.Name}}</th></tr>
+	<tr><th>Balance</th><td>{{.Balance}}</td></tr>
+	<tr><th>Exchange rate</th><td>¤1 = {{.ExchangeRate}}</td></tr>
+</table>
+</body>
+</html>
+`))
+
+// Badges are available at /badge/<server>.svg and widgets at
+// /badge/<server>.html.
+func addBadgePages(router *httprouter.Router, db lurkcoin.Database) {
+	router.GET("/badge/:server", func(w http.ResponseWriter, r *http.Request,
+		params httprouter.Params) {
+		name := params.ByName("server")
+		var tmpl *template.Template
+		var contentType string
+		if strings.HasSuffix(name, ".svg") {
+			tmpl = badgeTemplate
+			contentType = "image/svg+xml"
+		} else if strings.HasSuffix(name, ".html") {
+			tmpl = badgeWidgetTemplate
+			contentType = "text/html; charset=utf-8"
+		} else {
+			http.NotFound(w, r)
+			return
+		}
+
+		info, ok := getBadgeInfo(db, name[:strings.LastIndexByte(name, '.')])
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, info); err != nil {
+			requestLogger(r).Error("Could not render badge", "error", err)
+			http.Error(w, "Internal error!", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		w.WriteHeader(http.StatusOK)
+		w.Write(buf.Bytes())
+	})
+}
@@ -19,17 +19,25 @@
 package api
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"github.com/julienschmidt/httprouter"
 	"github.com/luk3yx/lurkcoin-core/lurkcoin"
 	"github.com/luk3yx/lurkcoin-core/lurkcoin/databases"
 	"gopkg.in/yaml.v2"
+	"io"
 	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 )
 
 type Config struct {
@@ -48,12 +56,78 @@ type Config struct {
 	// An optional logfile
 	Logfile string `yaml:"logfile"`
 
+	// The minimum log level (debug, info, warning or error) and format
+	// (text or json).
+	LogLevel  string `yaml:"log_level"`
+	LogFormat string `yaml:"log_format"`
+
+	// An optional journal file that every transaction and admin action is
+	// appended to.
+	Journal string `yaml:"journal"`
+
+	// The number of transactions kept in each server's history (10 by
+	// default).
+	HistoryLength int `yaml:"history_length"`
+
+	// The maximum number of pending transactions each server can have (0
+	// for unlimited) and what to do when a server has too many.
+	PendingTransactions struct {
+		Limit    int    `yaml:"limit"`
+		Overflow string `yaml:"overflow"`
+	} `yaml:"pending_transactions"`
+
+	// The number of decimal places currency values are stored with (2 by
+	// default).
+	CurrencyDecimals int `yaml:"currency_decimals"`
+
+	// The default maximum transaction size (in lurkcoins), this can be
+	// overridden for individual servers on the admin pages.
+	TransactionLimit string `yaml:"transaction_limit"`
+
+	// Additional currencies, each server has a separate balance in each
+	// currency.
+	Currencies []string `yaml:"currencies"`
+
+	// The highest target balance servers can set and the target balance of
+	// new servers.
+	MaxTargetBalance     string `yaml:"max_target_balance"`
+	DefaultTargetBalance string `yaml:"default_target_balance"`
+
+	// Fees charged on payments between servers, credited to the treasury
+	// server.
+	Fees struct {
+		Treasury   string  `yaml:"treasury"`
+		Flat       string  `yaml:"flat"`
+		Percentage float64 `yaml:"percentage"`
+		Servers    map[string]struct {
+			Flat       string  `yaml:"flat"`
+			Percentage float64 `yaml:"percentage"`
+		} `yaml:"servers"`
+	} `yaml:"fees"`
+
 	Database struct {
 		Type     string            `yaml:"type"`
 		Location string            `yaml:"location"`
 		Options  map[string]string `yaml:"options"`
+
+		// Rejects all changes to the database.
+		ReadOnly bool `yaml:"read_only"`
+
+		// The number of recently used servers to keep in memory.
+		CacheSize int `yaml:"cache_size"`
 	} `yaml:"database"`
 
+	// Periodic snapshots of the database file (bbolt only).
+	Snapshots struct {
+		Directory string `yaml:"directory"`
+
+		// How often to take snapshots (defaults to 1 hour).
+		Interval string `yaml:"interval"`
+
+		// The number of snapshots to keep (defaults to 24).
+		Keep int `yaml:"keep"`
+	} `yaml:"snapshots"`
+
 	// TLS
 	TLS struct {
 		Enable   bool   `yaml:"enable"`
@@ -65,6 +139,33 @@ type Config struct {
 	AdminPages struct {
 		Enable bool              `yaml:"enable"`
 		Users  AdminLoginDetails `yaml:"users"`
+
+		// Exposes net/http/pprof at /debug/pprof/ to admin users.
+		EnablePprof bool `yaml:"enable_pprof"`
+
+		// Custom admin roles (role name: list of permissions), see
+		// admin-permissions.go.
+		Roles map[string][]string `yaml:"roles"`
+
+		// A directory containing templates that replace the built-in ones,
+		// see adminTemplateSet.
+		TemplateDirectory string `yaml:"template_directory"`
+
+		// Brute-force protection, see adminLoginThrottle.
+		LoginLockout struct {
+			MaxFailures int    `yaml:"max_failures"`
+			Duration    string `yaml:"duration"`
+		} `yaml:"login_lockout"`
+
+		// Optional external authentication providers.
+		LDAP ldapConfig `yaml:"ldap"`
+		OIDC oidcConfig `yaml:"oidc"`
+
+		// If an address or port is set, the admin pages are served on a
+		// separate listener instead of alongside the API.
+		NetworkProtocol string `yaml:"network_protocol"`
+		Address         string `yaml:"address"`
+		Port            uint16 `yaml:"port"`
 	} `yaml:"admin_pages"`
 
 	// HTTP redirects
@@ -78,6 +179,191 @@ type Config struct {
 
 	// Disables HTTP keep-alives.
 	DisableHTTPKeepAlives bool `yaml:"disable_http_keepalives"`
+
+	// HTTP server timeouts (for example "30s"), by default there are no
+	// timeouts.
+	HTTPReadTimeout  string `yaml:"http_read_timeout"`
+	HTTPWriteTimeout string `yaml:"http_write_timeout"`
+	HTTPIdleTimeout  string `yaml:"http_idle_timeout"`
+
+	// The maximum size of API request bodies in bytes (defaults to 4096).
+	MaxRequestBodySize int64 `yaml:"max_request_body_size"`
+
+	// Reverse proxies (IP addresses, CIDR ranges or "unix") that are trusted
+	// to set the X-Forwarded-For and X-Real-IP headers.
+	TrustedProxies []string `yaml:"trusted_proxies"`
+
+	// How long to wait for requests and webhook deliveries to finish when
+	// shutting down (defaults to 30 seconds).
+	ShutdownTimeout string `yaml:"shutdown_timeout"`
+
+	// An optional file to write the process ID to.
+	PidFile string `yaml:"pid_file"`
+
+	AccessLog struct {
+		Enable bool `yaml:"enable"`
+
+		// The proportion of successful requests to log, between 0 and 1.
+		// Requests that fail are always logged.
+		SampleRate float64 `yaml:"sample_rate"`
+
+		// Logs a keyed hash of IP addresses instead of the addresses
+		// themselves. If IPHashKey is empty a random key is used.
+		HashIPs   bool   `yaml:"hash_ips"`
+		IPHashKey string `yaml:"ip_hash_key"`
+
+		// "text" (the default) writes the access log to the regular log,
+		// "common", "combined" and "json" write one line per request to
+		// File (or the regular log if File is empty).
+		Format string `yaml:"format"`
+		File   string `yaml:"file"`
+	} `yaml:"access_log"`
+
+	// API requests per minute, 0 disables rate limiting.
+	RateLimits struct {
+		// Per server token, once the token has been checked.
+		Authenticated int `yaml:"authenticated"`
+
+		// Per IP address, for requests without a (checked) token.
+		Unauthenticated int `yaml:"unauthenticated"`
+	} `yaml:"rate_limits"`
+
+	// Enables the public status page at /status.
+	StatusPage bool `yaml:"status_page"`
+
+	// Enables the public statistics page at /stats.
+	StatsPage bool `yaml:"stats_page"`
+
+	// Enables the /healthz and /readyz endpoints.
+	HealthChecks bool `yaml:"health_checks"`
+
+	// Enables public balance badges at /badge/<server>.svg.
+	Badges bool `yaml:"badges"`
+
+	// If true, webhook URLs set with the API must respond to a challenge.
+	VerifyWebhookURLs bool `yaml:"verify_webhook_urls"`
+
+	// Restrictions on webhook URLs, see lurkcoin.WebhookURLPolicy. Private
+	// and own addresses are blocked unless the options are set to false.
+	WebhookURLs struct {
+		AllowAnyPath      bool     `yaml:"allow_any_path"`
+		Schemes           []string `yaml:"schemes"`
+		AllowedHosts      []string `yaml:"allowed_hosts"`
+		DeniedHosts       []string `yaml:"denied_hosts"`
+		BlockPrivateIPs   *bool    `yaml:"block_private_ips"`
+		BlockOwnAddresses *bool    `yaml:"block_own_addresses"`
+		BlockedNetworks   []string `yaml:"blocked_networks"`
+	} `yaml:"webhook_urls"`
+
+	// Serves Swagger UI at /v3/docs.
+	SwaggerUI bool `yaml:"swagger_ui"`
+
+	// How long after a transaction is made the receiving server can revert
+	// it with /v3/revert_transaction (defaults to 24 hours).
+	RevertWindow string `yaml:"revert_window"`
+
+	// Exchange rate quotes from /v3/quote. If Key is empty a random key is
+	// used and quotes are invalidated when lurkcoin restarts.
+	Quotes struct {
+		MaxLifetime string `yaml:"max_lifetime"`
+		Key         string `yaml:"key"`
+	} `yaml:"quotes"`
+
+	// How long deleted servers are kept for so that they can be undeleted
+	// (defaults to 7 days, "0" deletes servers immediately).
+	DeletedServerRetention string `yaml:"deleted_server_retention"`
+
+	// Sends errors and panics to Sentry (or a Sentry-compatible service).
+	ErrorReporting struct {
+		SentryDSN   string `yaml:"sentry_dsn"`
+		Environment string `yaml:"environment"`
+	} `yaml:"error_reporting"`
+
+	// Posts admin-relevant events to Discord, Matrix and/or email.
+	Notifications struct {
+		// Transactions of at least this many lurkcoins send a notification.
+		LargeTransaction string `yaml:"large_transaction"`
+
+		// Servers that send at least this many lurkcoins in a day send a
+		// notification.
+		DailyVolume string `yaml:"daily_volume"`
+
+		Log struct {
+			Enable bool     `yaml:"enable"`
+			Events []string `yaml:"events"`
+		} `yaml:"log"`
+
+		// Notifications are sent as JSON to these URLs.
+		Webhooks []struct {
+			URL    string   `yaml:"url"`
+			Events []string `yaml:"events"`
+		} `yaml:"webhooks"`
+
+		Discord []struct {
+			WebhookURL string   `yaml:"webhook_url"`
+			Events     []string `yaml:"events"`
+		} `yaml:"discord"`
+
+		Matrix []struct {
+			Homeserver  string   `yaml:"homeserver"`
+			AccessToken string   `yaml:"access_token"`
+			RoomID      string   `yaml:"room_id"`
+			Events      []string `yaml:"events"`
+		} `yaml:"matrix"`
+
+		Email []struct {
+			// The SMTP server (host:port). STARTTLS is used if supported.
+			SMTPServer string   `yaml:"smtp_server"`
+			Username   string   `yaml:"username"`
+			Password   string   `yaml:"password"`
+			From       string   `yaml:"from"`
+			To         []string `yaml:"to"`
+			Events     []string `yaml:"events"`
+		} `yaml:"email"`
+	} `yaml:"notifications"`
+
+	// Alert rules, alerts are sent to the above notifiers.
+	Alerts struct {
+		// How often to check the rules (defaults to 5 minutes).
+		Interval string `yaml:"interval"`
+
+		// Fires if a server has more than this many pending transactions.
+		PendingTransactions int `yaml:"pending_transactions"`
+
+		// Fires if at least this proportion (0-1) of webhook deliveries
+		// failed since the last check.
+		WebhookFailureRate float64 `yaml:"webhook_failure_rate"`
+
+		// How often to check the database for inconsistencies (like
+		// "lurkcoin verify"). This is disabled by default.
+		Reconciliation string `yaml:"reconciliation"`
+
+		// Fires if the total supply changes by at least this many percent
+		// between checks.
+		SupplyChange float64 `yaml:"supply_change"`
+	} `yaml:"alerts"`
+
+	// An external reference rate (for example a fiat currency). This is
+	// purely informational.
+	PriceFeed struct {
+		// The name of the reference currency.
+		Currency string `yaml:"currency"`
+
+		// A URL that returns JSON and a dot-separated path to the rate in
+		// the response.
+		URL   string `yaml:"url"`
+		Field string `yaml:"field"`
+
+		// If true, the rate is the value of one unit of the reference
+		// currency in lurkcoins instead of the other way around.
+		Invert bool `yaml:"invert"`
+
+		// How often to fetch the rate (defaults to 10 minutes).
+		Interval string `yaml:"interval"`
+
+		// A fixed rate to use if URL is empty.
+		Rate float64 `yaml:"rate"`
+	} `yaml:"price_feed"`
 }
 
 func LoadConfig(filename string) (*Config, error) {
@@ -96,38 +382,264 @@ func LoadConfig(filename string) (*Config, error) {
 	}
 
 	if config.Name == "lurkcoin" {
-		log.Println("Warning: The selected server name already exists!")
+		lurkcoin.LogWarning("The selected server name already exists!")
+	}
+
+	// This has to be done before any other currency values are parsed.
+	if config.CurrencyDecimals != 0 {
+		err = lurkcoin.SetCurrencyDecimals(config.CurrencyDecimals)
+		if err != nil {
+			return nil, err
+		}
 	}
 	return &config, nil
 }
 
+func parseFee(flat string, percentage float64) (fee lurkcoin.Fee, err error) {
+	if flat != "" {
+		fee.Flat, err = lurkcoin.ParseCurrency(flat)
+		if err != nil {
+			return fee, fmt.Errorf("Invalid flat fee: %q", flat)
+		}
+	}
+	fee.Percentage = percentage
+	return fee, nil
+}
+
+func setFeeSchedule(config *Config) (err error) {
+	schedule := lurkcoin.FeeSchedule{
+		Treasury: config.Fees.Treasury,
+		Servers:  make(map[string]lurkcoin.Fee, len(config.Fees.Servers)),
+	}
+	schedule.Default, err = parseFee(config.Fees.Flat, config.Fees.Percentage)
+	if err != nil {
+		return err
+	}
+	for name, f := range config.Fees.Servers {
+		schedule.Servers[name], err = parseFee(f.Flat, f.Percentage)
+		if err != nil {
+			return err
+		}
+	}
+	return lurkcoin.SetFeeSchedule(schedule)
+}
+
+// Purges deleted servers once their retention period is over.
+func purgeDeletedServers(db lurkcoin.Database) {
+	for {
+		if _, err := lurkcoin.PurgeDeletedServers(db); err != nil {
+			lurkcoin.LogError("Could not purge deleted servers", "error",
+				err)
+		}
+		time.Sleep(time.Hour)
+	}
+}
+
 func OpenDatabase(config *Config) (lurkcoin.Database, error) {
-	return databases.OpenDatabase(
+	if config.HistoryLength != 0 {
+		if config.HistoryLength < 1 ||
+			config.HistoryLength > lurkcoin.MaxHistoryLength {
+			return nil, fmt.Errorf("history_length must be between 1 and %d",
+				lurkcoin.MaxHistoryLength)
+		}
+		lurkcoin.SetHistoryLength(config.HistoryLength)
+	}
+
+	err := lurkcoin.SetPendingTransactionLimit(
+		config.PendingTransactions.Limit,
+		config.PendingTransactions.Overflow,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	err = setFeeSchedule(config)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.TransactionLimit != "" {
+		limit, err := lurkcoin.ParseCurrency(config.TransactionLimit)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid transaction limit: %q",
+				config.TransactionLimit)
+		}
+		if err := lurkcoin.SetTransactionLimit(limit); err != nil {
+			return nil, err
+		}
+	}
+
+	maxTargetBalance := lurkcoin.GetMaxTargetBalance()
+	defaultTargetBalance := lurkcoin.GetDefaultTargetBalance()
+	if config.MaxTargetBalance != "" {
+		maxTargetBalance, err = lurkcoin.ParseCurrency(config.MaxTargetBalance)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid maximum target balance: %q",
+				config.MaxTargetBalance)
+		}
+	}
+	if config.DefaultTargetBalance != "" {
+		defaultTargetBalance, err = lurkcoin.ParseCurrency(
+			config.DefaultTargetBalance)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid default target balance: %q",
+				config.DefaultTargetBalance)
+		}
+	}
+	err = lurkcoin.SetTargetBalanceLimits(maxTargetBalance,
+		defaultTargetBalance)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := lurkcoin.SetCurrencies(config.Currencies); err != nil {
+		return nil, err
+	}
+
+	blockPrivateIPs := config.WebhookURLs.BlockPrivateIPs
+	blockOwnAddresses := config.WebhookURLs.BlockOwnAddresses
+	err = lurkcoin.SetWebhookURLPolicy(lurkcoin.WebhookURLPolicy{
+		AllowAnyPath:      config.WebhookURLs.AllowAnyPath,
+		Schemes:           config.WebhookURLs.Schemes,
+		AllowedHosts:      config.WebhookURLs.AllowedHosts,
+		DeniedHosts:       config.WebhookURLs.DeniedHosts,
+		BlockPrivateIPs:   blockPrivateIPs == nil || *blockPrivateIPs,
+		BlockOwnAddresses: blockOwnAddresses == nil || *blockOwnAddresses,
+		BlockedNetworks:   config.WebhookURLs.BlockedNetworks,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if config.DeletedServerRetention != "" {
+		retention, err := time.ParseDuration(config.DeletedServerRetention)
+		if err != nil {
+			return nil, err
+		}
+		if err := lurkcoin.SetDeletedServerRetention(retention); err != nil {
+			return nil, err
+		}
+	}
+
+	db, err := databases.OpenDatabase(
 		config.Database.Type,
 		config.Database.Location,
 		config.Database.Options,
 	)
+	if err == nil && config.Database.CacheSize > 0 {
+		db, err = databases.CachedDatabase(db, config.Database.CacheSize,
+			config.Database.Options)
+	}
+	if err == nil && config.Database.ReadOnly {
+		db = lurkcoin.ReadOnlyDatabase(db)
+	}
+
+	// Don't truncate amounts if currency_decimals has been lowered.
+	if err == nil {
+		if err = lurkcoin.CheckCurrencyPrecision(db); err != nil {
+			lurkcoin.CloseDatabase(db)
+			return nil, err
+		}
+	}
+	return db, err
 }
 
-func StartServer(config *Config) {
-	lurkcoin.SeedPRNG()
-	lurkcoin.PrintASCIIArt()
-	log.Printf("Supported database types: %s",
-		strings.Join(databases.GetSupportedDatabaseTypes(), ", "))
-	db, err := OpenDatabase(config)
-	if err != nil {
-		log.Fatal(err)
+func setupLogging(config *Config) error {
+	level := lurkcoin.LevelInfo
+	if config.LogLevel != "" {
+		var err error
+		level, err = lurkcoin.ParseLogLevel(config.LogLevel)
+		if err != nil {
+			return err
+		}
 	}
 
-	router := MakeHTTPRouter(db, config)
+	switch strings.ToLower(config.LogFormat) {
+	case "", "text":
+		lurkcoin.ConfigureLogging(level, false)
+	case "json":
+		lurkcoin.ConfigureLogging(level, true)
+	default:
+		return fmt.Errorf("Unknown log format: %q", config.LogFormat)
+	}
+	return nil
+}
+
+func isRestartSignal(sig os.Signal) bool {
+	for _, s := range restartSignals {
+		if sig == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Waits for SIGINT or SIGTERM, a second signal exits immediately. If a
+// restart signal (SIGUSR2) is received the listeners' files are returned so
+// that they can be passed to the new process. If a server stops with an
+// error lurkcoin exits.
+func waitForShutdownSignal(listeners []net.Listener,
+	serveErrors <-chan error) []*os.File {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, append([]os.Signal{os.Interrupt, syscall.SIGTERM},
+		restartSignals...)...)
+	defer signal.Stop(signals)
+	for {
+		var sig os.Signal
+		select {
+		case err := <-serveErrors:
+			log.Fatal(err)
+		case sig = <-signals:
+		}
+
+		if !isRestartSignal(sig) {
+			lurkcoin.LogInfo("Shutting down", "signal", sig.String())
+			return nil
+		}
+
+		files, err := listenerFiles(listeners)
+		if err == nil {
+			lurkcoin.LogInfo("Restarting", "signal", sig.String())
+			return files
+		}
+		lurkcoin.LogError("Could not restart", "error", err)
+	}
+}
 
-	var address, networkProtocol, urlAddress string
-	switch config.NetworkProtocol {
+// Stops the servers from accepting new connections and waits for requests
+// to finish.
+func shutdownServers(ctx context.Context, servers []*http.Server) {
+	var wg sync.WaitGroup
+	for _, server := range servers {
+		wg.Add(1)
+		go func(server *http.Server) {
+			defer wg.Done()
+			if err := server.Shutdown(ctx); err != nil {
+				lurkcoin.LogWarning("Some requests didn't finish before "+
+					"the shutdown timeout", "error", err)
+			}
+		}(server)
+	}
+	wg.Wait()
+}
+
+// Binds to an address. name is only used in log messages.
+func listen(name, networkProtocol, address string, port uint16,
+	useTLS bool) (net.Listener, error) {
+	// Use the listener from the previous process when restarting.
+	if ln, ok, err := inheritedListener(name); ok {
+		if err == nil {
+			lurkcoin.LogInfo("Using inherited listener for "+name, "address",
+				ln.Addr().String())
+		}
+		return ln, err
+	}
+
+	var urlAddress string
+	switch networkProtocol {
 	case "", "tcp":
-		if config.Port == 0 {
-			address = config.Address
-		} else {
-			address = fmt.Sprintf("%s:%d", address, config.Port)
+		if port != 0 {
+			address = fmt.Sprintf("%s:%d", address, port)
 		}
 		networkProtocol = "tcp"
 		urlAddress = address
@@ -135,21 +647,23 @@ func StartServer(config *Config) {
 			urlAddress = "[::]" + urlAddress
 		}
 	case "unix":
-		address = config.Address
 		networkProtocol = "unix"
 		urlAddress = "unix:" + address + ":"
-		if config.Port != 0 {
-			log.Fatal("The port option is invalid with UNIX sockets.")
+		if port != 0 {
+			return nil, errors.New("The port option is invalid with UNIX " +
+				"sockets.")
 		}
 	default:
-		log.Fatalf("Unrecognised network protocol: %q", config.NetworkProtocol)
+		return nil, fmt.Errorf("Unrecognised network protocol: %q",
+			networkProtocol)
 	}
 
-	if config.TLS.Enable {
-		log.Printf("Starting server on https://%s/", urlAddress)
+	if useTLS {
+		urlAddress = "https://" + urlAddress + "/"
 	} else {
-		log.Printf("Starting server on http://%s/", urlAddress)
+		urlAddress = "http://" + urlAddress + "/"
 	}
+	lurkcoin.LogInfo("Starting "+name, "url", urlAddress)
 
 	// Remove any socket file that already exists
 	var changeSocketPermissions bool
@@ -163,15 +677,173 @@ func StartServer(config *Config) {
 	}
 
 	// Bind to the address
-	var ln net.Listener
-	ln, err = net.Listen(networkProtocol, address)
+	ln, err := net.Listen(networkProtocol, address)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
 	// Change permissions on the UNIX socket
 	if changeSocketPermissions {
 		if err := os.Chmod(address, 0777); err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+	return ln, nil
+}
+
+// Options shared by the API and admin HTTP servers.
+type httpServerOptions struct {
+	proxies                                *trustedProxies
+	accessLog                              *accessLogger
+	readTimeout, writeTimeout, idleTimeout time.Duration
+}
+
+func parseHTTPServerOptions(config *Config) (*httpServerOptions, error) {
+	proxies, err := parseTrustedProxies(config.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	accessLog, err := newAccessLogger(config)
+	if err != nil {
+		return nil, err
+	}
+	opts := &httpServerOptions{proxies: proxies, accessLog: accessLog}
+
+	timeouts := []struct {
+		s string
+		d *time.Duration
+	}{
+		{config.HTTPReadTimeout, &opts.readTimeout},
+		{config.HTTPWriteTimeout, &opts.writeTimeout},
+		{config.HTTPIdleTimeout, &opts.idleTimeout},
+	}
+	for _, timeout := range timeouts {
+		if timeout.s == "" {
+			continue
+		}
+		*timeout.d, err = time.ParseDuration(timeout.s)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return opts, nil
+}
+
+func newHTTPServer(router http.Handler, config *Config,
+	opts *httpServerOptions) *http.Server {
+	handler := wrapRequestID(wrapTrustedProxies(
+		opts.accessLog.wrap(router), opts.proxies))
+	server := &http.Server{
+		Handler:      handler,
+		ConnState:    trackConnState,
+		ReadTimeout:  opts.readTimeout,
+		WriteTimeout: opts.writeTimeout,
+		IdleTimeout:  opts.idleTimeout,
+	}
+
+	// Suppress HTTP logs.
+	if config.SuppressHTTPLogs {
+		server.ErrorLog = log.New(ioutil.Discard, "", 0)
+	} else {
+		server.ErrorLog = lurkcoin.NewStdLogger(lurkcoin.LevelWarning)
+	}
+
+	// My laptop doesn't work nicely with Keep-Alive.
+	if config.DisableHTTPKeepAlives {
+		server.SetKeepAlivesEnabled(false)
+	}
+	return server
+}
+
+func serve(server *http.Server, ln net.Listener, config *Config) error {
+	if config.TLS.Enable {
+		return server.ServeTLS(ln, config.TLS.CertFile, config.TLS.KeyFile)
+	}
+	return server.Serve(ln)
+}
+
+func StartServer(config *Config) {
+	lurkcoin.SeedPRNG()
+	if err := setupLogging(config); err != nil {
+		log.Fatal(err)
+	}
+	shutdownTimeout := 30 * time.Second
+	if config.ShutdownTimeout != "" {
+		var err error
+		shutdownTimeout, err = time.ParseDuration(config.ShutdownTimeout)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	lurkcoin.PrintASCIIArt()
+	if err := setupErrorReporting(config); err != nil {
+		log.Fatal(err)
+	}
+	if err := setupNotifications(config); err != nil {
+		log.Fatal(err)
+	}
+	if err := setupPriceFeed(config); err != nil {
+		log.Fatal(err)
+	}
+	lurkcoin.LogInfo("Supported database types", "types",
+		strings.Join(databases.GetSupportedDatabaseTypes(), ","))
+	db, err := OpenDatabase(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if config.Database.ReadOnly {
+		lurkcoin.LogWarning("The database is read-only, changes will be " +
+			"rejected.")
+	}
+
+	journal, err := OpenJournal(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	lurkcoin.SetJournal(journal)
+
+	if err := setupSnapshots(config, db); err != nil {
+		log.Fatal(err)
+	}
+	if err := setupAlerts(config, db); err != nil {
+		log.Fatal(err)
+	}
+	if !config.Database.ReadOnly {
+		go purgeDeletedServers(db)
+	}
+
+	serverOptions, err := parseHTTPServerOptions(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	router := MakeHTTPRouter(db, config)
+	ln, err := listen("server", config.NetworkProtocol, config.Address,
+		config.Port, config.TLS.Enable)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	listenerNames := []string{"server"}
+	listeners := []net.Listener{ln}
+
+	var adminRouter *httprouter.Router
+	if adminPagesEnabled(config) && hasSeparateAdminListener(config) {
+		adminRouter = MakeAdminHTTPRouter(db, config)
+		adminLn, err := listen("admin pages", config.AdminPages.NetworkProtocol,
+			config.AdminPages.Address, config.AdminPages.Port,
+			config.TLS.Enable)
+		if err != nil {
+			log.Fatal(err)
+		}
+		listenerNames = append(listenerNames, "admin pages")
+		listeners = append(listeners, adminLn)
+	}
+
+	if config.PidFile != "" {
+		pid := []byte(fmt.Sprintf("%d\n", os.Getpid()))
+		if err := ioutil.WriteFile(config.PidFile, pid, 0644); err != nil {
 			log.Fatal(err)
 		}
 	}
@@ -187,27 +859,72 @@ func StartServer(config *Config) {
 			log.Fatal(err)
 		}
 		defer f.Close()
-		log.Printf("Using logfile %#v.", config.Logfile)
+		lurkcoin.LogInfo("Using logfile", "logfile", config.Logfile)
 		log.SetOutput(f)
 	}
 
-	// Suppress HTTP logs.
-	server := &http.Server{Addr: address, Handler: router}
-	if config.SuppressHTTPLogs {
-		server.ErrorLog = log.New(ioutil.Discard, "", 0)
+	servers := []*http.Server{newHTTPServer(router, config, serverOptions)}
+	if adminRouter != nil {
+		servers = append(servers,
+			newHTTPServer(adminRouter, config, serverOptions))
 	}
 
-	// My laptop doesn't work nicely with Keep-Alive.
-	if config.DisableHTTPKeepAlives {
+	// Serve the webpage
+	serveErrors := make(chan error, len(servers))
+	for i, server := range servers {
+		go func(server *http.Server, ln net.Listener) {
+			serveErrors <- serve(server, ln, config)
+		}(server, listeners[i])
+	}
+
+	restartFiles := waitForShutdownSignal(listeners, serveErrors)
+
+	// Stop accepting connections. The listeners are closed directly instead
+	// of with Shutdown() so that requests on connections that have already
+	// been accepted get a response. Serve() returns an error once the
+	// listener is closed which can be ignored.
+	for _, server := range servers {
 		server.SetKeepAlivesEnabled(false)
 	}
+	for _, ln := range listeners {
+		ln.Close()
+	}
+	for range servers {
+		<-serveErrors
+	}
+	waitForNewConnections(time.Second)
 
-	// Serve the webpage
-	if config.TLS.Enable {
-		err = server.ServeTLS(ln, config.TLS.CertFile, config.TLS.KeyFile)
-	} else {
-		err = server.Serve(ln)
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	shutdownServers(ctx, servers)
+
+	// Wait for any webhooks or refunds that requests started before closing
+	// the database.
+	if !lurkcoin.WaitForBackgroundTasks(shutdownTimeout) {
+		lurkcoin.LogWarning("Some webhook deliveries didn't finish before " +
+			"the shutdown timeout")
+	}
+	lurkcoin.SetJournal(nil)
+	if closer, ok := journal.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			lurkcoin.LogError("Error closing journal", "error", err)
+		}
+	}
+	if err := lurkcoin.CloseDatabase(db); err != nil {
+		lurkcoin.LogError("Error closing database", "error", err)
 	}
 
-	log.Fatal(err)
+	// The new process is only started after the database is closed as most
+	// databases can't be opened by two processes at once. Connections made
+	// in the meantime wait in the listeners' queues.
+	if restartFiles != nil {
+		if err := restartProcess(listenerNames, restartFiles); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if config.PidFile != "" {
+		os.Remove(config.PidFile)
+	}
+	lurkcoin.LogInfo("Shutdown complete")
 }
@@ -0,0 +1,123 @@
+//
+// lurkcoin health checks
+// Copyright © 2020 by luk3yx
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/julienschmidt/httprouter"
+	"github.com/luk3yx/lurkcoin-core/lurkcoin"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// The database is considered unreachable if pinging it takes longer than
+// this.
+const healthCheckTimeout = 2 * time.Second
+
+type healthDatabaseStatus struct {
+	OK           bool    `json:"ok"`
+	ResponseTime float64 `json:"response_time"`
+}
+
+type health struct {
+	Status       string               `json:"status"`
+	Database     healthDatabaseStatus `json:"database"`
+	WebhookQueue int                  `json:"webhook_queue"`
+	Uptime       float64              `json:"uptime"`
+}
+
+type healthChecker struct {
+	lock sync.Mutex
+	db   lurkcoin.Database
+
+	// Like the status page, a ping that times out is waited for by the
+	// next check instead of starting another one.
+	pendingCheck chan error
+	checkStarted time.Time
+}
+
+func (self *healthChecker) pingDatabase() healthDatabaseStatus {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.pendingCheck == nil {
+		done := make(chan error, 1)
+		self.pendingCheck = done
+		self.checkStarted = time.Now()
+		go func() {
+			defer func() {
+				if v := recover(); v != nil {
+					done <- fmt.Errorf("%v", v)
+				}
+			}()
+			done <- lurkcoin.PingDatabase(self.db)
+		}()
+	}
+
+	timer := time.NewTimer(healthCheckTimeout)
+	defer timer.Stop()
+	select {
+	case err := <-self.pendingCheck:
+		self.pendingCheck = nil
+		if err != nil {
+			// The health check endpoints are public, so errors are only
+			// logged.
+			lurkcoin.LogWarning("Database health check failed", "error", err)
+		}
+		return healthDatabaseStatus{err == nil,
+			time.Since(self.checkStarted).Seconds()}
+	case <-timer.C:
+		return healthDatabaseStatus{false,
+			time.Since(self.checkStarted).Seconds()}
+	}
+}
+
+func (self *healthChecker) get() health {
+	res := health{
+		Status:       "ok",
+		Database:     self.pingDatabase(),
+		WebhookQueue: lurkcoin.GetWebhookQueueLength(),
+		Uptime:       time.Since(startTime).Seconds(),
+	}
+	if !res.Database.OK {
+		res.Status = "unavailable"
+	}
+	return res
+}
+
+// /healthz always returns HTTP 200 while lurkcoin is running (for liveness
+// probes), /readyz returns HTTP 503 if the database is unreachable.
+func addHealthChecks(router *httprouter.Router, db lurkcoin.Database) {
+	checker := &healthChecker{db: db}
+	handler := func(ready bool) httprouter.Handle {
+		return func(w http.ResponseWriter, r *http.Request,
+			_ httprouter.Params) {
+			h := checker.get()
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.Header().Set("Cache-Control", "no-store")
+			if ready && !h.Database.OK {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+			json.NewEncoder(w).Encode(h)
+		}
+	}
+	router.GET("/healthz", handler(false))
+	router.GET("/readyz", handler(true))
+}
@@ -24,6 +24,7 @@ import (
 	"github.com/julienschmidt/httprouter"
 	"github.com/luk3yx/lurkcoin-core/lurkcoin"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"strings"
 )
@@ -37,10 +38,15 @@ type HTTPRequest struct {
 	DbTransaction *lurkcoin.DatabaseTransaction
 	Request       *http.Request
 	Params        httprouter.Params
+	Logger        *lurkcoin.Logger
+
+	// Set by checkRateLimit().
+	rateLimitKey string
 }
 
 func MakeHTTPRequest(db lurkcoin.Database, request *http.Request, params httprouter.Params) *HTTPRequest {
-	return &HTTPRequest{nil, db, nil, request, params}
+	return &HTTPRequest{nil, db, nil, request, params, requestLogger(request),
+		""}
 }
 
 type HTTPHandler func(*HTTPRequest) (interface{}, error)
@@ -58,31 +64,40 @@ func (self *HTTPRequest) Unmarshal(v interface{}) error {
 		return errors.New("ERR_INVALIDREQUEST")
 	}
 
-	length := self.Request.ContentLength
-
-	// Default to the maximum length plus one.
-	if length < 0 {
-		length = 4097
-	} else if length > 4096 {
+	limit := lurkcoin.GetMaxRequestBodySize()
+	if self.Request.ContentLength > limit {
 		return errors.New("ERR_PAYLOADTOOLARGE")
 	}
 
-	raw := make([]byte, length)
-	actual_length, _ := self.Request.Body.Read(raw)
-
-	if actual_length < 3 {
-		return errors.New("ERR_INVALIDREQUEST")
-	} else if actual_length > 4096 {
+	// Read the entire body, a single Read() call may only return part of it
+	// (for example with chunked uploads). The body is usually also limited
+	// by limitRequestBody(), but LimitReader ensures that this never reads
+	// more than one byte past the limit.
+	raw, err := ioutil.ReadAll(io.LimitReader(self.Request.Body, limit+1))
+	if int64(len(raw)) > limit {
 		return errors.New("ERR_PAYLOADTOOLARGE")
+	} else if err != nil {
+		// MaxBytesReader returns an error once the limit is reached.
+		if int64(len(raw)) >= limit {
+			return errors.New("ERR_PAYLOADTOOLARGE")
+		}
+		return errors.New("ERR_INVALIDREQUEST")
+	} else if len(raw) < 3 {
+		return errors.New("ERR_INVALIDREQUEST")
 	}
 
-	json_err := json.Unmarshal(raw[:actual_length], v)
+	json_err := json.Unmarshal(raw, v)
 	if json_err != nil {
 		return errors.New("ERR_INVALIDREQUEST")
 	}
 	return nil
 }
 
+// Limits the size of the request body to the configured maximum.
+func limitRequestBody(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, lurkcoin.GetMaxRequestBodySize())
+}
+
 func (self *HTTPRequest) AbortTransaction() {
 	if self.DbTransaction != nil {
 		self.DbTransaction.Abort()
@@ -90,11 +105,18 @@ func (self *HTTPRequest) AbortTransaction() {
 	}
 }
 
-func (self *HTTPRequest) FinishTransaction() {
+// Returns lurkcoin.ErrReadOnly (and doesn't save anything) if the database is
+// read-only and the request modified a server.
+func (self *HTTPRequest) FinishTransaction() error {
 	if self.DbTransaction != nil {
+		if lurkcoin.IsReadOnly(self.Database) &&
+			self.DbTransaction.IsModified() {
+			return lurkcoin.ErrReadOnly
+		}
 		self.DbTransaction.Finish()
 		self.DbTransaction = nil
 	}
+	return nil
 }
 
 func authenticateRequest(r *http.Request, db lurkcoin.Database, otherServers ...string) (bool, *lurkcoin.DatabaseTransaction, *lurkcoin.Server) {
@@ -104,7 +126,8 @@ func authenticateRequest(r *http.Request, db lurkcoin.Database, otherServers ...
 		return false, nil, nil
 	}
 
-	return lurkcoin.AuthenticateRequest(db, username, token, otherServers)
+	return lurkcoin.AuthenticateRequest(db, username, token, otherServers,
+		requestLogger(r))
 }
 
 func (self *HTTPRequest) Authenticate(otherServers ...string) error {
@@ -119,15 +142,28 @@ func (self *HTTPRequest) Authenticate(otherServers ...string) error {
 		username,
 		token,
 		otherServers,
+		self.Logger,
 	)
 
 	if !authed {
 		return errors.New("ERR_INVALIDLOGIN")
 	}
 
+	self.setServer(tr, server)
+	return nil
+}
+
+// Sets the server that made the request after it has been authenticated.
+func (self *HTTPRequest) setServer(tr *lurkcoin.DatabaseTransaction,
+	server *lurkcoin.Server) {
+	// Add the server's UID to any log messages.
+	self.Logger = self.Logger.With("server", server.UID)
+	tr.SetLogger(self.Logger)
+	setAccessLogServer(self.Request, server.UID)
+
 	self.Server = server
 	self.DbTransaction = tr
-	return nil
+	self.trustRateLimitKey()
 }
 
 func securityTxt(w http.ResponseWriter, r *http.Request,
@@ -146,7 +182,13 @@ func makeRedirect(router *httprouter.Router, source, target string) {
 
 func MakeHTTPRouter(db lurkcoin.Database, config *Config) *httprouter.Router {
 	router := httprouter.New()
+	router.PanicHandler = handlePanic
 	router.GET("/.well-known/security.txt", securityTxt)
+	setMetricsDatabase(db)
+	setRateLimits(config)
+	if config.MaxRequestBodySize > 0 {
+		lurkcoin.SetMaxRequestBodySize(config.MaxRequestBodySize)
+	}
 
 	// Add custom redirects
 	for source, target := range config.Redirects {
@@ -159,13 +201,28 @@ func MakeHTTPRouter(db lurkcoin.Database, config *Config) *httprouter.Router {
 			"https://www.youtube.com/watch?v=dQw4w9WgXcQ")
 	}
 
-	if config.AdminPages.Enable && config.AdminPages.Users != nil {
-		addAdminPages(router, db, config.AdminPages.Users)
+	if adminPagesEnabled(config) && !hasSeparateAdminListener(config) {
+		addAdminPages(router, db, config)
+	}
+	if config.StatusPage {
+		addStatusPages(router, db, config.Name)
+	}
+	if config.StatsPage {
+		addPublicStatsPages(router, config.Name)
+	}
+	if config.HealthChecks {
+		addHealthChecks(router, db)
+	}
+	if config.Badges {
+		addBadgePages(router, db)
 	}
 	if config.MinAPIVersion > 3 {
 		return router
 	}
-	addV3API(router, db)
+	addV3API(router, db, config)
+	addOpenAPIPages(router, config)
+	addMinetestAPI(router, db)
+	addStatementAPI(router, db)
 	if config.MinAPIVersion > 2 {
 		return router
 	}
@@ -173,6 +230,24 @@ func MakeHTTPRouter(db lurkcoin.Database, config *Config) *httprouter.Router {
 	return router
 }
 
+func adminPagesEnabled(config *Config) bool {
+	return config.AdminPages.Enable && config.AdminPages.Users != nil
+}
+
+func hasSeparateAdminListener(config *Config) bool {
+	return config.AdminPages.Address != "" || config.AdminPages.Port != 0
+}
+
+// Makes the router for the admin listener, this should only be used if the
+// admin pages are enabled and hasSeparateAdminListener() returns true.
+func MakeAdminHTTPRouter(db lurkcoin.Database, config *Config) *httprouter.Router {
+	router := httprouter.New()
+	router.PanicHandler = handlePanic
+	makeRedirect(router, "/", "/admin")
+	addAdminPages(router, db, config)
+	return router
+}
+
 func isYes(s string) bool {
 	switch strings.ToLower(s) {
 	case "true", "yes", "y", "1":
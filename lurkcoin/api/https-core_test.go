@@ -0,0 +1,174 @@
+//
+// lurkcoin request body tests
+// Copyright © 2020 by luk3yx
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package api
+
+import (
+	"encoding/json"
+	"github.com/luk3yx/lurkcoin-core/lurkcoin"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+const testBodyLimit = 64
+
+// Returns a JSON object that is exactly size bytes long.
+func testBody(size int) string {
+	return `{"a":"` + strings.Repeat("x", size-8) + `"}`
+}
+
+// Sends body in small chunks with a delay between each one, the request
+// doesn't have a Content-Length so it uses chunked transfer encoding.
+func slowChunkedBody(body string) io.Reader {
+	r, w := io.Pipe()
+	go func() {
+		for i := 0; i < len(body); i += 5 {
+			end := i + 5
+			if end > len(body) {
+				end = len(body)
+			}
+			time.Sleep(time.Millisecond)
+			if _, err := io.WriteString(w, body[i:end]); err != nil {
+				return
+			}
+		}
+		w.Close()
+	}()
+	return r
+}
+
+// Wraps a reader so that each Read() returns at most one byte, which also
+// makes the request use chunked transfer encoding.
+func slowReaderBody(body string) io.Reader {
+	return iotest.OneByteReader(strings.NewReader(body))
+}
+
+func fixedLengthBody(body string) io.Reader {
+	return strings.NewReader(body)
+}
+
+// Starts a test server that calls f with v3WrapHTTPHandler.
+func newUnmarshalTestServer(f HTTPHandler) *httptest.Server {
+	handle := v3WrapHTTPHandler(nil, "/test", false, f)
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+		handle(w, r, nil)
+	}))
+}
+
+func TestUnmarshalStreamingBodies(t *testing.T) {
+	oldLimit := lurkcoin.GetMaxRequestBodySize()
+	lurkcoin.SetMaxRequestBodySize(testBodyLimit)
+	defer lurkcoin.SetMaxRequestBodySize(oldLimit)
+
+	server := newUnmarshalTestServer(func(r *HTTPRequest) (interface{},
+		error) {
+		var v map[string]string
+		if err := r.Unmarshal(&v); err != nil {
+			return nil, err
+		}
+		return v["a"], nil
+	})
+	defer server.Close()
+
+	bodies := []struct {
+		name string
+		f    func(string) io.Reader
+	}{
+		{"chunked", slowChunkedBody},
+		{"slow reader", slowReaderBody},
+		{"content length", fixedLengthBody},
+	}
+	sizes := []struct {
+		size   int
+		status int
+		err    string
+	}{
+		{16, http.StatusOK, ""},
+		{testBodyLimit, http.StatusOK, ""},
+		{testBodyLimit + 1, http.StatusRequestEntityTooLarge,
+			"ERR_PAYLOADTOOLARGE"},
+		{testBodyLimit * 100, http.StatusRequestEntityTooLarge,
+			"ERR_PAYLOADTOOLARGE"},
+	}
+
+	for _, body := range bodies {
+		for _, size := range sizes {
+			raw := testBody(size.size)
+			res, err := http.Post(server.URL, "application/json",
+				body.f(raw))
+			if err != nil {
+				t.Fatalf("%s (%d bytes): %s", body.name, size.size, err)
+			}
+			var result struct {
+				Success bool   `json:"success"`
+				Result  string `json:"result"`
+				Error   string `json:"error"`
+			}
+			err = json.NewDecoder(res.Body).Decode(&result)
+			res.Body.Close()
+			if err != nil {
+				t.Fatalf("%s (%d bytes): %s", body.name, size.size, err)
+			}
+
+			if res.StatusCode != size.status || result.Error != size.err {
+				t.Errorf("%s (%d bytes): got HTTP %d %q, expected HTTP %d %q",
+					body.name, size.size, res.StatusCode, result.Error,
+					size.status, size.err)
+			} else if size.err == "" && result.Result != raw[6:len(raw)-2] {
+				t.Errorf("%s (%d bytes): the body was not decoded "+
+					"correctly", body.name, size.size)
+			}
+		}
+	}
+}
+
+func TestUnmarshalInvalidBodies(t *testing.T) {
+	server := newUnmarshalTestServer(func(r *HTTPRequest) (interface{},
+		error) {
+		var v map[string]string
+		return nil, r.Unmarshal(&v)
+	})
+	defer server.Close()
+
+	for _, body := range []string{"", "{}}", `{"a":`} {
+		res, err := http.Post(server.URL, "application/json",
+			slowChunkedBody(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var result struct {
+			Error string `json:"error"`
+		}
+		err = json.NewDecoder(res.Body).Decode(&result)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != http.StatusBadRequest ||
+			result.Error != "ERR_INVALIDREQUEST" {
+			t.Errorf("%q: got HTTP %d %q", body, res.StatusCode,
+				result.Error)
+		}
+	}
+}
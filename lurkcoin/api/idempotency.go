@@ -0,0 +1,151 @@
+//
+// lurkcoin idempotency keys
+// Copyright © 2020 by luk3yx
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/luk3yx/lurkcoin-core/lurkcoin"
+	"sync"
+	"time"
+)
+
+// Clients can send an Idempotency-Key header with /v3/pay so that retried
+// requests don't send the payment twice. Keys are only remembered for a
+// limited time and are not persisted.
+const idempotencyKeyLifetime = time.Hour
+const maxIdempotencyKeyLength = 128
+
+// Keys are reserved while the payment is being sent. If the request never
+// finishes the reservation expires after this long.
+const idempotencyReservationLifetime = time.Minute
+
+type idempotencyEntry struct {
+	// The transaction is nil while the payment is still being sent.
+	transaction *lurkcoin.Transaction
+	fingerprint string
+	expiry      time.Time
+}
+
+type idempotencyCache struct {
+	lock    sync.Mutex
+	entries map[string]idempotencyEntry
+}
+
+var payIdempotencyCache = &idempotencyCache{
+	entries: make(map[string]idempotencyEntry),
+}
+
+// Returns a fingerprint of a request so that reused keys can be detected.
+func idempotencyFingerprint(endpoint string, params interface{}) string {
+	data, err := json.Marshal(params)
+	if err != nil {
+		panic(err)
+	}
+	h := sha256.New()
+	h.Write([]byte(endpoint))
+	h.Write([]byte{0})
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Returns the transaction previously sent with key, or reserves key if it
+// hasn't been used yet. ERR_IDEMPOTENCYCONFLICT is returned if the key was
+// used for a different request or the original request hasn't finished.
+func (self *idempotencyCache) reserve(serverUID, key,
+	fingerprint string) (*lurkcoin.Transaction, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	// Remove expired entries.
+	now := time.Now()
+	for k, entry := range self.entries {
+		if now.After(entry.expiry) {
+			delete(self.entries, k)
+		}
+	}
+
+	k := serverUID + "\x00" + key
+	if entry, ok := self.entries[k]; ok {
+		if entry.transaction == nil || entry.fingerprint != fingerprint {
+			return nil, errors.New("ERR_IDEMPOTENCYCONFLICT")
+		}
+		return entry.transaction, nil
+	}
+
+	self.entries[k] = idempotencyEntry{nil, fingerprint,
+		now.Add(idempotencyReservationLifetime)}
+	return nil, nil
+}
+
+// Removes a reservation made by reserve().
+func (self *idempotencyCache) release(serverUID, key string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	k := serverUID + "\x00" + key
+	if entry, ok := self.entries[k]; ok && entry.transaction == nil {
+		delete(self.entries, k)
+	}
+}
+
+// Stores the transaction sent with a reserved key.
+func (self *idempotencyCache) set(serverUID, key, fingerprint string,
+	transaction *lurkcoin.Transaction) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.entries[serverUID+"\x00"+key] = idempotencyEntry{
+		transaction,
+		fingerprint,
+		time.Now().Add(idempotencyKeyLifetime),
+	}
+}
+
+// Calls pay() unless key has already been used with the same request, in
+// which case the original transaction is returned. The transaction is only
+// remembered once the server's DatabaseTransaction has been committed, so
+// keys of payments that were never saved can be retried.
+func payIdempotently(server *lurkcoin.Server, key, fingerprint string,
+	pay func() (*lurkcoin.Transaction, error)) (*lurkcoin.Transaction, error) {
+	if key == "" {
+		return pay()
+	} else if len(key) > maxIdempotencyKeyLength {
+		return nil, errors.New("ERR_INVALIDREQUEST")
+	}
+
+	uid := server.UID
+	t, err := payIdempotencyCache.reserve(uid, key, fingerprint)
+	if t != nil || err != nil {
+		return t, err
+	}
+
+	t, err = pay()
+	if err != nil {
+		payIdempotencyCache.release(uid, key)
+		return nil, err
+	}
+	server.AfterCommit(func() {
+		payIdempotencyCache.set(uid, key, fingerprint, t)
+	})
+	server.AfterAbort(func() {
+		payIdempotencyCache.release(uid, key)
+	})
+	return t, nil
+}
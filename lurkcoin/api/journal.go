@@ -0,0 +1,177 @@
+//
+// lurkcoin journal export
+// Copyright © 2020 by luk3yx
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/julienschmidt/httprouter"
+	"github.com/luk3yx/lurkcoin-core/lurkcoin"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Opens the journal specified in the config. If no journal is configured,
+// nil is returned.
+func OpenJournal(config *Config) (lurkcoin.Journal, error) {
+	if config.Journal == "" {
+		return nil, nil
+	}
+	j, err := lurkcoin.OpenFileJournal(config.Journal)
+	if err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// Parses a time specified as a UNIX timestamp, an RFC 3339 timestamp or a
+// date (YYYY-MM-DD). Empty strings return a zero time.Time.
+func ParseTimeFilter(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(n, 0), nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return t, nil
+	}
+	return time.Time{}, errors.New("Invalid time: " + s)
+}
+
+// Returns a logger that adds the admin user to log messages.
+func adminLogger(r *http.Request, adminUser string) *lurkcoin.Logger {
+	return requestLogger(r).With("component", "admin", "admin_user",
+		adminUser)
+}
+
+// Records an admin action in the journal and audit log and sends any
+// notifications. before and after are the old and new values of whatever the
+// action changed, only the new value is written to the journal.
+func journalAdminAction(r *http.Request, db lurkcoin.Database, adminUser,
+	action, server, before, after string) {
+	lurkcoin.AppendToJournal(&lurkcoin.JournalEntry{
+		Type:      lurkcoin.JournalAdminAction,
+		AdminUser: adminUser,
+		Action:    action,
+		Server:    server,
+		Value:     after,
+	}, requestLogger(r))
+	err := lurkcoin.AppendAuditLog(db, &lurkcoin.AuditLogEntry{
+		AdminUser: adminUser,
+		Action:    action,
+		Server:    server,
+		Before:    before,
+		After:     after,
+		IP:        getClientIP(r),
+		RequestID: getRequestID(r),
+	})
+	if err != nil {
+		adminLogger(r, adminUser).Error("Could not write to the audit log",
+			"action", action, "error", err)
+	}
+	notifyAdminAction(adminUser, action, server)
+}
+
+// Like journalAdminAction, but waits until the DatabaseTransaction that server
+// was obtained from has been committed.
+func journalServerAction(r *http.Request, db lurkcoin.Database,
+	server *lurkcoin.Server, adminUser, action, uid, before, after string) {
+	server.AfterCommit(func() {
+		journalAdminAction(r, db, adminUser, action, uid, before, after)
+	})
+}
+
+// The journal can be downloaded from /admin/journal.jsonl. The since, until
+// and type query parameters can be used to filter entries. The hash chain can
+// be checked with /admin/journal-chain.json (optionally with ?hash=).
+func addJournalPages(router *httprouter.Router,
+	getPermissions func(string) AdminPermissions,
+	authenticate adminAuthenticator) {
+	router.GET("/admin/journal.jsonl", func(w http.ResponseWriter,
+		r *http.Request, _ httprouter.Params) {
+		username, ok := authenticate(w, r)
+		if !ok {
+			return
+		}
+		if !getPermissions(username).Has(PermDownloadBackups) {
+			writeAdminErrorPage(w, "You may not download the journal.")
+			return
+		}
+
+		j := lurkcoin.GetJournal()
+		if j == nil {
+			writeAdminErrorPage(w, "The journal is not enabled.")
+			return
+		}
+
+		query := r.URL.Query()
+		since, err := ParseTimeFilter(query.Get("since"))
+		if err != nil {
+			writeAdminErrorPage(w, err.Error())
+			return
+		}
+		until, err := ParseTimeFilter(query.Get("until"))
+		if err != nil {
+			writeAdminErrorPage(w, err.Error())
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.WriteHeader(http.StatusOK)
+		err = lurkcoin.ExportJournal(j, w, since, until, query.Get("type"))
+		if err != nil {
+			requestLogger(r).Error("Could not export journal", "error", err)
+			io.WriteString(w, "\n")
+		}
+	})
+
+	router.GET("/admin/journal-chain.json", func(w http.ResponseWriter,
+		r *http.Request, _ httprouter.Params) {
+		username, ok := authenticate(w, r)
+		if !ok {
+			return
+		}
+		if !getPermissions(username).Has(PermView) {
+			writeAdminErrorPage(w, "You may not verify the journal.")
+			return
+		}
+
+		j, ok := lurkcoin.GetJournal().(*lurkcoin.FileJournal)
+		if !ok {
+			writeAdminErrorPage(w, "The journal is not enabled.")
+			return
+		}
+
+		report, err := j.VerifyChain(r.URL.Query().Get("hash"))
+		if err != nil {
+			requestLogger(r).Error("Could not verify journal", "error", err)
+			writeAdminErrorPage(w, "Could not read the journal.")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(report)
+	})
+}
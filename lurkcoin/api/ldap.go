@@ -0,0 +1,142 @@
+//
+// lurkcoin LDAP admin authentication
+// Copyright © 2020 by luk3yx
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+// +build !lurkcoin.disableldap
+
+package api
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/luk3yx/lurkcoin-core/lurkcoin"
+	"strings"
+)
+
+// Escapes a value for use in a DN (RFC 4514).
+func escapeDN(s string) string {
+	var builder strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == ',' || c == '+' || c == '"' || c == '\\' || c == '<' ||
+			c == '>' || c == ';' || c == '=' ||
+			(c == '#' && i == 0) || (c == ' ' && (i == 0 || i == len(s)-1)):
+			builder.WriteByte('\\')
+			builder.WriteByte(c)
+		case c < 0x20:
+			fmt.Fprintf(&builder, "\\%02x", c)
+		default:
+			builder.WriteByte(c)
+		}
+	}
+	return builder.String()
+}
+
+func (self *ldapConfig) dial() (*ldap.Conn, error) {
+	conn, err := ldap.DialURL(self.URL)
+	if err != nil {
+		return nil, err
+	}
+	if self.StartTLS {
+		host := self.URL
+		if i := strings.Index(host, "://"); i >= 0 {
+			host = host[i+3:]
+		}
+		if i := strings.LastIndexByte(host, ':'); i >= 0 {
+			host = host[:i]
+		}
+		err = conn.StartTLS(&tls.Config{ServerName: host})
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// Finds the user's DN and groups, and verifies their password.
+func (self *ldapConfig) authenticate(username, password string) (AdminPermissions, bool) {
+	conn, err := self.dial()
+	if err != nil {
+		lurkcoin.LogError("Could not connect to the LDAP server", "error", err)
+		return AdminPermissions{}, false
+	}
+	defer conn.Close()
+
+	var userDN string
+	var searchBase, searchFilter string
+	scope := ldap.ScopeWholeSubtree
+	if self.UserDN != "" {
+		userDN = fmt.Sprintf(self.UserDN, escapeDN(username))
+		searchBase, searchFilter, scope = userDN, "(objectClass=*)",
+			ldap.ScopeBaseObject
+
+		// Bind as the user before searching so that the user can read their
+		// own groups.
+		if err := conn.Bind(userDN, password); err != nil {
+			return AdminPermissions{}, false
+		}
+	} else {
+		if self.BindDN != "" {
+			if err := conn.Bind(self.BindDN, self.BindPassword); err != nil {
+				lurkcoin.LogError("Could not bind to the LDAP server", "error",
+					err)
+				return AdminPermissions{}, false
+			}
+		}
+		searchBase = self.SearchBase
+		searchFilter = fmt.Sprintf(self.SearchFilter,
+			ldap.EscapeFilter(username))
+	}
+
+	groupAttribute := self.GroupAttribute
+	if groupAttribute == "" {
+		groupAttribute = "memberOf"
+	}
+	res, err := conn.Search(ldap.NewSearchRequest(searchBase, scope,
+		ldap.NeverDerefAliases, 2, 10, false, searchFilter,
+		[]string{groupAttribute}, nil))
+	if err != nil || len(res.Entries) != 1 {
+		return AdminPermissions{}, false
+	}
+	entry := res.Entries[0]
+
+	if userDN == "" {
+		// Verify the password by binding as the user.
+		if err := conn.Bind(entry.DN, password); err != nil {
+			return AdminPermissions{}, false
+		}
+	}
+
+	return mapGroupPermissions(self.Groups,
+		entry.GetAttributeValues(groupAttribute))
+}
+
+func newLDAPAuthenticator(config *ldapConfig) (passwordAuthenticator, error) {
+	if config.URL == "" {
+		return nil, nil
+	}
+	if config.UserDN == "" && (config.SearchBase == "" ||
+		config.SearchFilter == "") {
+		return nil, errors.New("LDAP authentication requires either " +
+			"user_dn or search_base and search_filter to be set.")
+	}
+	return config.authenticate, nil
+}
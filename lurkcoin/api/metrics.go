@@ -0,0 +1,149 @@
+//
+// lurkcoin API metrics
+// Copyright © 2020 by luk3yx
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package api
+
+import (
+	"encoding/json"
+	"github.com/julienschmidt/httprouter"
+	"github.com/luk3yx/lurkcoin-core/lurkcoin"
+	"github.com/luk3yx/lurkcoin-core/lurkcoin/metrics"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var apiRequestDuration = metrics.NewHistogramVec(
+	"lurkcoin_api_request_duration_seconds",
+	"The time taken to handle API requests.",
+	nil,
+	"route",
+)
+
+var apiErrors = metrics.NewCounterVec(
+	"lurkcoin_api_errors_total",
+	"The number of API requests that returned an error.",
+	"route", "code",
+)
+
+// Records an API request. errCode should be empty if the request succeeded.
+func recordAPIRequest(route string, start time.Time, errCode string) {
+	apiRequestDuration.Observe(time.Since(start).Seconds(), route)
+	if errCode != "" {
+		apiErrors.Inc(route, errCode)
+	}
+}
+
+// Economy statistics are cached to prevent every scrape from iterating over
+// the database once per metric.
+var economyStats struct {
+	lock    sync.Mutex
+	db      lurkcoin.Database
+	stats   lurkcoin.EconomyStats
+	updated time.Time
+}
+
+func setMetricsDatabase(db lurkcoin.Database) {
+	economyStats.lock.Lock()
+	defer economyStats.lock.Unlock()
+	economyStats.db = db
+	economyStats.updated = time.Time{}
+}
+
+func getEconomyStats() (lurkcoin.EconomyStats, bool) {
+	economyStats.lock.Lock()
+	defer economyStats.lock.Unlock()
+	if economyStats.db == nil {
+		return lurkcoin.EconomyStats{}, false
+	}
+	if time.Since(economyStats.updated) > 10*time.Second {
+		economyStats.stats = lurkcoin.GetEconomyStats(economyStats.db)
+		economyStats.updated = time.Now()
+	}
+	return economyStats.stats, true
+}
+
+func economyGauge(name, help string,
+	f func(lurkcoin.EconomyStats) *big.Float) {
+	metrics.NewGaugeFunc(name, help, func() []metrics.Sample {
+		stats, ok := getEconomyStats()
+		if !ok {
+			return nil
+		}
+		value := f(stats)
+		if value == nil {
+			return nil
+		}
+		res, _ := value.Float64()
+		return []metrics.Sample{{Value: res}}
+	})
+}
+
+func init() {
+	economyGauge("lurkcoin_servers", "The number of servers.",
+		func(stats lurkcoin.EconomyStats) *big.Float {
+			return new(big.Float).SetInt64(int64(stats.Servers))
+		})
+	economyGauge("lurkcoin_money_supply",
+		"The sum of every server's balance.",
+		func(stats lurkcoin.EconomyStats) *big.Float {
+			return stats.TotalSupply.Float()
+		})
+	economyGauge("lurkcoin_pending_transactions",
+		"The total number of pending transactions.",
+		func(stats lurkcoin.EconomyStats) *big.Float {
+			return new(big.Float).SetInt64(
+				int64(stats.PendingTransactions))
+		})
+	economyGauge("lurkcoin_exchange_rate_min",
+		"The lowest exchange rate (from lurkcoins) of any server.",
+		func(stats lurkcoin.EconomyStats) *big.Float {
+			return stats.MinExchangeRate
+		})
+	economyGauge("lurkcoin_exchange_rate_max",
+		"The highest exchange rate (from lurkcoins) of any server.",
+		func(stats lurkcoin.EconomyStats) *big.Float {
+			return stats.MaxExchangeRate
+		})
+}
+
+// Metrics are available in Prometheus' format at /admin/metrics and as JSON
+// at /admin/metrics.json.
+func addMetricsPages(router *httprouter.Router,
+	authenticate adminAuthenticator) {
+	router.GET("/admin/metrics", func(w http.ResponseWriter,
+		r *http.Request, _ httprouter.Params) {
+		if _, ok := authenticate(w, r); !ok {
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w.WriteHeader(http.StatusOK)
+		metrics.WritePrometheus(w)
+	})
+
+	router.GET("/admin/metrics.json", func(w http.ResponseWriter,
+		r *http.Request, _ httprouter.Params) {
+		if _, ok := authenticate(w, r); !ok {
+			return
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(metrics.Snapshot())
+	})
+}
@@ -0,0 +1,315 @@
+//
+// lurkcoin: Minetest-friendly API
+// Copyright © 2020 by luk3yx
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+// The /minetest/ endpoints are equivalent to the v3 API but accept
+// form-encoded requests (or query strings), always return HTTP 200 and keep
+// responses small enough for Minetest's HTTP API. Authentication can be done
+// with HTTP basic authentication or the "name" and "token" fields.
+
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/julienschmidt/httprouter"
+	"github.com/luk3yx/lurkcoin-core/lurkcoin"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Responses are kept below this size. Lists of pending transactions are
+// truncated to fit.
+const minetestMaxResponseSize = 16 * 1024
+
+// Room left for everything other than transaction lists.
+const minetestResponseOverhead = 1024
+
+func (self *HTTPRequest) authenticateMinetest(otherServers ...string) error {
+	if _, _, ok := self.Request.BasicAuth(); ok {
+		return self.Authenticate(otherServers...)
+	}
+
+	authed, tr, server := lurkcoin.AuthenticateRequest(
+		self.Database,
+		self.Request.Form.Get("name"),
+		self.Request.Form.Get("token"),
+		otherServers,
+		self.Logger,
+	)
+
+	if !authed {
+		return errors.New("ERR_INVALIDLOGIN")
+	}
+
+	self.setServer(tr, server)
+	return nil
+}
+
+func minetestWrapHTTPHandler(db lurkcoin.Database, route string,
+	autoLogin bool, handlerFunc HTTPHandler) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request,
+		params httprouter.Params) {
+		start := time.Now()
+		req := MakeHTTPRequest(db, r, params)
+		defer req.AbortTransaction()
+
+		var result interface{}
+		var err error
+		limitRequestBody(w, r)
+		if r.ParseForm() != nil {
+			err = errors.New("ERR_INVALIDREQUEST")
+		} else if username, token, ok := r.BasicAuth(); ok {
+			err = req.checkRateLimit(w, username, token)
+		} else {
+			err = req.checkRateLimit(w, r.Form.Get("name"),
+				r.Form.Get("token"))
+		}
+		if err == nil {
+			if !autoLogin || req.authenticateMinetest() == nil {
+				result, err = handlerFunc(req)
+			} else {
+				err = errors.New("ERR_INVALIDLOGIN")
+			}
+		}
+
+		var raw []byte
+		if err == nil {
+			raw, err = json.Marshal(map[string]interface{}{
+				"success": true,
+				"result":  result,
+			})
+			if err == nil && len(raw) > minetestMaxResponseSize {
+				err = errors.New("response too large")
+			}
+		}
+
+		var errCode string
+		if err == nil {
+			err = req.FinishTransaction()
+		}
+		if err != nil {
+			req.AbortTransaction()
+			var msg string
+			errCode, msg, _ = lurkcoin.LookupError(err.Error())
+			if errCode == "ERR_INTERNALERROR" {
+				req.Logger.Error("Internal error", "error", err)
+			}
+			raw, _ = json.Marshal(map[string]interface{}{
+				"success":    false,
+				"error":      errCode,
+				"message":    msg,
+				"request_id": getRequestID(r),
+			})
+		}
+
+		// Minetest's HTTP API doesn't return the body of failed requests.
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		w.Write(raw)
+		recordAPIRequest(route, start, errCode)
+	}
+}
+
+// Adds an endpoint that doesn't change anything, these can also be used with
+// GET requests.
+func minetestGet(router *httprouter.Router, db lurkcoin.Database,
+	url string, requireLogin bool, f HTTPHandler) {
+	url = "/minetest/" + url
+	f2 := minetestWrapHTTPHandler(db, url, requireLogin, f)
+	router.GET(url, f2)
+	router.POST(url, f2)
+}
+
+// Adds an endpoint that changes something. These only accept POST requests
+// so that they can't be called by following a link (with the token in the
+// query string).
+func minetestPost(router *httprouter.Router, db lurkcoin.Database,
+	url string, requireLogin bool, f HTTPHandler) {
+	url = "/minetest/" + url
+	router.POST(url, minetestWrapHTTPHandler(db, url, requireLogin, f))
+}
+
+// Returns a list from a form, values can be repeated or comma-separated.
+func minetestFormList(form url.Values, key string) []string {
+	var res []string
+	for _, value := range form[key] {
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				res = append(res, item)
+			}
+		}
+	}
+	return res
+}
+
+// Returns as many transactions as fit in budget bytes of JSON and true if
+// any transactions were left out. Empty lists are never nil so that they
+// are encoded as [] instead of null.
+func minetestFitTransactions(transactions []lurkcoin.Transaction,
+	budget int) ([]lurkcoin.Transaction, bool) {
+	if transactions == nil {
+		transactions = []lurkcoin.Transaction{}
+	}
+	for i, transaction := range transactions {
+		raw, err := json.Marshal(transaction)
+		if err != nil {
+			return transactions[:i], true
+		}
+		budget -= len(raw) + 1
+		if budget < 0 {
+			return transactions[:i], true
+		}
+	}
+	return transactions, false
+}
+
+func minetestParseAmount(s string) (lurkcoin.Currency, error) {
+	amount, err := lurkcoin.ParseCurrency(s)
+	if err != nil || amount.IsNil() {
+		return amount, errors.New("ERR_INVALIDAMOUNT")
+	}
+	return amount, nil
+}
+
+func addMinetestAPI(router *httprouter.Router, db lurkcoin.Database) {
+	minetestGet(router, db, "summary", true,
+		func(r *HTTPRequest) (interface{}, error) {
+			return r.Server.GetSummary(), nil
+		})
+
+	minetestGet(router, db, "balance", true,
+		func(r *HTTPRequest) (interface{}, error) {
+			return r.Server.GetBalance(), nil
+		})
+
+	minetestGet(router, db, "history", true,
+		func(r *HTTPRequest) (interface{}, error) {
+			return r.Server.GetHistory(), nil
+		})
+
+	minetestPost(router, db, "pay", false,
+		func(r *HTTPRequest) (interface{}, error) {
+			form := r.Request.Form
+			targetServerName := form.Get("target_server")
+			if err := r.authenticateMinetest(targetServerName); err != nil {
+				return nil, err
+			}
+			amount, err := minetestParseAmount(form.Get("amount"))
+			if err != nil {
+				return nil, err
+			}
+			targetServer, ok := r.DbTransaction.GetCachedServer(targetServerName)
+			if !ok {
+				return nil, errors.New("ERR_SERVERNOTFOUND")
+			}
+
+			key := r.Request.Header.Get("Idempotency-Key")
+			if key == "" {
+				key = form.Get("idempotency_key")
+			}
+			fingerprint := idempotencyFingerprint(r.Request.URL.Path,
+				[]string{form.Get("source"), form.Get("target"),
+					targetServerName, amount.RawString(),
+					form.Get("local_currency")})
+			return payIdempotently(r.Server, key, fingerprint,
+				func() (*lurkcoin.Transaction, error) {
+					return r.Server.Pay(form.Get("source"),
+						form.Get("target"), targetServer, amount,
+						isYes(form.Get("local_currency")), true)
+				})
+		})
+
+	minetestGet(router, db, "exchange_rates", false,
+		func(r *HTTPRequest) (interface{}, error) {
+			form := r.Request.Form
+			amount, err := minetestParseAmount(form.Get("amount"))
+			if err != nil {
+				return nil, err
+			}
+			return lurkcoin.GetExchangeRate(r.Database, form.Get("source"),
+				form.Get("target"), amount)
+		})
+
+	minetestGet(router, db, "pending_transactions", true,
+		func(r *HTTPRequest) (interface{}, error) {
+			transactions, _ := minetestFitTransactions(
+				r.Server.GetPendingTransactions(),
+				minetestMaxResponseSize-minetestResponseOverhead)
+			return transactions, nil
+		})
+
+	minetestPost(router, db, "acknowledge_transactions", true,
+		func(r *HTTPRequest) (interface{}, error) {
+			for _, id := range minetestFormList(r.Request.Form, "transactions") {
+				r.Server.RemovePendingTransaction(id)
+			}
+			return nil, nil
+		})
+
+	minetestPost(router, db, "reject_transactions", true,
+		func(r *HTTPRequest) (interface{}, error) {
+			// RejectTransactions() locks the server itself.
+			uid := r.Server.UID
+			r.AbortTransaction()
+			_, err := lurkcoin.RejectTransactions(r.Database, uid,
+				minetestFormList(r.Request.Form, "transactions"), r.Logger)
+			return nil, err
+		})
+
+	minetestGet(router, db, "target_balance", true,
+		func(r *HTTPRequest) (interface{}, error) {
+			return r.Server.GetTargetBalance(), nil
+		})
+
+	minetestPost(router, db, "set_target_balance", true,
+		func(r *HTTPRequest) (interface{}, error) {
+			targetBalance, err := minetestParseAmount(
+				r.Request.Form.Get("target_balance"))
+			if err != nil {
+				return nil, err
+			}
+			if !r.Server.SetTargetBalance(targetBalance) {
+				return nil, errors.New("ERR_INVALIDAMOUNT")
+			}
+			return nil, nil
+		})
+
+	// Returns the balance, exchange rate (from one lurkcoin) and pending
+	// transactions in one request. Transactions listed in "acknowledge" are
+	// acknowledged first so that a poll only needs one request.
+	minetestPost(router, db, "poll", true,
+		func(r *HTTPRequest) (interface{}, error) {
+			for _, id := range minetestFormList(r.Request.Form, "acknowledge") {
+				r.Server.RemovePendingTransaction(id)
+			}
+
+			_, exchangeRate := r.Server.GetExchangeRate(
+				lurkcoin.CurrencyFromInt64(1), false)
+			transactions, more := minetestFitTransactions(
+				r.Server.GetPendingTransactions(),
+				minetestMaxResponseSize-minetestResponseOverhead)
+			return map[string]interface{}{
+				"balance":           r.Server.GetBalance(),
+				"exchange_rate":     json.RawMessage(exchangeRate.String()),
+				"transactions":      transactions,
+				"more_transactions": more,
+			}, nil
+		})
+}
@@ -0,0 +1,296 @@
+//
+// lurkcoin admin notifications
+// Copyright © 2020 by luk3yx
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/luk3yx/lurkcoin-core/lurkcoin"
+	"mime"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var notificationClient = &http.Client{Timeout: 10 * time.Second}
+
+// Filters notifications by event, an empty list allows every event.
+type notificationFilter []string
+
+func (self notificationFilter) allows(event string) bool {
+	if len(self) == 0 {
+		return true
+	}
+	for _, e := range self {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// Sends a JSON request in a separate goroutine.
+func sendNotificationRequest(service, method, url string, body interface{},
+	headers map[string]string) {
+	raw, err := json.Marshal(body)
+	if err != nil {
+		return
+	}
+	go func() {
+		req, err := http.NewRequest(method, url, bytes.NewReader(raw))
+		if err != nil {
+			lurkcoin.LogWarning("Could not send notification", "service",
+				service, "error", err)
+			return
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("User-Agent", "lurkcoin/"+lurkcoin.VERSION)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		res, err := notificationClient.Do(req)
+		if err != nil {
+			lurkcoin.LogWarning("Could not send notification", "service",
+				service, "error", err)
+			return
+		}
+		res.Body.Close()
+		if res.StatusCode >= 300 {
+			lurkcoin.LogWarning("Could not send notification", "service",
+				service, "status", res.StatusCode)
+		}
+	}()
+}
+
+// Logs notifications.
+type logNotifier struct {
+	events notificationFilter
+}
+
+func (self *logNotifier) Notify(n *lurkcoin.Notification) {
+	if self.events.allows(n.Event) {
+		lurkcoin.LogInfo("Notification: "+n.Message, "event", n.Event)
+	}
+}
+
+// Posts notifications as JSON to an arbitrary URL.
+type webhookNotifier struct {
+	name   string
+	url    string
+	events notificationFilter
+}
+
+func (self *webhookNotifier) Notify(n *lurkcoin.Notification) {
+	if !self.events.allows(n.Event) {
+		return
+	}
+	sendNotificationRequest("webhook", "POST", self.url,
+		map[string]interface{}{
+			"name":    self.name,
+			"event":   n.Event,
+			"message": n.Message,
+			"time":    n.Time.Unix(),
+		}, nil)
+}
+
+// Posts notifications to a Discord channel with a webhook.
+type discordNotifier struct {
+	name       string
+	webhookURL string
+	events     notificationFilter
+}
+
+func (self *discordNotifier) Notify(n *lurkcoin.Notification) {
+	if !self.events.allows(n.Event) {
+		return
+	}
+	sendNotificationRequest("Discord", "POST", self.webhookURL,
+		map[string]interface{}{
+			"username": self.name,
+			"content":  n.Message,
+			// Don't ping anyone if a server name contains @everyone.
+			"allowed_mentions": map[string]interface{}{
+				"parse": []string{},
+			},
+		}, nil)
+}
+
+// Sends notifications to a Matrix room as m.notice messages.
+type matrixNotifier struct {
+	name        string
+	homeserver  string
+	accessToken string
+	roomID      string
+	events      notificationFilter
+}
+
+var matrixTxnID int64
+
+func (self *matrixNotifier) Notify(n *lurkcoin.Notification) {
+	if !self.events.allows(n.Event) {
+		return
+	}
+	txnID := fmt.Sprintf("lurkcoin-%d-%d", n.Time.UnixNano(),
+		atomic.AddInt64(&matrixTxnID, 1))
+	sendNotificationRequest("Matrix", "PUT",
+		strings.TrimSuffix(self.homeserver, "/")+"/_matrix/client/r0/rooms/"+
+			url.PathEscape(self.roomID)+"/send/m.room.message/"+txnID,
+		map[string]string{
+			"msgtype": "m.notice",
+			"body":    "[" + self.name + "] " + n.Message,
+		},
+		map[string]string{"Authorization": "Bearer " + self.accessToken})
+}
+
+// Sends notifications by email.
+type emailNotifier struct {
+	name       string
+	smtpServer string
+	auth       smtp.Auth
+	from       string
+	to         []string
+	events     notificationFilter
+}
+
+// Removes newlines from email headers.
+var emailHeaderReplacer = strings.NewReplacer("\r", " ", "\n", " ")
+
+func (self *emailNotifier) Notify(n *lurkcoin.Notification) {
+	if !self.events.allows(n.Event) {
+		return
+	}
+
+	subject := fmt.Sprintf("[%s] %s", self.name, n.Message)
+	if r := []rune(subject); len(r) > 100 {
+		subject = string(r[:97]) + "..."
+	}
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", self.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(self.to, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n",
+		mime.QEncoding.Encode("utf-8", emailHeaderReplacer.Replace(subject)))
+	fmt.Fprintf(&msg, "Date: %s\r\n", n.Time.Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&msg, "%s\r\n\r\nEvent: %s\r\nTime: %s\r\n", n.Message,
+		n.Event, n.Time.UTC().Format(time.RFC3339))
+
+	go func() {
+		err := smtp.SendMail(self.smtpServer, self.auth, self.from, self.to,
+			msg.Bytes())
+		if err != nil {
+			lurkcoin.LogWarning("Could not send notification email",
+				"error", err)
+		}
+	}()
+}
+
+func setupNotifications(config *Config) error {
+	name := config.Name
+	if name == "" {
+		name = "lurkcoin"
+	}
+	if c := config.Notifications.Log; c.Enable {
+		lurkcoin.AddNotifier(&logNotifier{c.Events})
+	}
+	for _, c := range config.Notifications.Webhooks {
+		if c.URL == "" {
+			return errors.New("No notification webhook URL specified.")
+		}
+		lurkcoin.AddNotifier(&webhookNotifier{name, c.URL, c.Events})
+	}
+	for _, c := range config.Notifications.Discord {
+		if c.WebhookURL == "" {
+			return errors.New("No Discord webhook URL specified.")
+		}
+		lurkcoin.AddNotifier(&discordNotifier{name, c.WebhookURL, c.Events})
+	}
+	for _, c := range config.Notifications.Matrix {
+		if c.Homeserver == "" || c.AccessToken == "" || c.RoomID == "" {
+			return errors.New("Matrix notifications require homeserver, " +
+				"access_token and room_id to be set.")
+		}
+		lurkcoin.AddNotifier(&matrixNotifier{name, c.Homeserver,
+			c.AccessToken, c.RoomID, c.Events})
+	}
+
+	for _, c := range config.Notifications.Email {
+		if c.SMTPServer == "" || c.From == "" || len(c.To) == 0 {
+			return errors.New("Email notifications require smtp_server, " +
+				"from and to to be set.")
+		}
+		var auth smtp.Auth
+		if c.Username != "" {
+			host, _, err := net.SplitHostPort(c.SMTPServer)
+			if err != nil {
+				return fmt.Errorf("Invalid SMTP server: %s", err)
+			}
+			auth = smtp.PlainAuth("", c.Username, c.Password, host)
+		}
+		lurkcoin.AddNotifier(&emailNotifier{name, c.SMTPServer, auth, c.From,
+			c.To, c.Events})
+	}
+
+	if threshold := config.Notifications.LargeTransaction; threshold != "" {
+		amount, err := lurkcoin.ParseCurrency(threshold)
+		if err != nil {
+			return fmt.Errorf("Invalid large_transaction value: %q",
+				threshold)
+		}
+		lurkcoin.SetLargeTransactionThreshold(amount)
+	}
+	if threshold := config.Notifications.DailyVolume; threshold != "" {
+		amount, err := lurkcoin.ParseCurrency(threshold)
+		if err != nil {
+			return fmt.Errorf("Invalid daily_volume value: %q", threshold)
+		}
+		lurkcoin.SetDailyVolumeThreshold(amount)
+	}
+	return nil
+}
+
+// Admin actions that send notifications.
+var adminActionEvents = map[string]string{
+	"create_server":    lurkcoin.EventServerCreated,
+	"delete_server":    lurkcoin.EventServerDeleted,
+	"regenerate_token": lurkcoin.EventTokenRegenerated,
+}
+
+func notifyAdminAction(adminUser, action, server string) {
+	event, ok := adminActionEvents[action]
+	if !ok {
+		return
+	}
+	var msg string
+	switch event {
+	case lurkcoin.EventServerCreated:
+		msg = "Admin %q created server %q."
+	case lurkcoin.EventServerDeleted:
+		msg = "Admin %q deleted server %q."
+	case lurkcoin.EventTokenRegenerated:
+		msg = "Admin %q regenerated the token of server %q."
+	}
+	lurkcoin.Notify(event, fmt.Sprintf(msg, adminUser, server))
+}
@@ -0,0 +1,335 @@
+//
+// lurkcoin OIDC admin login
+// Copyright © 2020 by luk3yx
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package api
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/luk3yx/lurkcoin-core/lurkcoin"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+type oidcConfig struct {
+	// The issuer URL, the provider's configuration is fetched from
+	// <issuer>/.well-known/openid-configuration.
+	Issuer       string `yaml:"issuer"`
+	ClientID     string `yaml:"client_id"`
+	ClientSecret string `yaml:"client_secret"`
+
+	// This must point to /admin/oidc/callback.
+	RedirectURL string `yaml:"redirect_url"`
+
+	// The scopes to request, "openid" is always requested. This defaults to
+	// "profile" and "groups", some providers (such as Google) reject scopes
+	// they don't know about.
+	Scopes []string `yaml:"scopes"`
+
+	// The claims containing the username and a list of groups. These
+	// default to "preferred_username" and "groups". Nested claims can be
+	// separated with dots, for example "realm_access.roles" for Keycloak
+	// realm roles. If the username claim is "email", the email address must
+	// be verified.
+	UsernameClaim string `yaml:"username_claim"`
+	GroupsClaim   string `yaml:"groups_claim"`
+
+	// Maps group names to permissions. Users that aren't in any of these
+	// groups (or in Users) can't log in.
+	Groups map[string]AdminPermissions `yaml:"groups"`
+
+	// Maps usernames to permissions, for providers that don't send groups.
+	// These are combined with any group permissions.
+	Users map[string]AdminPermissions `yaml:"users"`
+}
+
+var oidcClient = &http.Client{Timeout: 10 * time.Second}
+
+// Login attempts expire after 10 minutes.
+const oidcLoginTimeout = 10 * time.Minute
+
+type oidcLogin struct {
+	nonce   string
+	next    string
+	expires time.Time
+}
+
+// A minimal OpenID Connect relying party using the authorization code flow.
+// ID tokens are received directly from the token endpoint over HTTPS, so
+// their signatures don't need to be verified (OpenID Connect Core 1.0,
+// section 3.1.3.7).
+type oidcProvider struct {
+	config *oidcConfig
+
+	lock                  sync.Mutex
+	authorizationEndpoint string
+	tokenEndpoint         string
+	logins                map[string]*oidcLogin
+}
+
+func newOIDCProvider(config *oidcConfig) (*oidcProvider, error) {
+	if config.Issuer == "" {
+		return nil, nil
+	}
+	if config.ClientID == "" || config.RedirectURL == "" {
+		return nil, errors.New("OpenID Connect authentication requires " +
+			"client_id and redirect_url to be set.")
+	}
+	return &oidcProvider{config: config,
+		logins: make(map[string]*oidcLogin)}, nil
+}
+
+// Fetches the provider's endpoints (if they haven't been fetched already).
+func (self *oidcProvider) discover() error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.tokenEndpoint != "" {
+		return nil
+	}
+
+	res, err := oidcClient.Get(strings.TrimSuffix(self.config.Issuer, "/") +
+		"/.well-known/openid-configuration")
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("HTTP %d", res.StatusCode)
+	}
+	var discovery struct {
+		Issuer                string `json:"issuer"`
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&discovery); err != nil {
+		return err
+	}
+	if discovery.Issuer != self.config.Issuer {
+		return errors.New("The issuer does not match the configuration.")
+	}
+	if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" {
+		return errors.New("Missing endpoints in the configuration.")
+	}
+	self.authorizationEndpoint = discovery.AuthorizationEndpoint
+	self.tokenEndpoint = discovery.TokenEndpoint
+	return nil
+}
+
+// Redirects the user to the provider. next is the page to return to after
+// logging in.
+func (self *oidcProvider) startLogin(w http.ResponseWriter, r *http.Request,
+	next string) {
+	if err := self.discover(); err != nil {
+		requestLogger(r).Error("OpenID Connect discovery failed", "error",
+			err)
+		writeAdminErrorPage(w, "Could not contact the login provider.")
+		return
+	}
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") {
+		next = "/admin"
+	}
+
+	state := lurkcoin.GenerateToken()
+	nonce := lurkcoin.GenerateToken()
+	self.lock.Lock()
+	now := time.Now()
+	for k, login := range self.logins {
+		if now.After(login.expires) {
+			delete(self.logins, k)
+		}
+	}
+	self.logins[state] = &oidcLogin{nonce, next, now.Add(oidcLoginTimeout)}
+	endpoint := self.authorizationEndpoint
+	self.lock.Unlock()
+
+	scopes := self.config.Scopes
+	if scopes == nil {
+		scopes = []string{"profile", "groups"}
+	}
+	query := url.Values{
+		"response_type": {"code"},
+		"client_id":     {self.config.ClientID},
+		"redirect_uri":  {self.config.RedirectURL},
+		"scope":         {strings.Join(append([]string{"openid"}, scopes...), " ")},
+		"state":         {state},
+		"nonce":         {nonce},
+	}
+	sep := "?"
+	if strings.Contains(endpoint, "?") {
+		sep = "&"
+	}
+	http.Redirect(w, r, endpoint+sep+query.Encode(), http.StatusSeeOther)
+}
+
+// Decodes the claims of a JWT without verifying its signature.
+func decodeJWTClaims(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("Invalid ID token.")
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(
+		strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return nil, err
+	}
+	var claims map[string]interface{}
+	err = json.Unmarshal(raw, &claims)
+	return claims, err
+}
+
+// Looks up a claim, dots in name separate nested claims.
+func lookupClaim(claims map[string]interface{}, name string) interface{} {
+	var res interface{} = claims
+	for _, part := range strings.Split(name, ".") {
+		obj, ok := res.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		res = obj[part]
+	}
+	return res
+}
+
+func claimAudienceContains(aud interface{}, clientID string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == clientID
+	case []interface{}:
+		for _, a := range aud {
+			if a == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Handles the redirect back from the provider. Returns the username (prefixed
+// with "oidc:"), the user's permissions, and the page to redirect to.
+func (self *oidcProvider) finishLogin(r *http.Request) (string,
+	AdminPermissions, string, error) {
+	var perms AdminPermissions
+	query := r.URL.Query()
+	if e := query.Get("error"); e != "" {
+		return "", perms, "", errors.New("The login provider returned an " +
+			"error: " + e)
+	}
+
+	self.lock.Lock()
+	login, ok := self.logins[query.Get("state")]
+	delete(self.logins, query.Get("state"))
+	tokenEndpoint := self.tokenEndpoint
+	self.lock.Unlock()
+	if !ok || time.Now().After(login.expires) {
+		return "", perms, "", errors.New("The login attempt has expired.")
+	}
+
+	// Exchange the code for an ID token.
+	req, err := http.NewRequest("POST", tokenEndpoint,
+		strings.NewReader(url.Values{
+			"grant_type":   {"authorization_code"},
+			"code":         {query.Get("code")},
+			"redirect_uri": {self.config.RedirectURL},
+		}.Encode()))
+	if err != nil {
+		return "", perms, "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(self.config.ClientID),
+		url.QueryEscape(self.config.ClientSecret))
+	res, err := oidcClient.Do(req)
+	if err != nil {
+		return "", perms, "", err
+	}
+	defer res.Body.Close()
+	raw, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return "", perms, "", err
+	}
+	if res.StatusCode != http.StatusOK {
+		return "", perms, "", fmt.Errorf("Token endpoint returned HTTP %d.",
+			res.StatusCode)
+	}
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.Unmarshal(raw, &tokens); err != nil {
+		return "", perms, "", err
+	}
+
+	// Validate the ID token.
+	claims, err := decodeJWTClaims(tokens.IDToken)
+	if err != nil {
+		return "", perms, "", err
+	}
+	if claims["iss"] != self.config.Issuer ||
+		!claimAudienceContains(claims["aud"], self.config.ClientID) ||
+		!lurkcoin.ConstantTimeCompare(fmt.Sprint(claims["nonce"]),
+			login.nonce) {
+		return "", perms, "", errors.New("Invalid ID token.")
+	}
+	if exp, ok := claims["exp"].(float64); !ok ||
+		time.Now().After(time.Unix(int64(exp), 0)) {
+		return "", perms, "", errors.New("The ID token has expired.")
+	}
+
+	usernameClaim := self.config.UsernameClaim
+	if usernameClaim == "" {
+		usernameClaim = "preferred_username"
+	}
+	username, _ := lookupClaim(claims, usernameClaim).(string)
+	if username == "" {
+		username, _ = claims["sub"].(string)
+	} else if usernameClaim == "email" && claims["email_verified"] != true {
+		return "", perms, "", errors.New("Your email address has not been " +
+			"verified.")
+	}
+
+	groupsClaim := self.config.GroupsClaim
+	if groupsClaim == "" {
+		groupsClaim = "groups"
+	}
+	var groups []string
+	switch rawGroups := lookupClaim(claims, groupsClaim).(type) {
+	case string:
+		groups = []string{rawGroups}
+	case []interface{}:
+		for _, group := range rawGroups {
+			if s, ok := group.(string); ok {
+				groups = append(groups, s)
+			}
+		}
+	}
+
+	perms, ok = mapGroupPermissions(self.config.Groups, groups)
+	if userPerms, exists := self.config.Users[username]; exists {
+		perms = perms.merge(userPerms)
+		ok = true
+	}
+	if !ok || username == "" {
+		return "", perms, "", errors.New("You do not have access to the " +
+			"admin pages.")
+	}
+	return "oidc:" + username, perms, login.next, nil
+}
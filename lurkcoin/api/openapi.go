@@ -0,0 +1,776 @@
+//
+// lurkcoin OpenAPI document
+// Copyright © 2020 by luk3yx
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package api
+
+import (
+	"encoding/json"
+	"github.com/julienschmidt/httprouter"
+	"github.com/luk3yx/lurkcoin-core/lurkcoin"
+	"html/template"
+	"net/http"
+	"strings"
+)
+
+// The OpenAPI document is generated from the below descriptions of each API
+// endpoint, these should be updated whenever an endpoint is added or
+// changed.
+type openAPIEndpoint struct {
+	method  string
+	path    string
+	summary string
+
+	// If true, the endpoint requires authentication (HTTP basic
+	// authentication for the v3 API and name/token parameters for the v2
+	// API).
+	requireLogin bool
+
+	params []openAPIParam
+	result openAPISchema
+	errors []string
+}
+
+type openAPIParam struct {
+	name        string
+	schema      openAPISchema
+	required    bool
+	description string
+}
+
+type openAPISchema = map[string]interface{}
+
+func openAPIType(t string) openAPISchema {
+	return openAPISchema{"type": t}
+}
+
+func openAPIRef(name string) openAPISchema {
+	return openAPISchema{"$ref": "#/components/schemas/" + name}
+}
+
+func openAPIArray(items openAPISchema) openAPISchema {
+	return openAPISchema{"type": "array", "items": items}
+}
+
+var openAPIComponents = openAPISchema{
+	"securitySchemes": openAPISchema{
+		"basicAuth": openAPISchema{
+			"type":        "http",
+			"scheme":      "basic",
+			"description": "The server name and API token.",
+		},
+	},
+	"schemas": openAPISchema{
+		"Currency": openAPISchema{
+			"type": "number",
+			"description": "An amount of money. Strings (like \"1.23\") " +
+				"are also accepted in requests. Anything past the number " +
+				"of decimal places in /v3/capabilities is ignored.",
+		},
+		"Transaction": openAPISchema{
+			"type": "object",
+			"properties": openAPISchema{
+				"id":              openAPIType("string"),
+				"source":          openAPIType("string"),
+				"source_server":   openAPIType("string"),
+				"target":          openAPIType("string"),
+				"target_server":   openAPIType("string"),
+				"amount":          openAPIRef("Currency"),
+				"sent_amount":     openAPIRef("Currency"),
+				"received_amount": openAPIRef("Currency"),
+				"time":            openAPIType("integer"),
+				"revertable":      openAPIType("boolean"),
+				"reverts":         openAPIType("string"),
+				"source_id":       openAPIType("string"),
+				"target_id":       openAPIType("string"),
+				"fee":             openAPIRef("Currency"),
+				"fee_for":         openAPIType("string"),
+				"currency":        openAPIType("string"),
+			},
+		},
+		"Summary": openAPISchema{
+			"type": "object",
+			"properties": openAPISchema{
+				"uid":               openAPIType("string"),
+				"name":              openAPIType("string"),
+				"bal":               openAPIRef("Currency"),
+				"balance":           openAPIType("string"),
+				"history":           openAPIArray(openAPIRef("Transaction")),
+				"interest_rate":     openAPIType("number"),
+				"target_balance":    openAPIRef("Currency"),
+				"reference_balance": openAPIRef("ReferenceValue"),
+				"frozen":            openAPIType("string"),
+				"credit_limit":      openAPIRef("Currency"),
+				"credit_used":       openAPIRef("Currency"),
+				"balances": openAPISchema{
+					"type":                 "object",
+					"additionalProperties": openAPIRef("Currency"),
+				},
+			},
+		},
+		"WebhookDelivery": openAPISchema{
+			"type": "object",
+			"properties": openAPISchema{
+				"time":        openAPIType("integer"),
+				"url":         openAPIType("string"),
+				"delivery_id": openAPIType("string"),
+				"attempt":     openAPIType("integer"),
+				"status_code": openAPIType("integer"),
+				"latency":     openAPIType("number"),
+				"error":       openAPIType("string"),
+			},
+		},
+		"WebhookEndpoint": openAPISchema{
+			"type": "object",
+			"properties": openAPISchema{
+				"id":     openAPIType("string"),
+				"url":    openAPIType("string"),
+				"events": openAPIArray(openAPIType("string")),
+			},
+		},
+		"ReferenceValue": openAPISchema{
+			"type": "object",
+			"properties": openAPISchema{
+				"currency": openAPIType("string"),
+				"value":    openAPIType("string"),
+			},
+		},
+		"Error": openAPISchema{
+			"type": "object",
+			"properties": openAPISchema{
+				"success":    openAPISchema{"type": "boolean", "enum": []bool{false}},
+				"error":      openAPIType("string"),
+				"message":    openAPIType("string"),
+				"request_id": openAPIType("string"),
+			},
+		},
+	},
+}
+
+var transactionIDsParam = []openAPIParam{{"transactions",
+	openAPIArray(openAPIType("string")), true, "A list of transaction IDs."}}
+
+var payParams = []openAPIParam{
+	{"source", openAPIType("string"), true,
+		"The user who is sending the transaction."},
+	{"target", openAPIType("string"), true, "The user to pay."},
+	{"target_server", openAPIType("string"), true,
+		"The server to pay the user on."},
+	{"amount", openAPIRef("Currency"), true, "The amount to pay."},
+	{"local_currency", openAPIType("boolean"), false,
+		"If true, amount is in the local server's currency."},
+}
+
+var payErrors = []string{"ERR_SERVERNOTFOUND", "ERR_INVALIDAMOUNT",
+	"ERR_CANNOTPAYNOTHING", "ERR_CANNOTAFFORD",
+	"ERR_TOOMANYPENDINGTRANSACTIONS", "ERR_ACCOUNTFROZEN"}
+
+var quoteParam = openAPIParam{"quote", openAPIType("string"), false,
+	"A quote token from /v3/quote, the amounts in the quote are used " +
+		"instead of the current exchange rates."}
+
+var currencyParam = openAPIParam{"currency", openAPIType("string"), false,
+	"An additional currency to use instead of lurkcoins (see " +
+		"/v3/capabilities)."}
+
+var webhookVersionParam = openAPIParam{"webhook_version",
+	openAPIType("integer"), false,
+	"The webhook payload version, 0 (the default) or 1."}
+
+var userWalletsParams = []openAPIParam{{"user_wallets",
+	openAPIType("boolean"), true,
+	"If true, payments to users are credited to their wallets."}}
+
+var identityUserParam = []openAPIParam{{"user", openAPIType("string"), true,
+	"The user on your server."}}
+
+var v3OpenAPIEndpoints = []openAPIEndpoint{
+	{"GET", "/v3/capabilities",
+		"Returns information about this lurkcoin instance (authentication " +
+			"is optional).", false, nil, openAPISchema{
+			"type": "object",
+			"properties": openAPISchema{
+				"version":             openAPIType("string"),
+				"transaction_limit":   openAPIRef("Currency"),
+				"revert_window":       openAPIType("number"),
+				"max_quote_lifetime":  openAPIType("number"),
+				"max_target_balance":  openAPIRef("Currency"),
+				"currency_decimals":   openAPIType("integer"),
+				"currencies":          openAPIArray(openAPIType("string")),
+				"max_webhook_version": openAPIType("integer"),
+				"webhook_events":      openAPIArray(openAPIType("string")),
+				"max_webhooks":        openAPIType("integer"),
+			},
+		}, nil},
+	{"GET", "/v3/summary", "Returns an account summary.", true, nil,
+		openAPIRef("Summary"), nil},
+	{"POST", "/v3/pay", "Sends a payment and returns the transaction.", true,
+		append(append([]openAPIParam{}, payParams...), quoteParam,
+			currencyParam),
+		openAPIRef("Transaction"), append([]string{"ERR_INVALIDQUOTE",
+			"ERR_QUOTEEXPIRED", "ERR_INVALIDCURRENCY",
+			"ERR_IDEMPOTENCYCONFLICT"}, payErrors...)},
+	{"POST", "/v3/quote",
+		"Locks the exchange rates and fee of a payment for a short time.",
+		true, []openAPIParam{
+			{"target_server", openAPIType("string"), true,
+				"The server the payment will be sent to."},
+			{"amount", openAPIRef("Currency"), true,
+				"The amount that will be sent."},
+			{"local_currency", openAPIType("boolean"), false,
+				"If true, amount is in the local server's currency."},
+			{"lifetime", openAPIType("number"), false,
+				"How long the quote is valid for in seconds."},
+		}, openAPISchema{
+			"type": "object",
+			"properties": openAPISchema{
+				"quote":           openAPIType("string"),
+				"sent_amount":     openAPIRef("Currency"),
+				"amount":          openAPIRef("Currency"),
+				"fee":             openAPIRef("Currency"),
+				"received_amount": openAPIRef("Currency"),
+				"expires":         openAPIType("integer"),
+			},
+		}, payErrors},
+	{"POST", "/v3/users/pay",
+		"Sends a payment from a user's wallet and returns the transaction.",
+		true, payParams, openAPIRef("Transaction"),
+		append([]string{"ERR_IDEMPOTENCYCONFLICT"}, payErrors...)},
+	{"GET", "/v3/users/{name}/balance",
+		"Returns the balance of a user's wallet (in lurkcoins).", true, nil,
+		openAPIRef("Currency"), nil},
+	{"POST", "/v3/identities/register",
+		"Registers a user with the global username registry and returns " +
+			"their global ID.", true, identityUserParam,
+		openAPIType("string"), nil},
+	{"POST", "/v3/identities/unregister",
+		"Removes a user from the global username registry.", true,
+		identityUserParam, nil, nil},
+	{"POST", "/v3/identities/link_code",
+		"Creates a code for linking another account to a user's global ID.",
+		true, identityUserParam, openAPISchema{
+			"type": "object",
+			"properties": openAPISchema{
+				"code":    openAPIType("string"),
+				"expires": openAPIType("integer"),
+			},
+		}, nil},
+	{"POST", "/v3/identities/link",
+		"Links a user to the global ID of a link code.", true,
+		append([]openAPIParam{{"code", openAPIType("string"), true,
+			"The link code."}}, identityUserParam...),
+		openAPIType("string"), []string{"ERR_INVALIDLINKCODE"}},
+	{"GET", "/v3/identities",
+		"Returns the accounts linked to a global ID.", true,
+		[]openAPIParam{
+			{"id", openAPIType("string"), false,
+				"The global ID to look up."},
+			{"server", openAPIType("string"), false,
+				"Look up the global ID of a user on this server."},
+			{"user", openAPIType("string"), false,
+				"Look up the global ID of this user."},
+		},
+		openAPISchema{
+			"type":     "object",
+			"nullable": true,
+			"properties": openAPISchema{
+				"id": openAPIType("string"),
+				"accounts": openAPIArray(openAPISchema{
+					"type": "object",
+					"properties": openAPISchema{
+						"server": openAPIType("string"),
+						"user":   openAPIType("string"),
+					},
+				}),
+			},
+		}, nil},
+	{"GET", "/v3/user_wallets",
+		"Returns true if payments to users are credited to their wallets.",
+		true, nil, openAPIType("boolean"), nil},
+	{"PUT", "/v3/user_wallets", "Enables or disables user wallets.", true,
+		userWalletsParams, nil, nil},
+	{"POST", "/v3/set_user_wallets",
+		"Enables or disables user wallets (the same as PUT " +
+			"/v3/user_wallets).", true, userWalletsParams, nil, nil},
+	{"GET", "/v3/balance", "Returns the server's balance.", true, nil,
+		openAPIRef("Currency"), nil},
+	{"GET", "/v3/history", "Returns the server's recent transactions.", true,
+		nil, openAPIArray(openAPIRef("Transaction")), nil},
+	{"POST", "/v3/exchange_rates", "Calculates an exchange rate.", false,
+		[]openAPIParam{
+			{"source", openAPIType("string"), false,
+				"The server the money is coming from."},
+			{"target", openAPIType("string"), false,
+				"The server the money is going to."},
+			{"amount", openAPIRef("Currency"), true,
+				"The amount of money being transferred."},
+			{"detailed", openAPIType("boolean"), false,
+				"If true, an object with the amount and the fee (in " +
+					"lurkcoins) is returned instead."},
+			currencyParam,
+		},
+		openAPIRef("Currency"),
+		[]string{"ERR_SOURCESERVERNOTFOUND", "ERR_TARGETSERVERNOTFOUND",
+			"ERR_INVALIDAMOUNT", "ERR_CANNOTPAYNOTHING",
+			"ERR_INVALIDCURRENCY"}},
+	{"POST", "/v3/exchange_rates/ladder",
+		"Calculates exchange rates for multiple amounts.", false,
+		[]openAPIParam{
+			{"source", openAPIType("string"), false,
+				"The server the money is coming from."},
+			{"target", openAPIType("string"), false,
+				"The server the money is going to."},
+			{"amounts", openAPIArray(openAPIRef("Currency")), false,
+				"The amounts of money being transferred (up to 100), " +
+					"defaults to 1, 10, 100, 1000 and 10000."},
+			currencyParam,
+		},
+		openAPIArray(openAPISchema{
+			"type": "object",
+			"properties": openAPISchema{
+				"amount": openAPIRef("Currency"),
+				"result": openAPIRef("Currency"),
+				"fee":    openAPIRef("Currency"),
+				"rate":   openAPIType("number"),
+				"error":  openAPIType("string"),
+			},
+		}),
+		[]string{"ERR_SOURCESERVERNOTFOUND", "ERR_TARGETSERVERNOTFOUND",
+			"ERR_INVALIDAMOUNT", "ERR_INVALIDCURRENCY"}},
+	{"GET", "/v3/pending_transactions",
+		"Returns transactions that haven't been processed yet.", true, nil,
+		openAPIArray(openAPIRef("Transaction")), nil},
+	{"POST", "/v3/acknowledge_transactions",
+		"Marks transactions as processed.", true,
+		append([]openAPIParam{{"detailed", openAPIType("boolean"), false,
+			"If true, the result is an object with whether each " +
+				"transaction was acknowledged and the transactions that " +
+				"are still pending."}}, transactionIDsParam...),
+		openAPISchema{
+			"type":     "object",
+			"nullable": true,
+			"properties": openAPISchema{
+				"acknowledged": openAPISchema{
+					"type":                 "object",
+					"additionalProperties": openAPIType("boolean"),
+				},
+				"pending_transactions": openAPIArray(
+					openAPIRef("Transaction")),
+			},
+		}, nil},
+	{"POST", "/v3/reject_transactions", "Marks transactions as rejected.",
+		true, transactionIDsParam, openAPISchema{
+			"type": "object",
+			"additionalProperties": openAPISchema{
+				"type": "object",
+				"properties": openAPISchema{
+					"rejected": openAPIType("boolean"),
+					"reversal": openAPIRef("Transaction"),
+					"error":    openAPIType("string"),
+				},
+			},
+		}, nil},
+	{"POST", "/v3/revert_transaction",
+		"Reverts a transaction received by the server.", true,
+		[]openAPIParam{{"transaction", openAPIType("string"), true,
+			"The ID of the transaction to revert."}},
+		openAPIRef("Transaction"), []string{"ERR_TRANSACTIONNOTFOUND",
+			"ERR_CANNOTREVERT", "ERR_REVERTWINDOWEXPIRED",
+			"ERR_CANNOTAFFORD"}},
+	{"GET", "/v3/transactions",
+		"Searches for transactions sent or received by the server.", true,
+		[]openAPIParam{
+			{"since", openAPIType("string"), false,
+				"Only return transactions made at or after this time."},
+			{"until", openAPIType("string"), false,
+				"Only return transactions made at or before this time."},
+			{"server", openAPIType("string"), false,
+				"Only return transactions sent to or received from this " +
+					"server."},
+			{"direction", openAPISchema{"type": "string",
+				"enum": []string{lurkcoin.TransactionsSent,
+					lurkcoin.TransactionsReceived}}, false,
+				"Only return sent or received transactions."},
+			{"min_amount", openAPIType("string"), false,
+				"The minimum amount (in lurkcoins)."},
+			{"after", openAPIType("string"), false,
+				"The \"next\" value from the previous page."},
+			{"limit", openAPIType("integer"), false,
+				"The maximum number of transactions to return (between 1 " +
+					"and 1000, 100 by default)."},
+		},
+		openAPISchema{
+			"type": "object",
+			"properties": openAPISchema{
+				"transactions": openAPIArray(openAPIRef("Transaction")),
+				"next":         openAPISchema{"type": "string", "nullable": true},
+			},
+		}, nil},
+	{"GET", "/v3/transactions/{id}",
+		"Looks up a transaction sent or received by the server.", true,
+		nil, openAPISchema{
+			"allOf": []openAPISchema{openAPIRef("Transaction"), {
+				"type": "object",
+				"properties": openAPISchema{
+					"status": openAPISchema{
+						"type": "string",
+						"enum": []string{lurkcoin.TransactionPending,
+							lurkcoin.TransactionAcknowledged,
+							lurkcoin.TransactionReverted},
+					},
+					"reverted_by": openAPIType("string"),
+				},
+			}},
+		}, []string{"ERR_TRANSACTIONNOTFOUND"}},
+	{"GET", "/v3/target_balance", "Returns the server's target balance.",
+		true, []openAPIParam{currencyParam}, openAPIRef("Currency"),
+		[]string{"ERR_INVALIDCURRENCY"}},
+	{"PUT", "/v3/target_balance", "Sets the server's target balance.", true,
+		[]openAPIParam{{"target_balance", openAPIRef("Currency"), true,
+			"The new target balance."}, currencyParam},
+		nil, []string{"ERR_INVALIDAMOUNT", "ERR_INVALIDCURRENCY"}},
+	{"POST", "/v3/set_target_balance",
+		"Sets the server's target balance (the same as PUT " +
+			"/v3/target_balance).", true,
+		[]openAPIParam{{"target_balance", openAPIRef("Currency"), true,
+			"The new target balance."}, currencyParam},
+		nil, []string{"ERR_INVALIDAMOUNT", "ERR_INVALIDCURRENCY"}},
+	{"GET", "/v3/webhook_url", "Returns the server's webhook URL (if any).",
+		true, nil, openAPIType("string"), nil},
+	{"PUT", "/v3/webhook_url",
+		"Sets the server's webhook URL and returns the URL that will be " +
+			"used.", true,
+		[]openAPIParam{{"webhook_url", openAPIType("string"), true,
+			"The new webhook URL, an empty string disables webhooks."},
+			webhookVersionParam},
+		openAPISchema{"type": "string", "nullable": true},
+		[]string{"ERR_INVALIDWEBHOOKURL", "ERR_WEBHOOKVERIFICATIONFAILED",
+			"ERR_INVALIDWEBHOOKVERSION"}},
+	{"POST", "/v3/set_webhook_url",
+		"Sets the server's webhook URL (the same as PUT /v3/webhook_url).",
+		true,
+		[]openAPIParam{{"webhook_url", openAPIType("string"), true,
+			"The new webhook URL, an empty string disables webhooks."},
+			webhookVersionParam},
+		openAPISchema{"type": "string", "nullable": true},
+		[]string{"ERR_INVALIDWEBHOOKURL", "ERR_WEBHOOKVERIFICATIONFAILED",
+			"ERR_INVALIDWEBHOOKVERSION"}},
+	{"GET", "/v3/webhook_secret",
+		"Returns the key used to sign webhook requests (if any).", true, nil,
+		openAPISchema{"type": "string", "nullable": true}, nil},
+	{"POST", "/v3/regenerate_webhook_secret",
+		"Replaces the webhook secret and returns the new one.", true, nil,
+		openAPIType("string"), nil},
+	{"GET", "/v3/webhook_deliveries",
+		"Returns recent webhook delivery attempts, newest first.", true, nil,
+		openAPIArray(openAPIRef("WebhookDelivery")), nil},
+	{"GET", "/v3/webhooks", "Returns the server's webhook endpoints.", true,
+		nil, openAPIArray(openAPIRef("WebhookEndpoint")), nil},
+	{"POST", "/v3/webhooks/add",
+		"Adds a webhook endpoint and returns it.", true,
+		[]openAPIParam{
+			{"url", openAPIType("string"), true, "The webhook URL."},
+			{"events", openAPIArray(openAPIType("string")), true,
+				"The events to send to the webhook (see " +
+					"/v3/capabilities)."},
+		},
+		openAPIRef("WebhookEndpoint"),
+		[]string{"ERR_INVALIDWEBHOOKURL", "ERR_WEBHOOKVERIFICATIONFAILED",
+			"ERR_INVALIDWEBHOOKEVENT", "ERR_TOOMANYWEBHOOKS"}},
+	{"POST", "/v3/webhooks/remove", "Removes a webhook endpoint.", true,
+		[]openAPIParam{{"id", openAPIType("string"), true,
+			"The ID of the webhook endpoint."}},
+		nil, []string{"ERR_WEBHOOKNOTFOUND"}},
+	{"GET", "/v3/reference_rate",
+		"Returns the external reference rate (if any).", false, nil,
+		openAPISchema{
+			"type": "object",
+			"properties": openAPISchema{
+				"currency": openAPIType("string"),
+				"rate":     openAPIType("number"),
+				"updated":  openAPIType("integer"),
+			},
+		}, nil},
+	{"GET", "/v3/version", "Returns the lurkcoin version.", false, nil,
+		openAPISchema{
+			"type": "object",
+			"properties": openAPISchema{
+				"version":   openAPIType("string"),
+				"copyright": openAPIArray(openAPIType("string")),
+				"license":   openAPIType("string"),
+				"source":    openAPIType("string"),
+			},
+		}, nil},
+}
+
+func openAPIOperationID(method, path string) string {
+	return strings.ToLower(method) + "_" +
+		strings.ReplaceAll(strings.Trim(path, "/"), "/", "_")
+}
+
+// Adds the response and error codes to the endpoint's description.
+func openAPIDescription(endpoint openAPIEndpoint) string {
+	if len(endpoint.errors) == 0 {
+		return endpoint.summary
+	}
+	return endpoint.summary + "\n\nErrors: " +
+		strings.Join(endpoint.errors, ", ")
+}
+
+func v3OpenAPIOperation(endpoint openAPIEndpoint) openAPISchema {
+	op := openAPISchema{
+		"operationId": openAPIOperationID(endpoint.method, endpoint.path),
+		"summary":     endpoint.summary,
+		"description": openAPIDescription(endpoint),
+		"tags":        []string{"v3"},
+	}
+	if endpoint.requireLogin {
+		op["security"] = []openAPISchema{{"basicAuth": []string{}}}
+	} else {
+		op["security"] = []openAPISchema{}
+	}
+
+	// Path parameters
+	var parameters []openAPISchema
+	for _, segment := range strings.Split(endpoint.path, "/") {
+		if strings.HasPrefix(segment, "{") {
+			parameters = append(parameters, openAPISchema{
+				"name":     strings.Trim(segment, "{}"),
+				"in":       "path",
+				"required": true,
+				"schema":   openAPIType("string"),
+			})
+		}
+	}
+
+	// GET endpoints use the query string.
+	if endpoint.method == "GET" {
+		for _, param := range endpoint.params {
+			parameters = append(parameters, openAPISchema{
+				"name":        param.name,
+				"in":          "query",
+				"required":    param.required,
+				"schema":      param.schema,
+				"description": param.description,
+			})
+		}
+	}
+	if parameters != nil {
+		op["parameters"] = parameters
+	}
+
+	if len(endpoint.params) > 0 && endpoint.method != "GET" {
+		properties := make(openAPISchema, len(endpoint.params))
+		var required []string
+		for _, param := range endpoint.params {
+			// OpenAPI 3.0 ignores siblings of $ref, so the schema is
+			// wrapped in allOf to keep the description.
+			properties[param.name] = openAPISchema{
+				"allOf":       []openAPISchema{param.schema},
+				"description": param.description,
+			}
+			if param.required {
+				required = append(required, param.name)
+			}
+		}
+		body := openAPISchema{"type": "object", "properties": properties}
+		if required != nil {
+			body["required"] = required
+		}
+		op["requestBody"] = openAPISchema{
+			"required": true,
+			"content": openAPISchema{
+				"application/json": openAPISchema{"schema": body},
+			},
+		}
+	}
+
+	result := endpoint.result
+	if result == nil {
+		result = openAPISchema{"nullable": true}
+	}
+	op["responses"] = openAPISchema{
+		"200": openAPISchema{
+			"description": "Success",
+			"content": openAPISchema{
+				"application/json": openAPISchema{
+					"schema": openAPISchema{
+						"type": "object",
+						"properties": openAPISchema{
+							"success": openAPISchema{"type": "boolean",
+								"enum": []bool{true}},
+							"result": result,
+						},
+					},
+				},
+			},
+		},
+		"default": openAPISchema{
+			"description": "Error",
+			"content": openAPISchema{
+				"application/json": openAPISchema{
+					"schema": openAPIRef("Error"),
+				},
+			},
+		},
+	}
+	return op
+}
+
+func v2OpenAPIOperation(endpoint openAPIEndpoint) openAPISchema {
+	params := endpoint.params
+	if endpoint.requireLogin {
+		params = append([]openAPIParam{
+			{"name", openAPIType("string"), true, "The server name."},
+			{"token", openAPIType("string"), true, "The API token."},
+		}, params...)
+	}
+	parameters := make([]openAPISchema, len(params))
+	for i, param := range params {
+		parameters[i] = openAPISchema{
+			"name":        param.name,
+			"in":          "query",
+			"required":    param.required,
+			"schema":      param.schema,
+			"description": param.description,
+		}
+	}
+
+	contentType := "application/json"
+	if endpoint.result["type"] == "string" {
+		contentType = "text/plain"
+	}
+	return openAPISchema{
+		"operationId": openAPIOperationID(endpoint.method, endpoint.path),
+		"summary":     endpoint.summary,
+		"description": openAPIDescription(endpoint) + "\n\nParameters " +
+			"can also be sent in a form-encoded or JSON request body.",
+		"tags":       []string{"v2"},
+		"deprecated": true,
+		"security":   []openAPISchema{},
+		"parameters": parameters,
+		"responses": openAPISchema{
+			"200": openAPISchema{
+				"description": "Success",
+				"content": openAPISchema{
+					contentType: openAPISchema{"schema": endpoint.result},
+				},
+			},
+			"default": openAPISchema{
+				"description": "An error message starting with \"ERROR: \"",
+				"content": openAPISchema{
+					"text/plain": openAPISchema{
+						"schema": openAPIType("string"),
+					},
+				},
+			},
+		},
+	}
+}
+
+// Generates the OpenAPI document for the APIs enabled in config.
+func makeOpenAPIDocument(config *Config) ([]byte, error) {
+	paths := make(openAPISchema)
+	addPaths := func(endpoints []openAPIEndpoint,
+		makeOperation func(openAPIEndpoint) openAPISchema) {
+		for _, endpoint := range endpoints {
+			path, ok := paths[endpoint.path].(openAPISchema)
+			if !ok {
+				path = make(openAPISchema)
+				paths[endpoint.path] = path
+			}
+			path[strings.ToLower(endpoint.method)] = makeOperation(endpoint)
+		}
+	}
+
+	var tags []openAPISchema
+	if config.MinAPIVersion <= 3 {
+		addPaths(v3OpenAPIEndpoints, v3OpenAPIOperation)
+		tags = append(tags, openAPISchema{"name": "v3",
+			"description": "Version 3 of the API. Endpoints that use GET " +
+				"also accept POST."})
+	}
+	if config.MinAPIVersion <= 2 && len(v2OpenAPIEndpoints) > 0 {
+		addPaths(v2OpenAPIEndpoints, v2OpenAPIOperation)
+		tags = append(tags, openAPISchema{"name": "v2",
+			"description": "The legacy lurkcoinV2 API. Endpoints also " +
+				"accept GET."})
+	}
+
+	return json.MarshalIndent(openAPISchema{
+		"openapi": "3.0.3",
+		"info": openAPISchema{
+			"title":   config.Name + " (lurkcoin)",
+			"version": lurkcoin.VERSION,
+			"license": openAPISchema{
+				"name": "AGPLv3",
+				"url":  "https://www.gnu.org/licenses/agpl-3.0.html",
+			},
+		},
+		"externalDocs": openAPISchema{
+			"description": "Source code",
+			"url":         lurkcoin.SOURCE_URL,
+		},
+		"tags":       tags,
+		"paths":      paths,
+		"components": openAPIComponents,
+	}, "", "  ")
+}
+
+var swaggerUITemplate = template.Must(template.New("swagger-ui").Parse(
+	`<!DOCTYPE html>
+<html>
+<head>
+	<meta charset="utf-8" />
+	<meta name="viewport" content="width=device-width, initial-scale=1" />
+	<title>{{.}} API documentation</title>
+	<link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css" />
+</head>
+<body>
+	<div id="swagger-ui"></div>
+	<script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js"></script>
+	<script>
+		SwaggerUIBundle({url: "openapi.json", dom_id: "#swagger-ui"});
+	</script>
+</body>
+</html>
+`))
+
+// Serves the OpenAPI document at /v3/openapi.json and (optionally) Swagger UI
+// at /v3/docs.
+func addOpenAPIPages(router *httprouter.Router, config *Config) {
+	doc, err := makeOpenAPIDocument(config)
+	if err != nil {
+		panic(err)
+	}
+
+	router.GET("/v3/openapi.json", func(w http.ResponseWriter,
+		r *http.Request, _ httprouter.Params) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Write(doc)
+	})
+
+	if !config.SwaggerUI {
+		return
+	}
+	router.GET("/v3/docs", func(w http.ResponseWriter, r *http.Request,
+		_ httprouter.Params) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		swaggerUITemplate.Execute(w, config.Name)
+	})
+}
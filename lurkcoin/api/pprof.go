@@ -0,0 +1,53 @@
+//
+// lurkcoin profiling endpoints
+// Copyright © 2020 by luk3yx
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package api
+
+import (
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"net/http/pprof"
+)
+
+type adminAuthenticator func(http.ResponseWriter, *http.Request) (string, bool)
+
+// Adds net/http/pprof's handlers to the router. Importing net/http/pprof also
+// registers these on http.DefaultServeMux, however lurkcoin doesn't use that.
+func addPprofPages(router *httprouter.Router, authenticate adminAuthenticator) {
+	f := func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+		if _, ok := authenticate(w, r); !ok {
+			return
+		}
+
+		// pprof.Index() also serves named profiles such as "heap".
+		switch params.ByName("item") {
+		case "/cmdline":
+			pprof.Cmdline(w, r)
+		case "/profile":
+			pprof.Profile(w, r)
+		case "/symbol":
+			pprof.Symbol(w, r)
+		case "/trace":
+			pprof.Trace(w, r)
+		default:
+			pprof.Index(w, r)
+		}
+	}
+	router.GET("/debug/pprof/*item", f)
+	router.POST("/debug/pprof/*item", f)
+}
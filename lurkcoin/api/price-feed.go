@@ -0,0 +1,184 @@
+//
+// lurkcoin: External price feeds
+// Copyright © 2020 by luk3yx
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/luk3yx/lurkcoin-core/lurkcoin"
+	"github.com/luk3yx/lurkcoin-core/lurkcoin/metrics"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var priceFeedClient = &http.Client{Timeout: 10 * time.Second}
+
+var priceFeedUpdates = metrics.NewCounterVec(
+	"lurkcoin_price_feed_updates_total",
+	"The number of attempts to fetch the external reference rate.",
+	"result",
+)
+
+func init() {
+	metrics.NewGaugeFunc("lurkcoin_reference_rate",
+		"The value of one lurkcoin in the reference currency.",
+		func() []metrics.Sample {
+			rate := lurkcoin.GetReferenceRate()
+			if rate == nil {
+				return nil
+			}
+			return []metrics.Sample{{Value: rate.Rate}}
+		})
+	metrics.NewGaugeFunc("lurkcoin_money_supply_reference",
+		"The sum of every server's balance in the reference currency.",
+		func() []metrics.Sample {
+			rate := lurkcoin.GetReferenceRate()
+			if rate == nil {
+				return nil
+			}
+			stats, ok := getEconomyStats()
+			if !ok || stats.TotalSupply.IsNil() {
+				return nil
+			}
+			supply, _ := stats.TotalSupply.Float().Float64()
+			return []metrics.Sample{{Value: supply * rate.Rate}}
+		})
+}
+
+// Looks up a dot-separated path (such as "data.rates.0.price") in decoded
+// JSON and returns the number there. Numbers stored as strings are accepted.
+func lookupPriceFeedField(data interface{}, path string) (float64, error) {
+	if path != "" {
+		for _, key := range strings.Split(path, ".") {
+			switch v := data.(type) {
+			case map[string]interface{}:
+				data = v[key]
+			case []interface{}:
+				i, err := strconv.Atoi(key)
+				if err != nil || i < 0 || i >= len(v) {
+					return 0, fmt.Errorf("Invalid array index: %q", key)
+				}
+				data = v[i]
+			default:
+				return 0, fmt.Errorf("Field not found: %q", path)
+			}
+		}
+	}
+
+	switch v := data.(type) {
+	case float64:
+		return v, nil
+	case string:
+		return strconv.ParseFloat(v, 64)
+	}
+	return 0, fmt.Errorf("Field %q is not a number", path)
+}
+
+type priceFeed struct {
+	url      string
+	field    string
+	currency string
+	invert   bool
+}
+
+// Fetches the current rate and updates the reference rate.
+func (self *priceFeed) update() error {
+	req, err := http.NewRequest("GET", self.url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", "lurkcoin/"+lurkcoin.VERSION)
+	res, err := priceFeedClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("HTTP status code %d", res.StatusCode)
+	}
+
+	var data interface{}
+	err = json.NewDecoder(io.LimitReader(res.Body, 1024*1024)).Decode(&data)
+	if err != nil {
+		return err
+	}
+	rate, err := lookupPriceFeedField(data, self.field)
+	if err != nil {
+		return err
+	}
+	if self.invert && rate != 0 {
+		rate = 1 / rate
+	}
+	if !(rate > 0) || rate > 1e15 {
+		return fmt.Errorf("Invalid rate: %v", rate)
+	}
+
+	lurkcoin.SetReferenceRate(self.currency, rate, time.Now())
+	return nil
+}
+
+func (self *priceFeed) run(interval time.Duration) {
+	for {
+		if err := self.update(); err == nil {
+			priceFeedUpdates.Inc("success")
+		} else {
+			priceFeedUpdates.Inc("error")
+			lurkcoin.LogWarning("Could not fetch reference rate", "error",
+				err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+func setupPriceFeed(config *Config) error {
+	c := config.PriceFeed
+	if c.URL == "" && c.Rate == 0 {
+		return nil
+	}
+	if c.Currency == "" {
+		return errors.New("price_feed requires currency to be set.")
+	}
+
+	// Fixed rates don't need to be fetched.
+	if c.URL == "" {
+		if c.Rate < 0 {
+			return errors.New("Invalid price_feed rate.")
+		}
+		lurkcoin.SetReferenceRate(c.Currency, c.Rate, time.Now())
+		return nil
+	}
+
+	interval := 10 * time.Minute
+	if c.Interval != "" {
+		var err error
+		interval, err = time.ParseDuration(c.Interval)
+		if err != nil || interval < time.Minute {
+			return fmt.Errorf("Invalid price_feed interval: %q", c.Interval)
+		}
+	}
+
+	feed := &priceFeed{c.URL, c.Field, c.Currency, c.Invert}
+	go feed.run(interval)
+	return nil
+}
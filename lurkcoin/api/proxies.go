@@ -0,0 +1,161 @@
+//
+// lurkcoin trusted reverse proxies
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package api
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+type clientIPKey struct{}
+type trustedProxyKey struct{}
+
+// A list of reverse proxies that are trusted to set the X-Forwarded-For and
+// X-Real-IP headers.
+type trustedProxies struct {
+	networks []*net.IPNet
+
+	// Trusts connections made over UNIX sockets.
+	unix bool
+}
+
+// Parses a list of IP addresses and CIDR ranges. "unix" trusts connections
+// made over UNIX domain sockets.
+func parseTrustedProxies(proxies []string) (*trustedProxies, error) {
+	if len(proxies) == 0 {
+		return nil, nil
+	}
+	res := &trustedProxies{}
+	for _, proxy := range proxies {
+		if proxy == "unix" {
+			res.unix = true
+			continue
+		}
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return nil, fmt.Errorf("Invalid trusted proxy: %q", proxy)
+			}
+			bits := 8 * net.IPv4len
+			if ip.To4() == nil {
+				bits = 8 * net.IPv6len
+			}
+			res.networks = append(res.networks,
+				&net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid trusted proxy: %q", proxy)
+		}
+		res.networks = append(res.networks, network)
+	}
+	return res, nil
+}
+
+func (self *trustedProxies) trustsIP(ip net.IP) bool {
+	for _, network := range self.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the host part of r.RemoteAddr, this is "" or "@" for UNIX sockets.
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Returns true if the request was made directly by a trusted proxy.
+func (self *trustedProxies) trustsRemote(r *http.Request) bool {
+	host := remoteHost(r)
+	if host == "" || host == "@" {
+		return self.unix
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && self.trustsIP(ip)
+}
+
+// Gets the client's IP address. If the request came from a trusted proxy,
+// the rightmost address in X-Forwarded-For that isn't a trusted proxy is
+// used.
+func (self *trustedProxies) clientIP(r *http.Request) string {
+	host := remoteHost(r)
+	if !self.trustsRemote(r) {
+		return host
+	}
+
+	if forwardedFor := r.Header["X-Forwarded-For"]; len(forwardedFor) > 0 {
+		addrs := strings.Split(strings.Join(forwardedFor, ","), ",")
+		for i := len(addrs) - 1; i >= 0; i-- {
+			ip := net.ParseIP(strings.TrimSpace(addrs[i]))
+			if ip == nil {
+				break
+			}
+			host = ip.String()
+			if !self.trustsIP(ip) {
+				break
+			}
+		}
+		return host
+	}
+
+	realIP := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP")))
+	if realIP != nil {
+		return realIP.String()
+	}
+	return host
+}
+
+// Gets the IP address of the client that made a request, taking trusted
+// proxies into account. This is "" or "@" for UNIX sockets.
+func getClientIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(clientIPKey{}).(string); ok {
+		return ip
+	}
+	return remoteHost(r)
+}
+
+func wrapTrustedProxies(handler http.Handler,
+	proxies *trustedProxies) http.Handler {
+	if proxies == nil {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), clientIPKey{},
+			proxies.clientIP(r))
+		ctx = context.WithValue(ctx, trustedProxyKey{},
+			proxies.trustsRemote(r))
+		handler.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// Returns true if the request was made by a trusted proxy, so that headers
+// like X-Forwarded-Proto can be trusted.
+func isFromTrustedProxy(r *http.Request) bool {
+	trusted, _ := r.Context().Value(trustedProxyKey{}).(bool)
+	return trusted
+}
@@ -0,0 +1,141 @@
+//
+// lurkcoin public statistics page
+// Copyright © 2020 by luk3yx
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package api
+
+import (
+	"encoding/json"
+	"github.com/julienschmidt/httprouter"
+	"github.com/luk3yx/lurkcoin-core/lurkcoin"
+	"html/template"
+	"net/http"
+)
+
+type publicStats struct {
+	Name         string                       `json:"name"`
+	Servers      int                          `json:"servers"`
+	TotalSupply  lurkcoin.Currency            `json:"total_supply"`
+	Transactions int                          `json:"transactions_24h"`
+	Volume       lurkcoin.Currency            `json:"volume_24h"`
+	HourlyVolume []lurkcoin.TransactionVolume `json:"hourly_volume"`
+}
+
+// Only aggregate statistics are included, so this doesn't reveal anything
+// about individual servers or transactions.
+func getPublicStats(name string) (publicStats, bool) {
+	economy, ok := getEconomyStats()
+	if !ok {
+		return publicStats{}, false
+	}
+	stats := publicStats{
+		Name:         name,
+		Servers:      economy.Servers,
+		TotalSupply:  economy.TotalSupply,
+		Volume:       lurkcoin.CurrencyFromInt64(0),
+		HourlyVolume: lurkcoin.GetRecentTransactionVolume(),
+	}
+	for _, hour := range stats.HourlyVolume {
+		stats.Transactions += hour.Transactions
+		stats.Volume = stats.Volume.Add(hour.Volume)
+	}
+	return stats, true
+}
+
+var publicStatsTemplate = template.Must(template.New("stats").Parse(
+	`<!DOCTYPE html>
+<html>
+<head>
+	<title>{{.Name}} statistics</title>
+	<link rel="stylesheet" href="https://cdnjs.cloudflare.com/ajax/libs/skeleton/2.0.4/skeleton.min.css" />
+	<meta name="viewport" content="width=device-width" />
+	<meta http-equiv="refresh" content="300" />
+</head>
+<body>
+<main style="padding: 1.5em;">
+<h2>{{.Name}} statistics</h2>
+<table>
+	<tbody>
+		<tr><th>Servers</th><td>{{.Servers}}</td></tr>
+		<tr><th>Total supply</th><td>{{.TotalSupply}}</td></tr>
+		<tr>
+			<th>Transactions (last 24 hours)</th>
+			<td>{{.Transactions}}</td>
+		</tr>
+		<tr><th>Volume (last 24 hours)</th><td>{{.Volume}}</td></tr>
+	</tbody>
+</table>
+<h4>Hourly volume</h4>
+<table>
+	<thead>
+		<tr>
+			<th>Hour (UTC)</th>
+			<th>Transactions</th>
+			<th>Volume</th>
+		</tr>
+	</thead>
+	<tbody>
+		{{range .HourlyVolume}}
+			<tr>
+				<td>{{.GetStart.UTC.Format "2006-01-02 15:04"}}</td>
+				<td>{{.Transactions}}</td>
+				<td>{{.Volume}}</td>
+			</tr>
+		{{end}}
+	</tbody>
+</table>
+<i>
+	Only transactions made since lurkcoin was last restarted are counted.
+	These statistics are also available as <a href="/stats.json">JSON</a>.
+</i>
+</main>
+</body>
+</html>
+`))
+
+// The statistics page is available at /stats and /stats.json.
+func addPublicStatsPages(router *httprouter.Router, name string) {
+	if name == "" {
+		name = "lurkcoin"
+	}
+
+	router.GET("/stats", func(w http.ResponseWriter, r *http.Request,
+		_ httprouter.Params) {
+		stats, ok := getPublicStats(name)
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if !ok {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		publicStatsTemplate.Execute(w, stats)
+	})
+
+	router.GET("/stats.json", func(w http.ResponseWriter, r *http.Request,
+		_ httprouter.Params) {
+		stats, ok := getPublicStats(name)
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		if !ok {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			json.NewEncoder(w).Encode(map[string]string{
+				"error": "Statistics are unavailable.",
+			})
+			return
+		}
+		json.NewEncoder(w).Encode(stats)
+	})
+}
@@ -0,0 +1,175 @@
+//
+// lurkcoin API rate limiting
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"github.com/luk3yx/lurkcoin-core/lurkcoin"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const rateLimitWindow = time.Minute
+
+type rateLimitCounter struct {
+	start time.Time
+	count int
+}
+
+// A fixed window rate limiter, each key can make up to limit requests per
+// minute.
+type rateLimiter struct {
+	lock      sync.Mutex
+	limit     int
+	counters  map[string]*rateLimitCounter
+	lastPurge time.Time
+}
+
+func newRateLimiter(limit int) *rateLimiter {
+	if limit <= 0 {
+		return nil
+	}
+	return &rateLimiter{limit: limit,
+		counters: make(map[string]*rateLimitCounter)}
+}
+
+// Counts a request and returns the number of requests remaining, the time
+// until the limit is reset and whether the request is allowed. If create is
+// false and key doesn't have a counter yet, nothing is counted and the last
+// value returned is false.
+func (self *rateLimiter) allow(key string, create bool) (int, time.Duration,
+	bool, bool) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	now := time.Now()
+	if now.Sub(self.lastPurge) > rateLimitWindow {
+		for k, counter := range self.counters {
+			if now.Sub(counter.start) >= rateLimitWindow {
+				delete(self.counters, k)
+			}
+		}
+		self.lastPurge = now
+	}
+
+	counter, ok := self.counters[key]
+	if !ok || now.Sub(counter.start) >= rateLimitWindow {
+		if !create {
+			return 0, 0, false, false
+		}
+		counter = &rateLimitCounter{start: now}
+		self.counters[key] = counter
+	}
+	reset := counter.start.Add(rateLimitWindow).Sub(now)
+	if counter.count >= self.limit {
+		return 0, reset, false, true
+	}
+	counter.count++
+	return self.limit - counter.count, reset, true, true
+}
+
+// Creates a counter for key if there isn't one already.
+func (self *rateLimiter) add(key string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	counter, ok := self.counters[key]
+	if !ok || time.Since(counter.start) >= rateLimitWindow {
+		self.counters[key] = &rateLimitCounter{start: time.Now()}
+	}
+}
+
+// The rate limiters are set in MakeHTTPRouter() and are nil if disabled.
+var rateLimiters struct {
+	sync.RWMutex
+	authenticated, unauthenticated *rateLimiter
+}
+
+func setRateLimits(config *Config) {
+	rateLimiters.Lock()
+	defer rateLimiters.Unlock()
+	rateLimiters.authenticated = newRateLimiter(
+		config.RateLimits.Authenticated)
+	rateLimiters.unauthenticated = newRateLimiter(
+		config.RateLimits.Unauthenticated)
+}
+
+func rateLimitKey(username, token string) string {
+	if username == "" && token == "" {
+		return ""
+	}
+	h := sha256.Sum256([]byte(lurkcoin.HomogeniseUsername(username) +
+		"\x00" + token))
+	return "token:" + hex.EncodeToString(h[:16])
+}
+
+// Checks the rate limit for a request and sets the X-RateLimit-* headers.
+// Requests with a token are limited per token (so that servers behind the
+// same IP address don't share a limit), but only once the token has been
+// checked by authenticating. Other requests, including the first request
+// made with each token in every rate limit window, are limited per IP
+// address so that random tokens can't be used to avoid the limit.
+func (self *HTTPRequest) checkRateLimit(w http.ResponseWriter, username,
+	token string) error {
+	rateLimiters.RLock()
+	limiter := rateLimiters.authenticated
+	rateLimiters.RUnlock()
+
+	var remaining int
+	var reset time.Duration
+	ok, found := false, false
+	self.rateLimitKey = rateLimitKey(username, token)
+	if limiter != nil && self.rateLimitKey != "" {
+		remaining, reset, ok, found = limiter.allow(self.rateLimitKey, false)
+	}
+	if !found {
+		rateLimiters.RLock()
+		limiter = rateLimiters.unauthenticated
+		rateLimiters.RUnlock()
+		if limiter == nil {
+			return nil
+		}
+		remaining, reset, ok, _ = limiter.allow("ip:"+
+			getClientIP(self.Request), true)
+	}
+
+	resetSeconds := strconv.Itoa(int((reset + time.Second - 1) / time.Second))
+	h := w.Header()
+	h.Set("X-RateLimit-Limit", strconv.Itoa(limiter.limit))
+	h.Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+	h.Set("X-RateLimit-Reset", resetSeconds)
+	if !ok {
+		h.Set("Retry-After", resetSeconds)
+		return errors.New("ERR_RATELIMITED")
+	}
+	return nil
+}
+
+// Called once the request's token has been checked, later requests with the
+// token use the per-token limit.
+func (self *HTTPRequest) trustRateLimitKey() {
+	rateLimiters.RLock()
+	limiter := rateLimiters.authenticated
+	rateLimiters.RUnlock()
+	if limiter != nil && self.rateLimitKey != "" {
+		limiter.add(self.rateLimitKey)
+	}
+}
@@ -0,0 +1,76 @@
+//
+// lurkcoin HTTP panic recovery
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/luk3yx/lurkcoin-core/lurkcoin"
+	"github.com/luk3yx/lurkcoin-core/lurkcoin/metrics"
+	"io"
+	"net/http"
+	"runtime/debug"
+	"strings"
+)
+
+var httpPanics = metrics.NewCounterVec(
+	"lurkcoin_http_panics_total",
+	"The number of HTTP requests that panicked.",
+	"area",
+)
+
+// Called by httprouter (from a deferred function) when a handler panics.
+// Database transactions are aborted by the handlers' own deferred calls, so
+// this only has to log the panic and send an error response. If the handler
+// has already started writing its response the error may not be visible.
+func handlePanic(w http.ResponseWriter, r *http.Request, v interface{}) {
+	area := "api"
+	if strings.HasPrefix(r.URL.Path, "/admin") {
+		area = "admin"
+	} else if strings.HasPrefix(r.URL.Path, "/v2/") {
+		area = "v2"
+	}
+	httpPanics.Inc(area)
+
+	requestLogger(r).Error("Recovered from panic", "panic", fmt.Sprint(v),
+		"method", r.Method, "path", r.URL.Path, "stack", string(debug.Stack()))
+	lurkcoin.ReportPanic(v, map[string]string{
+		"component": "http",
+		"path":      r.URL.Path,
+	})
+
+	switch area {
+	case "admin":
+		writeAdminErrorPage(w, "Internal error!")
+	case "v2":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, "ERROR: Internal error! (request ID: "+
+			getRequestID(r)+")")
+	default:
+		_, msg, code := lurkcoin.LookupError("ERR_INTERNALERROR")
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success":    false,
+			"error":      "ERR_INTERNALERROR",
+			"message":    msg,
+			"request_id": getRequestID(r),
+		})
+	}
+}
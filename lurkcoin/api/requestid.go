@@ -0,0 +1,67 @@
+//
+// lurkcoin request IDs
+// Copyright © 2020 by luk3yx
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"github.com/luk3yx/lurkcoin-core/lurkcoin"
+	"net/http"
+	"regexp"
+)
+
+type requestIDKey struct{}
+
+// Client-provided request IDs are only used if they match this.
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9\-_.:]{1,64}$`)
+
+func generateRequestID() string {
+	raw := make([]byte, 12)
+	if _, err := rand.Read(raw); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+// Gets the request ID of a request, or an empty string if the request has not
+// been passed through wrapRequestID().
+func getRequestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	return id
+}
+
+// Returns a logger that adds the request ID to log messages.
+func requestLogger(r *http.Request) *lurkcoin.Logger {
+	return lurkcoin.NewLogger(getRequestID(r))
+}
+
+// Assigns each request an ID, if the X-Request-ID header is sent by a client
+// (or reverse proxy) then it is used instead.
+func wrapRequestID(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID.MatchString(id) {
+			id = generateRequestID()
+		}
+		w.Header().Set("X-Request-ID", id)
+		ctx := context.WithValue(r.Context(), requestIDKey{}, id)
+		handler.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
@@ -0,0 +1,40 @@
+//
+// lurkcoin graceful restarts
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+// +build windows
+
+package api
+
+import (
+	"errors"
+	"net"
+	"os"
+)
+
+var restartSignals []os.Signal
+
+func inheritedListener(string) (net.Listener, bool, error) {
+	return nil, false, nil
+}
+
+func listenerFiles([]net.Listener) ([]*os.File, error) {
+	return nil, errors.New("Restarting is not supported on Windows.")
+}
+
+func restartProcess([]string, []*os.File) error {
+	return errors.New("Restarting is not supported on Windows.")
+}
@@ -0,0 +1,124 @@
+//
+// lurkcoin graceful restarts
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+// +build !windows
+
+package api
+
+import (
+	"fmt"
+	"github.com/luk3yx/lurkcoin-core/lurkcoin"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// Sending this signal to lurkcoin makes it restart itself (for example after
+// the binary has been upgraded) without closing its listeners.
+var restartSignals = []os.Signal{syscall.SIGUSR2}
+
+// The names of listeners passed to a restarted process, the listeners are
+// file descriptors 3, 4, etc in the same order.
+const inheritedListenersEnv = "LURKCOIN_LISTENERS"
+
+// The executable is looked up on startup as /proc/self/exe points to the old
+// (deleted) binary after an upgrade.
+var executablePath, _ = os.Executable()
+
+var inheritedListeners struct {
+	once  sync.Once
+	files map[string]*os.File
+}
+
+// Returns a listener passed from the previous process (if any).
+func inheritedListener(name string) (net.Listener, bool, error) {
+	inheritedListeners.once.Do(func() {
+		inheritedListeners.files = make(map[string]*os.File)
+		names := os.Getenv(inheritedListenersEnv)
+		os.Unsetenv(inheritedListenersEnv)
+		if names == "" {
+			return
+		}
+		for i, name := range strings.Split(names, ",") {
+			inheritedListeners.files[name] = os.NewFile(uintptr(3+i), name)
+		}
+	})
+
+	f, ok := inheritedListeners.files[name]
+	if !ok {
+		return nil, false, nil
+	}
+	delete(inheritedListeners.files, name)
+	defer f.Close()
+	ln, err := net.FileListener(f)
+	return ln, true, err
+}
+
+// Duplicates the listeners' file descriptors so that they stay open after
+// the listeners are closed.
+func listenerFiles(listeners []net.Listener) ([]*os.File, error) {
+	files := make([]*os.File, len(listeners))
+	for i, ln := range listeners {
+		var err error
+		switch ln := ln.(type) {
+		case *net.TCPListener:
+			files[i], err = ln.File()
+		case *net.UnixListener:
+			// Don't delete the socket file when the listener is closed.
+			ln.SetUnlinkOnClose(false)
+			files[i], err = ln.File()
+		default:
+			err = fmt.Errorf("Unsupported listener type: %T", ln)
+		}
+		if err != nil {
+			for _, f := range files[:i] {
+				f.Close()
+			}
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// Starts a new lurkcoin process with the same arguments that inherits the
+// listeners in files.
+func restartProcess(names []string, files []*os.File) error {
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	if executablePath == "" {
+		return fmt.Errorf("Could not find the lurkcoin executable")
+	}
+	cmd := exec.Command(executablePath, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(os.Environ(),
+		inheritedListenersEnv+"="+strings.Join(names, ","))
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	lurkcoin.LogInfo("Started new lurkcoin process", "pid", cmd.Process.Pid)
+	return cmd.Process.Release()
+}
@@ -0,0 +1,191 @@
+//
+// lurkcoin runtime statistics
+// Copyright © 2020 by luk3yx
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package api
+
+import (
+	"encoding/json"
+	"github.com/julienschmidt/httprouter"
+	"github.com/luk3yx/lurkcoin-core/lurkcoin"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var startTime = time.Now()
+
+// The number of open HTTP connections, updated by trackConnState().
+var openConnections int64
+
+// Connections that haven't sent a request yet.
+var newConnectionsLock sync.Mutex
+var newConnections = make(map[net.Conn]struct{})
+
+func trackConnState(conn net.Conn, state http.ConnState) {
+	switch state {
+	case http.StateNew:
+		atomic.AddInt64(&openConnections, 1)
+	case http.StateHijacked, http.StateClosed:
+		atomic.AddInt64(&openConnections, -1)
+	}
+
+	newConnectionsLock.Lock()
+	if state == http.StateNew {
+		newConnections[conn] = struct{}{}
+	} else {
+		delete(newConnections, conn)
+	}
+	newConnectionsLock.Unlock()
+}
+
+// Waits until every connection has started sending a request (or timeout
+// elapses). http.Server.Shutdown() closes connections that send a request
+// after it is called without a response.
+func waitForNewConnections(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		newConnectionsLock.Lock()
+		n := len(newConnections)
+		newConnectionsLock.Unlock()
+		if n == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+type runtimeStats struct {
+	Uptime          float64             `json:"uptime"`
+	Goroutines      int                 `json:"goroutines"`
+	HeapAlloc       uint64              `json:"heap_alloc"`
+	HeapInuse       uint64              `json:"heap_inuse"`
+	Sys             uint64              `json:"sys"`
+	NumGC           uint32              `json:"num_gc"`
+	OpenConnections int64               `json:"open_connections"`
+	WebhookQueue    int                 `json:"webhook_queue"`
+	DatabaseLocks   *lurkcoin.LockStats `json:"database_locks"`
+}
+
+func getRuntimeStats(db lurkcoin.Database) (stats runtimeStats) {
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+	stats.Uptime = time.Since(startTime).Seconds()
+	stats.Goroutines = runtime.NumGoroutine()
+	stats.HeapAlloc = memStats.HeapAlloc
+	stats.HeapInuse = memStats.HeapInuse
+	stats.Sys = memStats.Sys
+	stats.NumGC = memStats.NumGC
+	stats.OpenConnections = atomic.LoadInt64(&openConnections)
+	stats.WebhookQueue = lurkcoin.GetWebhookQueueLength()
+	if lockDb, ok := db.(lurkcoin.LockStatsDatabase); ok {
+		lockStats := lockDb.GetLockStats()
+		stats.DatabaseLocks = &lockStats
+	}
+	return
+}
+
+// The page is static and uses JavaScript to fetch /admin/runtime.json.
+const runtimeStatsPage = adminPagesHeader + `
+<a href="/admin">Go back</a>
+<h2>Runtime statistics</h2>
+<noscript>
+	<h4>JavaScript is required to view runtime statistics.</h4>
+</noscript>
+<table>
+	<tbody id="stats"></tbody>
+</table>
+<i id="updated"></i>
+<script>
+	"use strict";
+	const labels = {
+		uptime: ["Uptime", n => Math.floor(n / 3600) + "h " +
+			Math.floor(n / 60 % 60) + "m " + Math.floor(n % 60) + "s"],
+		goroutines: ["Goroutines", String],
+		heap_alloc: ["Heap (allocated)", mib],
+		heap_inuse: ["Heap (in use)", mib],
+		sys: ["Memory obtained from the OS", mib],
+		num_gc: ["Garbage collections", String],
+		open_connections: ["Open connections", String],
+		webhook_queue: ["Webhook queue length", String],
+		database_locks: ["Database locks", n => n === null ? "Unknown" :
+			n.held + " held, " + n.waiting + " waiting"],
+	};
+	function mib(n) {
+		return (n / 1048576).toFixed(2) + " MiB";
+	}
+	async function update() {
+		try {
+			const res = await fetch("/admin/runtime.json", {
+				credentials: "same-origin",
+			});
+			const stats = await res.json();
+			const tbody = document.getElementById("stats");
+			tbody.textContent = "";
+			for (const key in labels) {
+				const tr = document.createElement("tr");
+				const name = document.createElement("th");
+				name.textContent = labels[key][0];
+				const value = document.createElement("td");
+				value.textContent = labels[key][1](stats[key]);
+				tr.appendChild(name);
+				tr.appendChild(value);
+				tbody.appendChild(tr);
+			}
+			document.getElementById("updated").textContent =
+				"Last updated: " + new Date().toLocaleTimeString();
+		} catch (e) {
+			document.getElementById("updated").textContent =
+				"Could not update statistics: " + e;
+		}
+	}
+	update();
+	window.setInterval(update, 2000);
+</script>
+` + adminPagesFooter
+
+func addRuntimeStatsPages(router *httprouter.Router, db lurkcoin.Database,
+	authenticate adminAuthenticator) {
+	page, _, err := adminTemplates.source("runtime-stats", runtimeStatsPage)
+	if err != nil {
+		log.Fatal(err)
+	}
+	router.GET("/admin/runtime", func(w http.ResponseWriter,
+		r *http.Request, _ httprouter.Params) {
+		if _, ok := authenticate(w, r); !ok {
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		io.WriteString(w, page)
+	})
+
+	router.GET("/admin/runtime.json", func(w http.ResponseWriter,
+		r *http.Request, _ httprouter.Params) {
+		if _, ok := authenticate(w, r); !ok {
+			return
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(getRuntimeStats(db))
+	})
+}
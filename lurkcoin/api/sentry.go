@@ -0,0 +1,157 @@
+//
+// lurkcoin Sentry integration
+// Copyright © 2020 by luk3yx
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package api
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/luk3yx/lurkcoin-core/lurkcoin"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// A minimal Sentry client that uses the "store" endpoint directly, so that
+// the Sentry SDK isn't required.
+type sentryReporter struct {
+	storeURL    string
+	authHeader  string
+	environment string
+	serverName  string
+	client      *http.Client
+}
+
+func newSentryReporter(dsn, environment string) (*sentryReporter, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, err
+	}
+	if u.User == nil || u.User.Username() == "" {
+		return nil, errors.New("The Sentry DSN does not contain a key.")
+	}
+
+	// The project ID is the last path component.
+	path := strings.TrimSuffix(u.Path, "/")
+	i := strings.LastIndexByte(path, '/')
+	if i < 0 || i == len(path)-1 {
+		return nil, errors.New("The Sentry DSN does not contain a project ID.")
+	}
+	projectID := path[i+1:]
+	storeURL := &url.URL{Scheme: u.Scheme, Host: u.Host,
+		Path: path[:i] + "/api/" + projectID + "/store/"}
+
+	authHeader := "Sentry sentry_version=7, sentry_client=lurkcoin/" +
+		lurkcoin.VERSION + ", sentry_key=" + u.User.Username()
+	if secret, ok := u.User.Password(); ok {
+		authHeader += ", sentry_secret=" + secret
+	}
+
+	hostname, _ := os.Hostname()
+	return &sentryReporter{storeURL.String(), authHeader, environment,
+		hostname, &http.Client{Timeout: 10 * time.Second}}, nil
+}
+
+type sentryFrame struct {
+	Filename string `json:"filename"`
+	Function string `json:"function"`
+	Lineno   int    `json:"lineno"`
+	InApp    bool   `json:"in_app"`
+}
+
+func (self *sentryReporter) Report(report *lurkcoin.ErrorReport) {
+	eventID := make([]byte, 16)
+	rand.Read(eventID)
+
+	// Sentry expects the outermost frame first.
+	frames := make([]sentryFrame, len(report.Stack))
+	for i, frame := range report.Stack {
+		frames[len(frames)-i-1] = sentryFrame{
+			frame.File,
+			frame.Function,
+			frame.Line,
+			strings.HasPrefix(frame.Function, "github.com/luk3yx/"),
+		}
+	}
+
+	event := map[string]interface{}{
+		"event_id":    hex.EncodeToString(eventID),
+		"timestamp":   report.Time.UTC().Format("2006-01-02T15:04:05"),
+		"level":       "error",
+		"platform":    "go",
+		"logger":      "lurkcoin",
+		"release":     "lurkcoin@" + lurkcoin.VERSION,
+		"server_name": self.serverName,
+		"tags":        report.Tags,
+		"exception": map[string]interface{}{
+			"values": []map[string]interface{}{{
+				"type":       report.Type,
+				"value":      report.Message,
+				"stacktrace": map[string]interface{}{"frames": frames},
+			}},
+		},
+	}
+	if self.environment != "" {
+		event["environment"] = self.environment
+	}
+
+	raw, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+
+	// Don't block the caller.
+	go func() {
+		req, err := http.NewRequest("POST", self.storeURL, bytes.NewReader(raw))
+		if err != nil {
+			return
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Sentry-Auth", self.authHeader)
+		res, err := self.client.Do(req)
+		if err != nil {
+			lurkcoin.LogWarning("Could not send error report to Sentry",
+				"error", err)
+			return
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			lurkcoin.LogWarning("Could not send error report to Sentry",
+				"status", res.StatusCode)
+		}
+	}()
+}
+
+func setupErrorReporting(config *Config) error {
+	if config.ErrorReporting.SentryDSN == "" {
+		return nil
+	}
+	reporter, err := newSentryReporter(config.ErrorReporting.SentryDSN,
+		config.ErrorReporting.Environment)
+	if err != nil {
+		return fmt.Errorf("Invalid Sentry DSN: %s", err)
+	}
+	lurkcoin.SetErrorReporter(reporter)
+	return nil
+}
@@ -0,0 +1,327 @@
+//
+// lurkcoin database snapshots
+// Copyright © 2020 by luk3yx
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/julienschmidt/httprouter"
+	"github.com/luk3yx/lurkcoin-core/lurkcoin"
+	"github.com/luk3yx/lurkcoin-core/lurkcoin/databases"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const snapshotPrefix = "lurkcoin-"
+const snapshotSuffix = ".db"
+const snapshotTimeFormat = "20060102-150405.000"
+
+type Snapshot struct {
+	Name string `json:"name"`
+	Time int64  `json:"time"`
+	Size int64  `json:"size"`
+}
+
+// Parses the time in a snapshot's file name.
+func parseSnapshotName(name string) (time.Time, bool) {
+	if !strings.HasPrefix(name, snapshotPrefix) ||
+		!strings.HasSuffix(name, snapshotSuffix) {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(snapshotTimeFormat,
+		name[len(snapshotPrefix):len(name)-len(snapshotSuffix)])
+	return t, err == nil
+}
+
+// Lists the snapshots in a directory, newest first.
+func ListSnapshots(dir string) ([]Snapshot, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	snapshots := []Snapshot{}
+	for _, f := range files {
+		if t, ok := parseSnapshotName(f.Name()); ok && f.Mode().IsRegular() {
+			snapshots = append(snapshots, Snapshot{f.Name(), t.Unix(),
+				f.Size()})
+		}
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].Name > snapshots[j].Name
+	})
+	return snapshots, nil
+}
+
+// Writes a new snapshot of the database to dir.
+func CreateSnapshot(db lurkcoin.Database, dir string) (Snapshot, error) {
+	snapshotDb, ok := lurkcoin.UnwrapDatabase(db).(lurkcoin.SnapshotDatabase)
+	if !ok {
+		return Snapshot{}, errors.New("This database does not support " +
+			"snapshots.")
+	}
+
+	now := time.Now().UTC()
+	name := snapshotPrefix + now.Format(snapshotTimeFormat) + snapshotSuffix
+	f, err := ioutil.TempFile(dir, ".tmp")
+	if err != nil {
+		return Snapshot{}, err
+	}
+	defer os.Remove(f.Name())
+	err = snapshotDb.WriteSnapshot(f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return Snapshot{}, err
+	}
+
+	info, err := os.Stat(f.Name())
+	if err != nil {
+		return Snapshot{}, err
+	}
+	err = os.Rename(f.Name(), filepath.Join(dir, name))
+	return Snapshot{name, now.Unix(), info.Size()}, err
+}
+
+// Returns the path to a snapshot or an error if it doesn't exist.
+func GetSnapshotPath(dir, name string) (string, error) {
+	if _, ok := parseSnapshotName(name); !ok || filepath.Base(name) != name {
+		return "", errors.New("Invalid snapshot name.")
+	}
+	path := filepath.Join(dir, name)
+	if _, err := os.Stat(path); err != nil {
+		return "", errors.New("The snapshot does not exist.")
+	}
+	return path, nil
+}
+
+// Replaces the contents of db with the snapshot. Servers that don't exist in
+// the snapshot are deleted.
+func RollbackToSnapshot(db lurkcoin.Database, config *Config,
+	name string) error {
+	path, err := GetSnapshotPath(config.Snapshots.Directory, name)
+	if err != nil {
+		return err
+	}
+
+	snapshot, err := databases.OpenDatabase(config.Database.Type, path,
+		map[string]string{"read_only": "true"})
+	if err != nil {
+		return err
+	}
+	if closer, ok := snapshot.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	var buf bytes.Buffer
+	if err := lurkcoin.BackupDatabase(snapshot, &buf); err != nil {
+		return err
+	}
+	return lurkcoin.RestoreDatabaseFull(db, &buf)
+}
+
+// Deletes all except the newest keep snapshots.
+func pruneSnapshots(dir string, keep int) error {
+	snapshots, err := ListSnapshots(dir)
+	if err != nil {
+		return err
+	}
+	for i := keep; i < len(snapshots); i++ {
+		if err := os.Remove(filepath.Join(dir, snapshots[i].Name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func runSnapshots(db lurkcoin.Database, dir string, interval time.Duration,
+	keep int) {
+	for range time.Tick(interval) {
+		_, err := CreateSnapshot(db, dir)
+		if err == nil {
+			err = pruneSnapshots(dir, keep)
+		}
+		if err != nil {
+			lurkcoin.LogError("Could not create snapshot", "error", err)
+			lurkcoin.ReportError(err, map[string]string{
+				"component": "snapshots",
+			})
+		}
+	}
+}
+
+func setupSnapshots(config *Config, db lurkcoin.Database) error {
+	// Read-only databases never change, so there's no point taking
+	// snapshots of them.
+	c := &config.Snapshots
+	if c.Directory == "" || config.Database.ReadOnly {
+		return nil
+	}
+	if _, ok := lurkcoin.UnwrapDatabase(db).(lurkcoin.SnapshotDatabase); !ok {
+		return fmt.Errorf("Snapshots are not supported by the %q database "+
+			"type.", config.Database.Type)
+	}
+	if err := os.MkdirAll(c.Directory, 0700); err != nil {
+		return err
+	}
+
+	interval := time.Hour
+	if c.Interval != "" {
+		var err error
+		interval, err = time.ParseDuration(c.Interval)
+		if err != nil {
+			return err
+		}
+		if interval <= 0 {
+			return errors.New("The snapshot interval must be positive.")
+		}
+	}
+	keep := c.Keep
+	if keep <= 0 {
+		keep = 24
+	}
+
+	go runSnapshots(db, c.Directory, interval, keep)
+	return nil
+}
+
+// Snapshots can be listed at /admin/snapshots.json, and created or rolled
+// back to with /admin/api/create-snapshot and /admin/api/rollback-snapshot.
+// Like /admin/api/regenerate-token, these require a JSON content type instead
+// of a CSRF token.
+func addSnapshotPages(router *httprouter.Router, db lurkcoin.Database,
+	config *Config, getPermissions func(string) AdminPermissions,
+	authenticate adminAuthenticator) {
+	dir := config.Snapshots.Directory
+	writeError := func(w http.ResponseWriter, code int, msg string) {
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(map[string]string{"error": msg})
+	}
+
+	// Returns the admin username if the request is allowed. Snapshots need
+	// the download_backups permission, rollbacks also need restore_backups
+	// since they replace the whole database.
+	check := func(w http.ResponseWriter, r *http.Request, requireJSON bool,
+		perms ...string) (string, bool) {
+		adminUser, ok := authenticate(w, r)
+		if !ok {
+			return "", false
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		d := getPermissions(adminUser)
+		for _, perm := range append(perms, PermDownloadBackups) {
+			if !d.Has(perm) {
+				writeError(w, http.StatusForbidden, "Permission denied")
+				return "", false
+			}
+		}
+		if requireJSON && !strings.HasPrefix(r.Header.Get("Content-Type"),
+			"application/json") {
+			writeError(w, http.StatusUnsupportedMediaType,
+				"Expected application/json")
+			return "", false
+		}
+		if dir == "" {
+			writeError(w, http.StatusNotFound, "Snapshots are not enabled.")
+			return "", false
+		}
+		return adminUser, true
+	}
+
+	router.GET("/admin/snapshots.json", func(w http.ResponseWriter,
+		r *http.Request, _ httprouter.Params) {
+		if _, ok := check(w, r, false); !ok {
+			return
+		}
+		snapshots, err := ListSnapshots(dir)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		json.NewEncoder(w).Encode(snapshots)
+	})
+
+	router.POST("/admin/api/create-snapshot", func(w http.ResponseWriter,
+		r *http.Request, _ httprouter.Params) {
+		adminUser, ok := check(w, r, true)
+		if !ok {
+			return
+		}
+		snapshot, err := CreateSnapshot(db, dir)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		adminLogger(r, adminUser).Info("Created snapshot", "snapshot",
+			snapshot.Name)
+		json.NewEncoder(w).Encode(snapshot)
+	})
+
+	router.POST("/admin/api/rollback-snapshot", func(w http.ResponseWriter,
+		r *http.Request, _ httprouter.Params) {
+		adminUser, ok := check(w, r, true, PermRestoreBackups)
+		if !ok {
+			return
+		}
+		var p struct {
+			Name string `json:"name"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			writeError(w, http.StatusBadRequest, "Invalid request")
+			return
+		}
+
+		if lurkcoin.IsReadOnly(db) {
+			writeError(w, http.StatusServiceUnavailable,
+				"The database is read-only.")
+			return
+		}
+		if _, err := GetSnapshotPath(dir, p.Name); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		// Take a snapshot first so that the rollback can be undone.
+		backup, err := CreateSnapshot(db, dir)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if err := RollbackToSnapshot(db, config, p.Name); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		adminLogger(r, adminUser).Info("Rolled back to snapshot",
+			"snapshot", p.Name)
+		journalAdminAction(r, db, adminUser, "rollback_snapshot", "", "",
+			p.Name)
+		json.NewEncoder(w).Encode(map[string]string{
+			"name":   p.Name,
+			"backup": backup.Name,
+		})
+	})
+}
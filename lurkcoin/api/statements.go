@@ -0,0 +1,127 @@
+//
+// lurkcoin: OFX and QIF statements
+// Copyright © 2020 by luk3yx
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package api
+
+import (
+	"bytes"
+	"errors"
+	"github.com/julienschmidt/httprouter"
+	"github.com/luk3yx/lurkcoin-core/lurkcoin"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var statementContentTypes = map[string]string{
+	"ofx": "application/x-ofx",
+	"qif": "application/qif",
+}
+
+// Servers can download a statement of their transactions from
+// /v3/statement/ofx or /v3/statement/qif (using HTTP basic authentication).
+// If the journal is enabled, since and until can be used to select
+// transactions, otherwise only the server's history is available.
+func addStatementAPI(router *httprouter.Router, db lurkcoin.Database) {
+	route := "/v3/statement/:format"
+	router.GET(route, func(w http.ResponseWriter, r *http.Request,
+		params httprouter.Params) {
+		start := time.Now()
+		errCode := writeStatement(w, r, db, params.ByName("format"))
+		recordAPIRequest(route, start, errCode)
+	})
+}
+
+func writeStatement(w http.ResponseWriter, r *http.Request,
+	db lurkcoin.Database, format string) string {
+	format = strings.ToLower(format)
+	contentType, ok := statementContentTypes[format]
+	var err error
+	if !ok {
+		err = errors.New("ERR_INVALIDREQUEST")
+	}
+
+	var since, until time.Time
+	if err == nil {
+		query := r.URL.Query()
+		since, err = ParseTimeFilter(query.Get("since"))
+		if err == nil {
+			until, err = ParseTimeFilter(query.Get("until"))
+		}
+		if err != nil {
+			err = errors.New("ERR_INVALIDREQUEST")
+		}
+	}
+
+	var name string
+	var balance lurkcoin.Currency
+	var history []lurkcoin.Transaction
+	if err == nil {
+		authed, tr, server := authenticateRequest(r, db)
+		if authed {
+			name = server.Name
+			balance = server.GetBalance()
+			history = server.GetHistory()
+			tr.Abort()
+		} else {
+			err = errors.New("ERR_INVALIDLOGIN")
+		}
+	}
+
+	// The server isn't locked while the journal is read.
+	var transactions []lurkcoin.Transaction
+	if err == nil {
+		if j := lurkcoin.GetJournal(); j != nil {
+			transactions, err = lurkcoin.CollectTransactions(nil, j, since,
+				until)
+		} else {
+			for i := len(history) - 1; i >= 0; i-- {
+				t := history[i].GetTime()
+				if (since.IsZero() || !t.Before(since)) &&
+					(until.IsZero() || !t.After(until)) {
+					transactions = append(transactions, history[i])
+				}
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	if err == nil {
+		err = lurkcoin.ExportStatement(&buf, name, balance, transactions,
+			format)
+	}
+
+	if err != nil {
+		errCode, msg, c := lurkcoin.LookupError(err.Error())
+		if errCode == "ERR_INTERNALERROR" {
+			requestLogger(r).Error("Could not export statement", "error",
+				err)
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(c)
+		w.Write([]byte("ERROR: " + msg))
+		return errCode
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+
+		lurkcoin.HomogeniseUsername(name)+"."+format+"\"")
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf.Bytes())
+	return ""
+}
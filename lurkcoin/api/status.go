@@ -0,0 +1,189 @@
+//
+// lurkcoin: Public status page
+// Copyright © 2020 by luk3yx
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/julienschmidt/httprouter"
+	"github.com/luk3yx/lurkcoin-core/lurkcoin"
+	"html/template"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// The database is considered unavailable if listing every server takes
+// longer than this.
+const statusDatabaseTimeout = 5 * time.Second
+
+type databaseStatus struct {
+	OK           bool    `json:"ok"`
+	ResponseTime float64 `json:"response_time"`
+}
+
+type status struct {
+	Name     string                 `json:"name"`
+	Version  string                 `json:"version"`
+	Started  int64                  `json:"started"`
+	Uptime   float64                `json:"uptime"`
+	Database databaseStatus         `json:"database"`
+	Economy  *lurkcoin.EconomyStats `json:"economy"`
+}
+
+// The status is public, so it is cached to make sure that requests can't
+// keep the database locked.
+type statusCache struct {
+	lock    sync.Mutex
+	db      lurkcoin.Database
+	name    string
+	status  status
+	updated time.Time
+
+	// If a database check times out, the next check waits for it instead
+	// of starting another one.
+	pendingCheck chan error
+	checkStarted time.Time
+}
+
+// Checks that every server can be locked within statusDatabaseTimeout.
+func (self *statusCache) checkDatabase() databaseStatus {
+	if self.pendingCheck == nil {
+		done := make(chan error, 1)
+		self.pendingCheck = done
+		self.checkStarted = time.Now()
+		go func() {
+			// Lock timeouts cause panics.
+			defer func() {
+				if v := recover(); v != nil {
+					done <- fmt.Errorf("%v", v)
+				}
+			}()
+			done <- lurkcoin.ForEach(self.db, func(*lurkcoin.Server) error {
+				return nil
+			}, false)
+		}()
+	}
+
+	select {
+	case err := <-self.pendingCheck:
+		self.pendingCheck = nil
+		return databaseStatus{err == nil,
+			time.Since(self.checkStarted).Seconds()}
+	case <-time.After(statusDatabaseTimeout):
+		return databaseStatus{false, time.Since(self.checkStarted).Seconds()}
+	}
+}
+
+func (self *statusCache) get() status {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if time.Since(self.updated) > 10*time.Second {
+		self.status.Database = self.checkDatabase()
+		if stats, ok := getEconomyStats(); ok && self.status.Database.OK {
+			self.status.Economy = &stats
+		} else {
+			self.status.Economy = nil
+		}
+		self.updated = time.Now()
+	}
+
+	res := self.status
+	res.Name = self.name
+	res.Version = lurkcoin.VERSION
+	res.Started = startTime.Unix()
+	res.Uptime = time.Since(startTime).Seconds()
+	return res
+}
+
+var statusTemplate = template.Must(template.New("status").Funcs(
+	template.FuncMap{
+		"Duration": func(seconds float64) time.Duration {
+			return (time.Duration(seconds) * time.Second).Round(time.Second)
+		},
+	},
+).Parse(`<!DOCTYPE html>
+<html>
+<head>
+	<title>{{.Name}} status</title>
+	<link rel="stylesheet" href="https://cdnjs.cloudflare.com/ajax/libs/skeleton/2.0.4/skeleton.min.css" />
+	<meta name="viewport" content="width=device-width" />
+	<meta http-equiv="refresh" content="60" />
+</head>
+<body>
+<main style="padding: 1.5em;">
+<h2>{{.Name}} status</h2>
+{{if .Database.OK}}
+	<h4 style="color: green;">All systems operational</h4>
+{{else}}
+	<h4 style="color: red;">The database is not responding</h4>
+{{end}}
+<table>
+	<tbody>
+		<tr><th>Version</th><td>{{.Version}}</td></tr>
+		<tr><th>Uptime</th><td>{{Duration .Uptime}}</td></tr>
+		<tr>
+			<th>Database response time</th>
+			<td>{{printf "%.3f" .Database.ResponseTime}}s</td>
+		</tr>
+		{{with .Economy}}
+			<tr><th>Servers</th><td>{{.Servers}}</td></tr>
+			<tr><th>Total supply</th><td>{{.TotalSupply}}</td></tr>
+			<tr>
+				<th>Pending transactions</th>
+				<td>{{.PendingTransactions}}</td>
+			</tr>
+		{{end}}
+	</tbody>
+</table>
+<i>This status is also available as <a href="/status.json">JSON</a>.</i>
+</main>
+</body>
+</html>
+`))
+
+// The status page is available at /status and /status.json.
+func addStatusPages(router *httprouter.Router, db lurkcoin.Database,
+	name string) {
+	if name == "" {
+		name = "lurkcoin"
+	}
+	cache := &statusCache{db: db, name: name}
+
+	router.GET("/status", func(w http.ResponseWriter, r *http.Request,
+		_ httprouter.Params) {
+		s := cache.get()
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if !s.Database.OK {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		statusTemplate.Execute(w, s)
+	})
+
+	router.GET("/status.json", func(w http.ResponseWriter, r *http.Request,
+		_ httprouter.Params) {
+		s := cache.get()
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		if !s.Database.OK {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(s)
+	})
+}
@@ -23,10 +23,11 @@ package api
 import (
 	"github.com/julienschmidt/httprouter"
 	"github.com/luk3yx/lurkcoin-core/lurkcoin"
-	"log"
 )
 
+var v2OpenAPIEndpoints []openAPIEndpoint
+
 func addV2API(_ *httprouter.Router, _ lurkcoin.Database, _ string) {
-	log.Print("lurkcoinV2 API enabled at runtime but disabled " +
+	lurkcoin.LogWarning("lurkcoinV2 API enabled at runtime but disabled " +
 		"during compilation.")
 }
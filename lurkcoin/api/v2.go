@@ -33,6 +33,7 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type v2Form interface {
@@ -63,7 +64,6 @@ func (self *v2MapForm) Get(key string) string {
 	}
 }
 
-var c1 = lurkcoin.CurrencyFromInt64(1)
 var f0 = big.NewFloat(0)
 var f500k = big.NewFloat(500000)
 
@@ -88,38 +88,46 @@ func (self *HTTPRequest) AuthenticateV2(query v2Form, otherServers ...string) er
 		username,
 		token,
 		otherServers,
+		self.Logger,
 	)
 
 	if !authed {
 		return errors.New("ERR_INVALIDLOGIN")
 	}
 
-	self.Server = server
-	self.DbTransaction = tr
+	self.setServer(tr, server)
 	return nil
 }
 
 type v2HTTPHandler func(*HTTPRequest, v2Form) (interface{}, error)
 
-func v2WrapHTTPHandler(db lurkcoin.Database, autoLogin bool,
+func v2WrapHTTPHandler(db lurkcoin.Database, route string, autoLogin bool,
 	handlerFunc v2HTTPHandler) httprouter.Handle {
 	return func(w http.ResponseWriter, r *http.Request,
 		params httprouter.Params) {
+		start := time.Now()
+		limitRequestBody(w, r)
 		req := MakeHTTPRequest(db, r, params)
 		defer req.AbortTransaction()
 		query := v2GetQuery(r)
 
 		var result interface{}
-		var err error
-		if !autoLogin || req.AuthenticateV2(query) == nil {
-			result, err = handlerFunc(req, query)
-		} else {
-			err = errors.New("ERR_INVALIDLOGIN")
+		err := req.checkRateLimit(w, query.Get("name"),
+			query.Get("token"))
+		if err == nil {
+			if !autoLogin || req.AuthenticateV2(query) == nil {
+				result, err = handlerFunc(req, query)
+			} else {
+				err = errors.New("ERR_INVALIDLOGIN")
+			}
 		}
 
 		var res []byte
+		var errCode string
+		if err == nil {
+			err = req.FinishTransaction()
+		}
 		if err == nil {
-			req.FinishTransaction()
 			if s, ok := result.(string); ok {
 				res = []byte(s)
 			} else {
@@ -137,7 +145,11 @@ func v2WrapHTTPHandler(db lurkcoin.Database, autoLogin bool,
 			req.AbortTransaction()
 			var c int
 			var msg string
-			_, msg, c = lurkcoin.LookupError(err.Error())
+			errCode, msg, c = lurkcoin.LookupError(err.Error())
+			if errCode == "ERR_INTERNALERROR" {
+				req.Logger.Error("Internal error", "error", err)
+				msg += " (request ID: " + getRequestID(r) + ")"
+			}
 			res = []byte("ERROR: " + msg)
 			if c != 401 && query.Get("force_200") == "200" {
 				c = 200
@@ -146,20 +158,109 @@ func v2WrapHTTPHandler(db lurkcoin.Database, autoLogin bool,
 		}
 
 		w.Write(res)
+		recordAPIRequest(route, start, errCode)
 	}
 }
 
 func v2Post(router *httprouter.Router, db lurkcoin.Database, url string,
 	autoLogin bool, f v2HTTPHandler) {
 	url = "/v2/" + url
-	f2 := v2WrapHTTPHandler(db, autoLogin, f)
+	f2 := v2WrapHTTPHandler(db, url, autoLogin, f)
 	router.GET(url, f2)
 	router.POST(url, f2)
 }
 
+var v2OpenAPIEndpoints = []openAPIEndpoint{
+	{"POST", "/v2/summary", "Returns an account summary.", true, nil,
+		openAPISchema{
+			"type": "object",
+			"properties": openAPISchema{
+				"uid":           openAPIType("string"),
+				"bal":           openAPIRef("Currency"),
+				"balance":       openAPIType("string"),
+				"history":       openAPIArray(openAPIType("string")),
+				"server":        openAPIType("boolean"),
+				"interest_rate": openAPIType("number"),
+			},
+		}, nil},
+	{"POST", "/v2/pay", "Sends a payment.", true,
+		[]openAPIParam{
+			{"source", openAPIType("string"), true,
+				"The user who is sending the transaction."},
+			{"target", openAPIType("string"), true, "The user to pay."},
+			{"server", openAPIType("string"), false,
+				"The server to pay the user on, this defaults to this " +
+					"lurkcoin instance."},
+			{"amount", openAPIType("string"), true, "The amount to pay."},
+			{"local_currency", openAPIType("boolean"), false,
+				"If true, amount is in the local server's currency."},
+		},
+		openAPIType("string"),
+		[]string{"ERR_SERVERNOTFOUND", "ERR_INVALIDAMOUNT",
+			"ERR_CANNOTPAYNOTHING", "ERR_CANNOTAFFORD"}},
+	{"POST", "/v2/bal", "Returns the server's balance.", true, nil,
+		openAPIRef("Currency"), nil},
+	{"POST", "/v2/history",
+		"Returns the server's recent transactions as text (one per line).",
+		true,
+		[]openAPIParam{{"json", openAPIType("string"), false,
+			"If set, a JSON list of strings is returned instead."}},
+		openAPIType("string"), nil},
+	{"POST", "/v2/exchange_rates", "Calculates an exchange rate.", false,
+		[]openAPIParam{
+			{"from", openAPIType("string"), false,
+				"The server the money is coming from."},
+			{"to", openAPIType("string"), false,
+				"The server the money is going to."},
+			{"amount", openAPIType("string"), false,
+				"The amount of money being transferred (defaults to 1)."},
+		},
+		openAPIRef("Currency"), nil},
+	{"POST", "/v2/get_exchange_rate",
+		"Calculates an exchange rate (the same as /v2/exchange_rates).",
+		false,
+		[]openAPIParam{
+			{"name", openAPIType("string"), false,
+				"The server the money is coming from."},
+			{"to", openAPIType("string"), false,
+				"The server the money is going to."},
+			{"amount", openAPIType("string"), false,
+				"The amount of money being transferred (defaults to 1)."},
+		},
+		openAPIRef("Currency"), nil},
+	{"POST", "/v2/get_transactions",
+		"Returns pending transactions as [id, target, amount, " +
+			"description] lists.", true,
+		[]openAPIParam{
+			{"simple", openAPIType("string"), false,
+				"If set, only the first transaction is returned as " +
+					"pipe-separated text."},
+			{"as_object", openAPIType("boolean"), false,
+				"If true, an object with \"exchange_rate\" and " +
+					"\"transactions\" keys is returned."},
+		},
+		openAPIArray(openAPIArray(openAPISchema{})), nil},
+	{"POST", "/v2/remove_transactions",
+		"Marks the first pending transactions as processed.", true,
+		[]openAPIParam{{"amount", openAPIType("integer"), false,
+			"The number of transactions to remove (defaults to 1)."}},
+		openAPIType("string"), nil},
+	{"POST", "/v2/get_exchange_multiplier",
+		"Returns the exchange rate multiplier.", true, nil,
+		openAPIType("number"), nil},
+	{"POST", "/v2/set_exchange_multiplier",
+		"Sets the exchange rate multiplier.", true,
+		[]openAPIParam{{"multiplier", openAPIType("number"), true,
+			"The new exchange rate multiplier."}},
+		openAPIType("string"), []string{"ERR_INVALIDAMOUNT"}},
+}
+
 func addV2API(router *httprouter.Router, db lurkcoin.Database,
 	lurkcoinName string) {
 
+	// This is created here so that it uses the configured precision.
+	c1 := lurkcoin.CurrencyFromInt64(1)
+
 	v2Post(router, db, "summary", true,
 		func(r *HTTPRequest, _ v2Form) (interface{}, error) {
 			summary := r.Server.GetSummary()
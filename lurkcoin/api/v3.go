@@ -26,28 +26,39 @@ import (
 	"errors"
 	"github.com/julienschmidt/httprouter"
 	"github.com/luk3yx/lurkcoin-core/lurkcoin"
+	"log"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 )
 
-func v3WrapHTTPHandler(db lurkcoin.Database, autoLogin bool,
+func v3WrapHTTPHandler(db lurkcoin.Database, route string, autoLogin bool,
 	handlerFunc HTTPHandler) httprouter.Handle {
 	return func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+		start := time.Now()
+		limitRequestBody(w, r)
 		req := MakeHTTPRequest(db, r, params)
 		defer req.AbortTransaction()
 
 		var result interface{}
-		var err error
-		if !autoLogin || req.Authenticate() == nil {
-			result, err = handlerFunc(req)
-		} else {
-			err = errors.New("ERR_INVALIDLOGIN")
+		username, token, _ := r.BasicAuth()
+		err := req.checkRateLimit(w, username, token)
+		if err == nil {
+			if !autoLogin || req.Authenticate() == nil {
+				result, err = handlerFunc(req)
+			} else {
+				err = errors.New("ERR_INVALIDLOGIN")
+			}
 		}
 
 		w.Header().Set("Content-Type", "application/json; charset=utf-8")
 		res := make(map[string]interface{})
+		var errCode string
+		if err == nil {
+			err = req.FinishTransaction()
+		}
 		if err == nil {
-			req.FinishTransaction()
 			res["success"] = true
 			res["result"] = result
 			w.WriteHeader(http.StatusOK)
@@ -56,6 +67,11 @@ func v3WrapHTTPHandler(db lurkcoin.Database, autoLogin bool,
 			var c int
 			res["success"] = false
 			res["error"], res["message"], c = lurkcoin.LookupError(err.Error())
+			res["request_id"] = getRequestID(r)
+			errCode = res["error"].(string)
+			if errCode == "ERR_INTERNALERROR" {
+				req.Logger.Error("Internal error", "error", err)
+			}
 
 			// Workaround for limitations of Minetest's HTTP API
 			if isYes(r.Header.Get("X-Force-OK")) {
@@ -71,64 +87,351 @@ func v3WrapHTTPHandler(db lurkcoin.Database, autoLogin bool,
 			raw = []byte(`{"success":false,"error":"ERR_INTERNALERROR","message":"Internal error!"}`)
 		}
 		w.Write(raw)
+		recordAPIRequest(route, start, errCode)
 	}
 }
 
 func v3Get(router *httprouter.Router, db lurkcoin.Database, url string,
 	requireLogin bool, f HTTPHandler) {
-	f2 := v3WrapHTTPHandler(db, requireLogin, f)
 	url = "/v3/" + url
+	f2 := v3WrapHTTPHandler(db, url, requireLogin, f)
 	router.GET(url, f2)
 	router.POST(url, f2)
 }
 
 func v3Post(router *httprouter.Router, db lurkcoin.Database, url string,
 	requireLogin bool, f HTTPHandler) {
-	router.POST("/v3/"+url, v3WrapHTTPHandler(db, requireLogin, f))
+	url = "/v3/" + url
+	router.POST(url, v3WrapHTTPHandler(db, url, requireLogin, f))
 }
 
 func v3Put(router *httprouter.Router, db lurkcoin.Database, url string,
 	requireLogin bool, f HTTPHandler) {
-	f2 := v3WrapHTTPHandler(db, requireLogin, f)
+	f2 := v3WrapHTTPHandler(db, "/v3/"+url, requireLogin, f)
 	router.PUT("/v3/"+url, f2)
 	router.POST("/v3/set_"+url, f2)
 }
 
-func addV3API(router *httprouter.Router, db lurkcoin.Database) {
+// Sends a challenge to webhookURL (see lurkcoin.VerifyWebhookURL) without
+// keeping the server locked while waiting for the webhook receiver. The
+// server is locked again afterwards, so r.Server is replaced.
+func verifyWebhookURL(r *HTTPRequest, webhookURL string, version int) error {
+	uid := r.Server.UID
+	secret := r.Server.GetWebhookSecret()
+	r.AbortTransaction()
+	err := lurkcoin.VerifyWebhookURL(webhookURL, version, secret)
+	if err != nil {
+		return err
+	}
+
+	tr := lurkcoin.BeginDbTransaction(r.Database)
+	tr.SetLogger(r.Logger)
+	server, ok := tr.GetOneServer(uid)
+	if !ok {
+		tr.Abort()
+		return errors.New("ERR_SERVERNOTFOUND")
+	}
+	r.Server, r.DbTransaction = server, tr
+	return nil
+}
+
+// Handles /v3/pay and /v3/users/pay, if fromWallet is true the payment is
+// sent from the source user's wallet.
+func v3PayHandler(fromWallet bool) HTTPHandler {
+	return func(r *HTTPRequest) (transaction interface{}, err error) {
+		var p struct {
+			Source        string            `json:"source"`
+			Target        string            `json:"target"`
+			TargetServer  string            `json:"target_server"`
+			Amount        lurkcoin.Currency `json:"amount"`
+			LocalCurrency bool              `json:"local_currency"`
+			Quote         string            `json:"quote"`
+			Currency      string            `json:"currency"`
+		}
+		err = r.Unmarshal(&p)
+		if err != nil {
+			return
+		}
+
+		// Wallets and quotes only support the primary currency.
+		if p.Currency != "" && (fromWallet || p.Quote != "" ||
+			!lurkcoin.IsValidCurrency(p.Currency)) {
+			err = errors.New("ERR_INVALIDCURRENCY")
+			return
+		}
+
+		// The target server and amount can be omitted if a quote is used.
+		var quote *lurkcoin.Quote
+		if p.Quote != "" {
+			if fromWallet {
+				err = errors.New("ERR_INVALIDREQUEST")
+				return
+			}
+			quote, err = lurkcoin.ParseQuote(p.Quote)
+			if err != nil {
+				return
+			}
+			if p.TargetServer == "" {
+				p.TargetServer = quote.TargetServer
+			}
+			if p.Amount.IsNil() {
+				p.Amount = quote.SentAmount
+			} else if !p.Amount.Eq(quote.SentAmount) {
+				err = errors.New("ERR_INVALIDQUOTE")
+				return
+			}
+		}
+
+		err = r.Authenticate(p.TargetServer)
+		if err != nil {
+			return
+		}
+		if p.Amount.IsNil() {
+			err = errors.New("ERR_INVALIDAMOUNT")
+			return
+		}
+		targetServer, ok := r.DbTransaction.GetCachedServer(p.TargetServer)
+		if !ok {
+			err = errors.New("ERR_SERVERNOTFOUND")
+			return
+		}
+
+		// If the idempotency key has been used before, return the
+		// original transaction.
+		key := r.Request.Header.Get("Idempotency-Key")
+		fingerprint := idempotencyFingerprint(r.Request.URL.Path, p)
+		t, err := payIdempotently(r.Server, key, fingerprint,
+			func() (*lurkcoin.Transaction, error) {
+				if quote != nil {
+					return r.Server.PayWithQuote(p.Source, p.Target,
+						targetServer, quote)
+				} else if fromWallet {
+					return r.Server.PayFromWallet(p.Source, p.Target,
+						targetServer, p.Amount, p.LocalCurrency)
+				}
+				return r.Server.PayIn(p.Currency, p.Source, p.Target,
+					targetServer, p.Amount, p.LocalCurrency, true)
+			})
+		transaction = t
+		return
+	}
+}
+
+// The amounts used by /v3/exchange_rates/ladder if none are specified.
+var defaultExchangeRateLadder = []int64{1, 10, 100, 1000, 10000}
+
+const maxExchangeRateLadderLength = 100
+
+// The number of transactions returned by /v3/transactions.
+const defaultTransactionPageSize = 100
+const maxTransactionPageSize = 1000
+
+func addV3API(router *httprouter.Router, db lurkcoin.Database,
+	config *Config) {
+	revertWindow := 24 * time.Hour
+	if config.RevertWindow != "" {
+		var err error
+		revertWindow, err = time.ParseDuration(config.RevertWindow)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if config.Quotes.MaxLifetime != "" {
+		lifetime, err := time.ParseDuration(config.Quotes.MaxLifetime)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := lurkcoin.SetMaxQuoteLifetime(lifetime); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if config.Quotes.Key != "" {
+		lurkcoin.SetQuoteKey([]byte(config.Quotes.Key))
+	}
+
+	// Clients can use this to check what this lurkcoin instance supports
+	// before sending requests. If a token is sent, the transaction limit is
+	// the limit of that server.
+	v3Get(router, db, "capabilities", false,
+		func(r *HTTPRequest) (interface{}, error) {
+			limit := lurkcoin.GetTransactionLimit()
+			if _, _, ok := r.Request.BasicAuth(); ok {
+				if err := r.Authenticate(); err != nil {
+					return nil, err
+				}
+				limit = r.Server.GetTransactionLimit()
+			}
+			quoteLifetime := lurkcoin.GetMaxQuoteLifetime()
+			return map[string]interface{}{
+				"version":             lurkcoin.VERSION,
+				"transaction_limit":   limit,
+				"revert_window":       revertWindow.Seconds(),
+				"max_quote_lifetime":  quoteLifetime.Seconds(),
+				"max_target_balance":  lurkcoin.GetMaxTargetBalance(),
+				"currency_decimals":   lurkcoin.GetCurrencyDecimals(),
+				"currencies":          lurkcoin.GetCurrencies(),
+				"max_webhook_version": lurkcoin.MaxWebhookVersion,
+				"webhook_events":      lurkcoin.WebhookEvents,
+				"max_webhooks":        lurkcoin.MaxWebhookEndpoints,
+			}, nil
+		})
+
 	v3Get(router, db, "summary", true,
 		func(r *HTTPRequest) (interface{}, error) {
 			return r.Server.GetSummary(), nil
 		})
 
-	v3Post(router, db, "pay", false,
-		func(r *HTTPRequest) (transaction interface{}, err error) {
+	v3Post(router, db, "pay", false, v3PayHandler(false))
+
+	v3Post(router, db, "quote", false,
+		func(r *HTTPRequest) (interface{}, error) {
 			var p struct {
-				Source        string            `json:"source"`
-				Target        string            `json:"target"`
 				TargetServer  string            `json:"target_server"`
 				Amount        lurkcoin.Currency `json:"amount"`
 				LocalCurrency bool              `json:"local_currency"`
+				Lifetime      float64           `json:"lifetime"`
 			}
-			err = r.Unmarshal(&p)
-			if err != nil {
-				return
+			if err := r.Unmarshal(&p); err != nil {
+				return nil, err
 			}
-			err = r.Authenticate(p.TargetServer)
-			if err != nil {
-				return
+			if err := r.Authenticate(p.TargetServer); err != nil {
+				return nil, err
 			}
 			if p.Amount.IsNil() {
-				err = errors.New("ERR_INVALIDAMOUNT")
-				return
+				return nil, errors.New("ERR_INVALIDAMOUNT")
 			}
 			targetServer, ok := r.DbTransaction.GetCachedServer(p.TargetServer)
 			if !ok {
-				err = errors.New("ERR_SERVERNOTFOUND")
-				return
+				return nil, errors.New("ERR_SERVERNOTFOUND")
 			}
-			transaction, err = r.Server.Pay(p.Source, p.Target, targetServer,
-				p.Amount, p.LocalCurrency, true)
-			return
+
+			lifetime := lurkcoin.GetMaxQuoteLifetime()
+			if p.Lifetime != 0 {
+				lifetime = time.Duration(p.Lifetime * float64(time.Second))
+			}
+			quote, token, err := r.Server.NewQuote(targetServer, p.Amount,
+				p.LocalCurrency, lifetime)
+			if err != nil {
+				return nil, err
+			}
+			return map[string]interface{}{
+				"quote":           token,
+				"sent_amount":     quote.SentAmount,
+				"amount":          quote.Amount,
+				"fee":             quote.Fee,
+				"received_amount": quote.ReceivedAmount,
+				"expires":         quote.Expires,
+			}, nil
+		})
+	v3Post(router, db, "users/pay", false, v3PayHandler(true))
+
+	// This can't be POSTed to as it would conflict with /v3/users/pay.
+	router.GET("/v3/users/:name/balance", v3WrapHTTPHandler(db,
+		"/v3/users/:name/balance", true,
+		func(r *HTTPRequest) (interface{}, error) {
+			return r.Server.GetWalletBalance(r.Params.ByName("name")), nil
+		}))
+
+	type identityUser struct {
+		User string `json:"user"`
+	}
+	v3Post(router, db, "identities/register", true,
+		func(r *HTTPRequest) (interface{}, error) {
+			var p identityUser
+			if err := r.Unmarshal(&p); err != nil {
+				return nil, err
+			}
+			return r.Server.RegisterIdentity(p.User)
+		})
+
+	v3Post(router, db, "identities/unregister", true,
+		func(r *HTTPRequest) (interface{}, error) {
+			var p identityUser
+			if err := r.Unmarshal(&p); err != nil {
+				return nil, err
+			}
+			r.Server.UnregisterIdentity(p.User)
+			return nil, nil
+		})
+
+	v3Post(router, db, "identities/link_code", true,
+		func(r *HTTPRequest) (interface{}, error) {
+			var p identityUser
+			if err := r.Unmarshal(&p); err != nil {
+				return nil, err
+			}
+			code, expiry, err := r.Server.NewIdentityLinkCode(p.User)
+			if err != nil {
+				return nil, err
+			}
+			return map[string]interface{}{
+				"code":    code,
+				"expires": expiry.Unix(),
+			}, nil
+		})
+
+	v3Post(router, db, "identities/link", true,
+		func(r *HTTPRequest) (interface{}, error) {
+			var p struct {
+				identityUser
+				Code string `json:"code"`
+			}
+			if err := r.Unmarshal(&p); err != nil {
+				return nil, err
+			}
+			return r.Server.LinkIdentity(p.User, p.Code)
+		})
+
+	v3Get(router, db, "identities", true,
+		func(r *HTTPRequest) (interface{}, error) {
+			query := r.Request.URL.Query()
+			id := query.Get("id")
+
+			// LookupIdentity() and FindIdentityAccounts() lock servers
+			// themselves.
+			r.AbortTransaction()
+			if id == "" {
+				if query.Get("server") == "" || query.Get("user") == "" {
+					return nil, errors.New("ERR_INVALIDREQUEST")
+				}
+				id = lurkcoin.LookupIdentity(r.Database, query.Get("server"),
+					query.Get("user"))
+				if id == "" {
+					return nil, nil
+				}
+			}
+
+			accounts, err := lurkcoin.FindIdentityAccounts(r.Database, id)
+			if err != nil {
+				return nil, err
+			} else if len(accounts) == 0 {
+				return nil, nil
+			}
+			return map[string]interface{}{
+				"id":       id,
+				"accounts": accounts,
+			}, nil
+		})
+
+	v3Get(router, db, "user_wallets", true,
+		func(r *HTTPRequest) (interface{}, error) {
+			return r.Server.WalletsEnabled(), nil
+		})
+
+	v3Put(router, db, "user_wallets", true,
+		func(r *HTTPRequest) (interface{}, error) {
+			var p struct {
+				Enabled *bool `json:"user_wallets"`
+			}
+			err := r.Unmarshal(&p)
+			if err != nil {
+				return nil, err
+			} else if p.Enabled == nil {
+				return nil, errors.New("ERR_INVALIDREQUEST")
+			}
+			r.Server.SetWalletsEnabled(*p.Enabled)
+			return nil, nil
 		})
 
 	v3Get(router, db, "balance", true,
@@ -144,16 +447,54 @@ func addV3API(router *httprouter.Router, db lurkcoin.Database) {
 	v3Post(router, db, "exchange_rates", false,
 		func(r *HTTPRequest) (interface{}, error) {
 			var p struct {
-				Source string `json:"source"`
-				Target string `json:"target"`
-				Amount lurkcoin.Currency
+				Source   string `json:"source"`
+				Target   string `json:"target"`
+				Amount   lurkcoin.Currency
+				Detailed bool   `json:"detailed"`
+				Currency string `json:"currency"`
 			}
 			r.Unmarshal(&p)
 			if p.Amount.IsNil() {
 				return nil, errors.New("ERR_INVALIDAMOUNT")
 			}
-			return lurkcoin.GetExchangeRate(r.Database, p.Source, p.Target,
-				p.Amount)
+			amount, fee, err := lurkcoin.GetExchangeRateWithFeeIn(r.Database,
+				p.Currency, p.Source, p.Target, p.Amount)
+			if err != nil {
+				return nil, err
+			} else if !p.Detailed {
+				return amount, nil
+			}
+			return map[string]lurkcoin.Currency{
+				"amount": amount,
+				"fee":    fee,
+			}, nil
+		})
+
+	v3Post(router, db, "exchange_rates/ladder", false,
+		func(r *HTTPRequest) (interface{}, error) {
+			var p struct {
+				Source   string              `json:"source"`
+				Target   string              `json:"target"`
+				Amounts  []lurkcoin.Currency `json:"amounts"`
+				Currency string              `json:"currency"`
+			}
+			r.Unmarshal(&p)
+			if p.Amounts == nil {
+				p.Amounts = make([]lurkcoin.Currency,
+					len(defaultExchangeRateLadder))
+				for i, amount := range defaultExchangeRateLadder {
+					p.Amounts[i] = lurkcoin.CurrencyFromInt64(amount)
+				}
+			} else if len(p.Amounts) > maxExchangeRateLadderLength {
+				return nil, errors.New("ERR_INVALIDREQUEST")
+			}
+			for _, amount := range p.Amounts {
+				if amount.IsNil() {
+					return nil, errors.New("ERR_INVALIDAMOUNT")
+				}
+			}
+			return lurkcoin.GetExchangeRates(r.Database, p.Currency,
+				p.Source, p.Target, p.Amounts)
 		})
 
 	v3Get(router, db, "pending_transactions", true,
@@ -166,33 +507,148 @@ func addV3API(router *httprouter.Router, db lurkcoin.Database) {
 	}
 	v3Post(router, db, "acknowledge_transactions", true,
 		func(r *HTTPRequest) (interface{}, error) {
-			var p transactionList
+			var p struct {
+				transactionList
+				Detailed bool `json:"detailed"`
+			}
 			r.Unmarshal(&p)
+			acknowledged := make(map[string]bool, len(p.TransactionIDs))
 			for _, id := range p.TransactionIDs {
-				r.Server.RemovePendingTransaction(id)
+				if r.Server.RemovePendingTransaction(id) {
+					acknowledged[id] = true
+				} else if !acknowledged[id] {
+					acknowledged[id] = false
+				}
 			}
-			return nil, nil
+			if !p.Detailed {
+				return nil, nil
+			}
+
+			// The server is still locked, so no transactions can be added
+			// between acknowledging and listing them.
+			return map[string]interface{}{
+				"acknowledged":         acknowledged,
+				"pending_transactions": r.Server.GetPendingTransactions(),
+			}, nil
 		})
 
 	v3Post(router, db, "reject_transactions", true,
 		func(r *HTTPRequest) (interface{}, error) {
 			var p transactionList
 			r.Unmarshal(&p)
-			for _, id := range p.TransactionIDs {
-				r.Server.RejectPendingTransaction(id, r.DbTransaction)
+
+			// RejectTransactions() locks the server itself.
+			uid := r.Server.UID
+			r.AbortTransaction()
+			return lurkcoin.RejectTransactions(r.Database, uid,
+				p.TransactionIDs, r.Logger)
+		})
+
+	v3Post(router, db, "revert_transaction", true,
+		func(r *HTTPRequest) (interface{}, error) {
+			var p struct {
+				TransactionID string `json:"transaction"`
 			}
-			return nil, nil
+			err := r.Unmarshal(&p)
+			if err != nil {
+				return nil, err
+			}
+
+			// RevertTransaction() locks the server itself.
+			uid := r.Server.UID
+			r.AbortTransaction()
+			return lurkcoin.RevertTransaction(r.Database, uid,
+				p.TransactionID, time.Now().Add(-revertWindow), r.Logger)
+		})
+
+	v3Get(router, db, "transactions", true,
+		func(r *HTTPRequest) (interface{}, error) {
+			query := r.Request.URL.Query()
+			filter := lurkcoin.TransactionFilter{
+				Counterpart: query.Get("server"),
+				Direction:   query.Get("direction"),
+				After:       query.Get("after"),
+			}
+			var err error
+			filter.Since, err = ParseTimeFilter(query.Get("since"))
+			if err != nil {
+				return nil, errors.New("ERR_INVALIDREQUEST")
+			}
+			filter.Until, err = ParseTimeFilter(query.Get("until"))
+			if err != nil {
+				return nil, errors.New("ERR_INVALIDREQUEST")
+			}
+			if s := query.Get("min_amount"); s != "" {
+				filter.MinAmount, err = lurkcoin.ParseCurrency(s)
+				if err != nil {
+					return nil, errors.New("ERR_INVALIDAMOUNT")
+				}
+			}
+			if filter.Direction != "" &&
+				filter.Direction != lurkcoin.TransactionsSent &&
+				filter.Direction != lurkcoin.TransactionsReceived {
+				return nil, errors.New("ERR_INVALIDREQUEST")
+			}
+
+			limit := defaultTransactionPageSize
+			if s := query.Get("limit"); s != "" {
+				limit, err = strconv.Atoi(s)
+				if err != nil || limit < 1 || limit > maxTransactionPageSize {
+					return nil, errors.New("ERR_INVALIDREQUEST")
+				}
+			}
+
+			// SearchTransactions() may lock the server itself.
+			uid := r.Server.UID
+			r.AbortTransaction()
+			transactions, more, err := lurkcoin.SearchTransactions(
+				r.Database, lurkcoin.GetJournal(), uid, filter, limit)
+			if err != nil {
+				return nil, err
+			}
+
+			res := map[string]interface{}{
+				"transactions": transactions,
+				"next":         nil,
+			}
+			if transactions == nil {
+				res["transactions"] = []lurkcoin.Transaction{}
+			}
+			if more {
+				res["next"] = transactions[len(transactions)-1].ID
+			}
+			return res, nil
+		})
+
+	v3Get(router, db, "transactions/:id", true,
+		func(r *HTTPRequest) (interface{}, error) {
+			// LookupTransaction() locks the server itself.
+			uid := r.Server.UID
+			r.AbortTransaction()
+			t, err := lurkcoin.LookupTransaction(r.Database, uid,
+				r.Params.ByName("id"))
+			if err != nil {
+				return nil, err
+			} else if t == nil {
+				return nil, errors.New("ERR_TRANSACTIONNOTFOUND")
+			}
+			return t, nil
 		})
 
 	v3Get(router, db, "target_balance", true,
 		func(r *HTTPRequest) (interface{}, error) {
-			return r.Server.GetTargetBalance(), nil
+			currency := r.Request.URL.Query().Get("currency")
+			if !lurkcoin.IsValidCurrency(currency) {
+				return nil, errors.New("ERR_INVALIDCURRENCY")
+			}
+			return r.Server.GetTargetBalanceIn(currency), nil
 		})
 
 	v3Put(router, db, "target_balance", true,
 		func(r *HTTPRequest) (interface{}, error) {
 			var p struct {
 				TargetBalance lurkcoin.Currency `json:"target_balance"`
+				Currency      string            `json:"currency"`
 			}
 			err := r.Unmarshal(&p)
 			if err != nil {
@@ -200,8 +656,10 @@ func addV3API(router *httprouter.Router, db lurkcoin.Database) {
 			}
 			if p.TargetBalance.IsNil() {
 				return nil, errors.New("ERR_INVALIDAMOUNT")
+			} else if !lurkcoin.IsValidCurrency(p.Currency) {
+				return nil, errors.New("ERR_INVALIDCURRENCY")
 			}
-			ok := r.Server.SetTargetBalance(p.TargetBalance)
+			ok := r.Server.SetTargetBalanceIn(p.Currency, p.TargetBalance)
 			if !ok {
 				return nil, errors.New("ERR_INVALIDAMOUNT")
 			}
@@ -216,6 +674,126 @@ func addV3API(router *httprouter.Router, db lurkcoin.Database) {
 			return r.Server.WebhookURL, nil
 		})
 
+	v3Put(router, db, "webhook_url", true,
+		func(r *HTTPRequest) (interface{}, error) {
+			var p struct {
+				WebhookURL     string `json:"webhook_url"`
+				WebhookVersion int    `json:"webhook_version"`
+			}
+			err := r.Unmarshal(&p)
+			if err != nil {
+				return nil, err
+			}
+			if p.WebhookVersion < 0 ||
+				p.WebhookVersion > lurkcoin.MaxWebhookVersion {
+				return nil, errors.New("ERR_INVALIDWEBHOOKVERSION")
+			}
+			if p.WebhookURL == "" {
+				r.Server.SetWebhookURL("")
+				r.Server.SetWebhookVersion(0)
+				return nil, nil
+			}
+
+			webhookURL, ok := lurkcoin.ValidateWebhookURL(p.WebhookURL)
+			if !ok || !lurkcoin.CheckWebhookURLAddresses(webhookURL) {
+				return nil, errors.New("ERR_INVALIDWEBHOOKURL")
+			}
+
+			if config.VerifyWebhookURLs {
+				err := verifyWebhookURL(r, webhookURL, p.WebhookVersion)
+				if err != nil {
+					return nil, err
+				}
+			}
+
+			r.Server.SetWebhookURL(webhookURL)
+			r.Server.SetWebhookVersion(p.WebhookVersion)
+			r.Logger.Info("Webhook URL updated", "webhook_url", webhookURL,
+				"webhook_version", p.WebhookVersion)
+			return webhookURL, nil
+		})
+
+	v3Get(router, db, "webhook_secret", true,
+		func(r *HTTPRequest) (interface{}, error) {
+			if secret := r.Server.GetWebhookSecret(); secret != "" {
+				return secret, nil
+			}
+			return nil, nil
+		})
+
+	v3Post(router, db, "regenerate_webhook_secret", true,
+		func(r *HTTPRequest) (interface{}, error) {
+			r.Logger.Info("Webhook secret regenerated")
+			return r.Server.RegenerateWebhookSecret(), nil
+		})
+
+	v3Get(router, db, "webhook_deliveries", true,
+		func(r *HTTPRequest) (interface{}, error) {
+			return lurkcoin.GetWebhookDeliveries(r.Server.UID), nil
+		})
+
+	v3Get(router, db, "webhooks", true,
+		func(r *HTTPRequest) (interface{}, error) {
+			webhooks := r.Server.GetWebhooks()
+			if webhooks == nil {
+				webhooks = []lurkcoin.WebhookEndpoint{}
+			}
+			return webhooks, nil
+		})
+
+	v3Post(router, db, "webhooks/add", true,
+		func(r *HTTPRequest) (interface{}, error) {
+			var p struct {
+				URL    string   `json:"url"`
+				Events []string `json:"events"`
+			}
+			if err := r.Unmarshal(&p); err != nil {
+				return nil, err
+			}
+
+			webhookURL, ok := lurkcoin.ValidateWebhookURL(p.URL)
+			if !ok || !lurkcoin.CheckWebhookURLAddresses(webhookURL) {
+				return nil, errors.New("ERR_INVALIDWEBHOOKURL")
+			}
+			if len(r.Server.GetWebhooks()) >= lurkcoin.MaxWebhookEndpoints {
+				return nil, errors.New("ERR_TOOMANYWEBHOOKS")
+			}
+			if config.VerifyWebhookURLs {
+				err := verifyWebhookURL(r, webhookURL, 1)
+				if err != nil {
+					return nil, err
+				}
+			}
+
+			endpoint, err := r.Server.AddWebhook(webhookURL, p.Events)
+			if err != nil {
+				return nil, err
+			}
+			r.Logger.Info("Webhook endpoint added", "webhook_url",
+				webhookURL, "id", endpoint.ID)
+			return endpoint, nil
+		})
+
+	v3Post(router, db, "webhooks/remove", true,
+		func(r *HTTPRequest) (interface{}, error) {
+			var p struct {
+				ID string `json:"id"`
+			}
+			if err := r.Unmarshal(&p); err != nil {
+				return nil, err
+			}
+			if !r.Server.RemoveWebhook(p.ID) {
+				return nil, errors.New("ERR_WEBHOOKNOTFOUND")
+			}
+			r.Logger.Info("Webhook endpoint removed", "id", p.ID)
+			return nil, nil
+		})
+
+	v3Get(router, db, "reference_rate", false,
+		func(r *HTTPRequest) (interface{}, error) {
+			return lurkcoin.GetReferenceRate(), nil
+		})
+
 	v3Get(router, db, "version", false,
 		func(r *HTTPRequest) (interface{}, error) {
 			return map[string]interface{}{
@@ -0,0 +1,129 @@
+//
+// lurkcoin admin audit log
+// Copyright © 2020 by luk3yx
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package lurkcoin
+
+import (
+	"errors"
+	"time"
+)
+
+// An admin action recorded in the audit log. Before and After are the old
+// and new values of whatever the action changed (if applicable).
+type AuditLogEntry struct {
+	ID        uint64 `json:"id"`
+	Time      int64  `json:"time"`
+	AdminUser string `json:"admin_user"`
+	Action    string `json:"action"`
+	Server    string `json:"server,omitempty"`
+	Before    string `json:"before,omitempty"`
+	After     string `json:"after,omitempty"`
+	IP        string `json:"ip,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+func (self *AuditLogEntry) GetTime() time.Time {
+	return time.Unix(self.Time, 0)
+}
+
+// Databases may implement this to store the admin audit log.
+type AuditLogDatabase interface {
+	// Appends an entry to the audit log and sets its ID. IDs must increase
+	// with each entry.
+	AppendAuditLog(*AuditLogEntry) error
+
+	// Calls f with every audit log entry, newest first, stopping if f
+	// returns an error.
+	ForEachAuditLog(f func(*AuditLogEntry) error) error
+}
+
+var ErrAuditLogUnsupported = errors.New(
+	"The database does not support audit logs.")
+
+func getAuditLogDatabase(db Database) (AuditLogDatabase, bool) {
+	auditDb, ok := UnwrapDatabase(db).(AuditLogDatabase)
+	return auditDb, ok
+}
+
+// Appends entry to the database's audit log. The entry's time is set if it
+// is zero.
+func AppendAuditLog(db Database, entry *AuditLogEntry) error {
+	if IsReadOnly(db) {
+		return ErrReadOnly
+	}
+	auditDb, ok := getAuditLogDatabase(db)
+	if !ok {
+		return ErrAuditLogUnsupported
+	}
+	if entry.Time == 0 {
+		entry.Time = time.Now().Unix()
+	}
+	return auditDb.AppendAuditLog(entry)
+}
+
+// Filters audit log entries, empty fields match every entry.
+type AuditLogFilter struct {
+	AdminUser string
+	Action    string
+	Server    string
+	Since     time.Time
+	Until     time.Time
+
+	// The maximum number of entries to return (0 returns every entry).
+	Limit int
+}
+
+func (self *AuditLogFilter) matches(entry *AuditLogEntry) bool {
+	return (self.AdminUser == "" || entry.AdminUser == self.AdminUser) &&
+		(self.Action == "" || entry.Action == self.Action) &&
+		(self.Server == "" ||
+			entry.Server == HomogeniseUsername(self.Server)) &&
+		(self.Since.IsZero() || entry.Time >= self.Since.Unix()) &&
+		(self.Until.IsZero() || entry.Time < self.Until.Unix())
+}
+
+var errStopAuditLog = errors.New("stop reading the audit log")
+
+// Returns the audit log entries that match filter, newest first.
+func ListAuditLog(db Database, filter AuditLogFilter) ([]*AuditLogEntry,
+	error) {
+	auditDb, ok := getAuditLogDatabase(db)
+	if !ok {
+		return nil, ErrAuditLogUnsupported
+	}
+
+	// Entries are read newest first, so anything older than filter.Since
+	// means there are no more matching entries.
+	var res []*AuditLogEntry
+	err := auditDb.ForEachAuditLog(func(entry *AuditLogEntry) error {
+		if !filter.Since.IsZero() && entry.Time < filter.Since.Unix() {
+			return errStopAuditLog
+		}
+		if filter.matches(entry) {
+			res = append(res, entry)
+			if filter.Limit > 0 && len(res) >= filter.Limit {
+				return errStopAuditLog
+			}
+		}
+		return nil
+	})
+	if err != nil && err != errStopAuditLog {
+		return nil, err
+	}
+	return res, nil
+}
@@ -0,0 +1,118 @@
+//
+// lurkcoin backup previews
+// Copyright © 2020 by luk3yx
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package lurkcoin
+
+import (
+	"encoding/json"
+	"sort"
+)
+
+// A server that would be changed by restoring a backup. The balances are nil
+// for aliases and for servers that don't exist on that side of the diff.
+type BackupDiffEntry struct {
+	UID        string
+	Name       string
+	OldBalance Currency
+	NewBalance Currency
+}
+
+// The changes that restoring a backup would make, see DiffBackup.
+type BackupDiff struct {
+	Created   []BackupDiffEntry
+	Changed   []BackupDiffEntry
+	Deleted   []BackupDiffEntry
+	Unchanged int
+}
+
+func encodedServerBalance(encodedServer *EncodedServer) Currency {
+	if encodedServer.AliasOf != "" {
+		return Currency{}
+	}
+	return encodedServer.Decode().GetBalance()
+}
+
+// Compares the servers in a backup (as returned by ReadBackup) with the
+// database. Deleted is only filled in if deleteMissing is true (as with
+// RestoreDatabaseFull). Servers aren't locked, so the diff may be out of date
+// by the time the backup is restored.
+func DiffBackup(db Database, encodedServers []EncodedServer,
+	deleteMissing bool) (*BackupDiff, error) {
+	existing := make(map[string]*EncodedServer)
+	err := db.ForEachEncoded(func(encodedServer *EncodedServer) error {
+		existing[HomogeniseUsername(encodedServer.Name)] = encodedServer
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	diff := &BackupDiff{}
+	restored := make(map[string]bool, len(encodedServers))
+	for i := range encodedServers {
+		newServer := &encodedServers[i]
+		uid := HomogeniseUsername(newServer.Name)
+		restored[uid] = true
+		entry := BackupDiffEntry{
+			UID:        uid,
+			Name:       newServer.Name,
+			NewBalance: encodedServerBalance(newServer),
+		}
+
+		oldServer, ok := existing[uid]
+		if !ok {
+			diff.Created = append(diff.Created, entry)
+			continue
+		}
+
+		oldRaw, err := json.Marshal(oldServer)
+		if err != nil {
+			return nil, err
+		}
+		newRaw, err := json.Marshal(newServer)
+		if err != nil {
+			return nil, err
+		}
+		if string(oldRaw) == string(newRaw) {
+			diff.Unchanged++
+			continue
+		}
+		entry.OldBalance = encodedServerBalance(oldServer)
+		diff.Changed = append(diff.Changed, entry)
+	}
+
+	if deleteMissing {
+		for uid, oldServer := range existing {
+			if !restored[uid] {
+				diff.Deleted = append(diff.Deleted, BackupDiffEntry{
+					UID:        uid,
+					Name:       oldServer.Name,
+					OldBalance: encodedServerBalance(oldServer),
+				})
+			}
+		}
+	}
+
+	for _, entries := range [][]BackupDiffEntry{diff.Created, diff.Changed,
+		diff.Deleted} {
+		sort.Slice(entries, func(i, j int) bool {
+			return entries[i].UID < entries[j].UID
+		})
+	}
+	return diff, nil
+}
@@ -0,0 +1,125 @@
+//
+// lurkcoin
+// Copyright © 2020 by luk3yx
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package lurkcoin
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	crypto_rand "crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+)
+
+// Encrypted backups are encrypted with AES-256-GCM, the key is derived from a
+// passphrase with PBKDF2-HMAC-SHA256.
+// Format: backupMagic || salt (16 bytes) || nonce (12 bytes) || ciphertext
+var backupMagic = []byte("lurkcoin-backup\x00\x01")
+
+const backupSaltSize = 16
+const backupKDFIterations = 200000
+
+// PBKDF2 (RFC 8018) with HMAC-SHA256, this is only used to derive a single
+// 32-byte key.
+func pbkdf2SHA256(password, salt []byte, iterations int) []byte {
+	prf := hmac.New(sha256.New, password)
+	var block [4]byte
+	binary.BigEndian.PutUint32(block[:], 1)
+	prf.Write(salt)
+	prf.Write(block[:])
+	u := prf.Sum(nil)
+	key := make([]byte, len(u))
+	copy(key, u)
+	for i := 1; i < iterations; i++ {
+		prf.Reset()
+		prf.Write(u)
+		u = prf.Sum(u[:0])
+		for j := range key {
+			key[j] ^= u[j]
+		}
+	}
+	return key
+}
+
+func newBackupCipher(passphrase string, salt []byte) (cipher.AEAD, error) {
+	if passphrase == "" {
+		return nil, errors.New("No passphrase specified")
+	}
+	key := pbkdf2SHA256([]byte(passphrase), salt, backupKDFIterations)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Returns true if data is an encrypted backup.
+func IsEncryptedBackup(data []byte) bool {
+	return bytes.HasPrefix(data, backupMagic)
+}
+
+// Encrypts a backup (as returned by BackupDatabase) with a passphrase.
+func EncryptBackup(plaintext []byte, passphrase string) ([]byte, error) {
+	salt := make([]byte, backupSaltSize)
+	if _, err := crypto_rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := newBackupCipher(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := crypto_rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	res := make([]byte, 0, len(backupMagic)+len(salt)+len(nonce)+
+		len(plaintext)+aead.Overhead())
+	res = append(res, backupMagic...)
+	res = append(res, salt...)
+	res = append(res, nonce...)
+	return aead.Seal(res, nonce, plaintext, backupMagic), nil
+}
+
+// Decrypts a backup encrypted with EncryptBackup.
+func DecryptBackup(data []byte, passphrase string) ([]byte, error) {
+	if !IsEncryptedBackup(data) {
+		return nil, errors.New("Not an encrypted backup")
+	}
+	data = data[len(backupMagic):]
+	if len(data) < backupSaltSize {
+		return nil, errors.New("Truncated backup")
+	}
+	aead, err := newBackupCipher(passphrase, data[:backupSaltSize])
+	if err != nil {
+		return nil, err
+	}
+	data = data[backupSaltSize:]
+	if len(data) < aead.NonceSize() {
+		return nil, errors.New("Truncated backup")
+	}
+	nonce := data[:aead.NonceSize()]
+	plaintext, err := aead.Open(nil, nonce, data[len(nonce):], backupMagic)
+	if err != nil {
+		return nil, errors.New("Incorrect passphrase or corrupted backup")
+	}
+	return plaintext, nil
+}
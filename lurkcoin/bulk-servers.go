@@ -0,0 +1,109 @@
+//
+// lurkcoin bulk server creation
+// Copyright © 2020 by luk3yx
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package lurkcoin
+
+import (
+	"errors"
+	"fmt"
+)
+
+// A server to create with CreateServers.
+type BulkServer struct {
+	Name string `json:"name"`
+
+	// The initial target balance, the default is used if this is nil.
+	TargetBalance *Currency `json:"target_balance,omitempty"`
+}
+
+// A server created by CreateServers. This is the only time that the token is
+// returned.
+type CreatedServer struct {
+	UID   string `json:"uid"`
+	Name  string `json:"name"`
+	Token string `json:"token"`
+}
+
+func checkNewServer(db Database, newServer *BulkServer,
+	seen map[string]bool) error {
+	name, length := PasteuriseUsername(newServer.Name)
+	uid := HomogeniseUsername(name)
+	if length < 3 || length > 32 || uid == "" {
+		return errors.New("The server name must be between 3 and 32 " +
+			"characters.")
+	}
+	if seen[uid] {
+		return errors.New("The server is listed more than once.")
+	}
+	seen[uid] = true
+
+	// Aliases and deleted servers also prevent the server from being
+	// created.
+	if servers, ok, _ := db.GetServers([]string{uid}); ok {
+		db.FreeServers(servers, false)
+		return errors.New("The server already exists.")
+	}
+
+	if t := newServer.TargetBalance; t != nil && (t.IsNil() ||
+		t.LtZero() || t.Gt(GetMaxTargetBalance())) {
+		return errors.New("Invalid target balance.")
+	}
+	return nil
+}
+
+// Creates every server in newServers. All servers are checked before any
+// are created, so nothing is created if any of them are invalid or already
+// exist.
+func CreateServers(db Database, newServers []BulkServer) ([]CreatedServer,
+	error) {
+	if IsReadOnly(db) {
+		return nil, ErrReadOnly
+	}
+	seen := make(map[string]bool, len(newServers))
+	for i := range newServers {
+		if err := checkNewServer(db, &newServers[i], seen); err != nil {
+			return nil, fmt.Errorf("Server %d (%q): %s", i+1,
+				newServers[i].Name, err)
+		}
+	}
+
+	tr := BeginDbTransaction(db)
+	defer tr.Abort()
+	created := make([]CreatedServer, 0, len(newServers))
+	for _, newServer := range newServers {
+		server, ok := tr.CreateServer(newServer.Name)
+		if !ok {
+			// Another server with the same name has been created since
+			// the servers were checked. Creating servers can't always be
+			// reverted with Abort(), so the servers are deleted instead.
+			tr.Abort()
+			for _, s := range created {
+				db.DeleteServer(s.UID)
+			}
+			return nil, fmt.Errorf("Server %q: The server already exists.",
+				newServer.Name)
+		}
+		if newServer.TargetBalance != nil {
+			server.SetTargetBalance(*newServer.TargetBalance)
+		}
+		created = append(created, CreatedServer{server.UID, server.Name,
+			server.GetNewToken()})
+	}
+	tr.Finish()
+	return created, nil
+}
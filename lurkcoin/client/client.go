@@ -0,0 +1,734 @@
+//
+// lurkcoin API client
+// Copyright © 2020 by luk3yx
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+// A client for version 3 of the lurkcoin HTTPS API. Unlike the rest of
+// lurkcoin-core, this package is intended to be imported by other programs.
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/luk3yx/lurkcoin-core/lurkcoin"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Client struct {
+	// The base URL of the lurkcoin instance, for example
+	// "https://lurkcoin.example.com".
+	BaseURL string
+
+	// The server name and token used to authenticate.
+	Username string
+	Token    string
+
+	HTTPClient *http.Client
+
+	// The number of times failed requests are retried. Requests are only
+	// retried if they fail because of a network error or a server error.
+	MaxRetries int
+
+	// The delay before the first retry, this is doubled after every retry.
+	RetryDelay time.Duration
+}
+
+// Creates a new client with sensible defaults.
+func New(baseURL, username, token string) *Client {
+	return &Client{
+		BaseURL:    strings.TrimSuffix(baseURL, "/"),
+		Username:   username,
+		Token:      token,
+		HTTPClient: &http.Client{Timeout: 30 * time.Second},
+		MaxRetries: 3,
+		RetryDelay: time.Second,
+	}
+}
+
+// Generates a random idempotency key.
+func NewIdempotencyKey() string {
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(raw)
+}
+
+type apiResponse struct {
+	Success   bool            `json:"success"`
+	Result    json.RawMessage `json:"result"`
+	Error     string          `json:"error"`
+	Message   string          `json:"message"`
+	RequestID string          `json:"request_id"`
+}
+
+func (self *Client) doOnce(ctx context.Context, method, endpoint string,
+	body []byte, headers map[string]string, result interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method,
+		self.BaseURL+"/v3/"+endpoint, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if self.Username != "" {
+		req.SetBasicAuth(self.Username, self.Token)
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	httpClient := self.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	raw, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+
+	var apiRes apiResponse
+	if err := json.Unmarshal(raw, &apiRes); err != nil {
+		return &Error{"ERR_INTERNALERROR",
+			fmt.Sprintf("Invalid response from server (HTTP %d).",
+				res.StatusCode), res.StatusCode,
+			res.Header.Get("X-Request-ID")}
+	}
+	if !apiRes.Success {
+		requestID := apiRes.RequestID
+		if requestID == "" {
+			requestID = res.Header.Get("X-Request-ID")
+		}
+		return &Error{apiRes.Error, apiRes.Message, res.StatusCode, requestID}
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(apiRes.Result, result)
+}
+
+// Sends a request with retries. params is encoded as JSON if it is not nil.
+func (self *Client) do(ctx context.Context, method, endpoint string,
+	params interface{}, headers map[string]string, result interface{}) error {
+	var body []byte
+	if params != nil {
+		var err error
+		body, err = json.Marshal(params)
+		if err != nil {
+			return err
+		}
+	}
+
+	delay := self.RetryDelay
+	for attempt := 0; ; attempt++ {
+		err := self.doOnce(ctx, method, endpoint, body, headers, result)
+		if err == nil || attempt >= self.MaxRetries {
+			return err
+		}
+
+		// Only retry server errors and network errors.
+		if apiErr, ok := err.(*Error); ok && !apiErr.Temporary() {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+func (self *Client) Summary(ctx context.Context) (*lurkcoin.Summary, error) {
+	var summary lurkcoin.Summary
+	err := self.do(ctx, "GET", "summary", nil, nil, &summary)
+	if err != nil {
+		return nil, err
+	}
+	return &summary, nil
+}
+
+func (self *Client) Balance(ctx context.Context) (lurkcoin.Currency, error) {
+	var balance lurkcoin.Currency
+	err := self.do(ctx, "GET", "balance", nil, nil, &balance)
+	return balance, err
+}
+
+func (self *Client) History(ctx context.Context) ([]lurkcoin.Transaction, error) {
+	var history []lurkcoin.Transaction
+	err := self.do(ctx, "GET", "history", nil, nil, &history)
+	return history, err
+}
+
+type PayRequest struct {
+	Source        string            `json:"source"`
+	Target        string            `json:"target"`
+	TargetServer  string            `json:"target_server"`
+	Amount        lurkcoin.Currency `json:"amount"`
+	LocalCurrency bool              `json:"local_currency"`
+
+	// A quote token from Quote(), if set the amounts in the quote are used
+	// and Amount must be the quote's SentAmount.
+	Quote string `json:"quote,omitempty"`
+
+	// The currency to send the payment in, see Capabilities.Currencies. This
+	// can't be used with quotes.
+	Currency string `json:"currency,omitempty"`
+
+	// If IdempotencyKey is empty, a random one is generated. Retried
+	// requests use the same key so that the payment is not sent twice.
+	IdempotencyKey string `json:"-"`
+}
+
+// Sends a payment.
+func (self *Client) Pay(ctx context.Context, p PayRequest) (*lurkcoin.Transaction, error) {
+	return self.pay(ctx, "pay", p)
+}
+
+// Sends a payment from the source user's wallet.
+func (self *Client) PayFromWallet(ctx context.Context,
+	p PayRequest) (*lurkcoin.Transaction, error) {
+	return self.pay(ctx, "users/pay", p)
+}
+
+func (self *Client) pay(ctx context.Context, endpoint string,
+	p PayRequest) (*lurkcoin.Transaction, error) {
+	key := p.IdempotencyKey
+	if key == "" {
+		key = NewIdempotencyKey()
+	}
+	var transaction lurkcoin.Transaction
+	err := self.do(ctx, "POST", endpoint, p,
+		map[string]string{"Idempotency-Key": key}, &transaction)
+	if err != nil {
+		return nil, err
+	}
+	return &transaction, nil
+}
+
+// Gets the balance of a user's wallet (in lurkcoins).
+func (self *Client) WalletBalance(ctx context.Context,
+	user string) (lurkcoin.Currency, error) {
+	var res lurkcoin.Currency
+	err := self.do(ctx, "GET", "users/"+url.PathEscape(user)+"/balance", nil,
+		nil, &res)
+	return res, err
+}
+
+// Gets the amount that target will receive if amount is sent from source.
+// Either source or target may be empty to convert to/from lurkcoins.
+func (self *Client) ExchangeRate(ctx context.Context, source, target string,
+	amount lurkcoin.Currency) (lurkcoin.Currency, error) {
+	var res lurkcoin.Currency
+	err := self.do(ctx, "POST", "exchange_rates", map[string]interface{}{
+		"source": source,
+		"target": target,
+		"amount": amount,
+	}, nil, &res)
+	return res, err
+}
+
+// Like ExchangeRate, but also returns the fee (in lurkcoins) that will be
+// deducted from the payment.
+func (self *Client) ExchangeRateWithFee(ctx context.Context, source,
+	target string, amount lurkcoin.Currency) (lurkcoin.Currency,
+	lurkcoin.Currency, error) {
+	var res struct {
+		Amount lurkcoin.Currency `json:"amount"`
+		Fee    lurkcoin.Currency `json:"fee"`
+	}
+	err := self.do(ctx, "POST", "exchange_rates", map[string]interface{}{
+		"source":   source,
+		"target":   target,
+		"amount":   amount,
+		"detailed": true,
+	}, nil, &res)
+	return res.Amount, res.Fee, err
+}
+
+type Capabilities struct {
+	Version          string            `json:"version"`
+	TransactionLimit lurkcoin.Currency `json:"transaction_limit"`
+
+	// These are in seconds.
+	RevertWindow     float64 `json:"revert_window"`
+	MaxQuoteLifetime float64 `json:"max_quote_lifetime"`
+
+	MaxTargetBalance lurkcoin.Currency `json:"max_target_balance"`
+	CurrencyDecimals int               `json:"currency_decimals"`
+
+	// Additional currencies that can be used as well as lurkcoins.
+	Currencies []string `json:"currencies"`
+
+	// The newest webhook version supported, see SetWebhookURLVersion().
+	MaxWebhookVersion int `json:"max_webhook_version"`
+
+	// The events webhook endpoints can subscribe to and the maximum number
+	// of endpoints, see AddWebhook().
+	WebhookEvents []string `json:"webhook_events"`
+	MaxWebhooks   int      `json:"max_webhooks"`
+}
+
+// Returns information about the lurkcoin instance, the transaction limit is
+// this server's limit.
+func (self *Client) Capabilities(ctx context.Context) (*Capabilities,
+	error) {
+	var res Capabilities
+	err := self.do(ctx, "GET", "capabilities", nil, nil, &res)
+	if err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+type Quote struct {
+	Quote          string            `json:"quote"`
+	SentAmount     lurkcoin.Currency `json:"sent_amount"`
+	Amount         lurkcoin.Currency `json:"amount"`
+	Fee            lurkcoin.Currency `json:"fee"`
+	ReceivedAmount lurkcoin.Currency `json:"received_amount"`
+	Expires        int64             `json:"expires"`
+}
+
+// Locks the exchange rate of a payment to targetServer for lifetime (or the
+// longest time allowed if lifetime is 0). The quote can be used once by
+// setting PayRequest.Quote.
+func (self *Client) Quote(ctx context.Context, targetServer string,
+	amount lurkcoin.Currency, localCurrency bool,
+	lifetime time.Duration) (*Quote, error) {
+	var res Quote
+	err := self.do(ctx, "POST", "quote", map[string]interface{}{
+		"target_server":  targetServer,
+		"amount":         amount,
+		"local_currency": localCurrency,
+		"lifetime":       lifetime.Seconds(),
+	}, nil, &res)
+	if err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// Gets the exchange rates between two servers for multiple amounts in one
+// request. If amounts is nil, the server's default amounts (1, 10, 100, 1000
+// and 10000) are used.
+func (self *Client) ExchangeRates(ctx context.Context, source, target string,
+	amounts []lurkcoin.Currency) ([]lurkcoin.ExchangeRate, error) {
+	return self.ExchangeRatesIn(ctx, "", source, target, amounts)
+}
+
+// Like ExchangeRates, but in the specified currency.
+func (self *Client) ExchangeRatesIn(ctx context.Context, currency, source,
+	target string, amounts []lurkcoin.Currency) ([]lurkcoin.ExchangeRate,
+	error) {
+	var res []lurkcoin.ExchangeRate
+	err := self.do(ctx, "POST", "exchange_rates/ladder",
+		map[string]interface{}{
+			"source":   source,
+			"target":   target,
+			"amounts":  amounts,
+			"currency": currency,
+		}, nil, &res)
+	return res, err
+}
+
+func (self *Client) PendingTransactions(ctx context.Context) ([]lurkcoin.Transaction, error) {
+	var transactions []lurkcoin.Transaction
+	err := self.do(ctx, "GET", "pending_transactions", nil, nil,
+		&transactions)
+	return transactions, err
+}
+
+type transactionList struct {
+	TransactionIDs []string `json:"transactions"`
+}
+
+// Removes transactions from the pending transaction list.
+func (self *Client) AcknowledgeTransactions(ctx context.Context, ids ...string) error {
+	return self.do(ctx, "POST", "acknowledge_transactions",
+		transactionList{ids}, nil, nil)
+}
+
+// Like AcknowledgeTransactions, but also returns whether each transaction
+// was pending (and has now been acknowledged) and the transactions that are
+// still pending afterwards.
+func (self *Client) AcknowledgeTransactionsDetailed(ctx context.Context,
+	ids ...string) (map[string]bool, []lurkcoin.Transaction, error) {
+	var res struct {
+		Acknowledged        map[string]bool        `json:"acknowledged"`
+		PendingTransactions []lurkcoin.Transaction `json:"pending_transactions"`
+	}
+	err := self.do(ctx, "POST", "acknowledge_transactions",
+		map[string]interface{}{"transactions": ids, "detailed": true}, nil,
+		&res)
+	return res.Acknowledged, res.PendingTransactions, err
+}
+
+// Rejects (and reverts if possible) pending transactions.
+func (self *Client) RejectTransactions(ctx context.Context, ids ...string) error {
+	return self.do(ctx, "POST", "reject_transactions", transactionList{ids},
+		nil, nil)
+}
+
+// Reverts a transaction that was sent to this server, even if it has already
+// been acknowledged. The transaction that sent the amount back is returned.
+func (self *Client) RevertTransaction(ctx context.Context,
+	id string) (*lurkcoin.Transaction, error) {
+	var transaction lurkcoin.Transaction
+	err := self.do(ctx, "POST", "revert_transaction",
+		map[string]string{"transaction": id}, nil, &transaction)
+	if err != nil {
+		return nil, err
+	}
+	return &transaction, nil
+}
+
+// Like RejectTransactions, but also returns whether each transaction was
+// rejected and the transaction that reverted it (if any). Transactions that
+// couldn't be rejected are still pending.
+func (self *Client) RejectTransactionsDetailed(ctx context.Context,
+	ids ...string) (map[string]lurkcoin.RejectionResult, error) {
+	var res map[string]lurkcoin.RejectionResult
+	err := self.do(ctx, "POST", "reject_transactions", transactionList{ids},
+		nil, &res)
+	return res, err
+}
+
+// Polls for pending transactions every interval until ctx is cancelled.
+// handler is called for every pending transaction. If it returns true the
+// transaction is acknowledged, otherwise it is rejected. Transient errors are
+// ignored, and the first other error is returned.
+func (self *Client) PollPendingTransactions(ctx context.Context,
+	interval time.Duration, handler func(lurkcoin.Transaction) bool) error {
+	for {
+		transactions, err := self.PendingTransactions(ctx)
+		if err == nil {
+			var accepted, rejected []string
+			for _, transaction := range transactions {
+				if handler(transaction) {
+					accepted = append(accepted, transaction.ID)
+				} else {
+					rejected = append(rejected, transaction.ID)
+				}
+			}
+			if len(accepted) > 0 {
+				err = self.AcknowledgeTransactions(ctx, accepted...)
+			}
+			if err == nil && len(rejected) > 0 {
+				err = self.RejectTransactions(ctx, rejected...)
+			}
+		}
+		if apiErr, ok := err.(*Error); ok && !apiErr.Temporary() {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
+
+// Returns a page of transactions sent or received by this server that match
+// filter, and the ID to use as filter.After to get the next page (or an empty
+// string if this is the last page). limit may be 0 to use the default page
+// size.
+func (self *Client) Transactions(ctx context.Context,
+	filter lurkcoin.TransactionFilter, limit int) ([]lurkcoin.Transaction,
+	string, error) {
+	query := make(url.Values)
+	if !filter.Since.IsZero() {
+		query.Set("since", strconv.FormatInt(filter.Since.Unix(), 10))
+	}
+	if !filter.Until.IsZero() {
+		query.Set("until", strconv.FormatInt(filter.Until.Unix(), 10))
+	}
+	if filter.Counterpart != "" {
+		query.Set("server", filter.Counterpart)
+	}
+	if filter.Direction != "" {
+		query.Set("direction", filter.Direction)
+	}
+	if !filter.MinAmount.IsNil() {
+		query.Set("min_amount", filter.MinAmount.RawString())
+	}
+	if filter.After != "" {
+		query.Set("after", filter.After)
+	}
+	if limit > 0 {
+		query.Set("limit", strconv.Itoa(limit))
+	}
+
+	var res struct {
+		Transactions []lurkcoin.Transaction `json:"transactions"`
+		Next         *string                `json:"next"`
+	}
+	err := self.do(ctx, "GET", "transactions?"+query.Encode(), nil, nil,
+		&res)
+	if err != nil || res.Next == nil {
+		return res.Transactions, "", err
+	}
+	return res.Transactions, *res.Next, nil
+}
+
+// Looks up a transaction sent or received by this server. Older
+// transactions can only be found if the journal is enabled on the lurkcoin
+// instance, otherwise ErrTransactionNotFound is returned.
+func (self *Client) Transaction(ctx context.Context,
+	id string) (*lurkcoin.TransactionStatus, error) {
+	var res lurkcoin.TransactionStatus
+	err := self.do(ctx, "GET", "transactions/"+url.PathEscape(id), nil, nil,
+		&res)
+	if err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+func (self *Client) TargetBalance(ctx context.Context) (lurkcoin.Currency, error) {
+	return self.TargetBalanceIn(ctx, "")
+}
+
+func (self *Client) TargetBalanceIn(ctx context.Context,
+	currency string) (lurkcoin.Currency, error) {
+	var res lurkcoin.Currency
+	endpoint := "target_balance"
+	if currency != "" {
+		endpoint += "?" + url.Values{"currency": {currency}}.Encode()
+	}
+	err := self.do(ctx, "GET", endpoint, nil, nil, &res)
+	return res, err
+}
+
+func (self *Client) SetTargetBalance(ctx context.Context,
+	targetBalance lurkcoin.Currency) error {
+	return self.SetTargetBalanceIn(ctx, "", targetBalance)
+}
+
+func (self *Client) SetTargetBalanceIn(ctx context.Context, currency string,
+	targetBalance lurkcoin.Currency) error {
+	return self.do(ctx, "PUT", "target_balance", map[string]interface{}{
+		"target_balance": targetBalance,
+		"currency":       currency,
+	}, nil, nil)
+}
+
+// Returns an empty string if no webhook URL is set.
+func (self *Client) WebhookURL(ctx context.Context) (string, error) {
+	var res *string
+	err := self.do(ctx, "GET", "webhook_url", nil, nil, &res)
+	if err != nil || res == nil {
+		return "", err
+	}
+	return *res, nil
+}
+
+// Sets the webhook URL (an empty string disables webhooks) and returns the
+// URL that will actually be used.
+func (self *Client) SetWebhookURL(ctx context.Context,
+	webhookURL string) (string, error) {
+	return self.SetWebhookURLVersion(ctx, webhookURL, 0)
+}
+
+// Like SetWebhookURL, but also sets the webhook version. Version 1 webhooks
+// include the transaction that was received.
+func (self *Client) SetWebhookURLVersion(ctx context.Context,
+	webhookURL string, version int) (string, error) {
+	var res *string
+	err := self.do(ctx, "PUT", "webhook_url", map[string]interface{}{
+		"webhook_url":     webhookURL,
+		"webhook_version": version,
+	}, nil, &res)
+	if err != nil || res == nil {
+		return "", err
+	}
+	return *res, nil
+}
+
+// Returns the key used to sign webhook requests, or an empty string if no
+// webhook URL has been set yet.
+func (self *Client) WebhookSecret(ctx context.Context) (string, error) {
+	var res *string
+	err := self.do(ctx, "GET", "webhook_secret", nil, nil, &res)
+	if err != nil || res == nil {
+		return "", err
+	}
+	return *res, nil
+}
+
+// Replaces the webhook secret and returns the new one.
+func (self *Client) RegenerateWebhookSecret(ctx context.Context) (string,
+	error) {
+	var res string
+	err := self.do(ctx, "POST", "regenerate_webhook_secret", nil, nil, &res)
+	return res, err
+}
+
+// Returns recent attempts to deliver webhooks to this server, newest first.
+func (self *Client) WebhookDeliveries(ctx context.Context) (
+	[]lurkcoin.WebhookDelivery, error) {
+	var res []lurkcoin.WebhookDelivery
+	err := self.do(ctx, "GET", "webhook_deliveries", nil, nil, &res)
+	return res, err
+}
+
+func (self *Client) Webhooks(ctx context.Context) ([]lurkcoin.WebhookEndpoint,
+	error) {
+	var res []lurkcoin.WebhookEndpoint
+	err := self.do(ctx, "GET", "webhooks", nil, nil, &res)
+	return res, err
+}
+
+// Adds a webhook endpoint that receives the specified events (see
+// lurkcoin.WebhookEvents).
+func (self *Client) AddWebhook(ctx context.Context, webhookURL string,
+	events []string) (*lurkcoin.WebhookEndpoint, error) {
+	var res lurkcoin.WebhookEndpoint
+	err := self.do(ctx, "POST", "webhooks/add", map[string]interface{}{
+		"url":    webhookURL,
+		"events": events,
+	}, nil, &res)
+	if err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+func (self *Client) RemoveWebhook(ctx context.Context, id string) error {
+	return self.do(ctx, "POST", "webhooks/remove", map[string]interface{}{
+		"id": id,
+	}, nil, nil)
+}
+
+// Checks the X-Lurkcoin-Timestamp and X-Lurkcoin-Signature headers of a
+// webhook request. Requests with timestamps that are more than
+// lurkcoin.WebhookReplayWindow away from the current time are rejected.
+func VerifyWebhookSignature(secret string, body []byte, timestamp,
+	signature string) bool {
+	t, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	age := time.Since(time.Unix(t, 0))
+	if age > lurkcoin.WebhookReplayWindow ||
+		age < -lurkcoin.WebhookReplayWindow {
+		return false
+	}
+	expected := lurkcoin.SignWebhookPayload(secret, t, body)
+	return hmac.Equal([]byte(expected), []byte(signature))
+}
+
+func (self *Client) WalletsEnabled(ctx context.Context) (bool, error) {
+	var res bool
+	err := self.do(ctx, "GET", "user_wallets", nil, nil, &res)
+	return res, err
+}
+
+// Enables or disables user wallets.
+func (self *Client) SetWalletsEnabled(ctx context.Context, enabled bool) error {
+	return self.do(ctx, "PUT", "user_wallets", map[string]interface{}{
+		"user_wallets": enabled,
+	}, nil, nil)
+}
+
+// Registers a user with the global username registry and returns their
+// global ID.
+func (self *Client) RegisterIdentity(ctx context.Context,
+	user string) (string, error) {
+	var id string
+	err := self.do(ctx, "POST", "identities/register",
+		map[string]string{"user": user}, nil, &id)
+	return id, err
+}
+
+// Removes a user from the global username registry.
+func (self *Client) UnregisterIdentity(ctx context.Context, user string) error {
+	return self.do(ctx, "POST", "identities/unregister",
+		map[string]string{"user": user}, nil, nil)
+}
+
+// Creates a code that can be passed to LinkIdentity on another server to
+// link a user there to the same global ID.
+func (self *Client) IdentityLinkCode(ctx context.Context,
+	user string) (string, time.Time, error) {
+	var res struct {
+		Code    string `json:"code"`
+		Expires int64  `json:"expires"`
+	}
+	err := self.do(ctx, "POST", "identities/link_code",
+		map[string]string{"user": user}, nil, &res)
+	return res.Code, time.Unix(res.Expires, 0), err
+}
+
+// Links a user to the global ID of a link code and returns the global ID.
+func (self *Client) LinkIdentity(ctx context.Context,
+	user, code string) (string, error) {
+	var id string
+	err := self.do(ctx, "POST", "identities/link",
+		map[string]string{"user": user, "code": code}, nil, &id)
+	return id, err
+}
+
+// A global ID and the accounts linked to it.
+type Identity struct {
+	ID       string                     `json:"id"`
+	Accounts []lurkcoin.IdentityAccount `json:"accounts"`
+}
+
+func (self *Client) getIdentity(ctx context.Context,
+	query url.Values) (*Identity, error) {
+	var res *Identity
+	err := self.do(ctx, "GET", "identities?"+query.Encode(), nil, nil, &res)
+	return res, err
+}
+
+// Returns the accounts linked to a global ID, or nil if there aren't any.
+func (self *Client) Identity(ctx context.Context, id string) (*Identity,
+	error) {
+	return self.getIdentity(ctx, url.Values{"id": {id}})
+}
+
+// Looks up the global ID of a user on any server, or returns nil if the user
+// isn't registered.
+func (self *Client) LookupIdentity(ctx context.Context,
+	server, user string) (*Identity, error) {
+	return self.getIdentity(ctx, url.Values{"server": {server},
+		"user": {user}})
+}
@@ -0,0 +1,94 @@
+//
+// lurkcoin API client
+// Copyright © 2020 by luk3yx
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package client
+
+import "net/http"
+
+// An error returned by the lurkcoin API. Errors can be compared with the
+// below variables using errors.Is(), for example
+// errors.Is(err, client.ErrCannotAfford).
+type Error struct {
+	// The error code, for example "ERR_CANNOTAFFORD".
+	Code string
+
+	// A human-readable error message.
+	Message string
+
+	// The HTTP status code returned by the server.
+	StatusCode int
+
+	// The request ID assigned by the server, this can be used to find the
+	// request in the server's logs.
+	RequestID string
+}
+
+func (self *Error) Error() string {
+	if self.Message == "" {
+		return self.Code
+	}
+	return self.Code + ": " + self.Message
+}
+
+func (self *Error) Is(target error) bool {
+	err, ok := target.(*Error)
+	return ok && err.Code == self.Code
+}
+
+// Returns true if the request can safely be retried.
+func (self *Error) Temporary() bool {
+	return self.StatusCode >= 500 ||
+		self.StatusCode == http.StatusTooManyRequests
+}
+
+func apiError(code string) *Error {
+	return &Error{Code: code}
+}
+
+var (
+	ErrInvalidLogin               = apiError("ERR_INVALIDLOGIN")
+	ErrInvalidRequest             = apiError("ERR_INVALIDREQUEST")
+	ErrPayloadTooLarge            = apiError("ERR_PAYLOADTOOLARGE")
+	ErrServerNotFound             = apiError("ERR_SERVERNOTFOUND")
+	ErrInvalidAmount              = apiError("ERR_INVALIDAMOUNT")
+	ErrCannotPayNothing           = apiError("ERR_CANNOTPAYNOTHING")
+	ErrCannotAfford               = apiError("ERR_CANNOTAFFORD")
+	ErrSourceUsernameTooLong      = apiError("ERR_SOURCEUSERNAMETOOLONG")
+	ErrUsernameTooLong            = apiError("ERR_USERNAMETOOLONG")
+	ErrSourceServerNotFound       = apiError("ERR_SOURCESERVERNOTFOUND")
+	ErrTargetServerNotFound       = apiError("ERR_TARGETSERVERNOTFOUND")
+	ErrTransactionLimit           = apiError("ERR_TRANSACTIONLIMIT")
+	ErrTransactionNotFound        = apiError("ERR_TRANSACTIONNOTFOUND")
+	ErrTooManyPendingTransactions = apiError("ERR_TOOMANYPENDINGTRANSACTIONS")
+	ErrInvalidLinkCode            = apiError("ERR_INVALIDLINKCODE")
+	ErrCannotRevert               = apiError("ERR_CANNOTREVERT")
+	ErrRevertWindowExpired        = apiError("ERR_REVERTWINDOWEXPIRED")
+	ErrAccountFrozen              = apiError("ERR_ACCOUNTFROZEN")
+	ErrInvalidQuote               = apiError("ERR_INVALIDQUOTE")
+	ErrQuoteExpired               = apiError("ERR_QUOTEEXPIRED")
+	ErrInvalidCurrency            = apiError("ERR_INVALIDCURRENCY")
+	ErrIdempotencyConflict        = apiError("ERR_IDEMPOTENCYCONFLICT")
+	ErrInvalidWebhookURL          = apiError("ERR_INVALIDWEBHOOKURL")
+	ErrWebhookVerificationFailed  = apiError("ERR_WEBHOOKVERIFICATIONFAILED")
+	ErrInvalidWebhookVersion      = apiError("ERR_INVALIDWEBHOOKVERSION")
+	ErrInvalidWebhookEvent        = apiError("ERR_INVALIDWEBHOOKEVENT")
+	ErrTooManyWebhooks            = apiError("ERR_TOOMANYWEBHOOKS")
+	ErrWebhookNotFound            = apiError("ERR_WEBHOOKNOTFOUND")
+	ErrInternalError              = apiError("ERR_INTERNALERROR")
+	ErrRateLimited                = apiError("ERR_RATELIMITED")
+)
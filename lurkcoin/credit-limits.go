@@ -0,0 +1,59 @@
+//
+// lurkcoin credit limits
+// Copyright © 2020 by luk3yx
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package lurkcoin
+
+import "errors"
+
+// Admins can give servers a credit limit, which allows their balance to go
+// below zero (down to the negative of the credit limit). Servers don't have
+// a credit limit by default.
+
+// Returns the server's credit limit, this is zero if the server doesn't have
+// one.
+func (self *Server) GetCreditLimit() Currency {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	return self.creditLimit
+}
+
+// Sets the server's credit limit. Lowering the credit limit doesn't change
+// the balance, however the server can't send payments until its balance is
+// above the negative of the new limit.
+func (self *Server) SetCreditLimit(limit Currency) error {
+	if limit.IsNil() || limit.LtZero() {
+		return errors.New("The credit limit must not be negative.")
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.creditLimit = limit
+	self.modified = true
+	self.queueSettingsEvent("credit_limit")
+	return nil
+}
+
+// Returns the amount of credit that the server is using (zero if its balance
+// isn't negative).
+func (self *Server) GetCreditUsed() Currency {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	if self.balance.LtZero() {
+		return self.balance.Neg()
+	}
+	return c0
+}
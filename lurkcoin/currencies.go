@@ -0,0 +1,188 @@
+//
+// lurkcoin multiple currencies
+// Copyright © 2020 by luk3yx
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package lurkcoin
+
+import (
+	"errors"
+	"math/big"
+	"regexp"
+	"sort"
+	"sync"
+)
+
+// Additional currencies, each server has a separate balance and target
+// balance (and therefore exchange rate) in each currency. The primary
+// currency (lurkcoins) has an empty name.
+var currenciesLock sync.RWMutex
+var currencies = make(map[string]bool)
+
+var currencyNameRegex = regexp.MustCompile(`^[a-z][a-z0-9_]{0,31}$`)
+
+// Sets the additional currencies. Balances in currencies that are removed
+// are kept in the database but can't be used.
+func SetCurrencies(names []string) error {
+	res := make(map[string]bool, len(names))
+	for _, name := range names {
+		if !currencyNameRegex.MatchString(name) || name == "lurkcoin" {
+			return errors.New("Invalid currency name: " + repr(name))
+		} else if res[name] {
+			return errors.New("Duplicate currency: " + repr(name))
+		}
+		res[name] = true
+	}
+	currenciesLock.Lock()
+	defer currenciesLock.Unlock()
+	currencies = res
+	return nil
+}
+
+// Returns a sorted list of additional currencies.
+func GetCurrencies() []string {
+	currenciesLock.RLock()
+	defer currenciesLock.RUnlock()
+	res := make([]string, 0, len(currencies))
+	for name := range currencies {
+		res = append(res, name)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// Returns true if currency is the primary currency or an additional
+// currency.
+func IsValidCurrency(currency string) bool {
+	if currency == "" {
+		return true
+	}
+	currenciesLock.RLock()
+	defer currenciesLock.RUnlock()
+	return currencies[currency]
+}
+
+type currencyBalance struct {
+	balance       Currency
+	targetBalance Currency
+}
+
+// The format balances in additional currencies are stored in.
+type EncodedBalance struct {
+	Balance       *big.Int `json:"balance"`
+	TargetBalance *big.Int `json:"target_balance"`
+}
+
+// Returns the balance and target balance in currency. self.lock must be held
+// when calling this.
+func (self *Server) balancesIn(currency string) (Currency, Currency) {
+	if currency == "" {
+		return self.balance, self.targetBalance
+	}
+	if b, ok := self.balances[currency]; ok {
+		return b.balance, b.targetBalance
+	}
+	return c0, GetDefaultTargetBalance()
+}
+
+func (self *Server) GetBalanceIn(currency string) Currency {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	balance, _ := self.balancesIn(currency)
+	return balance
+}
+
+func (self *Server) GetTargetBalanceIn(currency string) Currency {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	_, targetBalance := self.balancesIn(currency)
+	return targetBalance
+}
+
+// Returns the server's balances in additional currencies, including ones
+// that have since been removed.
+func (self *Server) GetBalances() map[string]Currency {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	res := make(map[string]Currency, len(self.balances))
+	for currency, b := range self.balances {
+		res[currency] = b.balance
+	}
+	return res
+}
+
+// Like ChangeBal but for any currency. Credit limits only apply to the
+// primary currency.
+func (self *Server) ChangeBalIn(currency string, num Currency) bool {
+	if currency == "" {
+		return self.ChangeBal(num)
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	balance, targetBalance := self.balancesIn(currency)
+	balance = balance.Add(num)
+	if num.LtZero() && balance.LtZero() {
+		return false
+	}
+	if self.balances == nil {
+		self.balances = make(map[string]currencyBalance)
+	}
+	self.balances[currency] = currencyBalance{balance, targetBalance}
+	self.modified = true
+	if events := self.queuedWebhookEvents(); events != nil {
+		events.balance = true
+	}
+	return true
+}
+
+// Like SetTargetBalance but for any currency.
+func (self *Server) SetTargetBalanceIn(currency string,
+	targetBalance Currency) bool {
+	if currency == "" {
+		return self.SetTargetBalance(targetBalance)
+	}
+	if targetBalance.LtZero() || targetBalance.Gt(GetMaxTargetBalance()) {
+		return false
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	balance, _ := self.balancesIn(currency)
+	if self.balances == nil {
+		self.balances = make(map[string]currencyBalance)
+	}
+	self.balances[currency] = currencyBalance{balance, targetBalance}
+	self.modified = true
+	self.queueSettingsEvent("target_balance")
+	return true
+}
+
+// Gets the exchange rate in currency, see GetExchangeRate().
+func (self *Server) GetExchangeRateIn(currency string, amount Currency,
+	toLurkcoin bool) (Currency, *big.Float) {
+	self.lock.RLock()
+	balance, targetBalance := self.balancesIn(currency)
+	self.lock.RUnlock()
+	return calculateExchangeRate(balance, targetBalance, amount, toLurkcoin)
+}
+
+// Sends a payment in currency.
+func (sourceServer *Server) PayIn(currency, source, target string,
+	targetServer *Server, sentAmount Currency, localCurrency bool,
+	revertable bool) (*Transaction, error) {
+	return sourceServer.pay(source, target, targetServer, sentAmount,
+		localCurrency, revertable, "", nil, currency)
+}
@@ -0,0 +1,107 @@
+//
+// lurkcoin currency arithmetic
+// Copyright © 2020 by luk3yx
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package lurkcoin
+
+import (
+	"math/big"
+	"strconv"
+)
+
+// Determines how results are rounded to the currency's precision.
+type RoundingMode uint8
+
+const (
+	// Rounds towards zero, this is what CurrencyFromFloat() does.
+	RoundTowardsZero RoundingMode = iota
+	RoundFloor
+	RoundCeil
+	RoundHalfEven
+)
+
+// Rounds num to an integer.
+func roundRat(num *big.Rat, mode RoundingMode) *big.Int {
+	res, rem := new(big.Int).QuoRem(num.Num(), num.Denom(), new(big.Int))
+	if rem.Sign() == 0 {
+		return res
+	}
+
+	// res has been rounded towards zero, work out if it should be rounded
+	// away from zero instead.
+	var away bool
+	switch mode {
+	case RoundFloor:
+		away = num.Sign() < 0
+	case RoundCeil:
+		away = num.Sign() > 0
+	case RoundHalfEven:
+		rem.Abs(rem).Lsh(rem, 1)
+		cmp := rem.Cmp(num.Denom())
+		away = cmp > 0 || (cmp == 0 && res.Bit(0) == 1)
+	}
+
+	if away {
+		res.Add(res, big.NewInt(int64(num.Sign())))
+	}
+	return res
+}
+
+// Converts a float64 to a big.Rat using its shortest decimal representation,
+// so that (for example) 0.3 becomes 3/10 and not 0.299999999999999988898.
+func ratFromFloat64(num float64) *big.Rat {
+	res, ok := new(big.Rat).SetString(strconv.FormatFloat(num, 'g', -1, 64))
+	if !ok {
+		panic("ratFromFloat64() called with NaN or infinity")
+	}
+	return res
+}
+
+// Converts num to Currency using the specified rounding mode.
+func CurrencyFromRat(num *big.Rat, mode RoundingMode) Currency {
+	r := new(big.Rat).SetInt(getPrecision().scale)
+	return Currency{roundRat(r.Mul(r, num), mode)}
+}
+
+// Multiplies the currency value by num without any floating point errors.
+func (self Currency) Mul(num *big.Rat, mode RoundingMode) Currency {
+	r := new(big.Rat).SetInt(self.raw)
+	return Currency{roundRat(r.Mul(r, num), mode)}
+}
+
+func (self Currency) MulFloat64(num float64, mode RoundingMode) Currency {
+	return self.Mul(ratFromFloat64(num), mode)
+}
+
+// Returns percentage% of the currency value.
+func (self Currency) Percentage(percentage float64,
+	mode RoundingMode) Currency {
+	r := ratFromFloat64(percentage)
+	return self.Mul(r.Quo(r, big.NewRat(100, 1)), mode)
+}
+
+// Rounds the currency value to the specified number of decimal places.
+func (self Currency) Round(decimals int, mode RoundingMode) Currency {
+	p := getPrecision()
+	if decimals >= p.decimals {
+		return self
+	}
+	scale := new(big.Int).Exp(i10, big.NewInt(int64(p.decimals-decimals)),
+		nil)
+	res := roundRat(new(big.Rat).SetFrac(self.raw, scale), mode)
+	return Currency{res.Mul(res, scale)}
+}
@@ -20,8 +20,10 @@ package lurkcoin
 
 import (
 	"errors"
+	"fmt"
 	"math/big"
 	"strings"
+	"sync/atomic"
 )
 
 // Create a custom Currency type that stores read-only currency values.
@@ -31,30 +33,142 @@ type Currency struct {
 
 var i0 = big.NewInt(0)
 var i10 = big.NewInt(10)
-var i100 = big.NewInt(100)
+
+// The number of decimal places stored in Currency values.
+const DefaultCurrencyDecimals = 2
+const MaxCurrencyDecimals = 8
+
+type currencyPrecision struct {
+	decimals int
+	scale    *big.Int
+	scaleF   *big.Float
+}
+
+var precision atomic.Value
+var defaultPrecision = newCurrencyPrecision(DefaultCurrencyDecimals)
+
+func newCurrencyPrecision(decimals int) *currencyPrecision {
+	scale := new(big.Int).Exp(i10, big.NewInt(int64(decimals)), nil)
+	return &currencyPrecision{decimals, scale, new(big.Float).SetInt(scale)}
+}
+
+func getPrecision() *currencyPrecision {
+	if p, ok := precision.Load().(*currencyPrecision); ok {
+		return p
+	}
+	return defaultPrecision
+}
+
+// Returns the number of decimal places currency values are stored with.
+func GetCurrencyDecimals() int {
+	return getPrecision().decimals
+}
+
+// Changes the number of decimal places currency values are stored with. This
+// should be called before the database is opened, stored values are converted
+// when they are loaded. If the precision is lowered, CheckCurrencyPrecision()
+// should be used to make sure that no stored values would lose precision.
+func SetCurrencyDecimals(decimals int) error {
+	if decimals < DefaultCurrencyDecimals || decimals > MaxCurrencyDecimals {
+		return fmt.Errorf("The currency precision must be between %d and %d "+
+			"decimal places.", DefaultCurrencyDecimals, MaxCurrencyDecimals)
+	}
+	old := GetCurrencyDecimals()
+	if decimals == old {
+		return nil
+	}
+	precision.Store(newCurrencyPrecision(decimals))
+
+	// Convert any global currency values to the new precision.
+	rescale := func(c Currency) Currency {
+		return Currency{rescaleRaw(c.raw, old, decimals)}
+	}
+	transactionLimitLock.Lock()
+	transactionLimit = rescale(transactionLimit)
+	maxTransactionLimit = rescale(maxTransactionLimit)
+	transactionLimitLock.Unlock()
+
+	targetBalanceLock.Lock()
+	maxTargetBalance = rescale(maxTargetBalance)
+	defaultTargetBalance = rescale(defaultTargetBalance)
+	targetBalanceLock.Unlock()
+
+	c1 = CurrencyFromInt64(1)
+	return nil
+}
+
+// Converts a raw value stored with one precision to another precision.
+func rescaleRaw(raw *big.Int, from, to int) *big.Int {
+	res := new(big.Int)
+	if to > from {
+		scale := new(big.Int).Exp(i10, big.NewInt(int64(to-from)), nil)
+		res.Mul(raw, scale)
+	} else if to < from {
+		scale := new(big.Int).Exp(i10, big.NewInt(int64(from-to)), nil)
+		res.Quo(raw, scale)
+	} else {
+		res.Set(raw)
+	}
+	return res
+}
+
+// Returns true if a raw integer stored with the given number of decimal
+// places (where 0 means the default) can be represented with the current
+// precision.
+func isRawRepresentable(raw *big.Int, decimals uint8) bool {
+	from, to := int(decimals), GetCurrencyDecimals()
+	if from <= to || raw == nil {
+		return true
+	}
+	scale := new(big.Int).Exp(i10, big.NewInt(int64(from-to)), nil)
+	return new(big.Int).Rem(raw, scale).Sign() == 0
+}
+
+// Converts a raw integer stored with the given number of decimal places
+// (where 0 means the default) to Currency. This panics instead of truncating
+// values that can't be represented with the current precision, lurkcoin
+// refuses to start if there are any (see CheckCurrencyPrecision).
+func currencyFromRaw(raw *big.Int, decimals uint8) Currency {
+	from := int(decimals)
+	if from == 0 {
+		from = DefaultCurrencyDecimals
+	}
+	if !isRawRepresentable(raw, uint8(from)) {
+		panic("Currency value has too many decimal places!")
+	}
+	return Currency{rescaleRaw(raw, from, GetCurrencyDecimals())}
+}
+
+// Returns the decimals value that should be stored alongside raw integers.
+func encodedCurrencyDecimals() uint8 {
+	decimals := GetCurrencyDecimals()
+	if decimals == DefaultCurrencyDecimals {
+		return 0
+	}
+	return uint8(decimals)
+}
 
 // A method to convert currency to a string.
 func (self Currency) RawString() string {
-	// This should probably be improved.
+	p := getPrecision()
 	whole := new(big.Int)
 	frac := new(big.Int)
 
 	var res string
 	if self.raw.Cmp(i0) >= 0 {
-		whole.DivMod(self.raw, i100, frac)
+		whole.DivMod(self.raw, p.scale, frac)
 		res = whole.String()
 	} else {
-		whole.DivMod(new(big.Int).Abs(self.raw), i100, frac)
+		whole.DivMod(new(big.Int).Abs(self.raw), p.scale, frac)
 		res = "-" + whole.String()
 	}
 
-	res += "."
-	if frac.Cmp(i10) < 0 {
-		res += "0"
-	} else if frac.Cmp(i100) >= 0 {
+	fracString := frac.String()
+	if len(fracString) > p.decimals {
 		panic("Unreachable code (big.Int DivMod did something it shouldn't).")
 	}
-	return res + frac.String()
+	return res + "." + strings.Repeat("0", p.decimals-len(fracString)) +
+		fracString
 }
 
 // Returns the currency as a human-readable string.
@@ -72,7 +186,7 @@ func (self Currency) String() string {
 
 	// Insert a comma when required
 	// 123456.78 → 123,456.78
-	l := len(raw) - 3
+	l := strings.IndexByte(raw, '.')
 	for i := s; i < len(raw); i++ {
 		if l > i && i > s && (l-i)%3 == 0 {
 			builder.WriteByte(',')
@@ -149,23 +263,26 @@ func (self Currency) IsNil() bool {
 }
 
 // Conversions
-var f100 *big.Float = big.NewFloat(100)
-
 func (self Currency) Float() *big.Float {
 	raw := new(big.Float).SetInt(self.raw)
-	return new(big.Float).Quo(raw, f100)
+	return new(big.Float).Quo(raw, getPrecision().scaleF)
 }
 
 func (self Currency) Int() *big.Int {
 	return new(big.Int).Set(self.raw)
 }
 
+// Returns the exact value of the currency as a big.Rat.
+func (self Currency) Rat() *big.Rat {
+	return new(big.Rat).SetFrac(self.raw, getPrecision().scale)
+}
+
 // JSON
 func (self Currency) MarshalJSON() ([]byte, error) {
 	res := []byte(self.RawString())
-	// Remove a single trailing zero (if any). If all trailing zeroes were
-	// removed, Python would interpret the value as an integer instead.
-	if res[len(res)-1] == '0' {
+	// Remove trailing zeroes but keep at least one decimal place, otherwise
+	// Python would interpret the value as an integer instead.
+	for res[len(res)-1] == '0' && res[len(res)-2] != '.' {
 		res = res[:len(res)-1]
 	}
 	return res, nil
@@ -180,11 +297,15 @@ func (self *Currency) setString(data string) bool {
 		data = data[2:]
 	}
 
-	f, success := new(big.Float).SetString(data)
+	// Use big.Rat so that values aren't subject to floating point errors,
+	// anything past the last decimal place is truncated.
+	if strings.ContainsRune(data, '/') {
+		return false
+	}
+	r, success := new(big.Rat).SetString(data)
 	if success {
-		res := new(big.Int)
-		new(big.Float).Mul(f, f100).Int(res)
-		self.raw = res
+		r.Mul(r, new(big.Rat).SetInt(getPrecision().scale))
+		self.raw = new(big.Int).Quo(r.Num(), r.Denom())
 	}
 	return success
 }
@@ -204,22 +325,42 @@ func (self *Currency) UnmarshalJSON(data []byte) error {
 	}
 }
 
+// Values with the default precision are encoded as plain big.Int values for
+// compatibility, other values are prefixed with 'd' and the number of decimal
+// places.
 func (self *Currency) GobEncode() ([]byte, error) {
-	return self.raw.GobEncode()
+	data, err := self.raw.GobEncode()
+	if err != nil || data == nil {
+		return data, err
+	}
+	decimals := encodedCurrencyDecimals()
+	if decimals == 0 {
+		return data, nil
+	}
+	return append([]byte{'d', decimals}, data...), nil
 }
 
 func (self *Currency) GobDecode(data []byte) error {
 	if self.raw != nil {
 		return errors.New("GobDecode() on already initialised Currency.")
 	}
-	self.raw = new(big.Int)
-	return self.raw.GobDecode(data)
+	var decimals uint8
+	if len(data) >= 2 && data[0] == 'd' {
+		decimals = data[1]
+		data = data[2:]
+	}
+	raw := new(big.Int)
+	if err := raw.GobDecode(data); err != nil {
+		return err
+	}
+	*self = currencyFromRaw(raw, decimals)
+	return nil
 }
 
 // Create new currency values
 func CurrencyFromFloat(num *big.Float) Currency {
 	f := new(big.Float)
-	f.Mul(num, f100)
+	f.Mul(num, getPrecision().scaleF)
 	raw := new(big.Int)
 	f.Int(raw)
 	return Currency{raw}
@@ -230,7 +371,8 @@ func CurrencyFromInt(num *big.Int) Currency {
 }
 
 func CurrencyFromInt64(num int64) Currency {
-	return Currency{new(big.Int).SetInt64(num * 100)}
+	raw := new(big.Int).SetInt64(num)
+	return Currency{raw.Mul(raw, getPrecision().scale)}
 }
 
 func CurrencyFromFloat64(num float64) Currency {
@@ -0,0 +1,255 @@
+//
+// lurkcoin currency tests
+// Copyright © 2020 by luk3yx
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package lurkcoin
+
+import (
+	"math/big"
+	"testing"
+)
+
+func setTestDecimals(t *testing.T, decimals int) {
+	if err := SetCurrencyDecimals(decimals); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRoundHalfEven(t *testing.T) {
+	tests := []struct {
+		num, expected string
+	}{
+		{"0.125", "0.12"},
+		{"0.135", "0.14"},
+		{"0.1251", "0.13"},
+		{"0.1249", "0.12"},
+		{"-0.125", "-0.12"},
+		{"-0.135", "-0.14"},
+		{"-0.1251", "-0.13"},
+		{"2.5", "2.50"},
+		{"0.005", "0.00"},
+		{"0.015", "0.02"},
+		{"-0.005", "0.00"},
+		{"1/3", "0.33"},
+		{"2/3", "0.67"},
+	}
+	for _, test := range tests {
+		num, ok := new(big.Rat).SetString(test.num)
+		if !ok {
+			t.Fatalf("invalid test number %q", test.num)
+		}
+		res := CurrencyFromRat(num, RoundHalfEven).RawString()
+		if res != test.expected {
+			t.Errorf("CurrencyFromRat(%s): got %s, expected %s", test.num,
+				res, test.expected)
+		}
+	}
+}
+
+func TestRoundingModes(t *testing.T) {
+	tests := []struct {
+		num      string
+		mode     RoundingMode
+		expected string
+	}{
+		{"1.005", RoundTowardsZero, "1.00"},
+		{"-1.005", RoundTowardsZero, "-1.00"},
+		{"1.005", RoundFloor, "1.00"},
+		{"-1.005", RoundFloor, "-1.01"},
+		{"1.005", RoundCeil, "1.01"},
+		{"-1.005", RoundCeil, "-1.00"},
+		{"1.005", RoundHalfEven, "1.00"},
+		{"-1.015", RoundHalfEven, "-1.02"},
+	}
+	for _, test := range tests {
+		num, _ := new(big.Rat).SetString(test.num)
+		res := CurrencyFromRat(num, test.mode).RawString()
+		if res != test.expected {
+			t.Errorf("CurrencyFromRat(%s, %d): got %s, expected %s",
+				test.num, test.mode, res, test.expected)
+		}
+	}
+}
+
+func TestCurrencyRoundHalfEven(t *testing.T) {
+	tests := []struct {
+		num      string
+		decimals int
+		expected string
+	}{
+		{"2.50", 0, "2.00"},
+		{"3.50", 0, "4.00"},
+		{"-2.50", 0, "-2.00"},
+		{"-3.50", 0, "-4.00"},
+		{"2.51", 0, "3.00"},
+		{"0.25", 1, "0.20"},
+		{"0.35", 1, "0.40"},
+		{"0.35", 2, "0.35"},
+	}
+	for _, test := range tests {
+		res := CurrencyFromString(test.num).Round(test.decimals,
+			RoundHalfEven).RawString()
+		if res != test.expected {
+			t.Errorf("%s.Round(%d): got %s, expected %s", test.num,
+				test.decimals, res, test.expected)
+		}
+	}
+
+	// 10.00 * 0.125 = 1.25, 10.10 * 0.125 = 1.2625
+	for _, test := range []struct{ num, expected string }{
+		{"10.00", "1.25"},
+		{"10.10", "1.26"},
+		{"10.20", "1.28"},
+		{"0.20", "0.02"},
+		{"0.60", "0.08"},
+	} {
+		res := CurrencyFromString(test.num).Mul(big.NewRat(1, 8),
+			RoundHalfEven).RawString()
+		if res != test.expected {
+			t.Errorf("%s.Mul(1/8): got %s, expected %s", test.num, res,
+				test.expected)
+		}
+	}
+}
+
+func TestRescaleRaw(t *testing.T) {
+	tests := []struct {
+		raw      int64
+		from, to int
+		expected int64
+	}{
+		{123, 2, 2, 123},
+		{123, 2, 4, 12300},
+		{-123, 2, 8, -123000000},
+		{12300, 4, 2, 123},
+		{12345, 4, 2, 123},
+		{-12345, 4, 2, -123},
+	}
+	for _, test := range tests {
+		res := rescaleRaw(big.NewInt(test.raw), test.from, test.to)
+		if res.Cmp(big.NewInt(test.expected)) != 0 {
+			t.Errorf("rescaleRaw(%d, %d, %d): got %s, expected %d",
+				test.raw, test.from, test.to, res, test.expected)
+		}
+	}
+}
+
+func TestCurrencyFromRaw(t *testing.T) {
+	defer SetCurrencyDecimals(DefaultCurrencyDecimals)
+
+	tests := []struct {
+		current  int
+		raw      int64
+		decimals uint8
+		expected string
+	}{
+		// A decimals value of 0 means the default precision.
+		{2, 123, 0, "1.23"},
+		{4, 123, 0, "1.2300"},
+		{4, 12345, 4, "1.2345"},
+		{8, -123, 0, "-1.23000000"},
+		{2, 12300, 4, "1.23"},
+		{4, 123450000, 8, "1.2345"},
+	}
+	for _, test := range tests {
+		setTestDecimals(t, test.current)
+		raw := big.NewInt(test.raw)
+		if !isRawRepresentable(raw, test.decimals) {
+			t.Errorf("%d (%d decimals) is not representable with %d "+
+				"decimals", test.raw, test.decimals, test.current)
+			continue
+		}
+		res := currencyFromRaw(raw, test.decimals).RawString()
+		if res != test.expected {
+			t.Errorf("currencyFromRaw(%d, %d) with %d decimals: got %s, "+
+				"expected %s", test.raw, test.decimals, test.current, res,
+				test.expected)
+		}
+	}
+}
+
+func TestCurrencyFromRawTruncation(t *testing.T) {
+	defer SetCurrencyDecimals(DefaultCurrencyDecimals)
+	setTestDecimals(t, 2)
+
+	for _, raw := range []int64{12345, -12345, 1} {
+		if isRawRepresentable(big.NewInt(raw), 4) {
+			t.Errorf("%d (4 decimals) is representable with 2 decimals", raw)
+		}
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("currencyFromRaw(%d, 4) did not panic", raw)
+				}
+			}()
+			currencyFromRaw(big.NewInt(raw), 4)
+		}()
+	}
+}
+
+func TestSetCurrencyDecimals(t *testing.T) {
+	defer SetCurrencyDecimals(DefaultCurrencyDecimals)
+	setTestDecimals(t, DefaultCurrencyDecimals)
+
+	for _, decimals := range []int{1, 9, -1} {
+		if SetCurrencyDecimals(decimals) == nil {
+			t.Errorf("SetCurrencyDecimals(%d) did not fail", decimals)
+		}
+	}
+
+	limit := GetTransactionLimit()
+	maxTarget := GetMaxTargetBalance()
+	defaultTarget := GetDefaultTargetBalance()
+	amount, err := ParseCurrency("1.23")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Global limits should keep the same value when the precision changes.
+	for _, decimals := range []int{4, 8, 3, DefaultCurrencyDecimals} {
+		setTestDecimals(t, decimals)
+		if GetCurrencyDecimals() != decimals {
+			t.Fatalf("GetCurrencyDecimals() returned %d, expected %d",
+				GetCurrencyDecimals(), decimals)
+		}
+		for _, c := range []struct {
+			name        string
+			old, actual Currency
+		}{
+			{"transaction limit", limit, GetTransactionLimit()},
+			{"max target balance", maxTarget, GetMaxTargetBalance()},
+			{"default target balance", defaultTarget,
+				GetDefaultTargetBalance()},
+		} {
+			expected := rescaleRaw(c.old.raw, DefaultCurrencyDecimals,
+				decimals)
+			if c.actual.raw.Cmp(expected) != 0 {
+				t.Errorf("%d decimals: %s is %s", decimals, c.name,
+					c.actual.RawString())
+			}
+		}
+
+		parsed, err := ParseCurrency("1.23")
+		if err != nil {
+			t.Errorf("%d decimals: %v", decimals, err)
+		} else if parsed.raw.Cmp(rescaleRaw(amount.raw,
+			DefaultCurrencyDecimals, decimals)) != 0 {
+			t.Errorf("%d decimals: 1.23 was parsed as %s", decimals,
+				parsed.RawString())
+		}
+	}
+}
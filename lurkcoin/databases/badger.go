@@ -0,0 +1,429 @@
+//
+// lurkcoin database (BadgerDB)
+// Copyright © 2020 by luk3yx
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+// +build !lurkcoin.disablebadger,!wasm
+
+package databases
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"github.com/luk3yx/lurkcoin-core/lurkcoin"
+	"strconv"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v2"
+)
+
+// Tags sent with any error reports.
+var badgerTags = map[string]string{"component": "badger"}
+
+// Servers are stored with this prefix so that other data can be added to the
+// database later.
+var badgerServerPrefix = []byte("lurkcoin/")
+
+type badgerDatabase struct {
+	db     *badger.DB
+	dblock genericDbLock
+	stopGC chan struct{}
+}
+
+// Audit log entries are stored as JSON with this prefix and their ID as a
+// big-endian number.
+var badgerAuditLogPrefix = []byte("audit_log/")
+
+// Admin users are stored as JSON with this prefix and their username.
+var badgerAdminUserPrefix = []byte("admin_users/")
+
+func badgerServerKey(uid string) []byte {
+	return append(append([]byte{}, badgerServerPrefix...), uid...)
+}
+
+func (self *badgerDatabase) GetServers(names []string) ([]*lurkcoin.Server, bool, string) {
+	return self.GetServersAs(lurkcoin.NewLockOwner(), names)
+}
+
+func (self *badgerDatabase) GetServersAs(owner lurkcoin.LockOwner,
+	names []string) ([]*lurkcoin.Server, bool, string) {
+	// Acquire locks
+	names, err := self.dblock.Lock(names, owner)
+	if err != nil {
+		return nil, false, reportLockError(err)
+	}
+
+	// Unlock if there is an error
+	ok := false
+	defer func() {
+		if !ok {
+			self.dblock.UnlockIDs(names)
+		}
+	}()
+
+	res := make([]*lurkcoin.Server, len(names))
+	var serverName string
+	err = self.db.View(func(tx *badger.Txn) error {
+		for i, name := range names {
+			item, err := tx.Get(badgerServerKey(name))
+			if err != nil {
+				serverName = name
+				return err
+			}
+			var encodedServer lurkcoin.EncodedServer
+			err = item.Value(func(raw []byte) error {
+				decoder := gob.NewDecoder(bytes.NewReader(raw))
+				return decoder.Decode(&encodedServer)
+			})
+			if err != nil {
+				return err
+			}
+			res[i] = encodedServer.Decode()
+		}
+		return nil
+	})
+
+	if err == nil {
+		ok = true
+		return res, true, serverName
+	} else {
+		return nil, false, serverName
+	}
+}
+
+func (self *badgerDatabase) FreeServers(servers []*lurkcoin.Server, save bool) {
+	defer self.dblock.Unlock(servers)
+	if !save {
+		return
+	}
+	err := self.db.Update(func(tx *badger.Txn) error {
+		for _, server := range servers {
+			if !server.IsModified() {
+				continue
+			}
+			var buf bytes.Buffer
+			encoder := gob.NewEncoder(&buf)
+			if err := encoder.Encode(server.Encode()); err != nil {
+				return err
+			}
+			if err := tx.Set(badgerServerKey(server.UID), buf.Bytes()); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		lurkcoin.ReportError(err, badgerTags)
+		panic(err)
+	}
+}
+
+// Creates a server. The server is not saved until FreeServer() is called.
+func (self *badgerDatabase) CreateServer(name string) (*lurkcoin.Server, bool) {
+	return self.CreateServerAs(lurkcoin.NewLockOwner(), name)
+}
+
+func (self *badgerDatabase) CreateServerAs(owner lurkcoin.LockOwner,
+	name string) (*lurkcoin.Server, bool) {
+	ids, err := self.dblock.Lock([]string{name}, owner)
+	if err != nil {
+		reportLockError(err)
+		return nil, false
+	}
+
+	err = self.db.View(func(tx *badger.Txn) error {
+		_, err := tx.Get(badgerServerKey(ids[0]))
+		return err
+	})
+	if err != badger.ErrKeyNotFound {
+		self.dblock.UnlockIDs(ids)
+		return nil, false
+	}
+
+	server := lurkcoin.NewServer(name)
+	return server, true
+}
+
+func (self *badgerDatabase) ListServers() (res []string) {
+	self.db.View(func(tx *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Prefix = badgerServerPrefix
+		it := tx.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			key := it.Item().Key()
+			res = append(res, string(key[len(badgerServerPrefix):]))
+		}
+		return nil
+	})
+	return
+}
+
+func (self *badgerDatabase) ListServersPage(after, prefix string,
+	limit int) (res []string) {
+	prefix = lurkcoin.HomogeniseUsername(prefix)
+	start, skip := serverPageStart(after, prefix)
+	self.db.View(func(tx *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Prefix = badgerServerKey(prefix)
+		it := tx.NewIterator(opts)
+		defer it.Close()
+		it.Seek(badgerServerKey(start))
+		for ; it.Valid() && (limit <= 0 || len(res) < limit); it.Next() {
+			uid := string(it.Item().Key()[len(badgerServerPrefix):])
+			if skip && uid == start {
+				continue
+			}
+			res = append(res, uid)
+		}
+		return nil
+	})
+	return
+}
+
+func (self *badgerDatabase) ForEachEncoded(f func(*lurkcoin.EncodedServer) error) error {
+	return self.db.View(func(tx *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = badgerServerPrefix
+		it := tx.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			var encodedServer lurkcoin.EncodedServer
+			err := it.Item().Value(func(raw []byte) error {
+				decoder := gob.NewDecoder(bytes.NewReader(raw))
+				return decoder.Decode(&encodedServer)
+			})
+			if err != nil {
+				return err
+			}
+			if err := f(&encodedServer); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// The next ID is found by looking at the last entry, concurrent writes
+// conflict with each other and are retried.
+func (self *badgerDatabase) AppendAuditLog(entry *lurkcoin.AuditLogEntry) error {
+	for {
+		err := self.db.Update(func(tx *badger.Txn) error {
+			opts := badger.DefaultIteratorOptions
+			opts.PrefetchValues = false
+			opts.Reverse = true
+			opts.Prefix = badgerAuditLogPrefix
+			it := tx.NewIterator(opts)
+			it.Seek(append(append([]byte{}, badgerAuditLogPrefix...), 0xff))
+			entry.ID = 1
+			if it.Valid() {
+				key := it.Item().Key()[len(badgerAuditLogPrefix):]
+				entry.ID = binary.BigEndian.Uint64(key) + 1
+			}
+			it.Close()
+
+			raw, err := json.Marshal(entry)
+			if err != nil {
+				return err
+			}
+			key := make([]byte, len(badgerAuditLogPrefix)+8)
+			copy(key, badgerAuditLogPrefix)
+			binary.BigEndian.PutUint64(key[len(badgerAuditLogPrefix):],
+				entry.ID)
+			return tx.Set(key, raw)
+		})
+		if err != badger.ErrConflict {
+			return err
+		}
+	}
+}
+
+func (self *badgerDatabase) ForEachAuditLog(f func(*lurkcoin.AuditLogEntry) error) error {
+	return self.db.View(func(tx *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Reverse = true
+		opts.Prefix = badgerAuditLogPrefix
+		it := tx.NewIterator(opts)
+		defer it.Close()
+		it.Seek(append(append([]byte{}, badgerAuditLogPrefix...), 0xff))
+		for ; it.Valid(); it.Next() {
+			var entry lurkcoin.AuditLogEntry
+			err := it.Item().Value(func(raw []byte) error {
+				return json.Unmarshal(raw, &entry)
+			})
+			if err != nil {
+				return err
+			}
+			if err := f(&entry); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (self *badgerDatabase) GetAdminUser(username string) (*lurkcoin.AdminUser, error) {
+	var user *lurkcoin.AdminUser
+	err := self.db.View(func(tx *badger.Txn) error {
+		key := append(append([]byte{}, badgerAdminUserPrefix...), username...)
+		item, err := tx.Get(key)
+		if err == badger.ErrKeyNotFound {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		user = new(lurkcoin.AdminUser)
+		return item.Value(func(raw []byte) error {
+			return json.Unmarshal(raw, user)
+		})
+	})
+	return user, err
+}
+
+func (self *badgerDatabase) SetAdminUser(user *lurkcoin.AdminUser) error {
+	raw, err := json.Marshal(user)
+	if err != nil {
+		return err
+	}
+	return self.db.Update(func(tx *badger.Txn) error {
+		key := append(append([]byte{}, badgerAdminUserPrefix...),
+			user.Username...)
+		return tx.Set(key, raw)
+	})
+}
+
+func (self *badgerDatabase) ListAdminUsers() ([]*lurkcoin.AdminUser, error) {
+	var res []*lurkcoin.AdminUser
+	err := self.db.View(func(tx *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = badgerAdminUserPrefix
+		it := tx.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			var user lurkcoin.AdminUser
+			err := it.Item().Value(func(raw []byte) error {
+				return json.Unmarshal(raw, &user)
+			})
+			if err != nil {
+				return err
+			}
+			res = append(res, &user)
+		}
+		return nil
+	})
+	return res, err
+}
+
+func (self *badgerDatabase) Ping() error {
+	if self.db.IsClosed() {
+		return errors.New("The database is closed.")
+	}
+	return self.db.View(func(*badger.Txn) error {
+		return nil
+	})
+}
+
+func (self *badgerDatabase) DeleteServer(name string) bool {
+	ids, err := self.dblock.Lock([]string{name}, lurkcoin.NewLockOwner())
+	if err != nil {
+		reportLockError(err)
+		return false
+	}
+	defer self.dblock.UnlockIDs(ids)
+	err = self.db.Update(func(tx *badger.Txn) error {
+		key := badgerServerKey(ids[0])
+		if _, err := tx.Get(key); err != nil {
+			return err
+		}
+		return tx.Delete(key)
+	})
+	return err == nil
+}
+
+func (self *badgerDatabase) GetLockStats() lurkcoin.LockStats {
+	return self.dblock.Stats()
+}
+
+// Badger doesn't remove old values from its value log automatically.
+func (self *badgerDatabase) runGC(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			for self.db.RunValueLogGC(0.5) == nil {
+			}
+		case <-self.stopGC:
+			return
+		}
+	}
+}
+
+func (self *badgerDatabase) Close() error {
+	close(self.stopGC)
+	return self.db.Close()
+}
+
+// Writes are synced to disk unless the "sync_writes" option is "false". The
+// "gc_interval" option sets how often to clean up the value log (default
+// "10m").
+func BadgerDatabase(dir string, options map[string]string) (lurkcoin.Database, error) {
+	syncWrites := true
+	if s, ok := options["sync_writes"]; ok {
+		var err error
+		syncWrites, err = strconv.ParseBool(s)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	gcInterval := 10 * time.Minute
+	if s, ok := options["gc_interval"]; ok {
+		var err error
+		gcInterval, err = time.ParseDuration(s)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	dblock, err := newGenericDbLock(options)
+	if err != nil {
+		return nil, err
+	}
+
+	badgerOptions := badger.DefaultOptions(dir).
+		WithSyncWrites(syncWrites).
+		WithLoggingLevel(badger.WARNING)
+	db, err := badger.Open(badgerOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &badgerDatabase{db, dblock, make(chan struct{})}
+	if gcInterval > 0 {
+		go res.runGC(gcInterval)
+	}
+	return res, nil
+}
+
+func init() {
+	RegisterDatabaseType("badger", BadgerDatabase)
+}
@@ -23,21 +23,40 @@ package databases
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/gob"
+	"encoding/json"
 	"errors"
 	"github.com/luk3yx/lurkcoin-core/lurkcoin"
+	"io"
+	"strconv"
+	"time"
 
 	bolt "go.etcd.io/bbolt"
 )
 
+// Tags sent with any error reports.
+var boltTags = map[string]string{"component": "bbolt"}
+
 type boltDatabase struct {
 	db     *bolt.DB
 	dblock genericDbLock
+
+	// If true, concurrent writes are combined into one transaction.
+	batch bool
 }
 
 func (self *boltDatabase) GetServers(names []string) ([]*lurkcoin.Server, bool, string) {
+	return self.GetServersAs(lurkcoin.NewLockOwner(), names)
+}
+
+func (self *boltDatabase) GetServersAs(owner lurkcoin.LockOwner,
+	names []string) ([]*lurkcoin.Server, bool, string) {
 	// Acquire locks
-	names = self.dblock.Lock(names)
+	names, err := self.dblock.Lock(names, owner)
+	if err != nil {
+		return nil, false, reportLockError(err)
+	}
 
 	// Unlock if there is an error
 	ok := false
@@ -49,7 +68,7 @@ func (self *boltDatabase) GetServers(names []string) ([]*lurkcoin.Server, bool,
 
 	res := make([]*lurkcoin.Server, len(names))
 	var serverName string
-	err := self.db.View(func(tx *bolt.Tx) error {
+	err = self.db.View(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte("lurkcoin"))
 		if bucket == nil {
 			if len(names) > 0 {
@@ -88,7 +107,14 @@ func (self *boltDatabase) FreeServers(servers []*lurkcoin.Server, save bool) {
 	if !save {
 		return
 	}
-	err := self.db.Update(func(tx *bolt.Tx) error {
+
+	// The function passed to Batch() may be called more than once, however
+	// that's fine since it only overwrites servers.
+	update := self.db.Update
+	if self.batch {
+		update = self.db.Batch
+	}
+	err := update(func(tx *bolt.Tx) error {
 		bucket, err := tx.CreateBucketIfNotExists([]byte("lurkcoin"))
 		if err != nil {
 			return err
@@ -105,15 +131,25 @@ func (self *boltDatabase) FreeServers(servers []*lurkcoin.Server, save bool) {
 		return nil
 	})
 	if err != nil {
+		lurkcoin.ReportError(err, boltTags)
 		panic(err)
 	}
 }
 
 // Creates a server. The server is not saved until FreeServer() is called.
 func (self *boltDatabase) CreateServer(name string) (*lurkcoin.Server, bool) {
-	ids := self.dblock.Lock([]string{name})
+	return self.CreateServerAs(lurkcoin.NewLockOwner(), name)
+}
 
-	err := self.db.View(func(tx *bolt.Tx) error {
+func (self *boltDatabase) CreateServerAs(owner lurkcoin.LockOwner,
+	name string) (*lurkcoin.Server, bool) {
+	ids, err := self.dblock.Lock([]string{name}, owner)
+	if err != nil {
+		reportLockError(err)
+		return nil, false
+	}
+
+	err = self.db.View(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte("lurkcoin"))
 		if bucket != nil && len(bucket.Get([]byte(ids[0]))) != 0 {
 			return errors.New("")
@@ -143,25 +179,235 @@ func (self *boltDatabase) ListServers() (res []string) {
 	return
 }
 
+func (self *boltDatabase) ListServersPage(after, prefix string,
+	limit int) (res []string) {
+	prefix = lurkcoin.HomogeniseUsername(prefix)
+	start, skip := serverPageStart(after, prefix)
+	self.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("lurkcoin"))
+		if bucket == nil {
+			return nil
+		}
+		c := bucket.Cursor()
+		k, _ := c.Seek([]byte(start))
+		if skip && string(k) == start {
+			k, _ = c.Next()
+		}
+		for ; k != nil && (limit <= 0 || len(res) < limit); k, _ = c.Next() {
+			if !bytes.HasPrefix(k, []byte(prefix)) {
+				break
+			}
+			res = append(res, string(k))
+		}
+		return nil
+	})
+	return
+}
+
+// Servers are read in a single read-only transaction, so f sees a consistent
+// copy of the database.
+func (self *boltDatabase) ForEachEncoded(f func(*lurkcoin.EncodedServer) error) error {
+	return self.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("lurkcoin"))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, raw []byte) error {
+			decoder := gob.NewDecoder(bytes.NewBuffer(raw))
+			var encodedServer lurkcoin.EncodedServer
+			if err := decoder.Decode(&encodedServer); err != nil {
+				return err
+			}
+			return f(&encodedServer)
+		})
+	})
+}
+
 func (self *boltDatabase) DeleteServer(name string) bool {
-	ids := self.dblock.Lock([]string{name})
+	ids, err := self.dblock.Lock([]string{name}, lurkcoin.NewLockOwner())
+	if err != nil {
+		reportLockError(err)
+		return false
+	}
 	defer self.dblock.UnlockIDs(ids)
-	err := self.db.Update(func(tx *bolt.Tx) error {
+	err = self.db.Update(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte("lurkcoin"))
-		if bucket != nil {
-			return bucket.Delete([]byte(ids[0]))
+		if bucket == nil || len(bucket.Get([]byte(ids[0]))) == 0 {
+			return errors.New("ERR_SERVERNOTFOUND")
 		}
-		return nil
+		return bucket.Delete([]byte(ids[0]))
 	})
 	return err == nil
 }
 
-func BoltDatabase(file string, _ map[string]string) (lurkcoin.Database, error) {
-	db, err := bolt.Open(file, 0600, nil)
+func (self *boltDatabase) GetLockStats() lurkcoin.LockStats {
+	return self.dblock.Stats()
+}
+
+// Snapshots are written in a read-only transaction so they don't block
+// anything.
+func (self *boltDatabase) WriteSnapshot(w io.Writer) error {
+	return self.db.View(func(tx *bolt.Tx) error {
+		_, err := tx.WriteTo(w)
+		return err
+	})
+}
+
+// Audit log entries are stored as JSON in the "audit_log" bucket, with their
+// ID (the bucket's sequence number) as a big-endian key.
+func (self *boltDatabase) AppendAuditLog(entry *lurkcoin.AuditLogEntry) error {
+	return self.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte("audit_log"))
+		if err != nil {
+			return err
+		}
+		entry.ID, err = bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		raw, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, entry.ID)
+		return bucket.Put(key, raw)
+	})
+}
+
+func (self *boltDatabase) ForEachAuditLog(f func(*lurkcoin.AuditLogEntry) error) error {
+	return self.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("audit_log"))
+		if bucket == nil {
+			return nil
+		}
+		c := bucket.Cursor()
+		for k, raw := c.Last(); k != nil; k, raw = c.Prev() {
+			var entry lurkcoin.AuditLogEntry
+			if err := json.Unmarshal(raw, &entry); err != nil {
+				return err
+			}
+			if err := f(&entry); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Admin users are stored as JSON in the "admin_users" bucket.
+func (self *boltDatabase) GetAdminUser(username string) (*lurkcoin.AdminUser, error) {
+	var user *lurkcoin.AdminUser
+	err := self.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("admin_users"))
+		if bucket == nil {
+			return nil
+		}
+		raw := bucket.Get([]byte(username))
+		if raw == nil {
+			return nil
+		}
+		user = new(lurkcoin.AdminUser)
+		return json.Unmarshal(raw, user)
+	})
+	return user, err
+}
+
+func (self *boltDatabase) SetAdminUser(user *lurkcoin.AdminUser) error {
+	raw, err := json.Marshal(user)
+	if err != nil {
+		return err
+	}
+	return self.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte("admin_users"))
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(user.Username), raw)
+	})
+}
+
+func (self *boltDatabase) ListAdminUsers() ([]*lurkcoin.AdminUser, error) {
+	var res []*lurkcoin.AdminUser
+	err := self.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("admin_users"))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(_, raw []byte) error {
+			var user lurkcoin.AdminUser
+			if err := json.Unmarshal(raw, &user); err != nil {
+				return err
+			}
+			res = append(res, &user)
+			return nil
+		})
+	})
+	return res, err
+}
+
+func (self *boltDatabase) Ping() error {
+	return self.db.View(func(*bolt.Tx) error {
+		return nil
+	})
+}
+
+func (self *boltDatabase) Close() error {
+	return self.db.Close()
+}
+
+// The "timeout" option sets how long to wait for the database file to be
+// unlocked (for example "5s"), by default this waits forever. If "read_only"
+// is "true", the database is opened read-only (and can be opened by multiple
+// processes at once).
+//
+// If "batch_delay" is set (for example "10ms"), writes made within that time
+// of each other are combined into one transaction (of up to "batch_size"
+// writes). This improves throughput on busy instances but delays writes
+// by up to batch_delay.
+func BoltDatabase(file string, options map[string]string) (lurkcoin.Database, error) {
+	boltOptions := *bolt.DefaultOptions
+	if timeout, ok := options["timeout"]; ok {
+		duration, err := time.ParseDuration(timeout)
+		if err != nil {
+			return nil, err
+		}
+		boltOptions.Timeout = duration
+	}
+	if readOnly, ok := options["read_only"]; ok {
+		var err error
+		boltOptions.ReadOnly, err = strconv.ParseBool(readOnly)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var batchDelay time.Duration
+	if delay, ok := options["batch_delay"]; ok {
+		var err error
+		batchDelay, err = time.ParseDuration(delay)
+		if err != nil {
+			return nil, err
+		}
+	}
+	batchSize := bolt.DefaultMaxBatchSize
+	if size, ok := options["batch_size"]; ok {
+		var err error
+		batchSize, err = strconv.Atoi(size)
+		if err != nil || batchSize < 1 {
+			return nil, errors.New("Invalid batch_size: " + size)
+		}
+	}
+	dblock, err := newGenericDbLock(options)
+	if err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(file, 0600, &boltOptions)
 	if err != nil {
 		return nil, err
 	}
-	return &boltDatabase{db, newGenericDbLock()}, nil
+	db.MaxBatchDelay = batchDelay
+	db.MaxBatchSize = batchSize
+	return &boltDatabase{db, dblock, batchDelay > 0}, nil
 }
 
 func init() {
@@ -0,0 +1,274 @@
+//
+// lurkcoin server cache
+// Copyright © 2020 by luk3yx
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package databases
+
+import (
+	"container/list"
+	"fmt"
+	"github.com/luk3yx/lurkcoin-core/lurkcoin"
+	"github.com/luk3yx/lurkcoin-core/lurkcoin/metrics"
+	"sync"
+)
+
+var serverCacheRequests = metrics.NewCounterVec(
+	"lurkcoin_server_cache_requests_total",
+	"The number of servers loaded through the server cache.",
+	"result",
+)
+
+type cacheEntry struct {
+	uid    string
+	server *lurkcoin.EncodedServer
+}
+
+// A Database wrapper that keeps recently used servers in memory so that they
+// don't have to be read from the underlying database (and decoded) every
+// time. Servers are locked by the wrapper and are only locked in the
+// underlying database while they are being read or written, so every
+// access to the underlying database must go through the wrapper.
+type cachedDatabase struct {
+	db     lurkcoin.Database
+	dblock genericDbLock
+	size   int
+
+	// Protects everything below.
+	lock    *sync.Mutex
+	lru     *list.List
+	entries map[string]*list.Element
+
+	// Servers returned by CreateServer that are still locked in the
+	// underlying database.
+	created map[string]*lurkcoin.Server
+}
+
+func (self *cachedDatabase) get(uid string) (*lurkcoin.EncodedServer, bool) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	e, ok := self.entries[uid]
+	if !ok {
+		return nil, false
+	}
+	self.lru.MoveToFront(e)
+	return e.Value.(*cacheEntry).server, true
+}
+
+func (self *cachedDatabase) add(uid string, server *lurkcoin.EncodedServer) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if e, ok := self.entries[uid]; ok {
+		e.Value.(*cacheEntry).server = server
+		self.lru.MoveToFront(e)
+		return
+	}
+
+	self.entries[uid] = self.lru.PushFront(&cacheEntry{uid, server})
+	for self.lru.Len() > self.size {
+		entry := self.lru.Remove(self.lru.Back()).(*cacheEntry)
+		delete(self.entries, entry.uid)
+	}
+}
+
+// self.lock must be locked.
+func (self *cachedDatabase) invalidate(uid string) {
+	if e, ok := self.entries[uid]; ok {
+		self.lru.Remove(e)
+		delete(self.entries, uid)
+	}
+}
+
+func (self *cachedDatabase) GetServers(names []string) ([]*lurkcoin.Server, bool, string) {
+	return self.GetServersAs(lurkcoin.NewLockOwner(), names)
+}
+
+func (self *cachedDatabase) GetServersAs(owner lurkcoin.LockOwner,
+	names []string) (servers []*lurkcoin.Server, ok bool, badServer string) {
+	ids, err := self.dblock.Lock(names, owner)
+	if err != nil {
+		return nil, false, reportLockError(err)
+	}
+	defer func() {
+		if !ok {
+			self.dblock.UnlockIDs(ids)
+		}
+	}()
+
+	servers = make([]*lurkcoin.Server, len(ids))
+	var missing []string
+	var missingIndexes []int
+	for i, id := range ids {
+		if encodedServer, cached := self.get(id); cached {
+			serverCacheRequests.Inc("hit")
+			servers[i] = encodedServer.Decode()
+		} else {
+			serverCacheRequests.Inc("miss")
+			missing = append(missing, id)
+			missingIndexes = append(missingIndexes, i)
+		}
+	}
+
+	if len(missing) > 0 {
+		loaded, loadedOk, bad := self.db.GetServers(missing)
+		if !loadedOk {
+			return nil, false, bad
+		}
+		for i, server := range loaded {
+			encodedServer := server.Encode()
+			self.add(server.UID, &encodedServer)
+			servers[missingIndexes[i]] = server
+		}
+		self.db.FreeServers(loaded, false)
+	}
+
+	return servers, true, ""
+}
+
+func (self *cachedDatabase) FreeServers(servers []*lurkcoin.Server, save bool) {
+	defer self.dblock.Unlock(servers)
+
+	var created, modified []*lurkcoin.Server
+	var uids []string
+	self.lock.Lock()
+	for _, server := range servers {
+		if createdServer, ok := self.created[server.UID]; ok {
+			delete(self.created, server.UID)
+			created = append(created, createdServer)
+		} else if save && server.IsModified() {
+			// Invalidate the cache before writing in case the write fails.
+			self.invalidate(server.UID)
+			modified = append(modified, server)
+			uids = append(uids, server.UID)
+		}
+	}
+	self.lock.Unlock()
+
+	if len(created) > 0 {
+		self.db.FreeServers(created, save)
+	}
+	if len(modified) == 0 {
+		return
+	}
+
+	// Copy the modified servers into the underlying database.
+	loaded, ok, badServer := self.db.GetServers(uids)
+	if !ok {
+		panic(fmt.Errorf("Server %q is missing from the underlying database.",
+			badServer))
+	}
+	encodedServers := make([]lurkcoin.EncodedServer, len(modified))
+	for i, server := range modified {
+		encodedServers[i] = server.Encode()
+		*loaded[i] = *encodedServers[i].Decode()
+		loaded[i].SetModified()
+	}
+	self.db.FreeServers(loaded, true)
+
+	for i, server := range modified {
+		self.add(server.UID, &encodedServers[i])
+	}
+}
+
+func (self *cachedDatabase) CreateServer(name string) (*lurkcoin.Server, bool) {
+	return self.CreateServerAs(lurkcoin.NewLockOwner(), name)
+}
+
+func (self *cachedDatabase) CreateServerAs(owner lurkcoin.LockOwner,
+	name string) (*lurkcoin.Server, bool) {
+	ids, err := self.dblock.Lock([]string{name}, owner)
+	if err != nil {
+		reportLockError(err)
+		return nil, false
+	}
+	if _, cached := self.get(ids[0]); cached {
+		self.dblock.UnlockIDs(ids)
+		return nil, false
+	}
+
+	// The new server stays locked in the underlying database until it is
+	// freed.
+	server, ok := self.db.CreateServer(name)
+	if !ok {
+		self.dblock.UnlockIDs(ids)
+		return nil, false
+	}
+	self.lock.Lock()
+	self.created[server.UID] = server
+	self.lock.Unlock()
+	return server, true
+}
+
+func (self *cachedDatabase) ListServers() []string {
+	return self.db.ListServers()
+}
+
+func (self *cachedDatabase) ListServersPage(after, prefix string,
+	limit int) []string {
+	return self.db.ListServersPage(after, prefix, limit)
+}
+
+// Changes are written to the underlying database as soon as servers are
+// freed, so there's no need to check the cache here.
+func (self *cachedDatabase) ForEachEncoded(f func(*lurkcoin.EncodedServer) error) error {
+	return self.db.ForEachEncoded(f)
+}
+
+func (self *cachedDatabase) DeleteServer(name string) bool {
+	ids, err := self.dblock.Lock([]string{name}, lurkcoin.NewLockOwner())
+	if err != nil {
+		reportLockError(err)
+		return false
+	}
+	defer self.dblock.UnlockIDs(ids)
+
+	self.lock.Lock()
+	self.invalidate(ids[0])
+	self.lock.Unlock()
+	return self.db.DeleteServer(ids[0])
+}
+
+func (self *cachedDatabase) GetLockStats() lurkcoin.LockStats {
+	return self.dblock.Stats()
+}
+
+func (self *cachedDatabase) UnwrapDatabase() lurkcoin.Database {
+	return self.db
+}
+
+// Wraps db so that up to size recently used servers are kept in memory.
+// This must not be used if anything else modifies db (for example other
+// lurkcoin instances using the same Redis database). The options are the
+// same as db's options and are used for lock_wait_timeout.
+func CachedDatabase(db lurkcoin.Database, size int,
+	options map[string]string) (lurkcoin.Database, error) {
+	if size <= 0 {
+		return nil, fmt.Errorf("Invalid cache size: %d", size)
+	}
+	dblock, err := newGenericDbLock(options)
+	if err != nil {
+		return nil, err
+	}
+	return &cachedDatabase{
+		db:      db,
+		dblock:  dblock,
+		size:    size,
+		lock:    new(sync.Mutex),
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+		created: make(map[string]*lurkcoin.Server),
+	}, nil
+}
@@ -0,0 +1,359 @@
+//
+// lurkcoin database locks
+// Copyright © 2020 by luk3yx
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package databases
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"github.com/luk3yx/lurkcoin-core/lurkcoin"
+	"sync"
+	"time"
+)
+
+var lockTags = map[string]string{"component": "database_lock"}
+
+// Returned (wrapped in a LockError) if a server lock can't be acquired in
+// time.
+var ErrLockTimeout = errors.New("Timed out waiting for a server lock")
+
+// Returned (wrapped in a LockError) instead of waiting for a lock that would
+// never be released, for example if a DatabaseTransaction tries to lock a
+// server that it has already locked, or if two DatabaseTransactions each hold
+// a server that the other one is waiting for.
+var ErrLockDeadlock = errors.New("Waiting for this server lock would " +
+	"deadlock")
+
+// Returned by Lock() if a server can't be locked.
+type LockError struct {
+	Server string
+	Err    error
+}
+
+func (self *LockError) Error() string {
+	return fmt.Sprintf("%s (server %q)", self.Err, self.Server)
+}
+
+func (self *LockError) Unwrap() error {
+	return self.Err
+}
+
+// Reports a Lock() error and returns the server that couldn't be locked, so
+// that GetServers() can return it.
+func reportLockError(err error) string {
+	lurkcoin.ReportError(err, lockTags)
+	var lockErr *LockError
+	if errors.As(err, &lockErr) {
+		return lockErr.Server
+	}
+	return ""
+}
+
+// A Lock() call that is waiting for servers to be unlocked.
+type lockWaiter struct {
+	ids     []string
+	owner   lurkcoin.LockOwner
+	ready   chan struct{}
+	granted bool
+	start   time.Time
+}
+
+// Generic database lock. Waiting calls are queued and granted in FIFO order,
+// a call is only granted once none of its servers are locked or wanted by
+// an earlier call in the queue, so calls that lock several servers can't be
+// starved by calls that only lock one.
+type genericDbLock struct {
+	lock *sync.Mutex
+
+	// The servers that are locked, mapped to whatever locked them.
+	held   map[string]lurkcoin.LockOwner
+	queue  *list.List
+	queued map[string]int
+
+	// Wait statistics for at most maxLockStats servers.
+	stats map[string]*lurkcoin.ServerLockStats
+
+	// How long to wait for locks, or zero to wait forever.
+	timeout time.Duration
+}
+
+// Returns the first server in ids that is locked or wanted by a waiting call,
+// or an empty string if ids can be locked now.
+func (self *genericDbLock) firstUnavailable(ids []string) string {
+	for _, id := range ids {
+		if _, held := self.held[id]; held || self.queued[id] > 0 {
+			return id
+		}
+	}
+	return ""
+}
+
+// Returns the owners that a call locking ids has to wait for, which are the
+// owners holding any of ids and any calls waiting for them that are before
+// stop in the queue (or anywhere in the queue if stop is nil).
+func (self *genericDbLock) blockers(ids []string,
+	stop *list.Element) []lurkcoin.LockOwner {
+	wanted := make(map[string]bool, len(ids))
+	var res []lurkcoin.LockOwner
+	for _, id := range ids {
+		wanted[id] = true
+		if owner, held := self.held[id]; held {
+			res = append(res, owner)
+		}
+	}
+	for e := self.queue.Front(); e != nil && e != stop; e = e.Next() {
+		waiter := e.Value.(*lockWaiter)
+		for _, id := range waiter.ids {
+			if wanted[id] {
+				res = append(res, waiter.owner)
+				break
+			}
+		}
+	}
+	return res
+}
+
+// Returns ErrLockDeadlock if owner can't wait for ids without deadlocking.
+// This follows the owners that owner would wait for (and the owners that
+// they're waiting for, etc) and fails if any of them are owner. self.lock
+// must be locked.
+func (self *genericDbLock) checkDeadlock(ids []string,
+	owner lurkcoin.LockOwner) error {
+	pending := self.blockers(ids, nil)
+	visited := make(map[lurkcoin.LockOwner]bool)
+	for len(pending) > 0 {
+		g := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if g == owner {
+			return ErrLockDeadlock
+		} else if visited[g] {
+			continue
+		}
+		visited[g] = true
+
+		for e := self.queue.Front(); e != nil; e = e.Next() {
+			if waiter := e.Value.(*lockWaiter); waiter.owner == g {
+				pending = append(pending, self.blockers(waiter.ids, e)...)
+			}
+		}
+	}
+	return nil
+}
+
+// The maximum number of servers to keep wait statistics for. Once this is
+// reached, the statistics of the server with the lowest total wait time are
+// removed to make room for new ones.
+const maxLockStats = 1000
+
+func (self *genericDbLock) recordWait(ids []string, duration time.Duration) {
+	seconds := duration.Seconds()
+	for _, id := range ids {
+		stats, ok := self.stats[id]
+		if !ok {
+			if len(self.stats) >= maxLockStats {
+				self.pruneStats()
+			}
+			stats = &lurkcoin.ServerLockStats{}
+			self.stats[id] = stats
+		}
+		stats.Waits++
+		stats.TotalWait += seconds
+		if seconds > stats.MaxWait {
+			stats.MaxWait = seconds
+		}
+	}
+}
+
+// Removes the statistics of the server that has been waited for the least.
+func (self *genericDbLock) pruneStats() {
+	var lowest string
+	var lowestWait float64
+	for id, stats := range self.stats {
+		if lowest == "" || stats.TotalWait < lowestWait {
+			lowest, lowestWait = id, stats.TotalWait
+		}
+	}
+	delete(self.stats, lowest)
+}
+
+func (self *genericDbLock) removeFromQueue(e *list.Element) {
+	waiter := self.queue.Remove(e).(*lockWaiter)
+	for _, id := range waiter.ids {
+		if self.queued[id]--; self.queued[id] == 0 {
+			delete(self.queued, id)
+		}
+	}
+}
+
+// Grants locks to any waiting calls that can now run. self.lock must be
+// locked.
+func (self *genericDbLock) grantWaiters() {
+	// Servers wanted by earlier calls that are still waiting.
+	blocked := make(map[string]bool)
+	var next *list.Element
+	for e := self.queue.Front(); e != nil; e = next {
+		next = e.Next()
+		waiter := e.Value.(*lockWaiter)
+		ok := true
+		for _, id := range waiter.ids {
+			if _, held := self.held[id]; held || blocked[id] {
+				ok = false
+				break
+			}
+		}
+
+		if !ok {
+			for _, id := range waiter.ids {
+				blocked[id] = true
+			}
+			continue
+		}
+
+		self.removeFromQueue(e)
+		for _, id := range waiter.ids {
+			self.held[id] = waiter.owner
+		}
+		self.recordWait(waiter.ids, time.Since(waiter.start))
+		waiter.granted = true
+		close(waiter.ready)
+	}
+}
+
+// Locks servers for owner and returns a list of homogenised server names. If
+// a server is specified more than once, if waiting would deadlock or if the
+// lock can't be acquired before the timeout, a *LockError is returned
+// instead.
+func (self *genericDbLock) Lock(names []string,
+	owner lurkcoin.LockOwner) ([]string, error) {
+	ids := make([]string, len(names))
+	seen := make(map[string]bool, len(names))
+	for i, name := range names {
+		ids[i] = lurkcoin.HomogeniseUsername(name)
+		if seen[ids[i]] {
+			return nil, &LockError{ids[i], errors.New("Attempted to lock " +
+				"server twice")}
+		}
+		seen[ids[i]] = true
+	}
+
+	self.lock.Lock()
+	unavailable := self.firstUnavailable(ids)
+	if unavailable == "" {
+		for _, id := range ids {
+			self.held[id] = owner
+		}
+		self.lock.Unlock()
+		return ids, nil
+	}
+
+	// Don't wait for locks that will never be released.
+	if err := self.checkDeadlock(ids, owner); err != nil {
+		self.lock.Unlock()
+		return nil, &LockError{unavailable, err}
+	}
+
+	// Wait in the queue.
+	waiter := &lockWaiter{ids, owner, make(chan struct{}), false, time.Now()}
+	e := self.queue.PushBack(waiter)
+	for _, id := range ids {
+		self.queued[id]++
+	}
+	self.lock.Unlock()
+
+	var deadline <-chan time.Time
+	if self.timeout > 0 {
+		timer := time.NewTimer(self.timeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	select {
+	case <-waiter.ready:
+	case <-deadline:
+		self.lock.Lock()
+		defer self.lock.Unlock()
+
+		// The lock may have been granted after the timer fired.
+		if waiter.granted {
+			break
+		}
+		self.removeFromQueue(e)
+		self.recordWait(ids, time.Since(waiter.start))
+
+		// Calls waiting behind this one may be able to run now.
+		self.grantWaiters()
+		return nil, &LockError{unavailable, ErrLockTimeout}
+	}
+
+	return ids, nil
+}
+
+// Unlocks
+func (self *genericDbLock) UnlockIDs(ids []string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for _, id := range ids {
+		delete(self.held, id)
+	}
+	self.grantWaiters()
+}
+
+func (self *genericDbLock) Unlock(servers []*lurkcoin.Server) {
+	ids := make([]string, len(servers))
+	for i, server := range servers {
+		ids[i] = server.UID
+	}
+	self.UnlockIDs(ids)
+}
+
+func (self *genericDbLock) Stats() lurkcoin.LockStats {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	servers := make(map[string]lurkcoin.ServerLockStats, len(self.stats))
+	for id, stats := range self.stats {
+		servers[id] = *stats
+	}
+	for id, n := range self.queued {
+		stats := servers[id]
+		stats.Waiting = n
+		servers[id] = stats
+	}
+	return lurkcoin.LockStats{Held: len(self.held),
+		Waiting: self.queue.Len(), Servers: servers}
+}
+
+// The "lock_wait_timeout" option sets how long to wait for server locks (for
+// example "30s"), by default this waits forever.
+func newGenericDbLock(options map[string]string) (genericDbLock, error) {
+	dblock := genericDbLock{
+		lock:   new(sync.Mutex),
+		held:   make(map[string]lurkcoin.LockOwner),
+		queue:  list.New(),
+		queued: make(map[string]int),
+		stats:  make(map[string]*lurkcoin.ServerLockStats),
+	}
+	if timeout, ok := options["lock_wait_timeout"]; ok {
+		var err error
+		dblock.timeout, err = time.ParseDuration(timeout)
+		if err != nil {
+			return genericDbLock{}, err
+		}
+	}
+	return dblock, nil
+}
@@ -0,0 +1,259 @@
+//
+// lurkcoin database lock tests
+// Copyright © 2020 by luk3yx
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package databases
+
+import (
+	"errors"
+	"github.com/luk3yx/lurkcoin-core/lurkcoin"
+	"testing"
+	"time"
+)
+
+func newTestLock(t *testing.T, timeout string) *genericDbLock {
+	options := map[string]string{}
+	if timeout != "" {
+		options["lock_wait_timeout"] = timeout
+	}
+	dblock, err := newGenericDbLock(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &dblock
+}
+
+// Calls Lock() in a new goroutine and waits until it is queued.
+func lockInBackground(dblock *genericDbLock, ids []string,
+	owner lurkcoin.LockOwner) <-chan error {
+	dblock.lock.Lock()
+	waiting := dblock.queue.Len()
+	dblock.lock.Unlock()
+
+	res := make(chan error, 1)
+	go func() {
+		_, err := dblock.Lock(ids, owner)
+		res <- err
+	}()
+	for {
+		dblock.lock.Lock()
+		n := dblock.queue.Len()
+		dblock.lock.Unlock()
+		if n > waiting {
+			return res
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func isGranted(res <-chan error) bool {
+	select {
+	case err := <-res:
+		if err != nil {
+			panic(err)
+		}
+		return true
+	case <-time.After(20 * time.Millisecond):
+		return false
+	}
+}
+
+// Calls that lock several servers must not be starved by later calls that
+// only lock one of them.
+func TestLockFairness(t *testing.T) {
+	tests := []struct {
+		name string
+
+		// The servers locked by each waiting call, in queue order.
+		waiters [][]string
+
+		// The waiters granted after "x" is unlocked and after each granted
+		// waiter is unlocked in turn.
+		order [][]int
+	}{
+		{"single server", [][]string{{"x"}, {"x"}},
+			[][]int{{0}, {1}}},
+		{"multiple servers first", [][]string{{"x", "y"}, {"y"}},
+			[][]int{{0}, {1}}},
+		{"independent waiters", [][]string{{"x"}, {"x", "y"}, {"y"}},
+			[][]int{{0}, {1}, {2}}},
+		{"granted together", [][]string{{"x", "y"}, {"z"}, {"x"}, {"y"}},
+			[][]int{{0}, {2, 3}}},
+	}
+
+	for _, test := range tests {
+		dblock := newTestLock(t, "")
+		holder := lurkcoin.NewLockOwner()
+		if _, err := dblock.Lock([]string{"x"}, holder); err != nil {
+			t.Fatal(err)
+		}
+
+		// "z" isn't held so it should be granted straight away.
+		results := make([]<-chan error, len(test.waiters))
+		granted := make([]bool, len(test.waiters))
+		for i, ids := range test.waiters {
+			if len(ids) == 1 && ids[0] == "z" {
+				res := make(chan error, 1)
+				_, err := dblock.Lock(ids, lurkcoin.NewLockOwner())
+				res <- err
+				results[i] = res
+				granted[i] = true
+				continue
+			}
+			results[i] = lockInBackground(dblock, ids,
+				lurkcoin.NewLockOwner())
+		}
+
+		unlock := []string{"x"}
+		for step, expected := range test.order {
+			dblock.UnlockIDs(unlock)
+			unlock = nil
+			want := make(map[int]bool, len(expected))
+			for _, i := range expected {
+				want[i] = true
+			}
+			for i, res := range results {
+				if granted[i] {
+					continue
+				}
+				ok := isGranted(res)
+				if ok != want[i] {
+					t.Errorf("%s: step %d: waiter %d granted: %v",
+						test.name, step, i, ok)
+				}
+				if ok {
+					granted[i] = true
+					unlock = append(unlock, test.waiters[i]...)
+				}
+			}
+		}
+	}
+}
+
+// Timeouts must never leave a lock held by a call that has given up, even if
+// the lock is granted just as the timer fires.
+func TestLockTimeout(t *testing.T) {
+	tests := []struct {
+		name    string
+		holdFor time.Duration
+		timeout string
+		ok      bool
+	}{
+		{"released early", 5 * time.Millisecond, "1s", true},
+		{"never released", time.Hour, "20ms", false},
+		{"released at the timeout", 20 * time.Millisecond, "20ms", false},
+	}
+
+	for _, test := range tests {
+		for attempt := 0; attempt < 20; attempt++ {
+			dblock := newTestLock(t, test.timeout)
+			holder := lurkcoin.NewLockOwner()
+			if _, err := dblock.Lock([]string{"x"}, holder); err != nil {
+				t.Fatal(err)
+			}
+			released := make(chan struct{})
+			timer := time.AfterFunc(test.holdFor, func() {
+				dblock.UnlockIDs([]string{"x"})
+				close(released)
+			})
+
+			_, err := dblock.Lock([]string{"x"}, lurkcoin.NewLockOwner())
+			if test.holdFor == time.Hour {
+				timer.Stop()
+			} else {
+				<-released
+			}
+
+			stats := dblock.Stats()
+			if err == nil {
+				if !test.ok && test.holdFor == time.Hour {
+					t.Errorf("%s: the lock was granted", test.name)
+				} else if stats.Held != 1 {
+					t.Errorf("%s: granted but %d locks are held", test.name,
+						stats.Held)
+				}
+			} else if !errors.Is(err, ErrLockTimeout) {
+				t.Errorf("%s: unexpected error: %v", test.name, err)
+			} else if test.ok {
+				t.Errorf("%s: timed out", test.name)
+			} else if test.holdFor != time.Hour && stats.Held != 0 {
+				t.Errorf("%s: timed out but %d locks are held", test.name,
+					stats.Held)
+			}
+			if stats.Waiting != 0 {
+				t.Errorf("%s: %d calls still waiting", test.name,
+					stats.Waiting)
+			}
+		}
+	}
+}
+
+// Owners that wait for each other's servers must get ErrLockDeadlock instead
+// of waiting forever.
+func TestLockCrossedAcquisitions(t *testing.T) {
+	tests := []struct {
+		name string
+
+		// The servers held by owners a and b.
+		heldA, heldB []string
+
+		// b waits for waitB first, then a tries to lock waitA.
+		waitB, waitA []string
+		deadlock     bool
+	}{
+		{"same owner twice", []string{"x"}, nil, nil, []string{"x"}, true},
+		{"crossed", []string{"x"}, []string{"y"}, []string{"x"},
+			[]string{"y"}, true},
+		{"crossed pair", []string{"x"}, []string{"y"}, []string{"x"},
+			[]string{"y", "z"}, true},
+		{"no cycle", []string{"x"}, []string{"y"}, []string{"x"},
+			[]string{"z"}, false},
+		{"queued behind waiter", []string{"x"}, nil, []string{"x", "y"},
+			[]string{"y"}, true},
+	}
+
+	for _, test := range tests {
+		dblock := newTestLock(t, "")
+		a, b := lurkcoin.NewLockOwner(), lurkcoin.NewLockOwner()
+		if _, err := dblock.Lock(test.heldA, a); err != nil {
+			t.Fatal(err)
+		}
+		if test.heldB != nil {
+			if _, err := dblock.Lock(test.heldB, b); err != nil {
+				t.Fatal(err)
+			}
+		}
+		var res <-chan error
+		if test.waitB != nil {
+			res = lockInBackground(dblock, test.waitB, b)
+		}
+
+		_, err := dblock.Lock(test.waitA, a)
+		if test.deadlock && !errors.Is(err, ErrLockDeadlock) {
+			t.Errorf("%s: got %v, expected a deadlock error", test.name,
+				err)
+		} else if !test.deadlock && err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		}
+
+		// Releasing a's servers lets b continue.
+		dblock.UnlockIDs(test.heldA)
+		if res != nil && !isGranted(res) {
+			t.Errorf("%s: b was not granted its lock", test.name)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+//
+// lurkcoin in-memory database
+// Copyright © 2020 by luk3yx
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package databases
+
+import (
+	"github.com/luk3yx/lurkcoin-core/lurkcoin"
+	"os"
+	"sync"
+)
+
+// A database that is never saved, for tests and throwaway instances.
+type memoryDatabase struct {
+	db         map[string]*lurkcoin.EncodedServer
+	dblock     genericDbLock
+	lock       *sync.RWMutex
+	auditLog   []lurkcoin.AuditLogEntry
+	adminUsers map[string]lurkcoin.AdminUser
+}
+
+func (self *memoryDatabase) GetServers(names []string) ([]*lurkcoin.Server, bool, string) {
+	return self.GetServersAs(lurkcoin.NewLockOwner(), names)
+}
+
+func (self *memoryDatabase) GetServersAs(owner lurkcoin.LockOwner,
+	names []string) ([]*lurkcoin.Server, bool, string) {
+	// Acquire locks
+	names, err := self.dblock.Lock(names, owner)
+	if err != nil {
+		return nil, false, reportLockError(err)
+	}
+
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+
+	servers := make([]*lurkcoin.Server, 0, len(names))
+	for _, name := range names {
+		encodedServer, exists := self.db[name]
+		if !exists {
+			self.dblock.UnlockIDs(names)
+			return nil, false, name
+		}
+		servers = append(servers, encodedServer.Decode())
+	}
+	return servers, true, ""
+}
+
+func (self *memoryDatabase) FreeServers(servers []*lurkcoin.Server, save bool) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.dblock.Unlock(servers)
+
+	if !save {
+		return
+	}
+
+	for _, server := range servers {
+		if server.IsModified() {
+			encodedServer := server.Encode()
+			self.db[server.UID] = &encodedServer
+		}
+	}
+}
+
+func (self *memoryDatabase) CreateServer(name string) (*lurkcoin.Server, bool) {
+	return self.CreateServerAs(lurkcoin.NewLockOwner(), name)
+}
+
+func (self *memoryDatabase) CreateServerAs(owner lurkcoin.LockOwner,
+	name string) (*lurkcoin.Server, bool) {
+	ids, err := self.dblock.Lock([]string{name}, owner)
+	if err != nil {
+		reportLockError(err)
+		return nil, false
+	}
+
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	if _, exists := self.db[ids[0]]; exists {
+		self.dblock.UnlockIDs(ids)
+		return nil, false
+	}
+
+	return lurkcoin.NewServer(name), true
+}
+
+func (self *memoryDatabase) ListServers() []string {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	res := make([]string, 0, len(self.db))
+	for k := range self.db {
+		res = append(res, k)
+	}
+	return res
+}
+
+func (self *memoryDatabase) ListServersPage(after, prefix string,
+	limit int) []string {
+	return paginateServers(self.ListServers(), after, prefix, limit)
+}
+
+func (self *memoryDatabase) ForEachEncoded(f func(*lurkcoin.EncodedServer) error) error {
+	return forEachInMap(self.lock, self.db, f)
+}
+
+func (self *memoryDatabase) DeleteServer(name string) (exists bool) {
+	ids, err := self.dblock.Lock([]string{name}, lurkcoin.NewLockOwner())
+	if err != nil {
+		reportLockError(err)
+		return false
+	}
+	defer self.dblock.UnlockIDs(ids)
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	_, exists = self.db[ids[0]]
+	delete(self.db, ids[0])
+	return
+}
+
+func (self *memoryDatabase) GetLockStats() lurkcoin.LockStats {
+	return self.dblock.Stats()
+}
+
+func (self *memoryDatabase) AppendAuditLog(entry *lurkcoin.AuditLogEntry) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	entry.ID = uint64(len(self.auditLog)) + 1
+	self.auditLog = append(self.auditLog, *entry)
+	return nil
+}
+
+func (self *memoryDatabase) ForEachAuditLog(f func(*lurkcoin.AuditLogEntry) error) error {
+	self.lock.RLock()
+	auditLog := self.auditLog
+	self.lock.RUnlock()
+	for i := len(auditLog) - 1; i >= 0; i-- {
+		entry := auditLog[i]
+		if err := f(&entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (self *memoryDatabase) GetAdminUser(username string) (*lurkcoin.AdminUser, error) {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	user, exists := self.adminUsers[username]
+	if !exists {
+		return nil, nil
+	}
+	return &user, nil
+}
+
+func (self *memoryDatabase) SetAdminUser(user *lurkcoin.AdminUser) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.adminUsers[user.Username] = *user
+	return nil
+}
+
+func (self *memoryDatabase) ListAdminUsers() ([]*lurkcoin.AdminUser, error) {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	res := make([]*lurkcoin.AdminUser, 0, len(self.adminUsers))
+	for _, user := range self.adminUsers {
+		user := user
+		res = append(res, &user)
+	}
+	return res, nil
+}
+
+// Creates an empty in-memory database.
+func NewMemoryDatabase() lurkcoin.Database {
+	dblock, _ := newGenericDbLock(nil)
+	return newMemoryDatabase(dblock)
+}
+
+func newMemoryDatabase(dblock genericDbLock) *memoryDatabase {
+	return &memoryDatabase{
+		make(map[string]*lurkcoin.EncodedServer),
+		dblock,
+		new(sync.RWMutex),
+		nil,
+		make(map[string]lurkcoin.AdminUser),
+	}
+}
+
+// If location is not empty, the database is initially loaded from a backup
+// file. Changes are never written to the file.
+func MemoryDatabase(location string, options map[string]string) (lurkcoin.Database, error) {
+	dblock, err := newGenericDbLock(options)
+	if err != nil {
+		return nil, err
+	}
+	db := newMemoryDatabase(dblock)
+	if location == "" {
+		return db, nil
+	}
+
+	f, err := os.Open(location)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if err := lurkcoin.RestoreDatabase(db, f); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+func init() {
+	RegisterDatabaseType("memory", MemoryDatabase)
+}
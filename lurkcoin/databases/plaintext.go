@@ -21,6 +21,7 @@
 package databases
 
 import (
+	"bytes"
 	"encoding/json"
 	"github.com/luk3yx/lurkcoin-core/lurkcoin"
 	"io/ioutil"
@@ -29,16 +30,34 @@ import (
 	"sync"
 )
 
+// Tags sent with any error reports.
+var plaintextTags = map[string]string{"component": "plaintext"}
+
 type plaintextDatabase struct {
 	db       map[string]*lurkcoin.EncodedServer
 	location string
 	dblock   genericDbLock
 	lock     *sync.RWMutex
+
+	// The audit log is stored separately, see auditLogLocation().
+	auditLock      *sync.Mutex
+	lastAuditLogID uint64
+
+	// Admin users are also stored separately, see adminUsersLocation().
+	adminUsersLock *sync.Mutex
 }
 
 func (self *plaintextDatabase) GetServers(names []string) ([]*lurkcoin.Server, bool, string) {
+	return self.GetServersAs(lurkcoin.NewLockOwner(), names)
+}
+
+func (self *plaintextDatabase) GetServersAs(owner lurkcoin.LockOwner,
+	names []string) ([]*lurkcoin.Server, bool, string) {
 	// Acquire locks
-	names = self.dblock.Lock(names)
+	names, err := self.dblock.Lock(names, owner)
+	if err != nil {
+		return nil, false, reportLockError(err)
+	}
 
 	// Unlock if there is an error
 	ok := false
@@ -67,6 +86,7 @@ func (self *plaintextDatabase) GetServers(names []string) ([]*lurkcoin.Server, b
 func (self *plaintextDatabase) save() {
 	f, err := ioutil.TempFile(path.Dir(self.location), ".tmp")
 	if err != nil {
+		lurkcoin.ReportError(err, plaintextTags)
 		panic(err)
 	}
 	fn := f.Name()
@@ -84,12 +104,14 @@ func (self *plaintextDatabase) save() {
 	encoder := json.NewEncoder(f)
 	err = encoder.Encode(encodedServers)
 	if err != nil {
+		lurkcoin.ReportError(err, plaintextTags)
 		panic(err)
 	}
 
 	f.Close()
 	err = os.Rename(fn, self.location)
 	if err != nil {
+		lurkcoin.ReportError(err, plaintextTags)
 		panic(err)
 	}
 }
@@ -118,7 +140,16 @@ func (self *plaintextDatabase) FreeServers(servers []*lurkcoin.Server, save bool
 }
 
 func (self *plaintextDatabase) CreateServer(name string) (*lurkcoin.Server, bool) {
-	ids := self.dblock.Lock([]string{name})
+	return self.CreateServerAs(lurkcoin.NewLockOwner(), name)
+}
+
+func (self *plaintextDatabase) CreateServerAs(owner lurkcoin.LockOwner,
+	name string) (*lurkcoin.Server, bool) {
+	ids, err := self.dblock.Lock([]string{name}, owner)
+	if err != nil {
+		reportLockError(err)
+		return nil, false
+	}
 	id := ids[0]
 
 	self.lock.Lock()
@@ -144,9 +175,24 @@ func (self *plaintextDatabase) ListServers() []string {
 	return res
 }
 
+func (self *plaintextDatabase) ListServersPage(after, prefix string,
+	limit int) []string {
+	return paginateServers(self.ListServers(), after, prefix, limit)
+}
+
+func (self *plaintextDatabase) ForEachEncoded(f func(*lurkcoin.EncodedServer) error) error {
+	return forEachInMap(self.lock, self.db, f)
+}
+
 func (self *plaintextDatabase) DeleteServer(name string) (exists bool) {
-	ids := self.dblock.Lock([]string{name})
+	ids, err := self.dblock.Lock([]string{name}, lurkcoin.NewLockOwner())
+	if err != nil {
+		reportLockError(err)
+		return false
+	}
 	defer self.dblock.UnlockIDs(ids)
+	self.lock.Lock()
+	defer self.lock.Unlock()
 	id := ids[0]
 	_, exists = self.db[id]
 	if exists {
@@ -156,12 +202,174 @@ func (self *plaintextDatabase) DeleteServer(name string) (exists bool) {
 	return
 }
 
-func PlaintextDatabase(location string, _ map[string]string) (lurkcoin.Database, error) {
+func (self *plaintextDatabase) GetLockStats() lurkcoin.LockStats {
+	return self.dblock.Stats()
+}
+
+// The audit log is appended to a JSON lines file next to the database so
+// that the whole log doesn't have to be rewritten every time it changes.
+func (self *plaintextDatabase) auditLogLocation() string {
+	return self.location + ".audit.jsonl"
+}
+
+func (self *plaintextDatabase) readAuditLog() ([]lurkcoin.AuditLogEntry, error) {
+	raw, err := ioutil.ReadFile(self.auditLogLocation())
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var res []lurkcoin.AuditLogEntry
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	for decoder.More() {
+		var entry lurkcoin.AuditLogEntry
+		if err := decoder.Decode(&entry); err != nil {
+			return nil, err
+		}
+		res = append(res, entry)
+	}
+	return res, nil
+}
+
+func (self *plaintextDatabase) AppendAuditLog(entry *lurkcoin.AuditLogEntry) error {
+	self.auditLock.Lock()
+	defer self.auditLock.Unlock()
+	if self.lastAuditLogID == 0 {
+		entries, err := self.readAuditLog()
+		if err != nil {
+			return err
+		}
+		if len(entries) > 0 {
+			self.lastAuditLogID = entries[len(entries)-1].ID
+		}
+	}
+
+	entry.ID = self.lastAuditLogID + 1
+	raw, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(self.auditLogLocation(),
+		os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(raw, '\n'))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		self.lastAuditLogID = entry.ID
+	}
+	return err
+}
+
+func (self *plaintextDatabase) ForEachAuditLog(f func(*lurkcoin.AuditLogEntry) error) error {
+	self.auditLock.Lock()
+	entries, err := self.readAuditLog()
+	self.auditLock.Unlock()
+	if err != nil {
+		return err
+	}
+	for i := len(entries) - 1; i >= 0; i-- {
+		if err := f(&entries[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Admin users are stored as a JSON object (username: user) next to the
+// database.
+func (self *plaintextDatabase) adminUsersLocation() string {
+	return self.location + ".admin-users.json"
+}
+
+func (self *plaintextDatabase) readAdminUsers() (map[string]*lurkcoin.AdminUser, error) {
+	res := make(map[string]*lurkcoin.AdminUser)
+	raw, err := ioutil.ReadFile(self.adminUsersLocation())
+	if os.IsNotExist(err) {
+		return res, nil
+	} else if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(raw, &res)
+	return res, err
+}
+
+func (self *plaintextDatabase) GetAdminUser(username string) (*lurkcoin.AdminUser, error) {
+	self.adminUsersLock.Lock()
+	defer self.adminUsersLock.Unlock()
+	users, err := self.readAdminUsers()
+	if err != nil {
+		return nil, err
+	}
+	return users[username], nil
+}
+
+// The file is replaced atomically like the database itself.
+func (self *plaintextDatabase) SetAdminUser(user *lurkcoin.AdminUser) error {
+	self.adminUsersLock.Lock()
+	defer self.adminUsersLock.Unlock()
+	users, err := self.readAdminUsers()
+	if err != nil {
+		return err
+	}
+	users[user.Username] = user
+	raw, err := json.Marshal(users)
+	if err != nil {
+		return err
+	}
+
+	location := self.adminUsersLocation()
+	f, err := ioutil.TempFile(path.Dir(location), ".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(raw)
+	if err == nil {
+		err = f.Chmod(0600)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), location)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+func (self *plaintextDatabase) ListAdminUsers() ([]*lurkcoin.AdminUser, error) {
+	self.adminUsersLock.Lock()
+	users, err := self.readAdminUsers()
+	self.adminUsersLock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	res := make([]*lurkcoin.AdminUser, 0, len(users))
+	for _, user := range users {
+		res = append(res, user)
+	}
+	return res, nil
+}
+
+func PlaintextDatabase(location string, options map[string]string) (lurkcoin.Database, error) {
+	dblock, err := newGenericDbLock(options)
+	if err != nil {
+		return nil, err
+	}
 	db := &plaintextDatabase{
 		make(map[string]*lurkcoin.EncodedServer),
 		location,
-		newGenericDbLock(),
+		dblock,
 		new(sync.RWMutex),
+		new(sync.Mutex),
+		0,
+		new(sync.Mutex),
 	}
 	f, err := os.OpenFile(location, os.O_RDONLY, 0)
 	if err == nil {
@@ -0,0 +1,557 @@
+//
+// lurkcoin Redis database
+// Copyright © 2020 by luk3yx
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+// +build !lurkcoin.disableredis
+
+package databases
+
+import (
+	crypto_rand "crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/luk3yx/lurkcoin-core/lurkcoin"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// Tags sent with any error reports.
+var redisTags = map[string]string{"component": "redis"}
+
+// The number of servers fetched at once by ForEachEncoded().
+const redisBatchSize = 100
+
+// Only deletes the lock if it is still held by this lurkcoin instance.
+var redisUnlockScript = redis.NewScript(1, `
+if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("del", KEYS[1])
+end
+return 0
+`)
+
+// Saves servers if every lock is still held by this lurkcoin instance, so
+// that changes aren't saved if a lock has expired and another instance has
+// locked the server. KEYS[1] is the servers set and is followed by the lock
+// keys and then the server keys. ARGV contains the lock values, followed by
+// the encoded servers and then their UIDs.
+var redisSaveScript = redis.NewScript(-1, `
+local n = #ARGV / 3
+for i = 1, n do
+	if redis.call("get", KEYS[i + 1]) ~= ARGV[i] then
+		return 0
+	end
+end
+for i = 1, n do
+	redis.call("set", KEYS[n + i + 1], ARGV[n + i])
+	redis.call("sadd", KEYS[1], ARGV[2 * n + i])
+end
+return 1
+`)
+
+// Returned (with panic()) if a lock expired before the servers were saved.
+var ErrRedisLockLost = errors.New("A Redis lock expired before the " +
+	"changes were saved")
+
+// Servers are stored as JSON in <prefix>server:<UID>, and the UIDs of every
+// server are stored in the <prefix>servers set. Locks are stored in
+// <prefix>lock:<UID> so that multiple lurkcoin instances can share a
+// database. Audit log entries are stored as JSON in the <prefix>audit_log
+// sorted set (scored by ID), with the last ID in <prefix>audit_log:id.
+type redisDatabase struct {
+	pool        *redis.Pool
+	prefix      string
+	lockTimeout time.Duration
+	dblock      genericDbLock
+
+	// The values of the Redis locks held by this instance.
+	lockValuesLock sync.Mutex
+	lockValues     map[string]string
+}
+
+func (self *redisDatabase) serverKey(id string) string {
+	return self.prefix + "server:" + id
+}
+
+func (self *redisDatabase) lockKey(id string) string {
+	return self.prefix + "lock:" + id
+}
+
+// Each lock has a random value so that locks that have expired and been
+// taken by another instance aren't deleted.
+func newRedisLockValue() string {
+	raw := make([]byte, 16)
+	if _, err := crypto_rand.Read(raw); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+// Acquires the Redis locks for ids (which must already be locked with
+// dblock). Either every lock is acquired or none of them are so that
+// instances can't deadlock each other.
+func (self *redisDatabase) lock(ids []string) error {
+	conn := self.pool.Get()
+	defer conn.Close()
+	value := newRedisLockValue()
+	ttl := strconv.FormatInt(int64(self.lockTimeout/time.Millisecond), 10)
+	delay := time.Millisecond
+	start := time.Now()
+	for {
+		acquired := 0
+		for _, id := range ids {
+			_, err := redis.String(conn.Do("SET", self.lockKey(id), value,
+				"NX", "PX", ttl))
+			if err == redis.ErrNil {
+				break
+			} else if err != nil {
+				self.unlockRedis(conn, ids[:acquired], value)
+				return err
+			}
+			acquired++
+		}
+		if acquired == len(ids) {
+			break
+		}
+
+		self.unlockRedis(conn, ids[:acquired], value)
+		if self.dblock.timeout > 0 && time.Since(start) > self.dblock.timeout {
+			return ErrLockTimeout
+		}
+		time.Sleep(delay)
+		if delay < 100*time.Millisecond {
+			delay *= 2
+		}
+	}
+
+	self.lockValuesLock.Lock()
+	defer self.lockValuesLock.Unlock()
+	for _, id := range ids {
+		self.lockValues[id] = value
+	}
+	return nil
+}
+
+func (self *redisDatabase) unlockRedis(conn redis.Conn, ids []string,
+	value string) {
+	for _, id := range ids {
+		if _, err := redisUnlockScript.Do(conn, self.lockKey(id),
+			value); err != nil {
+			lurkcoin.ReportError(err, redisTags)
+		}
+	}
+}
+
+// Releases the Redis locks and dblock locks for ids.
+func (self *redisDatabase) unlock(conn redis.Conn, ids []string) {
+	values := make([]string, len(ids))
+	self.lockValuesLock.Lock()
+	for i, id := range ids {
+		values[i] = self.lockValues[id]
+		delete(self.lockValues, id)
+	}
+	self.lockValuesLock.Unlock()
+
+	for i, id := range ids {
+		self.unlockRedis(conn, []string{id}, values[i])
+	}
+	self.dblock.UnlockIDs(ids)
+}
+
+// Locks ids with dblock and Redis.
+func (self *redisDatabase) lockIDs(names []string,
+	owner lurkcoin.LockOwner) ([]string, error) {
+	ids, err := self.dblock.Lock(names, owner)
+	if err != nil {
+		reportLockError(err)
+		return nil, err
+	}
+	if err := self.lock(ids); err != nil {
+		self.dblock.UnlockIDs(ids)
+		lurkcoin.ReportError(err, redisTags)
+		return nil, err
+	}
+	return ids, nil
+}
+
+func (self *redisDatabase) GetServers(names []string) ([]*lurkcoin.Server, bool, string) {
+	return self.GetServersAs(lurkcoin.NewLockOwner(), names)
+}
+
+func (self *redisDatabase) GetServersAs(owner lurkcoin.LockOwner,
+	names []string) ([]*lurkcoin.Server, bool, string) {
+	// Acquire locks
+	ids, err := self.lockIDs(names, owner)
+	if err != nil {
+		var lockErr *LockError
+		if errors.As(err, &lockErr) {
+			return nil, false, lockErr.Server
+		} else if len(names) > 0 {
+			return nil, false, lurkcoin.HomogeniseUsername(names[0])
+		}
+		return nil, false, ""
+	}
+
+	conn := self.pool.Get()
+	defer conn.Close()
+	res := make([]*lurkcoin.Server, len(ids))
+	for i, id := range ids {
+		raw, err := redis.Bytes(conn.Do("GET", self.serverKey(id)))
+		var encodedServer lurkcoin.EncodedServer
+		if err == nil {
+			err = json.Unmarshal(raw, &encodedServer)
+		}
+		if err != nil {
+			if err != redis.ErrNil {
+				lurkcoin.ReportError(err, redisTags)
+			}
+			self.unlock(conn, ids)
+			return nil, false, id
+		}
+		res[i] = encodedServer.Decode()
+	}
+	return res, true, ""
+}
+
+func (self *redisDatabase) FreeServers(servers []*lurkcoin.Server, save bool) {
+	conn := self.pool.Get()
+	defer conn.Close()
+	ids := make([]string, len(servers))
+	for i, server := range servers {
+		ids[i] = server.UID
+	}
+	defer self.unlock(conn, ids)
+	if !save {
+		return
+	}
+
+	var lockKeys, serverKeys, lockValues, encoded, uids []interface{}
+	self.lockValuesLock.Lock()
+	for _, server := range servers {
+		if !server.IsModified() {
+			continue
+		}
+		raw, err := json.Marshal(server.Encode())
+		if err != nil {
+			self.lockValuesLock.Unlock()
+			lurkcoin.ReportError(err, redisTags)
+			panic(err)
+		}
+		lockKeys = append(lockKeys, self.lockKey(server.UID))
+		serverKeys = append(serverKeys, self.serverKey(server.UID))
+		lockValues = append(lockValues, self.lockValues[server.UID])
+		encoded = append(encoded, raw)
+		uids = append(uids, server.UID)
+	}
+	self.lockValuesLock.Unlock()
+	if len(uids) == 0 {
+		return
+	}
+
+	args := []interface{}{1 + len(lockKeys) + len(serverKeys),
+		self.prefix + "servers"}
+	args = append(append(args, lockKeys...), serverKeys...)
+	args = append(append(append(args, lockValues...), encoded...), uids...)
+	saved, err := redis.Bool(redisSaveScript.Do(conn, args...))
+	if err == nil && !saved {
+		err = ErrRedisLockLost
+	}
+	if err != nil {
+		lurkcoin.ReportError(err, redisTags)
+		panic(err)
+	}
+}
+
+// Creates a server. The server is not saved until FreeServer() is called.
+func (self *redisDatabase) CreateServer(name string) (*lurkcoin.Server, bool) {
+	return self.CreateServerAs(lurkcoin.NewLockOwner(), name)
+}
+
+func (self *redisDatabase) CreateServerAs(owner lurkcoin.LockOwner,
+	name string) (*lurkcoin.Server, bool) {
+	ids, err := self.lockIDs([]string{name}, owner)
+	if err != nil {
+		return nil, false
+	}
+
+	conn := self.pool.Get()
+	defer conn.Close()
+	exists, err := redis.Bool(conn.Do("EXISTS", self.serverKey(ids[0])))
+	if err != nil || exists {
+		if err != nil {
+			lurkcoin.ReportError(err, redisTags)
+		}
+		self.unlock(conn, ids)
+		return nil, false
+	}
+
+	return lurkcoin.NewServer(name), true
+}
+
+func (self *redisDatabase) ListServers() []string {
+	conn := self.pool.Get()
+	defer conn.Close()
+	res, err := redis.Strings(conn.Do("SMEMBERS", self.prefix+"servers"))
+	if err != nil {
+		lurkcoin.ReportError(err, redisTags)
+	}
+	return res
+}
+
+func (self *redisDatabase) ListServersPage(after, prefix string,
+	limit int) []string {
+	return paginateServers(self.ListServers(), after, prefix, limit)
+}
+
+// Servers are fetched with MGET in batches, servers that are deleted while
+// this is running are skipped.
+func (self *redisDatabase) ForEachEncoded(f func(*lurkcoin.EncodedServer) error) error {
+	uids := self.ListServers()
+	sort.Strings(uids)
+
+	conn := self.pool.Get()
+	defer conn.Close()
+	for len(uids) > 0 {
+		n := len(uids)
+		if n > redisBatchSize {
+			n = redisBatchSize
+		}
+		args := make([]interface{}, n)
+		for i, uid := range uids[:n] {
+			args[i] = self.serverKey(uid)
+		}
+		uids = uids[n:]
+
+		values, err := redis.ByteSlices(conn.Do("MGET", args...))
+		if err != nil {
+			return err
+		}
+		for _, raw := range values {
+			if raw == nil {
+				continue
+			}
+			var encodedServer lurkcoin.EncodedServer
+			if err := json.Unmarshal(raw, &encodedServer); err != nil {
+				return err
+			}
+			if err := f(&encodedServer); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (self *redisDatabase) AppendAuditLog(entry *lurkcoin.AuditLogEntry) error {
+	conn := self.pool.Get()
+	defer conn.Close()
+	id, err := redis.Uint64(conn.Do("INCR", self.prefix+"audit_log:id"))
+	if err != nil {
+		return err
+	}
+	entry.ID = id
+	raw, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Do("ZADD", self.prefix+"audit_log", id, raw)
+	return err
+}
+
+func (self *redisDatabase) ForEachAuditLog(f func(*lurkcoin.AuditLogEntry) error) error {
+	conn := self.pool.Get()
+	defer conn.Close()
+	// Entries are fetched by score so that new entries don't shift the
+	// batches.
+	max := "+inf"
+	for {
+		values, err := redis.ByteSlices(conn.Do("ZREVRANGEBYSCORE",
+			self.prefix+"audit_log", max, "-inf", "LIMIT", 0,
+			redisBatchSize))
+		if err != nil {
+			return err
+		}
+		for _, raw := range values {
+			var entry lurkcoin.AuditLogEntry
+			if err := json.Unmarshal(raw, &entry); err != nil {
+				return err
+			}
+			if err := f(&entry); err != nil {
+				return err
+			}
+			max = "(" + strconv.FormatUint(entry.ID, 10)
+		}
+		if len(values) < redisBatchSize {
+			return nil
+		}
+	}
+}
+
+// Admin users are stored as JSON in a hash.
+func (self *redisDatabase) GetAdminUser(username string) (*lurkcoin.AdminUser, error) {
+	conn := self.pool.Get()
+	defer conn.Close()
+	raw, err := redis.Bytes(conn.Do("HGET", self.prefix+"admin_users",
+		username))
+	if err == redis.ErrNil {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	user := new(lurkcoin.AdminUser)
+	if err := json.Unmarshal(raw, user); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func (self *redisDatabase) SetAdminUser(user *lurkcoin.AdminUser) error {
+	raw, err := json.Marshal(user)
+	if err != nil {
+		return err
+	}
+	conn := self.pool.Get()
+	defer conn.Close()
+	_, err = conn.Do("HSET", self.prefix+"admin_users", user.Username, raw)
+	return err
+}
+
+func (self *redisDatabase) ListAdminUsers() ([]*lurkcoin.AdminUser, error) {
+	conn := self.pool.Get()
+	defer conn.Close()
+	values, err := redis.ByteSlices(conn.Do("HVALS",
+		self.prefix+"admin_users"))
+	if err != nil {
+		return nil, err
+	}
+	res := make([]*lurkcoin.AdminUser, 0, len(values))
+	for _, raw := range values {
+		var user lurkcoin.AdminUser
+		if err := json.Unmarshal(raw, &user); err != nil {
+			return nil, err
+		}
+		res = append(res, &user)
+	}
+	return res, nil
+}
+
+func (self *redisDatabase) Ping() error {
+	conn := self.pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("PING")
+	return err
+}
+
+func (self *redisDatabase) Close() error {
+	return self.pool.Close()
+}
+
+func (self *redisDatabase) DeleteServer(name string) bool {
+	ids, err := self.lockIDs([]string{name}, lurkcoin.NewLockOwner())
+	if err != nil {
+		return false
+	}
+	conn := self.pool.Get()
+	defer conn.Close()
+	defer self.unlock(conn, ids)
+
+	conn.Send("MULTI")
+	conn.Send("DEL", self.serverKey(ids[0]))
+	conn.Send("SREM", self.prefix+"servers", ids[0])
+	res, err := redis.Ints(conn.Do("EXEC"))
+	return err == nil && res[0] > 0
+}
+
+func (self *redisDatabase) GetLockStats() lurkcoin.LockStats {
+	return self.dblock.Stats()
+}
+
+// The location is either "host:port" or a redis:// URL. The "password" and
+// "db" options can be used to log in and select a database, "prefix" is
+// prepended to every key (and defaults to "lurkcoin:"), and "lock_timeout" is
+// how long servers stay locked if lurkcoin crashes (30s by default).
+func RedisDatabase(location string, options map[string]string) (lurkcoin.Database, error) {
+	var dialOptions []redis.DialOption
+	if password, ok := options["password"]; ok {
+		dialOptions = append(dialOptions, redis.DialPassword(password))
+	}
+	if db, ok := options["db"]; ok {
+		n, err := strconv.Atoi(db)
+		if err != nil {
+			return nil, errors.New("Invalid Redis database number: " + db)
+		}
+		dialOptions = append(dialOptions, redis.DialDatabase(n))
+	}
+
+	prefix := "lurkcoin:"
+	if p, ok := options["prefix"]; ok {
+		prefix = p
+	}
+	lockTimeout := 30 * time.Second
+	if timeout, ok := options["lock_timeout"]; ok {
+		var err error
+		lockTimeout, err = time.ParseDuration(timeout)
+		if err != nil || lockTimeout < time.Second {
+			return nil, errors.New("Invalid lock_timeout: " + timeout)
+		}
+	}
+
+	dblock, err := newGenericDbLock(options)
+	if err != nil {
+		return nil, err
+	}
+
+	dial := func() (redis.Conn, error) {
+		if strings.Contains(location, "://") {
+			return redis.DialURL(location, dialOptions...)
+		}
+		return redis.Dial("tcp", location, dialOptions...)
+	}
+	pool := &redis.Pool{
+		Dial:        dial,
+		MaxIdle:     16,
+		IdleTimeout: 5 * time.Minute,
+		TestOnBorrow: func(conn redis.Conn, t time.Time) error {
+			if time.Since(t) < time.Minute {
+				return nil
+			}
+			_, err := conn.Do("PING")
+			return err
+		},
+	}
+
+	// Make sure that the database is reachable.
+	conn := pool.Get()
+	defer conn.Close()
+	if _, err := conn.Do("PING"); err != nil {
+		pool.Close()
+		return nil, err
+	}
+
+	return &redisDatabase{pool: pool, prefix: prefix,
+		lockTimeout: lockTimeout, dblock: dblock,
+		lockValues: make(map[string]string)}, nil
+}
+
+func init() {
+	RegisterDatabaseType("redis", RedisDatabase)
+}
@@ -55,71 +55,62 @@ func GetSupportedDatabaseTypes() []string {
 	return res
 }
 
-// Generic database lock
-type genericDbLock struct {
-	lock  *sync.Mutex
-	locks map[string]*sync.Mutex
-}
-
-// Locks servers and returns a list of homogenised server names.
-// It would probably be more efficient to just use one larger lock.
-func (self *genericDbLock) Lock(names []string) []string {
-	ids := make([]string, len(names))
-	for i, name := range names {
-		ids[i] = lurkcoin.HomogeniseUsername(name)
+// Implements ListServersPage() for databases that can only list every UID.
+func paginateServers(uids []string, after, prefix string, limit int) []string {
+	prefix = lurkcoin.HomogeniseUsername(prefix)
+	sort.Strings(uids)
+
+	// Skip to the first UID that can be returned.
+	start := after
+	if prefix > start {
+		start = prefix
+	}
+	i := sort.SearchStrings(uids, start)
+	if i < len(uids) && uids[i] == after {
+		i++
 	}
 
-	// Ensure none of the servers are locked.
-	self.lock.Lock()
-	ok := false
-	for !ok {
-		ok = true
-		for _, name := range ids {
-			cachedServerLock, exists := self.locks[name]
-			if !exists {
-				continue
-			}
-
-			ok = false
-			self.lock.Unlock()
-			cachedServerLock.Lock()
-			cachedServerLock.Unlock()
-			self.lock.Lock()
+	var res []string
+	for ; i < len(uids) && (limit <= 0 || len(res) < limit); i++ {
+		if !strings.HasPrefix(uids[i], prefix) {
 			break
 		}
+		res = append(res, uids[i])
 	}
-
-	defer self.lock.Unlock()
-
-	// Create locks so the above code does not have to make use of polling.
-	for _, name := range ids {
-		var lock sync.Mutex
-		lock.Lock()
-		self.locks[name] = &lock
-	}
-
-	return ids
+	return res
 }
 
-// Unlocks
-func (self *genericDbLock) UnlockIDs(ids []string) {
-	self.lock.Lock()
-	defer self.lock.Unlock()
-	for _, id := range ids {
-		self.locks[id].Unlock()
-		delete(self.locks, id)
+// Returns the key to start iterating from in ListServersPage() and whether
+// the key itself should be skipped, for databases that store servers in
+// sorted order.
+func serverPageStart(after, prefix string) (string, bool) {
+	if prefix > after {
+		return prefix, false
 	}
+	return after, after != ""
 }
 
-func (self *genericDbLock) Unlock(servers []*lurkcoin.Server) {
-	self.lock.Lock()
-	defer self.lock.Unlock()
-	for _, server := range servers {
-		self.locks[server.UID].Unlock()
-		delete(self.locks, server.UID)
+// Implements ForEachEncoded() for databases that keep servers in a map.
+// Servers in the map are replaced instead of being modified when they are
+// saved, so they can be used after the lock is released.
+func forEachInMap(lock *sync.RWMutex, m map[string]*lurkcoin.EncodedServer,
+	f func(*lurkcoin.EncodedServer) error) error {
+	lock.RLock()
+	uids := make([]string, 0, len(m))
+	for uid := range m {
+		uids = append(uids, uid)
 	}
-}
+	sort.Strings(uids)
+	servers := make([]*lurkcoin.EncodedServer, len(uids))
+	for i, uid := range uids {
+		servers[i] = m[uid]
+	}
+	lock.RUnlock()
 
-func newGenericDbLock() genericDbLock {
-	return genericDbLock{new(sync.Mutex), make(map[string]*sync.Mutex)}
+	for _, encodedServer := range servers {
+		if err := f(encodedServer); err != nil {
+			return err
+		}
+	}
+	return nil
 }
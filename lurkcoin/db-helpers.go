@@ -19,11 +19,13 @@
 package lurkcoin
 
 import (
+	"bufio"
+	"compress/gzip"
 	"encoding/json"
 	"errors"
 	"io"
-	"sort"
 	"sync"
+	"sync/atomic"
 )
 
 type Database interface {
@@ -41,21 +43,177 @@ type Database interface {
 
 	CreateServer(string) (*Server, bool)
 	ListServers() []string
+
+	// ListServersPage(after, prefix, limit)
+	// Returns up to limit server UIDs (or all of them if limit is 0) that
+	// start with prefix in sorted order. If after is not empty, only UIDs
+	// that sort after it are returned so that the last UID of a page can be
+	// used to get the next one.
+	ListServersPage(string, string, int) []string
+
+	// ForEachEncoded(f)
+	// Calls f with every server in sorted UID order (stopping if f returns
+	// an error) without locking them, so the servers may be slightly out of
+	// date. f must not modify the servers or use the database.
+	ForEachEncoded(func(*EncodedServer) error) error
+
 	DeleteServer(string) bool
 }
 
+// The number of servers listed at a time when iterating over the database.
+const listServersPageSize = 100
+
+// Calls f with the UID of every server in the database in sorted order.
+func forEachServerUID(db Database, f func(string) error) error {
+	after := ""
+	for {
+		page := db.ListServersPage(after, "", listServersPageSize)
+		for _, uid := range page {
+			if err := f(uid); err != nil {
+				return err
+			}
+		}
+		if len(page) < listServersPageSize {
+			return nil
+		}
+		after = page[len(page)-1]
+	}
+}
+
+// Identifies whatever holds a server lock (usually a DatabaseTransaction) so
+// that databases can detect deadlocks.
+type LockOwner uint64
+
+var lastLockOwner uint64
+
+// Returns a new unique LockOwner.
+func NewLockOwner() LockOwner {
+	return LockOwner(atomic.AddUint64(&lastLockOwner, 1))
+}
+
+// Databases that lock servers may implement this so that all the locks held
+// by a DatabaseTransaction have the same owner. GetServers() and
+// CreateServer() should use a new LockOwner for every call.
+type LockOwnerDatabase interface {
+	GetServersAs(LockOwner, []string) ([]*Server, bool, string)
+	CreateServerAs(LockOwner, string) (*Server, bool)
+}
+
+// Databases may implement this to expose statistics about server locks.
+type LockStatsDatabase interface {
+	GetLockStats() LockStats
+}
+
+// Databases may implement this to support point-in-time snapshots.
+type SnapshotDatabase interface {
+	// Writes a consistent copy of the database file to w.
+	WriteSnapshot(w io.Writer) error
+}
+
+// Databases may implement this to check that they are reachable.
+type PingableDatabase interface {
+	Ping() error
+}
+
+// Checks that db is reachable. Databases that don't implement
+// PingableDatabase are checked by listing a server.
+func PingDatabase(db Database) error {
+	for d := db; ; {
+		if pingable, ok := d.(PingableDatabase); ok {
+			return pingable.Ping()
+		}
+		wrapper, ok := d.(WrappedDatabase)
+		if !ok {
+			break
+		}
+		d = wrapper.UnwrapDatabase()
+	}
+	db.ListServersPage("", "", 1)
+	return nil
+}
+
+// Implemented by databases that wrap another database (such as read-only
+// and cached databases).
+type WrappedDatabase interface {
+	UnwrapDatabase() Database
+}
+
+// Returns the underlying database if db is a wrapper.
+func UnwrapDatabase(db Database) Database {
+	for {
+		wrapper, ok := db.(WrappedDatabase)
+		if !ok {
+			return db
+		}
+		db = wrapper.UnwrapDatabase()
+	}
+}
+
+// Closes db if the underlying database implements io.Closer. db must not be
+// used afterwards.
+func CloseDatabase(db Database) error {
+	if closer, ok := UnwrapDatabase(db).(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+type LockStats struct {
+	// The number of servers that are currently locked.
+	Held int `json:"held"`
+
+	// The number of GetServers() (or similar) calls that are waiting for a
+	// lock to be released.
+	Waiting int `json:"waiting"`
+
+	// Statistics for servers that have been waited for (optional).
+	Servers map[string]ServerLockStats `json:"servers,omitempty"`
+}
+
+type ServerLockStats struct {
+	// The number of calls currently waiting for this server.
+	Waiting int `json:"waiting"`
+
+	// The number of times a lock had to be waited for, and the total and
+	// longest wait times in seconds.
+	Waits     uint64  `json:"waits"`
+	TotalWait float64 `json:"total_wait"`
+	MaxWait   float64 `json:"max_wait"`
+}
+
 // An atomic database transaction.
 type DatabaseTransaction struct {
 	db      Database
 	lock    *sync.Mutex
 	servers map[string]*Server
+	logger  *Logger
+
+	// Aliases that were followed by GetServers(), mapped to the UIDs of the
+	// servers they point to.
+	aliases map[string]string
+
+	// Passed to databases that implement LockOwnerDatabase.
+	owner LockOwner
+}
+
+// Locks and loads servers from the database.
+func (self *DatabaseTransaction) lockServers(uids []string) ([]*Server, bool,
+	string) {
+	if db, ok := self.db.(LockOwnerDatabase); ok {
+		return db.GetServersAs(self.owner, uids)
+	}
+	return self.db.GetServers(uids)
 }
 
 // Attempt to use the cache to get servers. Not goroutine-safe.
 func (self *DatabaseTransaction) getFromCache(names []string) ([]*Server, bool, string) {
 	servers := make([]*Server, len(names))
 	for i, name := range names {
+		name = HomogeniseUsername(name)
 		server, exists := self.servers[name]
+		if !exists {
+			server, exists = self.servers[self.aliases[name]]
+		}
 		if !exists {
 			return nil, false, ""
 		}
@@ -66,7 +224,14 @@ func (self *DatabaseTransaction) getFromCache(names []string) ([]*Server, bool,
 }
 
 // Get a server. The server will be freed once Finish() or Abort() is called.
+// Aliases of renamed servers are followed, so the returned servers' UIDs may
+// not match the names passed in.
 func (self *DatabaseTransaction) GetServers(names ...string) ([]*Server, bool, string) {
+	return self.getServers(names, true)
+}
+
+func (self *DatabaseTransaction) getServers(names []string,
+	followAliases bool) ([]*Server, bool, string) {
 	self.lock.Lock()
 	defer self.lock.Unlock()
 
@@ -82,40 +247,56 @@ func (self *DatabaseTransaction) GetServers(names ...string) ([]*Server, bool, s
 	self.servers = make(map[string]*Server)
 
 	// Deduplicate the list
-	deduplicated := false
-	rawNames := names
-	if len(names) > 1 {
-		// Search for duplicates
-		known := make(map[string]bool, len(names))
-		i := 0
-		for _, name := range names {
-			name = HomogeniseUsername(name)
-			if known[name] {
-				deduplicated = true
-				continue
-			}
-			names[i] = name
-			known[name] = true
-			i++
-		}
+	uids := deduplicateServerNames(names)
 
-		names = names[:i]
+	// Otherwise call GetServer
+	var servers []*Server
+	var ok bool
+	var badServer string
+	if followAliases {
+		self.aliases = make(map[string]string)
+		servers, ok, badServer = getServersFollowingAliases(self, uids,
+			self.aliases)
+	} else {
+		servers, ok, badServer = self.lockServers(uids)
+	}
+	if !ok {
+		return servers, ok, badServer
 	}
 
-	// Otherwise call GetServer
-	servers, ok, badServer := self.db.GetServers(names)
-	if ok {
+	// Deleted servers can only be accessed with getServers(names, false).
+	if followAliases {
 		for _, server := range servers {
-			self.servers[server.UID] = server
+			if server.deletedAt != 0 {
+				self.db.FreeServers(servers, false)
+				return nil, false, findRequestedName(self.aliases,
+					server.UID)
+			}
 		}
 	}
 
-	// If the list has been deduplicated, call getFromCache().
-	if deduplicated && ok {
-		return self.getFromCache(rawNames)
+	for _, server := range servers {
+		server.logger = self.logger
+		server.db = self.db
+		self.servers[server.UID] = server
 	}
 
-	return servers, ok, badServer
+	// Return the servers in the order they were requested in.
+	return self.getFromCache(names)
+}
+
+// Returns the homogenised names without any duplicates.
+func deduplicateServerNames(names []string) []string {
+	uids := make([]string, 0, len(names))
+	known := make(map[string]bool, len(names))
+	for _, name := range names {
+		uid := HomogeniseUsername(name)
+		if !known[uid] {
+			uids = append(uids, uid)
+			known[uid] = true
+		}
+	}
+	return uids
 }
 
 func (self *DatabaseTransaction) GetOneServer(name string) (server *Server, ok bool) {
@@ -129,10 +310,12 @@ func (self *DatabaseTransaction) GetOneServer(name string) (server *Server, ok b
 
 // Get a server already in the cache
 func (self *DatabaseTransaction) GetCachedServer(name string) (server *Server, ok bool) {
-	name = HomogeniseUsername(name)
 	self.lock.Lock()
 	defer self.lock.Unlock()
-	server, ok = self.servers[name]
+	servers, ok, _ := self.getFromCache([]string{name})
+	if ok {
+		server = servers[0]
+	}
 	return
 }
 
@@ -146,8 +329,16 @@ func (self *DatabaseTransaction) CreateServer(name string) (*Server, bool) {
 	}
 
 	name, _ = PasteuriseUsername(name)
-	server, ok := self.db.CreateServer(name)
+	var server *Server
+	var ok bool
+	if db, isOwnerDb := self.db.(LockOwnerDatabase); isOwnerDb {
+		server, ok = db.CreateServerAs(self.owner, name)
+	} else {
+		server, ok = self.db.CreateServer(name)
+	}
 	if ok {
+		server.logger = self.logger
+		server.db = self.db
 		self.servers[HomogeniseUsername(name)] = server
 	}
 	return server, ok
@@ -167,21 +358,27 @@ func (self *DatabaseTransaction) ListServers() []string {
 	return self.db.ListServers()
 }
 
+// Calls the underlying database's ListServersPage().
+func (self *DatabaseTransaction) ListServersPage(after, prefix string,
+	limit int) []string {
+	return self.db.ListServersPage(after, prefix, limit)
+}
+
 // Iterate over the database. Server objects are freed after f() returns.
 func (self *DatabaseTransaction) ForEach(f func(*Server) error, saveChanges bool) error {
-	serverNames := self.ListServers()
-	sort.Strings(serverNames)
-
 	// Abort if f() panics.
 	defer self.Abort()
 
-	for _, name := range serverNames {
-		server, ok := self.GetOneServer(name)
+	return forEachServerUID(self.db, func(name string) error {
+		servers, ok, _ := self.getServers([]string{name}, false)
 
-		// If the server has been deleted in the meantime, ignore it.
-		if !ok {
-			continue
+		// If the server has been deleted in the meantime, ignore it. Aliases
+		// are skipped since the server they point to is listed separately.
+		if !ok || servers[0].aliasOf != "" || servers[0].deletedAt != 0 {
+			self.free(false)
+			return nil
 		}
+		server := servers[0]
 
 		// If f(server) returns an error then stop iterating.
 		err := f(server)
@@ -191,14 +388,40 @@ func (self *DatabaseTransaction) ForEach(f func(*Server) error, saveChanges bool
 
 		// Unlock the server (this is the same as calling Finish/Abort).
 		self.free(saveChanges)
-	}
-	return nil
+		return nil
+	})
 }
 
 func ForEach(db Database, f func(*Server) error, saveChanges bool) error {
 	return BeginDbTransaction(db).ForEach(f, saveChanges)
 }
 
+// Permanently deletes a server (and any aliases of it) and removes any
+// pending transactions that it sent from other servers, since they can no
+// longer be rejected. Returns the number of pending transactions removed and
+// false if the server doesn't exist. Deleted servers can also be purged.
+func PurgeServer(db Database, name string) (int, bool) {
+	uid := HomogeniseUsername(name)
+	aliases, _ := findAliases(db, uid)
+	if !db.DeleteServer(uid) {
+		return 0, false
+	}
+	clearWebhookDeliveries(uid)
+	for _, alias := range aliases {
+		db.DeleteServer(alias)
+	}
+
+	removed := 0
+	ForEach(db, func(server *Server) error {
+		removed += server.removePendingTransactionsFrom(uid)
+		for _, alias := range aliases {
+			removed += server.removePendingTransactionsFrom(alias)
+		}
+		return nil
+	}, true)
+	return removed, true
+}
+
 func (self *DatabaseTransaction) free(save bool) {
 	self.lock.Lock()
 	defer self.lock.Unlock()
@@ -208,12 +431,78 @@ func (self *DatabaseTransaction) free(save bool) {
 	}
 
 	servers := make([]*Server, 0, len(self.servers))
+	var fees []Transaction
+	var callbacks []func()
 	for _, server := range self.servers {
+		server.flushWebhookEvents(save)
+		fees = append(fees, server.takeQueuedFees()...)
+		callbacks = append(callbacks, server.takeCallbacks(save)...)
 		servers = append(servers, server)
 	}
 	self.db.FreeServers(servers, save)
+	for _, f := range callbacks {
+		f()
+	}
+
+	// Fees are only credited once the payments have been saved.
+	if save {
+		for _, transaction := range fees {
+			creditFee(self.db, transaction, self.logger)
+		}
+	}
 
 	self.servers = nil
+	self.aliases = nil
+}
+
+// Calls f once the DatabaseTransaction that the server was obtained from has
+// been committed. f is discarded if the transaction is aborted. If the server
+// wasn't obtained from a DatabaseTransaction, f is called immediately.
+func (self *Server) AfterCommit(f func()) {
+	self.lock.Lock()
+	if self.db != nil {
+		self.afterCommit = append(self.afterCommit, f)
+		self.lock.Unlock()
+		return
+	}
+	self.lock.Unlock()
+	f()
+}
+
+// Calls f if the DatabaseTransaction that the server was obtained from is
+// aborted (or if the server is read-only and nothing was saved).
+func (self *Server) AfterAbort(f func()) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.db != nil {
+		self.afterAbort = append(self.afterAbort, f)
+	}
+}
+
+// Removes any functions queued with AfterCommit() and AfterAbort() and
+// returns the ones that should be called.
+func (self *Server) takeCallbacks(save bool) []func() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	funcs := self.afterAbort
+	if save && !self.readOnly {
+		funcs = self.afterCommit
+	}
+	self.afterCommit = nil
+	self.afterAbort = nil
+	return funcs
+}
+
+// Returns true if any servers in the transaction have been modified.
+func (self *DatabaseTransaction) IsModified() bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for _, server := range self.servers {
+		if server.IsModified() {
+			return true
+		}
+	}
+	return false
 }
 
 // Commits the changes made to the database.
@@ -231,16 +520,36 @@ func (self *DatabaseTransaction) GetRawDatabase() Database {
 	return self.db
 }
 
+// Sets the logger used for any transactions made with servers from this
+// DatabaseTransaction.
+func (self *DatabaseTransaction) SetLogger(logger *Logger) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.logger = logger
+	for _, server := range self.servers {
+		server.logger = logger
+	}
+}
+
+func (self *DatabaseTransaction) GetLogger() *Logger {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.logger
+}
+
 // Creates a new DatabaseTransaction object for a database.
 func BeginDbTransaction(db Database) *DatabaseTransaction {
 	var mutex sync.Mutex
-	return &DatabaseTransaction{db, &mutex, nil}
+	return &DatabaseTransaction{db, &mutex, nil, nil, nil, NewLockOwner()}
 }
 
+// logger may be nil.
 func AuthenticateRequest(db Database, username, token string,
-	otherServers []string) (bool, *DatabaseTransaction, *Server) {
+	otherServers []string, logger *Logger) (bool, *DatabaseTransaction,
+	*Server) {
 	// Begin a database transaction.
 	tr := BeginDbTransaction(db)
+	tr.SetLogger(logger)
 
 	// Calling tr.GetServers(username, otherServers...) doesn't work
 	serverNames := make([]string, len(otherServers)+1)
@@ -274,47 +583,153 @@ func AuthenticateRequest(db Database, username, token string,
 	return false, nil, nil
 }
 
-// Backup a database.
+// Backup a database. Servers are written one at a time, so the backup is not
+// a snapshot of the entire database if transactions are made while it is
+// running.
 func BackupDatabase(db Database, writer io.Writer) error {
-	tr := BeginDbTransaction(db)
-	defer tr.Abort()
-
-	// Make a list of encoded servers. This uses pointers to reduce copying.
-	var encodedServers []*EncodedServer
-	tr.ForEach(func(server *Server) error {
-		encodedServer := server.Encode()
-		encodedServers = append(encodedServers, &encodedServer)
-		return nil
-	}, false)
+	w := bufio.NewWriter(writer)
+	w.WriteByte('[')
+	first := true
+	err := db.ForEachEncoded(func(encodedServer *EncodedServer) error {
+		raw, err := json.Marshal(encodedServer)
+		if err != nil {
+			return err
+		}
+		if !first {
+			w.WriteByte(',')
+		}
+		first = false
+		_, err = w.Write(raw)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	w.WriteString("]\n")
+	return w.Flush()
+}
 
-	// Nothing was changed, abort the transaction.
-	tr.Abort()
+// Backup a database as newline-delimited JSON (one server per line).
+// RestoreDatabase accepts backups in either format.
+func BackupDatabaseNDJSON(db Database, writer io.Writer) error {
+	w := bufio.NewWriter(writer)
+	encoder := json.NewEncoder(w)
+	err := db.ForEachEncoded(func(encodedServer *EncodedServer) error {
+		return encoder.Encode(encodedServer)
+	})
+	if err != nil {
+		return err
+	}
+	return w.Flush()
+}
 
-	// Save the encoded servers with JSON.
-	encoder := json.NewEncoder(writer)
-	return encoder.Encode(encodedServers)
+// Backup a database and compress it with gzip.
+func BackupDatabaseGzip(db Database, writer io.Writer, ndjson bool) error {
+	gz := gzip.NewWriter(writer)
+	var err error
+	if ndjson {
+		err = BackupDatabaseNDJSON(db, gz)
+	} else {
+		err = BackupDatabase(db, gz)
+	}
+	if err != nil {
+		return err
+	}
+	return gz.Close()
 }
 
-// Restore a database. This is not atomic and may result in a partially
-// restored database.
-// TODO: Delete servers that exist in the database but do not exist in the
-// backup.
+// Restore a database from a backup (which may be compressed with gzip). This
+// is not atomic and may result in a partially restored database. Servers that
+// aren't in the backup are left alone, use RestoreDatabaseFull to delete them.
 func RestoreDatabase(db Database, reader io.Reader) error {
+	return restoreDatabase(db, reader, false)
+}
+
+// Like RestoreDatabase, but also deletes any servers that exist in the
+// database but not in the backup.
+func RestoreDatabaseFull(db Database, reader io.Reader) error {
+	return restoreDatabase(db, reader, true)
+}
+
+// Reads the servers in a backup (which may be compressed with gzip) without
+// restoring them.
+func ReadBackup(reader io.Reader) ([]EncodedServer, error) {
 	var encodedServers []EncodedServer
-	decoder := json.NewDecoder(reader)
-	err := decoder.Decode(&encodedServers)
+	bufReader := bufio.NewReader(reader)
+
+	// Decompress gzipped backups.
+	if magic, err := bufReader.Peek(2); err == nil &&
+		magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(bufReader)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		bufReader = bufio.NewReader(gz)
+	}
+
+	decoder := json.NewDecoder(bufReader)
+
+	// Skip any leading whitespace to determine the backup format.
+	var first byte
+	for {
+		b, err := bufReader.Peek(1)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if b[0] != ' ' && b[0] != '\t' && b[0] != '\r' && b[0] != '\n' {
+			first = b[0]
+			break
+		}
+		bufReader.Discard(1)
+	}
+
+	if first == '[' {
+		err := decoder.Decode(&encodedServers)
+		if err != nil {
+			return nil, err
+		}
+		if decoder.More() {
+			return nil, errors.New("Extra JSON value")
+		}
+	} else {
+		// Newline-delimited JSON
+		for decoder.More() {
+			var encodedServer EncodedServer
+			if err := decoder.Decode(&encodedServer); err != nil {
+				return nil, err
+			}
+			encodedServers = append(encodedServers, encodedServer)
+		}
+	}
+	return encodedServers, nil
+}
+
+func restoreDatabase(db Database, reader io.Reader, deleteMissing bool) error {
+	encodedServers, err := ReadBackup(reader)
 	if err != nil {
 		return err
 	}
-	if decoder.More() {
-		return errors.New("Extra JSON value")
+	for _, encodedServer := range encodedServers {
+		if err := encodedServer.CheckPrecision(); err != nil {
+			return err
+		}
 	}
 
 	tr := BeginDbTransaction(db)
 	defer tr.Abort()
 
 	for _, encodedServer := range encodedServers {
-		server, ok := tr.GetOrCreateServer(encodedServer.Name)
+		// Aliases are restored as they are instead of being followed.
+		servers, ok, _ := tr.getServers([]string{encodedServer.Name}, false)
+		var server *Server
+		if ok {
+			server = servers[0]
+		} else {
+			server, ok = tr.CreateServer(encodedServer.Name)
+		}
 		if !ok {
 			return errors.New("Could not create server.")
 		}
@@ -326,5 +741,19 @@ func RestoreDatabase(db Database, reader io.Reader) error {
 		// Save
 		tr.Finish()
 	}
+
+	if !deleteMissing {
+		return nil
+	}
+
+	restored := make(map[string]bool, len(encodedServers))
+	for _, encodedServer := range encodedServers {
+		restored[HomogeniseUsername(encodedServer.Name)] = true
+	}
+	for _, name := range db.ListServers() {
+		if !restored[name] {
+			markAndPurgeServer(db, name, false)
+		}
+	}
 	return nil
 }
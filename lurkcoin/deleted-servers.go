@@ -0,0 +1,202 @@
+//
+// lurkcoin deleted servers
+// Copyright © 2020 by luk3yx
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package lurkcoin
+
+import (
+	"errors"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Deleted servers are kept as tombstones (servers with DeletedAt set) for
+// the retention period so that they can be undeleted, and are then purged
+// by PurgeDeletedServers(). Pending transactions sent by deleted servers are
+// only removed from other servers once they are purged.
+var deletedServerRetention = int64(7 * 24 * time.Hour)
+
+// DeletedAt is set to this while a deleted server is being purged so that it
+// can't be undeleted. Servers left in this state (if lurkcoin stops in the
+// middle of purging them) are purged by the next PurgeDeletedServers() call.
+const deletedAtPurging = -1
+
+func GetDeletedServerRetention() time.Duration {
+	return time.Duration(atomic.LoadInt64(&deletedServerRetention))
+}
+
+// Sets how long deleted servers are kept for, this is 7 days by default. If
+// retention is zero, servers are purged as soon as they are deleted.
+func SetDeletedServerRetention(retention time.Duration) error {
+	if retention < 0 {
+		return errors.New("The deleted server retention period must not " +
+			"be negative.")
+	}
+	atomic.StoreInt64(&deletedServerRetention, int64(retention))
+	return nil
+}
+
+// Deletes a server. The server can be undeleted with UndeleteServer() until
+// the retention period is over. Returns the number of pending transactions
+// removed (this is only non-zero if the server is purged immediately) and
+// false if the server doesn't exist.
+func DeleteServer(db Database, name string) (int, bool) {
+	if IsReadOnly(db) {
+		return 0, false
+	} else if GetDeletedServerRetention() == 0 {
+		return PurgeServer(db, name)
+	}
+
+	tr := BeginDbTransaction(db)
+	defer tr.Abort()
+	servers, ok, _ := tr.getServers([]string{name}, false)
+	if !ok || servers[0].deletedAt != 0 {
+		return 0, false
+	}
+	server := servers[0]
+
+	// Aliases don't contain anything worth keeping.
+	if server.aliasOf != "" {
+		tr.Abort()
+		return PurgeServer(db, name)
+	}
+
+	server.lock.Lock()
+	server.deletedAt = time.Now().Unix()
+	server.modified = true
+	server.lock.Unlock()
+	tr.Finish()
+	return 0, true
+}
+
+// Restores a deleted server. Returns false if the server doesn't exist,
+// hasn't been deleted or is being purged.
+func UndeleteServer(db Database, name string) bool {
+	if IsReadOnly(db) {
+		return false
+	}
+	tr := BeginDbTransaction(db)
+	defer tr.Abort()
+	servers, ok, _ := tr.getServers([]string{name}, false)
+	if !ok || servers[0].deletedAt == 0 ||
+		servers[0].deletedAt == deletedAtPurging {
+		return false
+	}
+	server := servers[0]
+	server.lock.Lock()
+	server.deletedAt = 0
+	server.modified = true
+	server.lock.Unlock()
+	tr.Finish()
+	return true
+}
+
+// Purges a server if it has been deleted, unlike PurgeServer() this won't
+// purge servers that haven't been deleted.
+func PurgeDeletedServer(db Database, name string) (int, bool) {
+	return markAndPurgeServer(db, name, true)
+}
+
+// The server is marked as being purged while it is still locked so that it
+// can't be undeleted (or modified) before PurgeServer() deletes it. If
+// onlyDeleted is true, servers that haven't been deleted aren't purged.
+func markAndPurgeServer(db Database, name string, onlyDeleted bool) (int,
+	bool) {
+	tr := BeginDbTransaction(db)
+	defer tr.Abort()
+	servers, ok, _ := tr.getServers([]string{name}, false)
+	if !ok || (onlyDeleted && servers[0].deletedAt == 0) {
+		return 0, false
+	}
+	server := servers[0]
+	server.lock.Lock()
+	server.deletedAt = deletedAtPurging
+	server.modified = true
+	server.lock.Unlock()
+	tr.Finish()
+
+	return PurgeServer(db, name)
+}
+
+type DeletedServer struct {
+	UID       string
+	Name      string
+	Balance   Currency
+	DeletedAt time.Time
+
+	// When the server will be purged by PurgeDeletedServers().
+	PurgeAt time.Time
+}
+
+// Lists deleted servers, the most recently deleted servers are listed first.
+func ListDeletedServers(db Database) ([]DeletedServer, error) {
+	retention := GetDeletedServerRetention()
+	var res []DeletedServer
+	err := db.ForEachEncoded(func(encodedServer *EncodedServer) error {
+		if encodedServer.DeletedAt == 0 {
+			return nil
+		}
+		deletedAt := time.Unix(encodedServer.DeletedAt, 0)
+		res = append(res, DeletedServer{
+			HomogeniseUsername(encodedServer.Name),
+			encodedServer.Name,
+			currencyFromRaw(encodedServer.Balance,
+				encodedServer.Decimals),
+			deletedAt,
+			deletedAt.Add(retention),
+		})
+		return nil
+	})
+	sort.SliceStable(res, func(i, k int) bool {
+		return res[i].DeletedAt.After(res[k].DeletedAt)
+	})
+	return res, err
+}
+
+// Purges deleted servers whose retention period is over and returns the
+// number of servers purged.
+func PurgeDeletedServers(db Database) (int, error) {
+	if IsReadOnly(db) {
+		return 0, nil
+	}
+	deleted, err := ListDeletedServers(db)
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	purged := 0
+	for _, server := range deleted {
+		if server.PurgeAt.After(now) {
+			continue
+		}
+		removed, ok := PurgeDeletedServer(db, server.UID)
+		if !ok {
+			continue
+		}
+		purged++
+		LogInfo("Purged deleted server", "server", server.UID,
+			"removed_pending_transactions", removed)
+		AppendToJournal(&JournalEntry{
+			Type:   JournalAdminAction,
+			Action: "purge_server",
+			Server: server.UID,
+		}, nil)
+	}
+	return purged, nil
+}
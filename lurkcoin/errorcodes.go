@@ -18,12 +18,28 @@
 
 package lurkcoin
 
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// The maximum size of API request bodies in bytes.
+var maxRequestBodySize int64 = 4096
+
+func GetMaxRequestBodySize() int64 {
+	return atomic.LoadInt64(&maxRequestBodySize)
+}
+
+// Sets the maximum size of API request bodies, this is 4096 bytes by default.
+func SetMaxRequestBodySize(size int64) {
+	atomic.StoreInt64(&maxRequestBodySize, size)
+}
+
 // Error codes
 var errorCodes = map[string]string{
-	"ERR_INVALIDLOGIN":   `Invalid login!`,
-	"ERR_INVALIDREQUEST": `Invalid request.`,
-	"ERR_PAYLOADTOOLARGE": `Request body too large. You may send a maximum ` +
-		`of 4096 bytes.`,
+	"ERR_INVALIDLOGIN":    `Invalid login!`,
+	"ERR_INVALIDREQUEST":  `Invalid request.`,
+	"ERR_PAYLOADTOOLARGE": `Request body too large.`,
 
 	"ERR_SERVERNOTFOUND":   `Server not found!`,
 	"ERR_INVALIDAMOUNT":    `Invalid number!`,
@@ -37,6 +53,32 @@ var errorCodes = map[string]string{
 	"ERR_SOURCESERVERNOTFOUND": `The "from" server does not exist!`,
 	"ERR_TARGETSERVERNOTFOUND": `The "to" server does not exist!`,
 	"ERR_TRANSACTIONLIMIT":     `The amount you specified exceeds the max spend!`,
+	"ERR_TRANSACTIONNOTFOUND":  `Transaction not found!`,
+	"ERR_TOOMANYPENDINGTRANSACTIONS": `The target server has too many ` +
+		`pending transactions! Please try again later.`,
+	"ERR_INVALIDLINKCODE":     `Invalid or expired link code!`,
+	"ERR_CANNOTREVERT":        `This transaction cannot be reverted!`,
+	"ERR_REVERTWINDOWEXPIRED": `This transaction is too old to be reverted!`,
+	"ERR_ACCOUNTFROZEN": `The source or target server has been frozen by ` +
+		`an administrator!`,
+	"ERR_INVALIDQUOTE": `Invalid quote!`,
+	"ERR_QUOTEEXPIRED": `This quote has expired or has already been used!`,
+	"ERR_INVALIDCURRENCY": `Invalid currency! Other currencies can't be ` +
+		`used with quotes or sent to user wallets.`,
+	"ERR_IDEMPOTENCYCONFLICT": `This idempotency key was used for a ` +
+		`different request, or the original request hasn't finished yet.`,
+
+	"ERR_INVALIDWEBHOOKURL": `Invalid webhook URL!`,
+	"ERR_WEBHOOKVERIFICATIONFAILED": `The webhook receiver did not ` +
+		`respond with the challenge.`,
+	"ERR_INVALIDWEBHOOKVERSION": `Unsupported webhook version!`,
+	"ERR_INVALIDWEBHOOKEVENT":   `Invalid or missing webhook events!`,
+	"ERR_TOOMANYWEBHOOKS":       `Your server has too many webhooks!`,
+	"ERR_WEBHOOKNOTFOUND":       `Webhook not found!`,
+
+	"ERR_READONLY": `This lurkcoin instance is read-only.`,
+	"ERR_RATELIMITED": `Too many requests! Please wait before trying ` +
+		`again.`,
 }
 
 func LookupError(code string) (string, string, int) {
@@ -46,8 +88,20 @@ func LookupError(code string) (string, string, int) {
 		switch code {
 		case "ERR_INVALIDLOGIN":
 			httpCode = 401
+		case "ERR_TRANSACTIONNOTFOUND", "ERR_WEBHOOKNOTFOUND":
+			httpCode = 404
 		case "ERR_PAYLOADTOOLARGE":
 			httpCode = 413
+			msg = fmt.Sprintf("%s You may send a maximum of %d bytes.", msg,
+				GetMaxRequestBodySize())
+		case "ERR_ACCOUNTFROZEN":
+			httpCode = 403
+		case "ERR_IDEMPOTENCYCONFLICT":
+			httpCode = 409
+		case "ERR_READONLY":
+			httpCode = 503
+		case "ERR_RATELIMITED":
+			httpCode = 429
 		default:
 			httpCode = 400
 		}
@@ -0,0 +1,104 @@
+//
+// lurkcoin
+// Copyright © 2020 by luk3yx
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package lurkcoin
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// An error or panic that should be sent to an external error reporting
+// service such as Sentry.
+type ErrorReport struct {
+	// The error type (for example "*errors.errorString") or "panic".
+	Type    string
+	Message string
+
+	// The stack trace, with the innermost frame first.
+	Stack []runtime.Frame
+
+	Tags map[string]string
+	Time time.Time
+}
+
+// Error reporters should not block, ReportError() and ReportPanic() are
+// called from request handlers.
+type ErrorReporter interface {
+	Report(*ErrorReport)
+}
+
+var errorReporterLock sync.RWMutex
+var errorReporter ErrorReporter
+
+// Sets the error reporter, nil disables error reporting.
+func SetErrorReporter(reporter ErrorReporter) {
+	errorReporterLock.Lock()
+	defer errorReporterLock.Unlock()
+	errorReporter = reporter
+}
+
+func getStack(skip int) []runtime.Frame {
+	pcs := make([]uintptr, 64)
+	n := runtime.Callers(skip+2, pcs)
+	frames := runtime.CallersFrames(pcs[:n])
+	var res []runtime.Frame
+	for {
+		frame, more := frames.Next()
+		res = append(res, frame)
+		if !more {
+			break
+		}
+	}
+	return res
+}
+
+func report(errType, msg string, tags map[string]string) {
+	errorReporterLock.RLock()
+	reporter := errorReporter
+	errorReporterLock.RUnlock()
+	if reporter == nil {
+		return
+	}
+
+	// Skip report() and ReportError()/ReportPanic().
+	reporter.Report(&ErrorReport{errType, msg, getStack(2), tags,
+		time.Now()})
+}
+
+// Reports an error to the configured error reporter (if any). tags may be nil.
+func ReportError(err error, tags map[string]string) {
+	report(fmt.Sprintf("%T", err), err.Error(), tags)
+}
+
+// Reports a value returned by recover(). This should be called from the
+// deferred function so that the stack trace includes the panicking code.
+func ReportPanic(v interface{}, tags map[string]string) {
+	report("panic", fmt.Sprint(v), tags)
+}
+
+// Logs and reports panics in background goroutines instead of crashing. This
+// must be called directly with defer.
+func RecoverAndReport(tags map[string]string) {
+	if v := recover(); v != nil {
+		LogError("Recovered from panic", "panic", fmt.Sprint(v))
+		ReportPanic(v, tags)
+	}
+}
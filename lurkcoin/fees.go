@@ -0,0 +1,185 @@
+//
+// lurkcoin transaction fees
+// Copyright © 2020 by luk3yx
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package lurkcoin
+
+import (
+	"errors"
+	"sync"
+)
+
+// A fee charged on payments, in lurkcoins.
+type Fee struct {
+	Flat Currency
+
+	// A percentage of the amount sent, between 0 and 100.
+	Percentage float64
+}
+
+func (self Fee) calculate(amount Currency) Currency {
+	fee := c0
+	if !self.Flat.IsNil() {
+		fee = self.Flat
+	}
+	if self.Percentage > 0 {
+		fee = fee.Add(amount.Percentage(self.Percentage, RoundTowardsZero))
+	}
+	return fee
+}
+
+// Fees are deducted from payments between different servers and are
+// credited to the treasury server. Fees for payments sent by servers in
+// Servers override the default fee.
+type FeeSchedule struct {
+	Treasury string
+	Default  Fee
+	Servers  map[string]Fee
+}
+
+var feeScheduleLock sync.RWMutex
+var feeSchedule FeeSchedule
+
+// Sets the fee schedule, an empty schedule (the default) disables fees.
+func SetFeeSchedule(schedule FeeSchedule) error {
+	fees := make([]Fee, 0, len(schedule.Servers)+1)
+	fees = append(fees, schedule.Default)
+	servers := make(map[string]Fee, len(schedule.Servers))
+	for name, fee := range schedule.Servers {
+		fees = append(fees, fee)
+		servers[HomogeniseUsername(name)] = fee
+	}
+	schedule.Servers = servers
+
+	charged := false
+	for _, fee := range fees {
+		if (!fee.Flat.IsNil() && fee.Flat.LtZero()) || fee.Percentage < 0 ||
+			fee.Percentage >= 100 {
+			return errors.New("Fees must not be negative and percentages " +
+				"must be less than 100")
+		}
+		if (!fee.Flat.IsNil() && fee.Flat.GtZero()) || fee.Percentage > 0 {
+			charged = true
+		}
+	}
+	if charged && schedule.Treasury == "" {
+		return errors.New("A treasury server is required to charge fees")
+	}
+	schedule.Treasury = HomogeniseUsername(schedule.Treasury)
+
+	feeScheduleLock.Lock()
+	defer feeScheduleLock.Unlock()
+	feeSchedule = schedule
+	return nil
+}
+
+// Returns the UID of the treasury server, or an empty string if fees are
+// disabled.
+func GetTreasury() string {
+	feeScheduleLock.RLock()
+	defer feeScheduleLock.RUnlock()
+	return feeSchedule.Treasury
+}
+
+// Calculates the fee charged on a payment of amount lurkcoins from source to
+// target (both server UIDs). Payments to and from the treasury are free.
+func CalculateFee(source, target string, amount Currency) Currency {
+	feeScheduleLock.RLock()
+	defer feeScheduleLock.RUnlock()
+	if feeSchedule.Treasury == "" || source == target ||
+		source == feeSchedule.Treasury || target == feeSchedule.Treasury {
+		return c0
+	}
+	if fee, ok := feeSchedule.Servers[source]; ok {
+		return fee.calculate(amount)
+	}
+	return feeSchedule.Default.calculate(amount)
+}
+
+// Queues a fee to be credited to the treasury once the DatabaseTransaction
+// that the server was obtained from is committed, so that aborted payments
+// don't credit fees.
+func (self *Server) queueFee(transaction Transaction) {
+	if transaction.Fee == nil || GetTreasury() == "" {
+		return
+	} else if self.db == nil {
+		self.logger.Error("Could not credit fee, the source server was not "+
+			"obtained from a DatabaseTransaction",
+			"transaction_id", transaction.ID)
+		return
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if !self.readOnly {
+		self.queuedFees = append(self.queuedFees, transaction)
+	}
+}
+
+// Removes and returns any queued fees.
+func (self *Server) takeQueuedFees() []Transaction {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	fees := self.queuedFees
+	self.queuedFees = nil
+	return fees
+}
+
+// Credits a fee to the treasury server in the background. This is done after
+// the payment's DatabaseTransaction has been committed since the treasury
+// isn't locked by whatever sent the payment.
+func creditFee(db Database, transaction Transaction, logger *Logger) {
+	treasury := GetTreasury()
+	if treasury == "" || transaction.Fee == nil {
+		return
+	}
+
+	backgroundTasks.Add(1)
+	go func() {
+		defer backgroundTasks.Done()
+		defer RecoverAndReport(nil)
+
+		tr := BeginDbTransaction(db)
+		defer tr.Abort()
+		tr.SetLogger(logger)
+		server, ok := tr.GetOneServer(treasury)
+		if !ok {
+			logger.Error("Could not credit fee, the treasury server does "+
+				"not exist", "transaction_id", transaction.ID,
+				"treasury", treasury)
+			return
+		}
+
+		// The fee is recorded as a separate transaction from the source
+		// server. Its amount has already been taken from the source server.
+		fee := *transaction.Fee
+		feeTransaction := MakeTransaction(transaction.Source,
+			transaction.SourceServer, "", server.Name, fee, fee, fee)
+		feeTransaction.FeeFor = transaction.ID
+		server.ChangeBal(fee)
+		server.AddToHistory(feeTransaction)
+		logger.Info(feeTransaction.String(),
+			"transaction_id", feeTransaction.ID,
+			"fee_for", transaction.ID)
+		server.queueJournalEntry(&JournalEntry{
+			Time:        feeTransaction.Time,
+			Type:        JournalTransaction,
+			Transaction: &feeTransaction,
+		})
+		tr.Finish()
+	}()
+}
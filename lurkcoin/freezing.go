@@ -0,0 +1,64 @@
+//
+// lurkcoin account freezing
+// Copyright © 2020 by luk3yx
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package lurkcoin
+
+// Servers can be frozen by an administrator (for example if their token has
+// been leaked) without deleting them. Frozen servers can't send payments,
+// and servers frozen with FrozenAll can't receive them either. Refunds of
+// rejected or reverted transactions are always allowed.
+const (
+	FrozenNone     = ""
+	FrozenOutgoing = "outgoing"
+	FrozenAll      = "all"
+)
+
+// Returns true if mode is a valid freeze mode.
+func IsValidFreezeMode(mode string) bool {
+	return mode == FrozenNone || mode == FrozenOutgoing || mode == FrozenAll
+}
+
+// Returns the server's freeze mode, this is FrozenNone unless the server has
+// been frozen.
+func (self *Server) GetFrozen() string {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	return self.frozen
+}
+
+// Freezes or unfreezes the server, returns false if mode is invalid.
+func (self *Server) SetFrozen(mode string) bool {
+	if !IsValidFreezeMode(mode) {
+		return false
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.frozen = mode
+	self.modified = true
+	self.queueSettingsEvent("frozen")
+	return true
+}
+
+// Returns true if a payment from source to target is blocked because either
+// server is frozen.
+func paymentBlockedByFreeze(source, target *Server) bool {
+	if source.GetFrozen() != FrozenNone {
+		return true
+	}
+	return target.GetFrozen() == FrozenAll
+}
@@ -0,0 +1,190 @@
+//
+// lurkcoin global username registry
+// Copyright © 2020 by luk3yx
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package lurkcoin
+
+import (
+	crypto_rand "crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Servers can opt in to registering their users with a global ID, so that the
+// same player can be recognised on multiple servers. A user on another server
+// is linked to an existing global ID with a short-lived link code.
+
+// An account linked to a global ID.
+type IdentityAccount struct {
+	Server string `json:"server"`
+	User   string `json:"user"`
+}
+
+// How long link codes can be used for.
+const IdentityLinkCodeLifetime = 10 * time.Minute
+
+func generateGlobalID() string {
+	raw := make([]byte, 8)
+	if _, err := crypto_rand.Read(raw); err != nil {
+		panic(err)
+	}
+	return "U" + strings.ToUpper(hex.EncodeToString(raw))
+}
+
+// Gets a user's global ID, this is an empty string if the user isn't
+// registered.
+func (self *Server) GetIdentity(user string) string {
+	user, _ = PasteuriseUsername(user)
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	return self.identities[user]
+}
+
+func (self *Server) setIdentity(user, id string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.identities == nil {
+		self.identities = make(map[string]string)
+	}
+	if id == "" {
+		delete(self.identities, user)
+	} else {
+		self.identities[user] = id
+	}
+	self.modified = true
+}
+
+// Registers a user with the global username registry and returns their
+// global ID. If the user is already registered, their existing ID is
+// returned.
+func (self *Server) RegisterIdentity(user string) (string, error) {
+	user, length := PasteuriseUsername(user)
+	if user == "" || length > 48 {
+		return "", errors.New("ERR_INVALIDREQUEST")
+	}
+	if id := self.GetIdentity(user); id != "" {
+		return id, nil
+	}
+	id := generateGlobalID()
+	self.setIdentity(user, id)
+	return id, nil
+}
+
+// Removes a user from the global username registry.
+func (self *Server) UnregisterIdentity(user string) {
+	user, _ = PasteuriseUsername(user)
+	if self.GetIdentity(user) != "" {
+		self.setIdentity(user, "")
+	}
+}
+
+// Link codes are only stored in memory.
+type identityLinkCode struct {
+	id     string
+	expiry time.Time
+}
+
+var linkCodesLock sync.Mutex
+var linkCodes = make(map[string]identityLinkCode)
+
+// Letters and numbers that are hard to mix up when typed in-game.
+const linkCodeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+// Creates a link code for a user's global ID (registering the user if
+// needed). The code can be used once with LinkIdentity() to link a user on
+// another server to the same global ID.
+func (self *Server) NewIdentityLinkCode(user string) (string, time.Time,
+	error) {
+	id, err := self.RegisterIdentity(user)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	raw := make([]byte, 10)
+	if _, err := crypto_rand.Read(raw); err != nil {
+		panic(err)
+	}
+	code := make([]byte, len(raw))
+	for i, b := range raw {
+		code[i] = linkCodeAlphabet[int(b)%len(linkCodeAlphabet)]
+	}
+
+	linkCodesLock.Lock()
+	defer linkCodesLock.Unlock()
+	now := time.Now()
+	for c, entry := range linkCodes {
+		if now.After(entry.expiry) {
+			delete(linkCodes, c)
+		}
+	}
+	expiry := now.Add(IdentityLinkCodeLifetime)
+	linkCodes[string(code)] = identityLinkCode{id, expiry}
+	return string(code), expiry, nil
+}
+
+// Links a user to the global ID of a link code and returns the global ID.
+// Any global ID the user was previously registered with is replaced.
+func (self *Server) LinkIdentity(user, code string) (string, error) {
+	user, length := PasteuriseUsername(user)
+	if user == "" || length > 48 {
+		return "", errors.New("ERR_INVALIDREQUEST")
+	}
+
+	code = strings.ToUpper(strings.TrimSpace(code))
+	linkCodesLock.Lock()
+	entry, ok := linkCodes[code]
+	delete(linkCodes, code)
+	linkCodesLock.Unlock()
+	if !ok || time.Now().After(entry.expiry) {
+		return "", errors.New("ERR_INVALIDLINKCODE")
+	}
+
+	self.setIdentity(user, entry.id)
+	return entry.id, nil
+}
+
+// Gets the global ID of a user on any server, this is an empty string if the
+// server doesn't exist or the user isn't registered.
+func LookupIdentity(db Database, serverName, user string) string {
+	tr := BeginDbTransaction(db)
+	defer tr.Abort()
+	server, ok := tr.GetOneServer(serverName)
+	if !ok {
+		return ""
+	}
+	return server.GetIdentity(user)
+}
+
+// Returns every account linked to a global ID. Every server has to be
+// checked, so this can be slow on instances with a lot of servers.
+func FindIdentityAccounts(db Database, id string) ([]IdentityAccount, error) {
+	var accounts []IdentityAccount
+	err := ForEach(db, func(server *Server) error {
+		server.lock.RLock()
+		defer server.lock.RUnlock()
+		for user, userID := range server.identities {
+			if userID == id {
+				accounts = append(accounts, IdentityAccount{server.Name, user})
+			}
+		}
+		return nil
+	}, false)
+	return accounts, err
+}
@@ -0,0 +1,172 @@
+//
+// lurkcoin journal hash chain
+// Copyright © 2020 by luk3yx
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package lurkcoin
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Every journal entry written by FileJournal includes the hash of the
+// previous entry (prev_hash) and its own hash (hash), which is the SHA-256
+// hash of the entry's JSON without the hash field. Editing or removing an
+// entry breaks the chain. Entries written before hashing was added are
+// allowed at the start of the journal.
+
+func hashJournalEntry(raw []byte) string {
+	h := sha256.Sum256(raw)
+	return hex.EncodeToString(h[:])
+}
+
+// Adds "hash" to the end of a marshalled entry and appends a newline.
+func appendJournalHash(raw []byte, hash string) []byte {
+	res := make([]byte, 0, len(raw)+len(hash)+12)
+	res = append(res, raw[:len(raw)-1]...)
+	res = append(res, `,"hash":"`...)
+	res = append(res, hash...)
+	return append(res, '"', '}', '\n')
+}
+
+type journalLineHash struct {
+	PrevHash string `json:"prev_hash"`
+	Hash     string `json:"hash"`
+}
+
+// Parses the hashes in a journal line and checks that the stored hash
+// matches the entry. If the entry has no hash, hashes.Hash will be empty.
+func checkJournalLine(line []byte) (hashes journalLineHash, valid bool,
+	err error) {
+	line = bytes.TrimRight(line, "\r\n")
+	if err = json.Unmarshal(line, &hashes); err != nil || hashes.Hash == "" {
+		return
+	}
+
+	suffix := []byte(`,"hash":"` + hashes.Hash + `"}`)
+	if !bytes.HasSuffix(line, suffix) {
+		return
+	}
+	raw := append(line[:len(line)-len(suffix):len(line)-len(suffix)], '}')
+	valid = hashJournalEntry(raw) == hashes.Hash
+	return
+}
+
+// Calls f() with every complete line in the journal file.
+func forEachJournalLine(location string, f func([]byte) error) error {
+	file, err := os.Open(location)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := f(line); err != nil {
+			return err
+		}
+	}
+}
+
+// Returns the hash of the last hashed entry in a journal file.
+func findLastJournalHash(location string) (string, error) {
+	var lastHash string
+	err := forEachJournalLine(location, func(line []byte) error {
+		var hashes journalLineHash
+		if json.Unmarshal(line, &hashes) == nil && hashes.Hash != "" {
+			lastHash = hashes.Hash
+		}
+		return nil
+	})
+	return lastHash, err
+}
+
+type JournalChainReport struct {
+	Entries         int    `json:"entries"`
+	UnhashedEntries int    `json:"unhashed_entries"`
+	LastHash        string `json:"last_hash,omitempty"`
+
+	Problems []Discrepancy `json:"problems"`
+}
+
+// Checks that the journal's hash chain is intact. If knownHash is not empty
+// (for example a hash recorded by the operator earlier), an entry with that
+// hash must exist so that truncated or rewritten journals can be detected.
+func (self *FileJournal) VerifyChain(knownHash string) (*JournalChainReport,
+	error) {
+	report := &JournalChainReport{Problems: []Discrepancy{}}
+	problem := func(format string, a ...interface{}) {
+		msg := fmt.Sprintf("Journal line %d: ", report.Entries) +
+			fmt.Sprintf(format, a...)
+		report.Problems = append(report.Problems, Discrepancy{Problem: msg})
+	}
+
+	foundKnownHash := false
+	err := forEachJournalLine(self.location, func(line []byte) error {
+		report.Entries++
+		hashes, valid, err := checkJournalLine(line)
+		if err != nil {
+			problem("Invalid JSON: %v", err)
+			return nil
+		}
+
+		if hashes.Hash == "" {
+			if report.LastHash == "" {
+				report.UnhashedEntries++
+			} else {
+				problem("Entry has no hash")
+			}
+			return nil
+		}
+
+		if !valid {
+			problem("Hash does not match entry (%s)", hashes.Hash)
+		}
+		if hashes.PrevHash != report.LastHash {
+			problem("Previous hash is %q, expected %q", hashes.PrevHash,
+				report.LastHash)
+		}
+		if hashes.Hash == knownHash {
+			foundKnownHash = true
+		}
+		report.LastHash = hashes.Hash
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if knownHash != "" && !foundKnownHash {
+		report.Problems = append(report.Problems, Discrepancy{
+			Problem: "The journal does not contain an entry with hash " +
+				knownHash + ", it may have been truncated or rewritten",
+		})
+	}
+	return report, nil
+}
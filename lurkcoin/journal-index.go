@@ -0,0 +1,130 @@
+//
+// lurkcoin journal index
+// Copyright © 2020 by luk3yx
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package lurkcoin
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+)
+
+// A journal that can look up transactions without reading every entry.
+type TransactionJournal interface {
+	Journal
+
+	// Returns the transaction with the specified ID (or nil if it isn't in
+	// the journal) and the ID of the first transaction that reverts it (if
+	// any).
+	FindTransaction(id string) (*Transaction, string, error)
+}
+
+// An index of the transactions in a FileJournal. Only the offset of each
+// transaction and the IDs of reversals are kept in memory. The index is
+// built the first time it is used, and entries appended since then
+// (including by other processes) are indexed before each lookup.
+type journalIndex struct {
+	lock      sync.Mutex
+	size      int64
+	offsets   map[string]int64
+	reversals map[string]string
+}
+
+// Indexes any new entries and returns the opened journal file.
+func (self *journalIndex) update(location string) (*os.File, error) {
+	file, err := os.Open(location)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	// Start again if the journal has been replaced with a smaller file.
+	if self.offsets == nil || info.Size() < self.size {
+		self.size = 0
+		self.offsets = make(map[string]int64)
+		self.reversals = make(map[string]string)
+	}
+	if _, err := file.Seek(self.size, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			// Partially written entries are indexed once they're complete.
+			return file, nil
+		} else if err != nil {
+			file.Close()
+			return nil, err
+		}
+
+		offset := self.size
+		self.size += int64(len(line))
+		var entry JournalEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			file.Close()
+			return nil, err
+		}
+		t := entry.Transaction
+		if entry.Type != JournalTransaction || t == nil {
+			continue
+		}
+		if _, exists := self.offsets[t.ID]; !exists {
+			self.offsets[t.ID] = offset
+		}
+		if _, exists := self.reversals[t.Reverts]; t.Reverts != "" &&
+			!exists {
+			self.reversals[t.Reverts] = t.ID
+		}
+	}
+}
+
+func (self *FileJournal) FindTransaction(id string) (*Transaction, string,
+	error) {
+	self.index.lock.Lock()
+	defer self.index.lock.Unlock()
+	file, err := self.index.update(self.location)
+	if err != nil {
+		return nil, "", err
+	}
+	defer file.Close()
+
+	revertedBy := self.index.reversals[id]
+	offset, ok := self.index.offsets[id]
+	if !ok {
+		return nil, revertedBy, nil
+	}
+	section := io.NewSectionReader(file, offset, self.index.size-offset)
+	line, err := bufio.NewReader(section).ReadBytes('\n')
+	if err != nil {
+		return nil, "", err
+	}
+	var entry JournalEntry
+	if err := json.Unmarshal(line, &entry); err != nil {
+		return nil, "", err
+	}
+	return entry.Transaction, revertedBy, nil
+}
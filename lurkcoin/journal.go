@@ -0,0 +1,221 @@
+//
+// lurkcoin
+// Copyright © 2020 by luk3yx
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package lurkcoin
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Journal entry types
+const (
+	JournalTransaction = "transaction"
+	JournalAdminAction = "admin"
+)
+
+// The journal is an append-only record of every transaction and admin action.
+// Unlike server histories, it is never truncated.
+type JournalEntry struct {
+	Time      int64  `json:"time"`
+	Type      string `json:"type"`
+	RequestID string `json:"request_id,omitempty"`
+
+	// Only used for transactions.
+	Transaction *Transaction `json:"transaction,omitempty"`
+
+	// Only used for admin actions. Value is the new value of whatever the
+	// action changed (if applicable).
+	AdminUser string `json:"admin_user,omitempty"`
+	Action    string `json:"action,omitempty"`
+	Server    string `json:"server,omitempty"`
+	Value     string `json:"value,omitempty"`
+
+	// The hash of the previous entry and of this entry, see journal-chain.go.
+	// Hash must be the last field.
+	PrevHash string `json:"prev_hash,omitempty"`
+	Hash     string `json:"hash,omitempty"`
+}
+
+func (self *JournalEntry) GetTime() time.Time {
+	return time.Unix(self.Time, 0)
+}
+
+type Journal interface {
+	Append(*JournalEntry) error
+
+	// Calls f() with every entry between since and until (inclusive) in
+	// chronological order. A zero since/until time means that the range is
+	// unbounded.
+	ForEach(since, until time.Time, f func(*JournalEntry) error) error
+}
+
+// A journal stored in a file as JSON lines.
+type FileJournal struct {
+	lock     sync.Mutex
+	file     *os.File
+	location string
+	lastHash string
+	index    journalIndex
+}
+
+func (self *FileJournal) Append(entry *JournalEntry) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	entry.PrevHash = self.lastHash
+	entry.Hash = ""
+	raw, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	entry.Hash = hashJournalEntry(raw)
+	raw = appendJournalHash(raw, entry.Hash)
+
+	if _, err = self.file.Write(raw); err != nil {
+		return err
+	}
+	self.lastHash = entry.Hash
+	return nil
+}
+
+// Returns the hash of the last entry written to the journal.
+func (self *FileJournal) LastHash() string {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.lastHash
+}
+
+func (self *FileJournal) ForEach(since, until time.Time,
+	f func(*JournalEntry) error) error {
+	file, err := os.Open(self.location)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			// Ignore any partially written entry at the end of the file.
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		var entry JournalEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return err
+		}
+		t := entry.GetTime()
+		if (!since.IsZero() && t.Before(since)) ||
+			(!until.IsZero() && t.After(until)) {
+			continue
+		}
+		if err := f(&entry); err != nil {
+			return err
+		}
+	}
+}
+
+func (self *FileJournal) Close() error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.file.Close()
+}
+
+// Opens (or creates) a journal file.
+func OpenFileJournal(location string) (*FileJournal, error) {
+	file, err := os.OpenFile(location, os.O_WRONLY|os.O_APPEND|os.O_CREATE,
+		0600)
+	if err != nil {
+		return nil, err
+	}
+	lastHash, err := findLastJournalHash(location)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &FileJournal{file: file, location: location, lastHash: lastHash}, nil
+}
+
+var journalLock sync.RWMutex
+var journal Journal
+
+// Sets the journal used by lurkcoin, nil disables the journal.
+func SetJournal(j Journal) {
+	journalLock.Lock()
+	defer journalLock.Unlock()
+	journal = j
+}
+
+// Returns the current journal or nil.
+func GetJournal() Journal {
+	journalLock.RLock()
+	defer journalLock.RUnlock()
+	return journal
+}
+
+// Appends an entry to the journal (if any). If entry.Time is zero it will be
+// set to the current time. Errors are logged and reported.
+func AppendToJournal(entry *JournalEntry, logger *Logger) {
+	j := GetJournal()
+	if j == nil {
+		return
+	}
+	if entry.Time == 0 {
+		entry.Time = time.Now().Unix()
+	}
+	if entry.RequestID == "" && logger != nil {
+		entry.RequestID = logger.RequestID
+	}
+	if err := j.Append(entry); err != nil {
+		logger.Error("Could not write to the journal", "error", err)
+		ReportError(err, map[string]string{"component": "journal"})
+	}
+}
+
+// Appends an entry to the journal once the server's DatabaseTransaction has
+// been committed, so that aborted changes are never journalled.
+func (self *Server) queueJournalEntry(entry *JournalEntry) {
+	if entry.Time == 0 {
+		entry.Time = time.Now().Unix()
+	}
+	logger := self.logger
+	self.AfterCommit(func() {
+		AppendToJournal(entry, logger)
+	})
+}
+
+// Writes journal entries to w as JSON lines. If entryType is not empty, only
+// entries of that type are written.
+func ExportJournal(j Journal, w io.Writer, since, until time.Time,
+	entryType string) error {
+	encoder := json.NewEncoder(w)
+	return j.ForEach(since, until, func(entry *JournalEntry) error {
+		if entryType != "" && entry.Type != entryType {
+			return nil
+		}
+		return encoder.Encode(entry)
+	})
+}
@@ -0,0 +1,279 @@
+//
+// lurkcoin
+// Copyright © 2020 by luk3yx
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package lurkcoin
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Supported ExportTransactions formats.
+var TransactionExportFormats = []string{"csv", "ledger", "beancount"}
+
+// Returns every transaction made between since and until (inclusive) in
+// chronological order. If j is nil, server histories are used instead,
+// however these only contain the most recent transactions of each server.
+func CollectTransactions(db Database, j Journal, since,
+	until time.Time) ([]Transaction, error) {
+	var transactions []Transaction
+	seen := make(map[string]bool)
+	add := func(transaction *Transaction) {
+		if seen[transaction.ID] {
+			return
+		}
+		t := transaction.GetTime()
+		if (!since.IsZero() && t.Before(since)) ||
+			(!until.IsZero() && t.After(until)) {
+			return
+		}
+		seen[transaction.ID] = true
+		transactions = append(transactions, *transaction)
+	}
+
+	if j != nil {
+		err := j.ForEach(since, until, func(entry *JournalEntry) error {
+			if entry.Type == JournalTransaction && entry.Transaction != nil {
+				add(entry.Transaction)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		tr := BeginDbTransaction(db)
+		defer tr.Abort()
+		tr.ForEach(func(server *Server) error {
+			for _, transaction := range server.GetHistory() {
+				add(&transaction)
+			}
+			return nil
+		}, false)
+		tr.Abort()
+	}
+
+	sort.SliceStable(transactions, func(i, k int) bool {
+		if transactions[i].Time == transactions[k].Time {
+			return transactions[i].ID < transactions[k].ID
+		}
+		return transactions[i].Time < transactions[k].Time
+	})
+	return transactions, nil
+}
+
+// Replaces characters that aren't allowed in ledger-cli account names.
+func ledgerAccountComponent(s string) string {
+	if s == "" {
+		return "unknown"
+	}
+	return strings.Map(func(r rune) rune {
+		if r == ':' || r == ';' || unicode.IsSpace(r) {
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+// Beancount account names are a lot stricter, components must start with a
+// capital letter or number and may only contain letters, numbers and dashes.
+func beancountAccountComponent(s string) string {
+	var builder strings.Builder
+	for _, r := range s {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if builder.Len() == 0 {
+				r = unicode.ToUpper(r)
+			}
+			builder.WriteRune(r)
+		} else if builder.Len() > 0 {
+			builder.WriteByte('-')
+		}
+	}
+	res := builder.String()
+	first, _ := utf8.DecodeRuneInString(res)
+	if !unicode.IsUpper(first) && !unicode.IsDigit(first) {
+		res = "X" + res
+	}
+	return res
+}
+
+func transactionAccount(server, user string,
+	component func(string) string) string {
+	res := "Assets:Servers:" + component(server)
+	if user != "" {
+		res += ":" + component(user)
+	}
+	return res
+}
+
+// Returns the fee charged on a transaction as a string, or an empty string if
+// there was no fee.
+func feeString(t Transaction) string {
+	if t.Fee == nil {
+		return ""
+	}
+	return t.Fee.RawString()
+}
+
+// Returns the ledger/beancount commodity of a transaction.
+func transactionCommodity(t Transaction) string {
+	if t.Currency == "" {
+		return "LURKCOIN"
+	}
+	return strings.ToUpper(t.Currency)
+}
+
+func exportCSV(w io.Writer, transactions []Transaction) error {
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"id", "time", "source", "source_server", "target",
+		"target_server", "amount", "sent_amount", "received_amount",
+		"revertable", "fee", "currency"})
+	for _, t := range transactions {
+		writer.Write([]string{
+			t.ID,
+			t.GetTime().Format(time.RFC3339),
+			t.Source,
+			t.SourceServer,
+			t.Target,
+			t.TargetServer,
+			t.Amount.RawString(),
+			t.SentAmount.RawString(),
+			t.ReceivedAmount.RawString(),
+			strconv.FormatBool(t.Revertable),
+			feeString(t),
+			t.Currency,
+		})
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+func exportLedger(w io.Writer, transactions []Transaction) error {
+	for _, t := range transactions {
+		_, err := fmt.Fprintf(w, "%s * %s\n    ; ID: %s\n"+
+			"    %s  %s %s\n    %s  %s %s\n\n",
+			t.GetTime().Format("2006/01/02"),
+			strings.Map(func(r rune) rune {
+				if unicode.IsSpace(r) {
+					return ' '
+				}
+				return r
+			}, fmt.Sprintf("%s (%s) to %s (%s)", t.Source, t.SourceServer,
+				t.Target, t.TargetServer)),
+			t.ID,
+			transactionAccount(t.TargetServer, t.Target,
+				ledgerAccountComponent),
+			t.netAmount().RawString(),
+			transactionCommodity(t),
+			transactionAccount(t.SourceServer, t.Source,
+				ledgerAccountComponent),
+			t.netAmount().Neg().RawString(),
+			transactionCommodity(t),
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func exportBeancount(w io.Writer, transactions []Transaction) error {
+	if _, err := io.WriteString(w, "option \"operating_currency\" \"LURKCOIN\"\n\n"); err != nil {
+		return err
+	}
+
+	// Accounts are restricted to lurkcoins unless there are transactions in
+	// other currencies.
+	constraint := " LURKCOIN"
+	for _, t := range transactions {
+		if t.Currency != "" {
+			constraint = ""
+			break
+		}
+	}
+
+	// Beancount requires accounts to be opened before they are used.
+	opened := make(map[string]bool)
+	open := func(account string, t time.Time) error {
+		if opened[account] {
+			return nil
+		}
+		opened[account] = true
+		_, err := fmt.Fprintf(w, "%s open %s%s\n",
+			t.Format("2006-01-02"), account, constraint)
+		return err
+	}
+
+	for _, t := range transactions {
+		date := t.GetTime()
+		target := transactionAccount(t.TargetServer, t.Target,
+			beancountAccountComponent)
+		source := transactionAccount(t.SourceServer, t.Source,
+			beancountAccountComponent)
+		if err := open(target, date); err != nil {
+			return err
+		}
+		if err := open(source, date); err != nil {
+			return err
+		}
+
+		_, err := fmt.Fprintf(w, "%s * %q %q\n  id: %q\n"+
+			"  %s  %s %s\n  %s  %s %s\n\n",
+			date.Format("2006-01-02"),
+			t.Source+" ("+t.SourceServer+")",
+			"Payment to "+t.Target+" ("+t.TargetServer+")",
+			t.ID,
+			target,
+			t.netAmount().RawString(),
+			transactionCommodity(t),
+			source,
+			t.netAmount().Neg().RawString(),
+			transactionCommodity(t),
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Writes transactions to w in the specified format (see
+// TransactionExportFormats). Amounts are in the transaction's currency
+// (lurkcoins by default), each server is an account and each user is a
+// sub-account of the server.
+func ExportTransactions(w io.Writer, transactions []Transaction,
+	format string) error {
+	switch strings.ToLower(format) {
+	case "csv":
+		return exportCSV(w, transactions)
+	case "ledger":
+		return exportLedger(w, transactions)
+	case "beancount":
+		return exportBeancount(w, transactions)
+	default:
+		return errors.New("Unknown export format: " + format)
+	}
+}
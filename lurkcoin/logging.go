@@ -0,0 +1,273 @@
+//
+// lurkcoin
+// Copyright © 2020 by luk3yx
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package lurkcoin
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type LogLevel int
+
+const (
+	LevelDebug LogLevel = iota
+	LevelInfo
+	LevelWarning
+	LevelError
+)
+
+var logLevelNames = []string{"debug", "info", "warning", "error"}
+
+func (self LogLevel) String() string {
+	if self < 0 || int(self) >= len(logLevelNames) {
+		return strconv.Itoa(int(self))
+	}
+	return logLevelNames[self]
+}
+
+// Parses a log level name ("debug", "info", "warning" or "error").
+func ParseLogLevel(s string) (LogLevel, error) {
+	s = strings.ToLower(s)
+	if s == "warn" {
+		s = "warning"
+	}
+	for i, name := range logLevelNames {
+		if s == name {
+			return LogLevel(i), nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown log level: %q", s)
+}
+
+var logSettingsLock sync.RWMutex
+var minLogLevel = LevelInfo
+var jsonLogs = false
+
+// Sets the minimum log level and whether log messages are written as JSON
+// (one object per line) instead of text. JSON log messages are written to
+// the standard logger's output (see log.SetOutput()).
+func ConfigureLogging(level LogLevel, json bool) {
+	logSettingsLock.Lock()
+	defer logSettingsLock.Unlock()
+	minLogLevel = level
+	jsonLogs = json
+}
+
+func getLogSettings() (LogLevel, bool) {
+	logSettingsLock.RLock()
+	defer logSettingsLock.RUnlock()
+	return minLogLevel, jsonLogs
+}
+
+// Returns true if log messages are written as JSON.
+func JSONLogsEnabled() bool {
+	_, json := getLogSettings()
+	return json
+}
+
+// A logger that adds the request ID (if any) and any other fields to log
+// messages so that log lines can be correlated and filtered. A nil *Logger
+// is valid and logs messages without a request ID.
+type Logger struct {
+	RequestID string
+
+	// Key/value pairs added to every message.
+	fields []interface{}
+}
+
+func NewLogger(requestID string) *Logger {
+	return &Logger{RequestID: requestID}
+}
+
+// Returns a copy of the logger that adds the key/value pairs in kv to every
+// message.
+func (self *Logger) With(kv ...interface{}) *Logger {
+	res := &Logger{}
+	if self != nil {
+		res.RequestID = self.RequestID
+		res.fields = append(res.fields, self.fields...)
+	}
+	res.fields = append(res.fields, kv...)
+	return res
+}
+
+// Print and Printf log messages at the info level.
+func (self *Logger) Print(v ...interface{}) {
+	self.Log(LevelInfo, fmt.Sprint(v...))
+}
+
+func (self *Logger) Printf(format string, v ...interface{}) {
+	self.Log(LevelInfo, fmt.Sprintf(format, v...))
+}
+
+func (self *Logger) Debug(msg string, kv ...interface{}) {
+	self.Log(LevelDebug, msg, kv...)
+}
+
+func (self *Logger) Info(msg string, kv ...interface{}) {
+	self.Log(LevelInfo, msg, kv...)
+}
+
+func (self *Logger) Warning(msg string, kv ...interface{}) {
+	self.Log(LevelWarning, msg, kv...)
+}
+
+func (self *Logger) Error(msg string, kv ...interface{}) {
+	self.Log(LevelError, msg, kv...)
+}
+
+// Logs msg with the key/value pairs in kv (and any fields added with
+// With()). Keys should be strings.
+func (self *Logger) Log(level LogLevel, msg string, kv ...interface{}) {
+	minLevel, json := getLogSettings()
+	if level < minLevel {
+		return
+	}
+
+	var requestID string
+	if self != nil {
+		requestID = self.RequestID
+		kv = append(self.fields[:len(self.fields):len(self.fields)], kv...)
+	}
+	if json {
+		writeJSONLog(level, requestID, msg, kv)
+	} else {
+		writeTextLog(level, requestID, msg, kv)
+	}
+}
+
+// The logger used by the package-level logging functions.
+var defaultLogger *Logger
+
+func LogDebug(msg string, kv ...interface{}) {
+	defaultLogger.Log(LevelDebug, msg, kv...)
+}
+
+func LogInfo(msg string, kv ...interface{}) {
+	defaultLogger.Log(LevelInfo, msg, kv...)
+}
+
+func LogWarning(msg string, kv ...interface{}) {
+	defaultLogger.Log(LevelWarning, msg, kv...)
+}
+
+func LogError(msg string, kv ...interface{}) {
+	defaultLogger.Log(LevelError, msg, kv...)
+}
+
+func logKey(key interface{}) string {
+	if s, ok := key.(string); ok {
+		return s
+	}
+	return fmt.Sprint(key)
+}
+
+func logValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	default:
+		return v
+	}
+}
+
+// Text messages look like "[request ID] Warning: msg key=value".
+func writeTextLog(level LogLevel, requestID, msg string, kv []interface{}) {
+	var b strings.Builder
+	if requestID != "" {
+		b.WriteString("[" + requestID + "] ")
+	}
+	switch level {
+	case LevelDebug:
+		b.WriteString("Debug: ")
+	case LevelWarning:
+		b.WriteString("Warning: ")
+	case LevelError:
+		b.WriteString("Error: ")
+	}
+	b.WriteString(msg)
+	for i := 0; i < len(kv); i += 2 {
+		var value interface{} = "(missing)"
+		if i+1 < len(kv) {
+			value = logValue(kv[i+1])
+		}
+		s := fmt.Sprint(value)
+		if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+			s = strconv.Quote(s)
+		}
+		b.WriteString(" " + logKey(kv[i]) + "=" + s)
+	}
+	log.Print(b.String())
+}
+
+var jsonLogLock sync.Mutex
+
+func writeJSONLog(level LogLevel, requestID, msg string, kv []interface{}) {
+	entry := make(map[string]interface{}, len(kv)/2+4)
+	for i := 0; i < len(kv); i += 2 {
+		var value interface{} = "(missing)"
+		if i+1 < len(kv) {
+			value = logValue(kv[i+1])
+		}
+		entry[logKey(kv[i])] = value
+	}
+	entry["time"] = time.Now().Format(time.RFC3339Nano)
+	entry["level"] = level.String()
+	entry["msg"] = msg
+	if requestID != "" {
+		entry["request_id"] = requestID
+	}
+
+	raw, err := json.Marshal(entry)
+	if err != nil {
+		raw, _ = json.Marshal(map[string]interface{}{
+			"time":  entry["time"],
+			"level": entry["level"],
+			"msg":   msg,
+			"error": "Could not encode log fields: " + err.Error(),
+		})
+	}
+
+	jsonLogLock.Lock()
+	defer jsonLogLock.Unlock()
+	w := log.Writer()
+	w.Write(append(raw, '\n'))
+}
+
+type stdLogWriter struct {
+	level LogLevel
+}
+
+func (self stdLogWriter) Write(p []byte) (int, error) {
+	defaultLogger.Log(self.level, strings.TrimRight(string(p), "\n"))
+	return len(p), nil
+}
+
+// Returns a *log.Logger that writes to the lurkcoin log at level, for
+// libraries that need a *log.Logger (such as net/http).
+func NewStdLogger(level LogLevel) *log.Logger {
+	return log.New(stdLogWriter{level}, "", 0)
+}
@@ -0,0 +1,347 @@
+//
+// lurkcoin metrics
+// Copyright © 2020 by luk3yx
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+// A small metrics library. This doesn't depend on the Prometheus client
+// library, however it can write metrics in Prometheus' text format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A single value, labels are in the same order as the metric's label names.
+type Sample struct {
+	Labels []string
+	Value  float64
+}
+
+// A snapshot of a histogram. Buckets are cumulative (like Prometheus).
+type HistogramSample struct {
+	Labels  []string
+	Buckets []uint64
+	Count   uint64
+	Sum     float64
+}
+
+type collector interface {
+	describe() (name, help, kind string, labelNames []string)
+	collect() ([]Sample, []HistogramSample, []float64)
+}
+
+// Counters
+type CounterVec struct {
+	name, help string
+	labelNames []string
+	lock       sync.Mutex
+	values     map[string]*Sample
+}
+
+func (self *CounterVec) Add(n float64, labels ...string) {
+	if len(labels) != len(self.labelNames) {
+		panic("Incorrect number of labels passed to CounterVec.Add().")
+	}
+	key := strings.Join(labels, "\x00")
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	sample, exists := self.values[key]
+	if !exists {
+		sample = &Sample{append([]string(nil), labels...), 0}
+		self.values[key] = sample
+	}
+	sample.Value += n
+}
+
+func (self *CounterVec) Inc(labels ...string) {
+	self.Add(1, labels...)
+}
+
+func (self *CounterVec) describe() (string, string, string, []string) {
+	return self.name, self.help, "counter", self.labelNames
+}
+
+func (self *CounterVec) collect() ([]Sample, []HistogramSample, []float64) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	res := make([]Sample, 0, len(self.values))
+	for _, sample := range self.values {
+		res = append(res, *sample)
+	}
+	return res, nil, nil
+}
+
+// Gauges are calculated when the metrics are collected.
+type GaugeFunc struct {
+	name, help string
+	labelNames []string
+	f          func() []Sample
+}
+
+func (self *GaugeFunc) describe() (string, string, string, []string) {
+	return self.name, self.help, "gauge", self.labelNames
+}
+
+func (self *GaugeFunc) collect() ([]Sample, []HistogramSample, []float64) {
+	return self.f(), nil, nil
+}
+
+// Histograms
+type HistogramVec struct {
+	name, help string
+	labelNames []string
+	buckets    []float64
+	lock       sync.Mutex
+	values     map[string]*HistogramSample
+}
+
+// Default histogram buckets (in seconds) suitable for HTTP request latencies.
+var DefaultBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25,
+	0.5, 1, 2.5, 5, 10}
+
+func (self *HistogramVec) Observe(value float64, labels ...string) {
+	if len(labels) != len(self.labelNames) {
+		panic("Incorrect number of labels passed to HistogramVec.Observe().")
+	}
+	key := strings.Join(labels, "\x00")
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	sample, exists := self.values[key]
+	if !exists {
+		sample = &HistogramSample{
+			append([]string(nil), labels...),
+			make([]uint64, len(self.buckets)),
+			0,
+			0,
+		}
+		self.values[key] = sample
+	}
+	for i, bucket := range self.buckets {
+		if value <= bucket {
+			sample.Buckets[i]++
+		}
+	}
+	sample.Count++
+	sample.Sum += value
+}
+
+func (self *HistogramVec) describe() (string, string, string, []string) {
+	return self.name, self.help, "histogram", self.labelNames
+}
+
+func (self *HistogramVec) collect() ([]Sample, []HistogramSample, []float64) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	res := make([]HistogramSample, 0, len(self.values))
+	for _, sample := range self.values {
+		s := *sample
+		s.Buckets = append([]uint64(nil), sample.Buckets...)
+		res = append(res, s)
+	}
+	return nil, res, self.buckets
+}
+
+// The registry
+var registryLock sync.RWMutex
+var registry = make(map[string]collector)
+
+func register(c collector) {
+	name, _, _, _ := c.describe()
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	if _, exists := registry[name]; exists {
+		panic("Duplicate metric name: " + name)
+	}
+	registry[name] = c
+}
+
+func NewCounterVec(name, help string, labelNames ...string) *CounterVec {
+	res := &CounterVec{name: name, help: help, labelNames: labelNames,
+		values: make(map[string]*Sample)}
+	if len(labelNames) == 0 {
+		res.values[""] = &Sample{}
+	}
+	register(res)
+	return res
+}
+
+func NewGaugeFunc(name, help string, f func() []Sample,
+	labelNames ...string) *GaugeFunc {
+	res := &GaugeFunc{name, help, labelNames, f}
+	register(res)
+	return res
+}
+
+// If buckets is nil, DefaultBuckets is used.
+func NewHistogramVec(name, help string, buckets []float64,
+	labelNames ...string) *HistogramVec {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	res := &HistogramVec{name: name, help: help, labelNames: labelNames,
+		buckets: buckets, values: make(map[string]*HistogramSample)}
+	register(res)
+	return res
+}
+
+func getCollectors() []collector {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	res := make([]collector, len(names))
+	for i, name := range names {
+		res[i] = registry[name]
+	}
+	return res
+}
+
+func sortSamples(samples []Sample) {
+	sort.Slice(samples, func(i, j int) bool {
+		return strings.Join(samples[i].Labels, "\x00") <
+			strings.Join(samples[j].Labels, "\x00")
+	})
+}
+
+func sortHistograms(histograms []HistogramSample) {
+	sort.Slice(histograms, func(i, j int) bool {
+		return strings.Join(histograms[i].Labels, "\x00") <
+			strings.Join(histograms[j].Labels, "\x00")
+	})
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	case math.IsNaN(f):
+		return "NaN"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func formatLabels(names, values []string, extra ...string) string {
+	if len(names) == 0 && len(extra) == 0 {
+		return ""
+	}
+	var builder strings.Builder
+	builder.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			builder.WriteByte(',')
+		}
+		fmt.Fprintf(&builder, `%s="%s"`, name,
+			labelEscaper.Replace(values[i]))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		if i > 0 || len(names) > 0 {
+			builder.WriteByte(',')
+		}
+		fmt.Fprintf(&builder, `%s="%s"`, extra[i], extra[i+1])
+	}
+	builder.WriteByte('}')
+	return builder.String()
+}
+
+// Writes all registered metrics in Prometheus' text exposition format.
+func WritePrometheus(w io.Writer) {
+	for _, c := range getCollectors() {
+		name, help, kind, labelNames := c.describe()
+		samples, histograms, buckets := c.collect()
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+		sortSamples(samples)
+		for _, sample := range samples {
+			fmt.Fprintf(w, "%s%s %s\n", name,
+				formatLabels(labelNames, sample.Labels),
+				formatFloat(sample.Value))
+		}
+		sortHistograms(histograms)
+		for _, h := range histograms {
+			for i, bucket := range buckets {
+				fmt.Fprintf(w, "%s_bucket%s %d\n", name,
+					formatLabels(labelNames, h.Labels, "le",
+						formatFloat(bucket)), h.Buckets[i])
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d\n", name,
+				formatLabels(labelNames, h.Labels, "le", "+Inf"), h.Count)
+			fmt.Fprintf(w, "%s_sum%s %s\n", name,
+				formatLabels(labelNames, h.Labels), formatFloat(h.Sum))
+			fmt.Fprintf(w, "%s_count%s %d\n", name,
+				formatLabels(labelNames, h.Labels), h.Count)
+		}
+	}
+}
+
+// JSON-friendly snapshots
+type MetricSnapshot struct {
+	Help    string                   `json:"help"`
+	Type    string                   `json:"type"`
+	Samples []map[string]interface{} `json:"samples"`
+}
+
+func labelMap(names, values []string) map[string]string {
+	res := make(map[string]string, len(names))
+	for i, name := range names {
+		res[name] = values[i]
+	}
+	return res
+}
+
+// Returns a snapshot of all metrics that can be passed to json.Marshal().
+func Snapshot() map[string]MetricSnapshot {
+	res := make(map[string]MetricSnapshot)
+	for _, c := range getCollectors() {
+		name, help, kind, labelNames := c.describe()
+		samples, histograms, buckets := c.collect()
+		snapshot := MetricSnapshot{help, kind,
+			make([]map[string]interface{}, 0, len(samples)+len(histograms))}
+		sortSamples(samples)
+		sortHistograms(histograms)
+		for _, sample := range samples {
+			snapshot.Samples = append(snapshot.Samples, map[string]interface{}{
+				"labels": labelMap(labelNames, sample.Labels),
+				"value":  sample.Value,
+			})
+		}
+		for _, h := range histograms {
+			bucketMap := make(map[string]uint64, len(buckets))
+			for i, bucket := range buckets {
+				bucketMap[formatFloat(bucket)] = h.Buckets[i]
+			}
+			snapshot.Samples = append(snapshot.Samples, map[string]interface{}{
+				"labels":  labelMap(labelNames, h.Labels),
+				"buckets": bucketMap,
+				"count":   h.Count,
+				"sum":     h.Sum,
+			})
+		}
+		res[name] = snapshot
+	}
+	return res
+}
@@ -45,6 +45,12 @@ const REPORT_SECURITY = "https://gitlab.com/luk3yx/lurkcoin-core/-/issues/new"
 const COPYRIGHT = "Copyright © 2021 by luk3yx"
 
 func PrintASCIIArt() {
+	// The ASCII art would just be noise in JSON logs.
+	if JSONLogsEnabled() {
+		LogInfo("Starting lurkcoin", "version", VERSION)
+		return
+	}
+
 	log.Print(`/\___/\    _            _             _`)
 	log.Print(`\  _  /   | |_   _ _ __| | _____ ___ (_)_ __`)
 	log.Print(`| (_) |   | | | | | '__| |/ / __/ _ \| | '_ \`)
@@ -109,15 +115,26 @@ func GenerateToken() string {
 }
 
 // Validate a webhook URL, returns the actual URL that should be used and a
-// boolean indicating success.
+// boolean indicating success. See SetWebhookURLPolicy().
 func ValidateWebhookURL(rawURL string) (string, bool) {
 	u, err := url.Parse(rawURL)
-	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+	if err != nil {
+		return "", false
+	}
+	policy := GetWebhookURLPolicy()
+	if !policy.allowsScheme(u.Scheme) || !policy.allowsHost(u.Hostname()) {
 		return "", false
 	}
-	path := u.Path
 
-	// Paths always end in /lurkcoin currently.
+	// Create a new URL object without extra parameters.
+	if policy.AllowAnyPath {
+		safeURL := &url.URL{Scheme: u.Scheme, Host: u.Host, Path: u.Path,
+			RawPath: u.RawPath, RawQuery: u.RawQuery}
+		return safeURL.String(), true
+	}
+
+	// Paths always end in /lurkcoin by default.
+	path := u.Path
 	if !strings.HasSuffix(path, "/lurkcoin") {
 		if !strings.HasSuffix(path, "/") {
 			path += "/"
@@ -125,51 +142,145 @@ func ValidateWebhookURL(rawURL string) (string, bool) {
 		path += "lurkcoin"
 	}
 
-	// Create a new URL object without extra parameters.
 	safeURL := &url.URL{Scheme: u.Scheme, Host: u.Host, Path: path}
 	return safeURL.String(), true
 }
 
 // Get an exchange rate between two servers
 func GetExchangeRate(db Database, source, target string, amount Currency) (Currency, error) {
-	tr := BeginDbTransaction(db)
-	defer tr.Abort()
+	amount, _, err := GetExchangeRateWithFee(db, source, target, amount)
+	return amount, err
+}
+
+// Like GetExchangeRate, but also returns the fee (in lurkcoins) that would be
+// deducted if the amount is sent from source to target. The fee has already
+// been deducted from the amount returned.
+func GetExchangeRateWithFee(db Database, source, target string,
+	amount Currency) (Currency, Currency, error) {
+	return GetExchangeRateWithFeeIn(db, "", source, target, amount)
+}
+
+// Like GetExchangeRateWithFee, but in the specified currency.
+func GetExchangeRateWithFeeIn(db Database, currency, source, target string,
+	amount Currency) (Currency, Currency, error) {
+	rates, err := GetExchangeRates(db, currency, source, target,
+		[]Currency{amount})
+	if err != nil {
+		return c0, c0, err
+	} else if rates[0].Error != "" {
+		return c0, c0, errors.New(rates[0].Error)
+	}
+	return rates[0].Result, rates[0].Fee, nil
+}
 
+// An exchange rate for one amount, see GetExchangeRates().
+type ExchangeRate struct {
+	Amount Currency `json:"amount"`
+	Result Currency `json:"result"`
+	Fee    Currency `json:"fee"`
+
+	// The effective exchange rate (Result / Amount).
+	Rate float64 `json:"rate"`
+
+	// If the amount can't be sent, the error code is stored here and the
+	// other values are zero.
+	Error string `json:"error,omitempty"`
+}
+
+// Gets the exchange rates between two servers for multiple amounts in
+// currency. Both servers are locked while the exchange rates are calculated,
+// so they are all calculated with the same balances.
+func GetExchangeRates(db Database, currency, source, target string,
+	amounts []Currency) ([]ExchangeRate, error) {
+	if !IsValidCurrency(currency) {
+		return nil, errors.New("ERR_INVALIDCURRENCY")
+	}
 	source = HomogeniseUsername(source)
 	target = HomogeniseUsername(target)
+	res := make([]ExchangeRate, len(amounts))
 	if source == target {
-		return amount, nil
+		for i, amount := range amounts {
+			res[i] = ExchangeRate{amount, amount, c0, 1, ""}
+		}
+		return res, nil
 	}
 
-	// Check the amount against the transaction limit
-	if amount.Gt(transactionLimit) {
-		return c0, errors.New("ERR_TRANSACTIONLIMIT")
+	var names []string
+	if source != "" {
+		names = append(names, source)
+	}
+	if target != "" {
+		names = append(names, target)
 	}
 
-	if source != "" {
-		sourceServer, ok := tr.GetOneServer(source)
+	tr := BeginDbTransaction(db)
+	defer tr.Abort()
+	var sourceServer, targetServer *Server
+	if len(names) > 0 {
+		servers, ok, badServer := tr.GetServers(names...)
 		if !ok {
-			return c0, errors.New("ERR_SOURCESERVERNOTFOUND")
+			if HomogeniseUsername(badServer) == source {
+				return nil, errors.New("ERR_SOURCESERVERNOTFOUND")
+			}
+			return nil, errors.New("ERR_TARGETSERVERNOTFOUND")
+		}
+		if source != "" {
+			sourceServer, servers = servers[0], servers[1:]
 		}
-		amount, _ = sourceServer.GetExchangeRate(amount, true)
-		if amount.Gt(transactionLimit) {
-			return c0, errors.New("ERR_TRANSACTIONLIMIT")
+		if target != "" {
+			targetServer = servers[0]
 		}
+	}
 
-		// Abort the transaction now to get the target server
-		tr.Abort()
+	for i, amount := range amounts {
+		result, fee, err := exchangeRateWithFee(sourceServer, targetServer,
+			amount, currency)
+		if err != nil {
+			res[i] = ExchangeRate{amount, c0, c0, 0, err.Error()}
+			continue
+		}
+		rate := 1.0
+		if !amount.IsZero() {
+			rate, _ = result.Div(amount).Float64()
+		}
+		res[i] = ExchangeRate{amount, result, fee, rate, ""}
 	}
-	if target != "" {
-		targetServer, ok := tr.GetOneServer(target)
-		if !ok {
-			return c0, errors.New("ERR_TARGETSERVERNOTFOUND")
+	return res, nil
+}
+
+// sourceServer and targetServer may be nil.
+func exchangeRateWithFee(sourceServer, targetServer *Server,
+	amount Currency, currency string) (Currency, Currency, error) {
+	// Check the amount against the transaction limit
+	limit := transactionLimitOf(sourceServer)
+	if amount.Gt(limit) {
+		return c0, c0, errors.New("ERR_TRANSACTIONLIMIT")
+	}
+
+	if sourceServer != nil {
+		amount, _ = sourceServer.GetExchangeRateIn(currency, amount, true)
+		if amount.Gt(limit) {
+			return c0, c0, errors.New("ERR_TRANSACTIONLIMIT")
 		}
-		amount, _ = targetServer.GetExchangeRate(amount, false)
-		if amount.Gt(transactionLimit) {
-			return c0, errors.New("ERR_TRANSACTIONLIMIT")
+	}
+
+	fee := c0
+	if sourceServer != nil && targetServer != nil && currency == "" {
+		fee = CalculateFee(sourceServer.UID, targetServer.UID, amount)
+		if fee.GtZero() {
+			amount = amount.Sub(fee)
+			if !amount.GtZero() {
+				return c0, c0, errors.New("ERR_CANNOTPAYNOTHING")
+			}
 		}
 	}
-	return amount, nil
+	if targetServer != nil {
+		amount, _ = targetServer.GetExchangeRateIn(currency, amount, false)
+		if amount.Gt(targetServer.GetTransactionLimit()) {
+			return c0, c0, errors.New("ERR_TRANSACTIONLIMIT")
+		}
+	}
+	return amount, fee, nil
 }
 
 // A Python-ish repr()
@@ -186,12 +297,16 @@ func GetV2History(summary Summary, appendID bool) (h []string) {
 	balance := summary.Bal
 	// This intentionally adds transactions the server sends to itself twice.
 	for _, transaction := range summary.History {
+		// lurkcoinV2 only supports one currency.
+		if transaction.Currency != "" {
+			continue
+		}
 		var suffix string
 		if appendID {
 			suffix = " [" + transaction.ID + "]"
 		}
 		if transaction.TargetServer == summary.Name {
-			amount_s := transaction.Amount.DeltaString()
+			amount_s := transaction.netAmount().DeltaString()
 			if transaction.SourceServer == "" && transaction.Target == "" {
 				h = append(h, fmt.Sprintf("%s: %s - %s%s", balance.String(),
 					amount_s, transaction.Source, suffix))
@@ -208,7 +323,7 @@ func GetV2History(summary Summary, appendID bool) (h []string) {
 
 			// Addition and subtraction are swapped because most recent
 			// transactions are first and we start with the current balance.
-			balance = balance.Sub(transaction.Amount)
+			balance = balance.Sub(transaction.netAmount())
 		}
 		if transaction.SourceServer == summary.Name {
 			amount_s := transaction.Amount.Neg().DeltaString()
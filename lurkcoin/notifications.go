@@ -0,0 +1,146 @@
+//
+// lurkcoin
+// Copyright © 2020 by luk3yx
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package lurkcoin
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Notification events
+const (
+	EventServerCreated      = "server_created"
+	EventServerDeleted      = "server_deleted"
+	EventTokenRegenerated   = "token_regenerated"
+	EventLargeTransaction   = "large_transaction"
+	EventWebhookCircuitOpen = "webhook_circuit_open"
+	EventHighDailyVolume    = "high_daily_volume"
+	EventAdminLoginLockout  = "admin_login_lockout"
+
+	// Alerts
+	EventPendingBacklog         = "pending_backlog"
+	EventWebhookFailureRate     = "webhook_failure_rate"
+	EventReconciliationMismatch = "reconciliation_mismatch"
+	EventSupplyChange           = "supply_change"
+)
+
+// An event that admins should be notified about.
+type Notification struct {
+	Event   string
+	Message string
+	Time    time.Time
+}
+
+// Notifiers should not block, Notify() is called from request handlers.
+type Notifier interface {
+	Notify(*Notification)
+}
+
+var notifiersLock sync.RWMutex
+var notifiers []Notifier
+var largeTransactionThreshold Currency
+var dailyVolumeThreshold Currency
+
+// Adds a notifier.
+func AddNotifier(notifier Notifier) {
+	notifiersLock.Lock()
+	defer notifiersLock.Unlock()
+	notifiers = append(notifiers, notifier)
+}
+
+// Transactions of at least threshold lurkcoins send a notification. A zero
+// or nil threshold disables these notifications.
+func SetLargeTransactionThreshold(threshold Currency) {
+	notifiersLock.Lock()
+	defer notifiersLock.Unlock()
+	largeTransactionThreshold = threshold
+}
+
+// A notification is sent the first time a server sends at least threshold
+// lurkcoins in a single (UTC) day. A zero or nil threshold disables these
+// notifications.
+func SetDailyVolumeThreshold(threshold Currency) {
+	notifiersLock.Lock()
+	defer notifiersLock.Unlock()
+	dailyVolumeThreshold = threshold
+}
+
+// Sends a notification to every notifier.
+func Notify(event, message string) {
+	notifiersLock.RLock()
+	defer notifiersLock.RUnlock()
+	if len(notifiers) == 0 {
+		return
+	}
+	notification := &Notification{event, message, time.Now()}
+	for _, notifier := range notifiers {
+		notifier.Notify(notification)
+	}
+}
+
+// The amount each server has sent today.
+var dailyVolumeLock sync.Mutex
+var dailyVolumeDay string
+var dailyVolumes = make(map[string]Currency)
+
+// Adds to a server's daily volume and returns true if the threshold has just
+// been exceeded.
+func addToDailyVolume(transaction *Transaction, threshold Currency) bool {
+	dailyVolumeLock.Lock()
+	defer dailyVolumeLock.Unlock()
+	day := transaction.GetTime().UTC().Format("2006-01-02")
+	if day != dailyVolumeDay {
+		dailyVolumeDay = day
+		dailyVolumes = make(map[string]Currency)
+	}
+
+	uid := HomogeniseUsername(transaction.SourceServer)
+	old, ok := dailyVolumes[uid]
+	if !ok {
+		old = CurrencyFromInt64(0)
+	}
+	volume := old.Add(transaction.Amount)
+	dailyVolumes[uid] = volume
+	return old.Lt(threshold) && !volume.Lt(threshold)
+}
+
+func notifyTransaction(transaction *Transaction) {
+	// Thresholds are in the primary currency.
+	if transaction.Currency != "" {
+		return
+	}
+
+	notifiersLock.RLock()
+	largeThreshold := largeTransactionThreshold
+	volumeThreshold := dailyVolumeThreshold
+	notifiersLock.RUnlock()
+
+	if !largeThreshold.IsNil() && largeThreshold.GtZero() &&
+		!transaction.Amount.Lt(largeThreshold) {
+		Notify(EventLargeTransaction, "Large transaction: "+
+			transaction.String())
+	}
+
+	if !volumeThreshold.IsNil() && volumeThreshold.GtZero() &&
+		addToDailyVolume(transaction, volumeThreshold) {
+		Notify(EventHighDailyVolume, fmt.Sprintf("Server %q has sent at "+
+			"least %s today.", transaction.SourceServer, volumeThreshold))
+	}
+}
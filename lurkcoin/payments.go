@@ -20,36 +20,25 @@ package lurkcoin
 
 import (
 	"errors"
-	"log"
 )
 
-// The transaction limit, currently 1e+11 so clients that parse JSON numbers as
-// 64-bit floats won't run into issues.
-// var transactionLimit Currency = CurrencyFromInt64(100000000000)
-
-// Temporarily changed to 10,000 due to broken exchange rate calculations
-var transactionLimit Currency = CurrencyFromInt64(10000)
-
 // Sends a payment.
 func (sourceServer *Server) Pay(source, target string,
 	targetServer *Server, sentAmount Currency, localCurrency bool,
 	revertable bool) (*Transaction, error) {
+	return sourceServer.pay(source, target, targetServer, sentAmount,
+		localCurrency, revertable, "", nil, "")
+}
 
-	// Ensure the source and target usernames aren't too long.
-	var length int
-	source, length = PasteuriseUsername(source)
-	if length > 48 {
-		return nil, errors.New("ERR_SOURCEUSERNAMETOOLONG")
-	}
-	target, length = PasteuriseUsername(target)
-	if length > 48 {
-		return nil, errors.New("ERR_USERNAMETOOLONG")
-	}
-
+// Calculates the amount of lurkcoins removed from the source server, the fee
+// and the amount received by the target server (in its local currency). Fees
+// are only charged on payments in the primary currency.
+func calculatePayment(sourceServer, targetServer *Server,
+	sentAmount Currency, localCurrency, chargeFee bool,
+	currency string) (amount, fee, receivedAmount Currency, err error) {
 	// Get the amount being sent in lurkcoins
-	var amount Currency
 	if localCurrency {
-		amount, _ = sourceServer.GetExchangeRate(sentAmount, true)
+		amount, _ = sourceServer.GetExchangeRateIn(currency, sentAmount, true)
 	} else {
 		amount = sentAmount
 	}
@@ -57,47 +46,140 @@ func (sourceServer *Server) Pay(source, target string,
 	// No stealing
 	if !sentAmount.GtZero() || !amount.GtZero() {
 		if amount.IsZero() {
-			return nil, errors.New("ERR_CANNOTPAYNOTHING")
+			err = errors.New("ERR_CANNOTPAYNOTHING")
+		} else {
+			err = errors.New("ERR_INVALIDAMOUNT")
 		}
-		return nil, errors.New("ERR_INVALIDAMOUNT")
+		return
+	}
+
+	// The source server's limit applies to the amount sent and the target
+	// server's limit applies to the amount received.
+	limit := sourceServer.GetTransactionLimit()
+	if sentAmount.Gt(limit) || amount.Gt(limit) {
+		err = errors.New("ERR_TRANSACTIONLIMIT")
+		return
 	}
 
-	if sentAmount.Gt(transactionLimit) || amount.Gt(transactionLimit) {
-		return nil, errors.New("ERR_TRANSACTIONLIMIT")
+	// Fees are deducted before the amount is converted to the target
+	// server's currency.
+	fee = c0
+	if chargeFee && currency == "" {
+		fee = CalculateFee(sourceServer.UID, targetServer.UID, amount)
+	}
+	netAmount := amount.Sub(fee)
+	if !netAmount.GtZero() {
+		err = errors.New("ERR_CANNOTPAYNOTHING")
+		return
 	}
 
-	var receivedAmount Currency
 	if sourceServer == targetServer {
 		receivedAmount = sentAmount
 	} else {
-		receivedAmount, _ = targetServer.GetExchangeRate(amount, false)
+		receivedAmount, _ = targetServer.GetExchangeRateIn(currency,
+			netAmount, false)
 	}
 
 	if !receivedAmount.GtZero() {
-		return nil, errors.New("ERR_CANNOTPAYNOTHING")
+		err = errors.New("ERR_CANNOTPAYNOTHING")
+	} else if receivedAmount.Gt(targetServer.GetTransactionLimit()) {
+		err = errors.New("ERR_TRANSACTIONLIMIT")
+	}
+	return
+}
+
+// Sends a payment, if reverts is not empty the payment is marked as a
+// reversal of that transaction. If quote isn't nil, the amounts in the quote
+// are used instead of the current exchange rates. Quotes can only be used
+// with the primary currency.
+func (sourceServer *Server) pay(source, target string,
+	targetServer *Server, sentAmount Currency, localCurrency bool,
+	revertable bool, reverts string, quote *Quote,
+	currency string) (*Transaction, error) {
+
+	if sourceServer.readOnly || targetServer.readOnly {
+		return nil, ErrReadOnly
+	}
+
+	// Wallets only store the primary currency, reversals are credited to the
+	// server instead.
+	if !IsValidCurrency(currency) || (currency != "" && (quote != nil ||
+		(target != "" && reverts == "" && targetServer.WalletsEnabled()))) {
+		return nil, errors.New("ERR_INVALIDCURRENCY")
+	}
+
+	// Refunds are still sent if either server is frozen.
+	if reverts == "" && paymentBlockedByFreeze(sourceServer, targetServer) {
+		return nil, errors.New("ERR_ACCOUNTFROZEN")
 	}
 
-	if receivedAmount.Gt(transactionLimit) {
-		return nil, errors.New("ERR_TRANSACTIONLIMIT")
+	// Ensure the source and target usernames aren't too long.
+	var length int
+	source, length = PasteuriseUsername(source)
+	if length > 48 {
+		return nil, errors.New("ERR_SOURCEUSERNAMETOOLONG")
+	}
+	target, length = PasteuriseUsername(target)
+	if length > 48 {
+		return nil, errors.New("ERR_USERNAMETOOLONG")
+	}
+
+	// Reversals are free.
+	var amount, fee, receivedAmount Currency
+	if quote != nil {
+		sentAmount = quote.SentAmount
+		amount, fee = quote.Amount, quote.Fee
+		receivedAmount = quote.ReceivedAmount
+	} else {
+		var err error
+		amount, fee, receivedAmount, err = calculatePayment(sourceServer,
+			targetServer, sentAmount, localCurrency, reverts == "", currency)
+		if err != nil {
+			return nil, err
+		}
+	}
+	netAmount := amount.Sub(fee)
+
+	// Reversals are always sent so that rejected transactions can't be lost.
+	if target != "" && reverts == "" && !targetServer.canAddPendingTransaction() {
+		return nil, errors.New("ERR_TOOMANYPENDINGTRANSACTIONS")
+	}
+
+	// Quotes can only be used once.
+	if quote != nil && !claimQuote(quote) {
+		return nil, errors.New("ERR_QUOTEEXPIRED")
 	}
 
 	// Remove the amount
-	if !sourceServer.ChangeBal(amount.Neg()) {
+	if !sourceServer.ChangeBalIn(currency, amount.Neg()) {
+		if quote != nil {
+			releaseQuote(quote)
+		}
 		return nil, errors.New("ERR_CANNOTAFFORD")
 	}
 
-	if !targetServer.ChangeBal(amount) {
+	if !targetServer.ChangeBalIn(currency, netAmount) {
 		// This should never happen
 		// Revert the previous balance change before returning
-		sourceServer.ChangeBal(amount)
+		sourceServer.ChangeBalIn(currency, amount)
 		return nil, errors.New("ERR_INTERNALERROR")
 	}
+	if currency == "" {
+		targetServer.creditWallet(target, netAmount)
+	}
 
 	transaction := MakeTransaction(source, sourceServer.Name, target,
 		targetServer.Name, amount, sentAmount, receivedAmount)
+	transaction.Currency = currency
 	if revertable {
 		transaction.Revertable = true
 	}
+	transaction.Reverts = reverts
+	if fee.GtZero() {
+		transaction.Fee = &fee
+	}
+	transaction.SourceID = sourceServer.GetIdentity(source)
+	transaction.TargetID = targetServer.GetIdentity(target)
 
 	// Add the transaction to the history
 	if sourceServer != targetServer {
@@ -106,7 +188,23 @@ func (sourceServer *Server) Pay(source, target string,
 	targetServer.AddToHistory(transaction)
 
 	// Log the transaction
-	log.Print(transaction)
+	sourceServer.logger.Info(transaction.String(),
+		"transaction_id", transaction.ID,
+		"source_server", sourceServer.UID,
+		"target_server", targetServer.UID)
+
+	// Metrics and notifications are only updated once the payment has been
+	// saved.
+	sourceServer.AfterCommit(func() {
+		recordTransaction(&transaction)
+		notifyTransaction(&transaction)
+	})
+	sourceServer.queueJournalEntry(&JournalEntry{
+		Time:        transaction.Time,
+		Type:        JournalTransaction,
+		Transaction: &transaction,
+	})
+	sourceServer.queueFee(transaction)
 
 	return &transaction, nil
 }
@@ -0,0 +1,108 @@
+//
+// lurkcoin pending transaction limits
+// Copyright © 2020 by luk3yx
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package lurkcoin
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Pending transaction overflow policies
+const (
+	// Payments to servers with too many pending transactions fail with
+	// ERR_TOOMANYPENDINGTRANSACTIONS.
+	PendingOverflowReject = "reject"
+
+	// The oldest pending transactions are rejected (and reverted if
+	// possible) to make room for new ones.
+	PendingOverflowRevertOldest = "revert_oldest"
+)
+
+var pendingLimitLock sync.RWMutex
+var pendingLimit int
+var pendingOverflowPolicy = PendingOverflowReject
+
+// Limits the number of pending transactions each server can have, 0 (the
+// default) disables the limit.
+func SetPendingTransactionLimit(limit int, policy string) error {
+	if limit < 0 {
+		return fmt.Errorf("Invalid pending transaction limit: %d", limit)
+	}
+	switch policy {
+	case "":
+		policy = PendingOverflowReject
+	case PendingOverflowReject, PendingOverflowRevertOldest:
+	default:
+		return fmt.Errorf("Unknown pending transaction overflow policy: %q",
+			policy)
+	}
+
+	pendingLimitLock.Lock()
+	defer pendingLimitLock.Unlock()
+	pendingLimit = limit
+	pendingOverflowPolicy = policy
+	return nil
+}
+
+func getPendingTransactionLimit() (int, string) {
+	pendingLimitLock.RLock()
+	defer pendingLimitLock.RUnlock()
+	return pendingLimit, pendingOverflowPolicy
+}
+
+// Returns false if the server has too many pending transactions and new
+// transactions should be rejected.
+func (self *Server) canAddPendingTransaction() bool {
+	limit, policy := getPendingTransactionLimit()
+	if limit == 0 || policy != PendingOverflowReject {
+		return true
+	}
+
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	return len(self.pendingTransactions) < limit
+}
+
+// Rejects the oldest pending transactions if there are too many with the
+// "revert_oldest" policy. The server must be locked.
+func (self *Server) removeOverflowingTransactions() {
+	limit, policy := getPendingTransactionLimit()
+	if limit == 0 || policy != PendingOverflowRevertOldest ||
+		len(self.pendingTransactions) <= limit {
+		return
+	}
+
+	n := len(self.pendingTransactions) - limit
+	removed := make([]Transaction, n)
+	copy(removed, self.pendingTransactions)
+	copy(self.pendingTransactions, self.pendingTransactions[n:])
+	for i := limit; i < len(self.pendingTransactions); i++ {
+		self.pendingTransactions[i] = Transaction{}
+	}
+	self.pendingTransactions = self.pendingTransactions[:limit]
+
+	for _, transaction := range removed {
+		self.logger.Warning("Rejecting pending transaction because the "+
+			"server has too many", "transaction_id", transaction.ID,
+			"limit", limit)
+		if transaction.Revertable && self.db != nil {
+			revertTransaction(self.db, self.UID, transaction, self.logger)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+//
+// lurkcoin exchange rate quotes
+// Copyright © 2020 by luk3yx
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package lurkcoin
+
+import (
+	"crypto/hmac"
+	crypto_rand "crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Quotes lock the exchange rates (and fee) of a payment for a short time so
+// that the amount received doesn't change between a price being displayed
+// and the payment being sent. Quote tokens are signed with quoteKey so that
+// they don't have to be stored, however used quotes are only remembered in
+// memory.
+type Quote struct {
+	ID             string   `json:"id"`
+	SourceServer   string   `json:"source_server"`
+	TargetServer   string   `json:"target_server"`
+	SentAmount     Currency `json:"sent_amount"`
+	LocalCurrency  bool     `json:"local_currency"`
+	Amount         Currency `json:"amount"`
+	Fee            Currency `json:"fee"`
+	ReceivedAmount Currency `json:"received_amount"`
+	Expires        int64    `json:"expires"`
+}
+
+func (self *Quote) expired() bool {
+	return time.Now().Unix() >= self.Expires
+}
+
+var quoteKeyLock sync.RWMutex
+var quoteKey = randomQuoteKey()
+
+func randomQuoteKey() []byte {
+	key := make([]byte, 32)
+	if _, err := crypto_rand.Read(key); err != nil {
+		panic(err)
+	}
+	return key
+}
+
+// Sets the key used to sign quotes. A random key is used by default, which
+// means that quotes become invalid when lurkcoin is restarted.
+func SetQuoteKey(key []byte) {
+	quoteKeyLock.Lock()
+	defer quoteKeyLock.Unlock()
+	quoteKey = key
+}
+
+func signQuote(payload string) string {
+	quoteKeyLock.RLock()
+	h := hmac.New(sha256.New, quoteKey)
+	quoteKeyLock.RUnlock()
+	h.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
+
+// The longest that a quote can be valid for.
+var maxQuoteLifetime = int64(5 * time.Minute)
+
+func GetMaxQuoteLifetime() time.Duration {
+	return time.Duration(atomic.LoadInt64(&maxQuoteLifetime))
+}
+
+// Sets the maximum quote lifetime, this is 5 minutes by default.
+func SetMaxQuoteLifetime(lifetime time.Duration) error {
+	if lifetime <= 0 {
+		return errors.New("The maximum quote lifetime must be positive.")
+	}
+	atomic.StoreInt64(&maxQuoteLifetime, int64(lifetime))
+	return nil
+}
+
+// Creates a quote for a payment from this server to targetServer and returns
+// it along with its token.
+func (self *Server) NewQuote(targetServer *Server, sentAmount Currency,
+	localCurrency bool, lifetime time.Duration) (*Quote, string, error) {
+	if lifetime <= 0 || lifetime > GetMaxQuoteLifetime() {
+		return nil, "", errors.New("ERR_INVALIDREQUEST")
+	}
+	if paymentBlockedByFreeze(self, targetServer) {
+		return nil, "", errors.New("ERR_ACCOUNTFROZEN")
+	}
+
+	amount, fee, receivedAmount, err := calculatePayment(self, targetServer,
+		sentAmount, localCurrency, true, "")
+	if err != nil {
+		return nil, "", err
+	}
+
+	rawID := make([]byte, 16)
+	if _, err := crypto_rand.Read(rawID); err != nil {
+		panic(err)
+	}
+	quote := &Quote{
+		ID:             base64.RawURLEncoding.EncodeToString(rawID),
+		SourceServer:   self.UID,
+		TargetServer:   targetServer.UID,
+		SentAmount:     sentAmount,
+		LocalCurrency:  localCurrency,
+		Amount:         amount,
+		Fee:            fee,
+		ReceivedAmount: receivedAmount,
+		Expires:        time.Now().Add(lifetime).Unix(),
+	}
+	data, err := json.Marshal(quote)
+	if err != nil {
+		return nil, "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	return quote, payload + "." + signQuote(payload), nil
+}
+
+// Checks a quote token's signature and returns the quote. This doesn't check
+// whether the quote has already been used.
+func ParseQuote(token string) (*Quote, error) {
+	split := strings.SplitN(token, ".", 2)
+	if len(split) != 2 || !hmac.Equal([]byte(signQuote(split[0])),
+		[]byte(split[1])) {
+		return nil, errors.New("ERR_INVALIDQUOTE")
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(split[0])
+	if err != nil {
+		return nil, errors.New("ERR_INVALIDQUOTE")
+	}
+	var quote Quote
+	if json.Unmarshal(data, &quote) != nil || quote.SentAmount.IsNil() ||
+		quote.Amount.IsNil() || quote.Fee.IsNil() ||
+		quote.ReceivedAmount.IsNil() {
+		return nil, errors.New("ERR_INVALIDQUOTE")
+	}
+	if quote.expired() {
+		return nil, errors.New("ERR_QUOTEEXPIRED")
+	}
+	return &quote, nil
+}
+
+// Used quotes are kept until they expire.
+var usedQuotesLock sync.Mutex
+var usedQuotes = make(map[string]int64)
+
+func claimQuote(quote *Quote) bool {
+	usedQuotesLock.Lock()
+	defer usedQuotesLock.Unlock()
+	now := time.Now().Unix()
+	for id, expires := range usedQuotes {
+		if now >= expires {
+			delete(usedQuotes, id)
+		}
+	}
+	if _, used := usedQuotes[quote.ID]; used || quote.expired() {
+		return false
+	}
+	usedQuotes[quote.ID] = quote.Expires
+	return true
+}
+
+func releaseQuote(quote *Quote) {
+	usedQuotesLock.Lock()
+	defer usedQuotesLock.Unlock()
+	delete(usedQuotes, quote.ID)
+}
+
+// Sends a payment using the amounts in a quote, the quote must have been
+// created by this server for a payment to targetServer.
+func (self *Server) PayWithQuote(source, target string, targetServer *Server,
+	quote *Quote) (*Transaction, error) {
+	if quote.SourceServer != self.UID ||
+		quote.TargetServer != targetServer.UID {
+		return nil, errors.New("ERR_INVALIDQUOTE")
+	}
+	return self.pay(source, target, targetServer, quote.SentAmount,
+		quote.LocalCurrency, true, "", quote, "")
+}
@@ -0,0 +1,115 @@
+//
+// lurkcoin raw server records
+// Copyright © 2020 by luk3yx
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package lurkcoin
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Raw access to EncodedServers so that broken records can be fixed from the
+// admin pages. Aliases are not followed and deleted servers can be accessed.
+
+// Returns the EncodedServer for the specified server.
+func GetEncodedServer(db Database, name string) (EncodedServer, bool) {
+	tr := BeginDbTransaction(db)
+	defer tr.Abort()
+	servers, ok, _ := tr.getServers([]string{name}, false)
+	if !ok {
+		return EncodedServer{}, false
+	}
+	return servers[0].Encode(), true
+}
+
+// Returns an error if Decode() would panic or create an invalid server.
+func (self *EncodedServer) Validate() error {
+	if self.Version > 0 {
+		return errors.New("Unrecognised EncodedServer version.")
+	}
+	if self.Name == "" {
+		return errors.New("The server name must not be empty.")
+	}
+	if self.Balance == nil || self.TargetBalance == nil {
+		return errors.New("The balance and target balance are required.")
+	}
+	if !IsValidFreezeMode(self.Frozen) {
+		return fmt.Errorf("Invalid freeze mode %q.", self.Frozen)
+	}
+	for user, balance := range self.Wallets {
+		if balance == nil {
+			return fmt.Errorf("The wallet balance of %q is missing.", user)
+		}
+	}
+	for currency, b := range self.Balances {
+		if b.Balance == nil || b.TargetBalance == nil {
+			return fmt.Errorf("The balance and target balance of %q are "+
+				"required.", currency)
+		}
+	}
+	return nil
+}
+
+// Parses and validates a JSON-encoded EncodedServer. Unknown fields are
+// rejected so that typos aren't silently ignored.
+func ParseEncodedServer(data []byte) (*EncodedServer, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	var encodedServer EncodedServer
+	if err := decoder.Decode(&encodedServer); err != nil {
+		return nil, err
+	}
+	if decoder.More() {
+		return nil, errors.New("Extra JSON value")
+	}
+	if err := encodedServer.Validate(); err != nil {
+		return nil, err
+	}
+	return &encodedServer, nil
+}
+
+// Overwrites a server with encodedServer. The server must already exist and
+// the name in encodedServer must refer to the same server (use RenameServer
+// to rename servers).
+func ReplaceEncodedServer(db Database, name string,
+	encodedServer *EncodedServer) error {
+	if IsReadOnly(db) {
+		return ErrReadOnly
+	}
+	if err := encodedServer.Validate(); err != nil {
+		return err
+	}
+	if HomogeniseUsername(encodedServer.Name) != HomogeniseUsername(name) {
+		return errors.New("The server name can only be changed by " +
+			"renaming the server.")
+	}
+
+	tr := BeginDbTransaction(db)
+	defer tr.Abort()
+	servers, ok, _ := tr.getServers([]string{name}, false)
+	if !ok {
+		return errors.New("The server does not exist.")
+	}
+	server := servers[0]
+	*server = *encodedServer.Decode()
+	server.SetModified()
+	tr.Finish()
+	return nil
+}
@@ -0,0 +1,92 @@
+//
+// lurkcoin read-only databases
+// Copyright © 2020 by luk3yx
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package lurkcoin
+
+import "errors"
+
+// Returned when something tries to modify a read-only database.
+var ErrReadOnly = errors.New("ERR_READONLY")
+
+// A Database wrapper that never saves any changes. Servers obtained from it
+// can't send payments and servers can't be created or deleted.
+type readOnlyDatabase struct {
+	Database
+}
+
+func (self readOnlyDatabase) GetServers(names []string) ([]*Server, bool, string) {
+	servers, ok, badServer := self.Database.GetServers(names)
+	for _, server := range servers {
+		server.readOnly = true
+	}
+	return servers, ok, badServer
+}
+
+func (self readOnlyDatabase) GetServersAs(owner LockOwner,
+	names []string) ([]*Server, bool, string) {
+	db, ok := self.Database.(LockOwnerDatabase)
+	if !ok {
+		return self.GetServers(names)
+	}
+	servers, ok, badServer := db.GetServersAs(owner, names)
+	for _, server := range servers {
+		server.readOnly = true
+	}
+	return servers, ok, badServer
+}
+
+func (self readOnlyDatabase) FreeServers(servers []*Server, _ bool) {
+	self.Database.FreeServers(servers, false)
+}
+
+func (self readOnlyDatabase) CreateServer(string) (*Server, bool) {
+	return nil, false
+}
+
+func (self readOnlyDatabase) CreateServerAs(LockOwner, string) (*Server,
+	bool) {
+	return nil, false
+}
+
+func (self readOnlyDatabase) DeleteServer(string) bool {
+	return false
+}
+
+func (self readOnlyDatabase) GetLockStats() LockStats {
+	if lockDb, ok := self.Database.(LockStatsDatabase); ok {
+		return lockDb.GetLockStats()
+	}
+	return LockStats{}
+}
+
+func (self readOnlyDatabase) UnwrapDatabase() Database {
+	return self.Database
+}
+
+// Wraps db so that all writes are rejected.
+func ReadOnlyDatabase(db Database) Database {
+	if IsReadOnly(db) {
+		return db
+	}
+	return readOnlyDatabase{db}
+}
+
+func IsReadOnly(db Database) bool {
+	_, ok := db.(readOnlyDatabase)
+	return ok
+}
@@ -0,0 +1,81 @@
+//
+// lurkcoin: External reference rates
+// Copyright © 2020 by luk3yx
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package lurkcoin
+
+import (
+	"math/big"
+	"sync"
+	"time"
+)
+
+// An external reference rate (for example a fiat currency or another game's
+// currency). This is purely informational and does not affect exchange
+// rates.
+type ReferenceRate struct {
+	// The name of the reference currency.
+	Currency string `json:"currency"`
+
+	// The value of one lurkcoin in the reference currency.
+	Rate float64 `json:"rate"`
+
+	// The time the rate was last fetched.
+	Updated int64 `json:"updated"`
+}
+
+// A lurkcoin value converted to the reference currency.
+type ReferenceValue struct {
+	Currency string `json:"currency"`
+	Value    string `json:"value"`
+}
+
+var referenceRateLock sync.RWMutex
+var referenceRate *ReferenceRate
+
+// Sets the current reference rate.
+func SetReferenceRate(currency string, rate float64, updated time.Time) {
+	referenceRateLock.Lock()
+	defer referenceRateLock.Unlock()
+	referenceRate = &ReferenceRate{currency, rate, updated.Unix()}
+}
+
+// Returns the current reference rate or nil if there isn't one.
+func GetReferenceRate() *ReferenceRate {
+	referenceRateLock.RLock()
+	defer referenceRateLock.RUnlock()
+	if referenceRate == nil {
+		return nil
+	}
+	res := *referenceRate
+	return &res
+}
+
+// Converts amount to the reference currency (rounded to 2 decimal places).
+func (self *ReferenceRate) Convert(amount Currency) *ReferenceValue {
+	if self == nil || amount.IsNil() {
+		return nil
+	}
+	value := new(big.Float).Mul(amount.Float(), big.NewFloat(self.Rate))
+	return &ReferenceValue{self.Currency, value.Text('f', 2)}
+}
+
+// Converts amount using the current reference rate. If there is no reference
+// rate, nil is returned.
+func ConvertToReference(amount Currency) *ReferenceValue {
+	return GetReferenceRate().Convert(amount)
+}
@@ -0,0 +1,186 @@
+//
+// lurkcoin server renaming
+// Copyright © 2020 by luk3yx
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package lurkcoin
+
+import (
+	"errors"
+	"math/big"
+)
+
+// Renamed servers leave an alias behind under their old UID so that
+// payments (and logins) using the old name keep working. Aliases are stored
+// in the database like any other server with only the name and AliasOf set.
+
+// The maximum number of aliases followed when getting a server.
+const maxAliasDepth = 8
+
+// Gets servers for tr, following any aliases. Any aliases that are followed
+// are added to aliases. If a server can't be found, the name originally
+// requested is returned.
+func getServersFollowingAliases(tr *DatabaseTransaction, uids []string,
+	aliases map[string]string) ([]*Server, bool, string) {
+	for depth := 0; ; depth++ {
+		servers, ok, badServer := tr.lockServers(uids)
+		if !ok {
+			return nil, false, findRequestedName(aliases,
+				HomogeniseUsername(badServer))
+		}
+
+		followed := false
+		resolved := make([]string, 0, len(servers))
+		seen := make(map[string]bool, len(servers))
+		for _, server := range servers {
+			uid := server.UID
+			if server.aliasOf != "" {
+				followed = true
+				uid = server.aliasOf
+				for alias, target := range aliases {
+					if target == server.UID {
+						aliases[alias] = uid
+					}
+				}
+				if _, ok := aliases[server.UID]; !ok {
+					aliases[server.UID] = uid
+				}
+			}
+			if !seen[uid] {
+				seen[uid] = true
+				resolved = append(resolved, uid)
+			}
+		}
+		if !followed {
+			return servers, true, ""
+		}
+
+		// Aliases can't be locked at the same time as the servers they
+		// point to as they may be locked in the wrong order.
+		tr.db.FreeServers(servers, false)
+		if depth >= maxAliasDepth {
+			return nil, false, uids[0]
+		}
+		uids = resolved
+	}
+}
+
+// Returns the alias that was followed to get to uid, or uid itself if no
+// aliases were followed.
+func findRequestedName(aliases map[string]string, uid string) string {
+	for alias, target := range aliases {
+		if target == uid {
+			return alias
+		}
+	}
+	return uid
+}
+
+// Returns the UIDs of any aliases that point to uid (directly or through
+// other aliases).
+func findAliases(db Database, uid string) ([]string, error) {
+	aliasOf := make(map[string]string)
+	err := db.ForEachEncoded(func(encodedServer *EncodedServer) error {
+		if encodedServer.AliasOf != "" {
+			aliasOf[HomogeniseUsername(encodedServer.Name)] =
+				encodedServer.AliasOf
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var res []string
+	for alias := range aliasOf {
+		target := alias
+		for depth := 0; depth <= maxAliasDepth && target != ""; depth++ {
+			target = aliasOf[target]
+			if target == uid {
+				res = append(res, alias)
+				break
+			}
+		}
+	}
+	return res, nil
+}
+
+// Renames a server. The old name becomes an alias of the new name, so
+// payments sent to the old name are received by the renamed server. The
+// token, balance, history and pending transactions are kept, however
+// transactions made before the server was renamed still have the old server
+// name. Servers can be renamed back to their previous name.
+func RenameServer(db Database, name, newName string) error {
+	if IsReadOnly(db) {
+		return ErrReadOnly
+	}
+	uid := HomogeniseUsername(name)
+	newName, length := PasteuriseUsername(newName)
+	newUID := HomogeniseUsername(newName)
+	if length < 3 || length > 32 || newUID == "" {
+		return errors.New("The server name must be between 3 and 32 " +
+			"characters.")
+	}
+
+	// Remove the alias if the server is being renamed back to an old name.
+	if newUID != uid {
+		if servers, ok, _ := db.GetServers([]string{newUID}); ok {
+			isAlias := servers[0].aliasOf == uid
+			db.FreeServers(servers, false)
+			if isAlias {
+				db.DeleteServer(newUID)
+			}
+		}
+	}
+
+	tr := BeginDbTransaction(db)
+	defer tr.Abort()
+	servers, ok, _ := tr.getServers([]string{uid}, false)
+	if !ok || servers[0].aliasOf != "" || servers[0].deletedAt != 0 {
+		return errors.New("The server does not exist.")
+	}
+	server := servers[0]
+
+	// Only the capitalisation or punctuation has changed.
+	if newUID == uid {
+		server.lock.Lock()
+		server.Name = newName
+		server.modified = true
+		server.lock.Unlock()
+		tr.Finish()
+		return nil
+	}
+
+	newServer, ok := tr.CreateServer(newName)
+	if !ok {
+		return errors.New("A server with that name already exists.")
+	}
+
+	// Move everything to the new server and replace the old one with an
+	// alias.
+	encoded := server.Encode()
+	encoded.Name = newName
+	*newServer = *encoded.Decode()
+	newServer.SetModified()
+
+	alias := EncodedServer{Name: server.Name, Balance: new(big.Int),
+		TargetBalance: new(big.Int), AliasOf: newUID}
+	*server = *alias.Decode()
+	server.SetModified()
+
+	tr.Finish()
+	return nil
+}
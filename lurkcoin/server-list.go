@@ -0,0 +1,139 @@
+//
+// lurkcoin server lists
+// Copyright © 2020 by luk3yx
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package lurkcoin
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+// A summary of a server for server lists.
+type ServerSummary struct {
+	UID                     string
+	Name                    string
+	Balance                 Currency
+	TargetBalance           Currency
+	PendingTransactionCount int
+}
+
+// Columns that server lists can be sorted by.
+const (
+	SortServersByName          = "name"
+	SortServersByBalance       = "balance"
+	SortServersByTargetBalance = "target_balance"
+	SortServersByPending       = "pending"
+)
+
+type ServerListOptions struct {
+	// Only servers with a UID that starts with Prefix and contains Search
+	// are listed.
+	Prefix string
+	Search string
+
+	// The column to sort by (SortServersByName if empty).
+	SortBy     string
+	Descending bool
+
+	// The number of matching servers to skip and the maximum number of
+	// servers to return (0 returns every server).
+	Offset int
+	Limit  int
+}
+
+var ErrInvalidSortColumn = errors.New("Invalid sort column.")
+
+func (self *ServerListOptions) less(a, b *ServerSummary) bool {
+	switch self.SortBy {
+	case SortServersByBalance:
+		if !a.Balance.Eq(b.Balance) {
+			return a.Balance.Lt(b.Balance)
+		}
+	case SortServersByTargetBalance:
+		if !a.TargetBalance.Eq(b.TargetBalance) {
+			return a.TargetBalance.Lt(b.TargetBalance)
+		}
+	case SortServersByPending:
+		if a.PendingTransactionCount != b.PendingTransactionCount {
+			return a.PendingTransactionCount < b.PendingTransactionCount
+		}
+	}
+	return a.UID < b.UID
+}
+
+// Lists servers sorted by any column. Unlike ListServersPage, this has to
+// read every server in the database, and servers aren't locked so the
+// summaries may be slightly out of date. The total number of matching servers
+// is also returned.
+func ListServerSummaries(db Database, opts ServerListOptions) ([]ServerSummary,
+	int, error) {
+	switch opts.SortBy {
+	case "":
+		opts.SortBy = SortServersByName
+	case SortServersByName, SortServersByBalance, SortServersByTargetBalance,
+		SortServersByPending:
+	default:
+		return nil, 0, ErrInvalidSortColumn
+	}
+
+	prefix := HomogeniseUsername(opts.Prefix)
+	search := HomogeniseUsername(opts.Search)
+	var res []ServerSummary
+	err := db.ForEachEncoded(func(encodedServer *EncodedServer) error {
+		if encodedServer.AliasOf != "" || encodedServer.DeletedAt != 0 {
+			return nil
+		}
+		uid := HomogeniseUsername(encodedServer.Name)
+		if !strings.HasPrefix(uid, prefix) ||
+			!strings.Contains(uid, search) {
+			return nil
+		}
+		server := encodedServer.Decode()
+		res = append(res, ServerSummary{
+			UID:                     server.UID,
+			Name:                    server.Name,
+			Balance:                 server.GetBalance(),
+			TargetBalance:           server.GetTargetBalance(),
+			PendingTransactionCount: len(encodedServer.PendingTransactions),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		if opts.Descending {
+			return opts.less(&res[j], &res[i])
+		}
+		return opts.less(&res[i], &res[j])
+	})
+
+	total := len(res)
+	if opts.Offset > 0 {
+		if opts.Offset > len(res) {
+			opts.Offset = len(res)
+		}
+		res = res[opts.Offset:]
+	}
+	if opts.Limit > 0 && len(res) > opts.Limit {
+		res = res[:opts.Limit]
+	}
+	return res, total, nil
+}
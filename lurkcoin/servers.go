@@ -19,11 +19,11 @@
 package lurkcoin
 
 import (
+	"errors"
+	"fmt"
 	"math/big"
-	"net/http"
-	"strings"
 	"sync"
-	"time"
+	"sync/atomic"
 )
 
 // Most mutable fields in Server are private to prevent race conditions.
@@ -39,15 +39,100 @@ type Server struct {
 	pendingTransactions []Transaction
 	token               string
 	WebhookURL          string
+	wallets             map[string]Currency
+	walletsEnabled      bool
+	identities          map[string]string
+	frozen              string
+	aliasOf             string
+	deletedAt           int64
+	transactionLimit    Currency
+	creditLimit         Currency
+	balances            map[string]currencyBalance
+	webhookVersion      int
+	webhookSecret       string
+	webhooks            []WebhookEndpoint
 	lock                *sync.RWMutex
 	modified            bool
+	readOnly            bool
+
+	// The logger and database of the DatabaseTransaction this server was
+	// obtained from.
+	logger *Logger
+	db     Database
+
+	// Events that haven't been sent to webhook endpoints yet.
+	webhookEvents *queuedWebhookEvents
+
+	// Payments with fees that haven't been credited to the treasury yet.
+	queuedFees []Transaction
+
+	// Functions to call once the DatabaseTransaction has been committed or
+	// aborted.
+	afterCommit []func()
+	afterAbort  []func()
+
+	// The plaintext token if it was generated since the server was loaded,
+	// only a hash of it is stored.
+	newToken string
 }
 
 type ServerCollection interface {
 	GetServer(name string) *Server
 }
 
-var MaxTargetBalance = CurrencyFromInt64(500000000)
+// The highest target balance that can be set, ¤500,000,000 by default.
+// Servers are created with the default target balance (¤500,000 by default).
+var targetBalanceLock sync.RWMutex
+var maxTargetBalance = CurrencyFromInt64(500000000)
+var defaultTargetBalance = CurrencyFromInt64(500000)
+
+func GetMaxTargetBalance() Currency {
+	targetBalanceLock.RLock()
+	defer targetBalanceLock.RUnlock()
+	return maxTargetBalance
+}
+
+func GetDefaultTargetBalance() Currency {
+	targetBalanceLock.RLock()
+	defer targetBalanceLock.RUnlock()
+	return defaultTargetBalance
+}
+
+// Sets the maximum and default target balances. The default target balance
+// can be zero (which disables exchange rates for new servers) but must not
+// be higher than the maximum. Existing servers aren't changed.
+func SetTargetBalanceLimits(max, defaultTarget Currency) error {
+	if max.LtZero() || defaultTarget.LtZero() || defaultTarget.Gt(max) {
+		return errors.New("Target balances must not be negative and the " +
+			"default target balance must not be higher than the maximum.")
+	}
+	targetBalanceLock.Lock()
+	defer targetBalanceLock.Unlock()
+	maxTargetBalance = max
+	defaultTargetBalance = defaultTarget
+	return nil
+}
+
+// The number of transactions kept in each server's history.
+var historyLength int32 = 10
+
+// The maximum history length, servers are always loaded and saved with their
+// entire history.
+const MaxHistoryLength = 1000
+
+func GetHistoryLength() int {
+	return int(atomic.LoadInt32(&historyLength))
+}
+
+// Sets the number of transactions kept in server histories, this is 10 by
+// default. Existing histories are truncated when the next transaction is
+// added to them.
+func SetHistoryLength(length int) {
+	if length < 1 || length > MaxHistoryLength {
+		panic("Invalid history length")
+	}
+	atomic.StoreInt32(&historyLength, int32(length))
+}
 
 func (self *Server) GetBalance() Currency {
 	self.lock.RLock()
@@ -67,12 +152,17 @@ func (self *Server) GetTargetBalance() Currency {
 func (self *Server) ChangeBal(num Currency) bool {
 	self.lock.Lock()
 	defer self.lock.Unlock()
+	// Balances can go below zero if the server has a credit limit. Payments
+	// can always be received, even if the credit limit has been lowered.
 	new_balance := self.balance.Add(num)
-	if new_balance.LtZero() {
+	if num.LtZero() && new_balance.Lt(self.creditLimit.Neg()) {
 		return false
 	}
 	self.balance = new_balance
 	self.modified = true
+	if events := self.queuedWebhookEvents(); events != nil {
+		events.balance = true
+	}
 	return true
 }
 
@@ -86,8 +176,6 @@ func (self *Server) GetHistory() []Transaction {
 	return res
 }
 
-var webhookClient = &http.Client{Timeout: time.Second * 5}
-
 func (self *Server) AddToHistory(transaction Transaction) {
 	self.lock.Lock()
 	defer self.lock.Unlock()
@@ -95,21 +183,32 @@ func (self *Server) AddToHistory(transaction Transaction) {
 
 	// Prepend transaction to self.history
 	// https://stackoverflow.com/a/53737602
-	if len(self.history) < 10 {
-		// Only increase the length of the slice if it is shorter than 10
-		// elements long, meaning the transaction history cannot be longer
-		// than 10 elements.
+	length := GetHistoryLength()
+	if len(self.history) < length {
+		// Only increase the length of the slice if it is shorter than the
+		// history length, meaning the transaction history cannot be longer
+		// than that.
 		self.history = append(self.history, Transaction{})
+	} else {
+		// The history length may have been decreased.
+		self.history = self.history[:length]
 	}
 	copy(self.history[1:], self.history)
 	self.history[0] = transaction
 
-	if self.Name != transaction.TargetServer || transaction.Target == "" {
+	// Payments to users on servers with wallets enabled are credited to
+	// their wallet instead.
+	if self.Name != transaction.TargetServer || transaction.Target == "" ||
+		self.walletsEnabled {
 		return
 	}
 
 	// Add to pending transactions.
 	self.pendingTransactions = append(self.pendingTransactions, transaction)
+	self.removeOverflowingTransactions()
+	if events := self.queuedWebhookEvents(); events != nil {
+		events.transactions = append(events.transactions, transaction)
+	}
 
 	// Validate the webhook URL (if any).
 	if self.WebhookURL == "" {
@@ -118,23 +217,7 @@ func (self *Server) AddToHistory(transaction Transaction) {
 
 	// Send a request to the webhook (in a separate goroutine so it doesn't
 	// block anything).
-	go func(webhookURL string) {
-		url, ok := ValidateWebhookURL(webhookURL)
-		if !ok {
-			return
-		}
-		reader := strings.NewReader(`{"version": 0}`)
-		req, err := http.NewRequest("POST", url, reader)
-		if err != nil {
-			return
-		}
-		req.Header.Set("Content-Type", "application/json")
-		req.Header.Set("User-Agent", "lurkcoin/3.0")
-		res, err := webhookClient.Do(req)
-		if err == nil {
-			res.Body.Close()
-		}
-	}(self.WebhookURL)
+	queueWebhook(self.webhookRequest(transaction))
 }
 
 // Get a list of pending transactions, similar to GetHistory().
@@ -174,33 +257,52 @@ func (self *Server) removeAndReturnPendingTransaction(id string) *Transaction {
 	return nil
 }
 
-// Remove a pending transaction given its ID.
-func (self *Server) RemovePendingTransaction(id string) {
-	self.removeAndReturnPendingTransaction(id)
+// Remove a pending transaction given its ID. Returns false if the transaction
+// isn't pending.
+func (self *Server) RemovePendingTransaction(id string) bool {
+	return self.removeAndReturnPendingTransaction(id) != nil
 }
 
-// Reject (and possibly revert) a pending transaction.
-func (self *Server) RejectPendingTransaction(id string,
-	tr *DatabaseTransaction) {
-	if tr == nil {
-		panic("nil *DatabaseTransaction passed to RejectPendingTransaction().")
+// Removes any pending transactions sent from sourceUID and returns the
+// number of transactions removed.
+func (self *Server) removePendingTransactionsFrom(sourceUID string) int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	i := 0
+	for _, transaction := range self.pendingTransactions {
+		if HomogeniseUsername(transaction.SourceServer) != sourceUID {
+			self.pendingTransactions[i] = transaction
+			i++
+		}
 	}
-
-	// Get the transaction and ensure
-	transaction := self.removeAndReturnPendingTransaction(id)
-	if transaction == nil || !transaction.Revertable {
-		return
+	removed := len(self.pendingTransactions) - i
+	if removed == 0 {
+		return 0
+	}
+	for j := i; j < len(self.pendingTransactions); j++ {
+		self.pendingTransactions[j] = Transaction{}
 	}
+	self.pendingTransactions = self.pendingTransactions[:i]
+	self.modified = true
+	return removed
+}
 
+// Sends the received amount of a transaction that was sent to currentUID back
+// to its source in the background. This is only used when the source server
+// can't be locked, RejectTransactions() should be used otherwise.
+func revertTransaction(db Database, currentUID string,
+	transaction Transaction, logger *Logger) {
 	// Defer to a goroutine to prevent deadlocks
-	// TODO: Do this in the current goroutine
-	db := tr.GetRawDatabase()
-	currentUID := self.UID
+	backgroundTasks.Add(1)
 	go func() {
+		defer backgroundTasks.Done()
+		defer RecoverAndReport(nil)
+
 		// Get the current server (the existing object is now invalid) and the
 		// source server.
 		tr := BeginDbTransaction(db)
 		defer tr.Abort()
+		tr.SetLogger(logger)
 
 		servers, ok, _ := tr.GetServers(currentUID, transaction.SourceServer)
 		if !ok {
@@ -210,8 +312,9 @@ func (self *Server) RejectPendingTransaction(id string,
 		// To try and prevent exploits, the received amount is used and exchange
 		// rates are re-calculated.
 		// Note that the source and target get flipped here.
-		servers[0].Pay(transaction.Target, transaction.Source, servers[1],
-			transaction.ReceivedAmount, true, false)
+		servers[0].pay(transaction.Target, transaction.Source, servers[1],
+			transaction.ReceivedAmount, true, false, transaction.ID, nil,
+			transaction.Currency)
 		tr.Finish()
 	}()
 }
@@ -238,7 +341,7 @@ func (self *Server) RemoveFirstPendingTransactions(amount int) {
 
 // Sets the target balance.
 func (self *Server) SetTargetBalance(targetBalance Currency) bool {
-	if targetBalance.LtZero() || targetBalance.Gt(MaxTargetBalance) {
+	if targetBalance.LtZero() || targetBalance.Gt(GetMaxTargetBalance()) {
 		return false
 	}
 
@@ -246,6 +349,7 @@ func (self *Server) SetTargetBalance(targetBalance Currency) bool {
 	defer self.lock.Unlock()
 	self.modified = true
 	self.targetBalance = targetBalance
+	self.queueSettingsEvent("target_balance")
 	return true
 }
 
@@ -269,67 +373,136 @@ func (self *Server) SetWebhookURL(webhookURL string) (ok bool) {
 	defer self.lock.Unlock()
 	self.modified = true
 	self.WebhookURL = safeURL
+	self.queueSettingsEvent("webhook_url")
+
+	// Generate a webhook secret the first time a webhook URL is set.
+	if safeURL != "" && self.webhookSecret == "" {
+		self.webhookSecret = generateWebhookSecret()
+	}
 	return
 }
 
+// Returns the key used to sign webhook requests (if any), see
+// SignWebhookPayload().
+func (self *Server) GetWebhookSecret() string {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	return self.webhookSecret
+}
+
+// Replaces the webhook secret and returns the new one.
+func (self *Server) RegenerateWebhookSecret() string {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.webhookSecret = generateWebhookSecret()
+	self.modified = true
+	self.queueSettingsEvent("webhook_secret")
+	return self.webhookSecret
+}
+
+func (self *Server) GetWebhookVersion() int {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	return self.webhookVersion
+}
+
+// Sets the webhook payload version, version 0 webhooks don't contain any
+// information and version 1 webhooks include the transaction. Returns false
+// if the version isn't supported.
+func (self *Server) SetWebhookVersion(version int) bool {
+	if version < 0 || version > MaxWebhookVersion {
+		return false
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.modified = true
+	self.webhookVersion = version
+	self.queueSettingsEvent("webhook_version")
+	return true
+}
+
 // Gets the exchange rate.
 // GetExchangeRate(<lurkcoins>, false) → <local currency>
 // GetExchangeRate(<local currency>, true) → <lurkcoins>
-var f2 = big.NewFloat(2)
-
+//
 // Exchange rate calculations are horrible at the moment, however they work
 // (at least I think they work).
 func (self *Server) GetExchangeRate(amount Currency, toLurkcoin bool) (Currency,
 	*big.Float) {
-	self.lock.RLock()
-	defer self.lock.RUnlock()
+	return self.GetExchangeRateIn("", amount, toLurkcoin)
+}
 
+func calculateExchangeRate(balance, targetBalance, amount Currency,
+	toLurkcoin bool) (Currency, *big.Float) {
 	// Do nothing if the amount is 0 or fixed exchange rates are enabled.
-	if amount.IsZero() || self.targetBalance.IsZero() {
+	if amount.IsZero() || targetBalance.IsZero() {
 		return amount, big.NewFloat(1)
 	}
 
-	// bal = max(self.balance, 0.01)
-	bal := self.balance
+	// bal = max(balance, 0.01)
+	bal := balance
 	if !bal.GtZero() {
 		bal = CurrencyFromString("0.01")
 	}
 
-	// base_exchange = self.TargetBal / bal
-	base_exchange := self.targetBalance.Div(bal)
+	// This uses big.Rat so that the only rounding done is when converting
+	// back to Currency.
+	// base_exchange = targetBalance / bal
+	targetBalanceRat := targetBalance.Rat()
+	base_exchange := new(big.Rat).Quo(targetBalanceRat, bal.Rat())
 
 	// To lurkcoin: adj_bal = bal - amount / base_exchange
 	// From lurkcoin: adj_bal = bal + amount
 	var adj_bal Currency
 	if toLurkcoin {
-		adj_bal = bal.Sub(CurrencyFromFloat(new(big.Float).Quo(amount.Float(),
-			base_exchange)))
+		adj_bal = bal.Sub(amount.Mul(new(big.Rat).Inv(base_exchange),
+			RoundTowardsZero))
 	} else {
 		adj_bal = bal.Add(amount)
 	}
+	if adj_bal.IsZero() {
+		return c0, new(big.Float).SetInf(false)
+	}
 
 	// Calculate the "pre-emptive" exchange rate and average the two.
-	preemptive := new(big.Float).Add(base_exchange,
-		self.targetBalance.Div(adj_bal))
-	exchange := new(big.Float).Quo(preemptive, f2)
+	exchange := new(big.Rat).Quo(targetBalanceRat, adj_bal.Rat())
+	exchange.Add(exchange, base_exchange)
+	exchange.Quo(exchange, big.NewRat(2, 1))
 
 	// Multiply (or divide) the exchange rate and the amount
-	res := new(big.Float)
+	var res Currency
 	if toLurkcoin {
-		res.Quo(amount.Float(), exchange)
+		if exchange.Sign() == 0 {
+			return c0, new(big.Float)
+		}
+		res = amount.Mul(new(big.Rat).Inv(exchange), RoundTowardsZero)
 	} else {
-		res.Mul(amount.Float(), exchange)
+		res = amount.Mul(exchange, RoundTowardsZero)
 	}
-	return CurrencyFromFloat(res), exchange
+	return res, new(big.Float).SetRat(exchange)
 }
 
-// Regenerates the token and returns the new one.
+// Regenerates the token and returns the new one. Only a hash of the token
+// is stored, so this is the only time that the token can be shown.
 func (self *Server) RegenerateToken() string {
 	self.lock.Lock()
 	defer self.lock.Unlock()
-	self.token = GenerateToken()
+	self.newToken = GenerateToken()
+	self.token = HashToken(self.newToken)
 	self.modified = true
-	return self.token
+	if events := self.queuedWebhookEvents(); events != nil {
+		events.tokenRegenerated = true
+	}
+	return self.newToken
+}
+
+// Returns the token of a server that was created or had its token
+// regenerated since it was loaded from the database, or "" otherwise.
+func (self *Server) GetNewToken() string {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	return self.newToken
 }
 
 // "Encoded" servers that have all their values public
@@ -341,7 +514,8 @@ type EncodedServer struct {
 	// The server name (not passed through HomogeniseUsername)
 	Name string `json:"name"`
 
-	// The balance in integer form where 1234 is ¤12.34.
+	// The balance in integer form where 1234 is ¤12.34 (with the default
+	// precision, see Decimals).
 	Balance *big.Int `json:"balance"`
 
 	// The target balance in the same format as the above balance.
@@ -352,6 +526,49 @@ type EncodedServer struct {
 	PendingTransactions []Transaction `json:"pending_transactions"`
 	Token               string        `json:"token"`
 	WebhookURL          string        `json:"webhook_url"`
+
+	// User wallets in the same format as the balance.
+	Wallets        map[string]*big.Int `json:"wallets,omitempty"`
+	WalletsEnabled bool                `json:"wallets_enabled,omitempty"`
+
+	// Users registered with the global username registry, mapped to their
+	// global ID.
+	Identities map[string]string `json:"identities,omitempty"`
+
+	// The freeze mode, see FrozenOutgoing and FrozenAll.
+	Frozen string `json:"frozen,omitempty"`
+
+	// If set, this is an alias left behind by RenameServer and all other
+	// fields (except the name) are ignored. This is the server's new UID.
+	AliasOf string `json:"alias_of,omitempty"`
+
+	// If set, the server has been deleted and will be permanently deleted
+	// once the retention period is over. This is a UNIX timestamp.
+	DeletedAt int64 `json:"deleted_at,omitempty"`
+
+	// Overrides the default transaction limit if set, in the same format as
+	// the balance.
+	TransactionLimit *big.Int `json:"transaction_limit,omitempty"`
+
+	// The credit limit in the same format as the balance, see
+	// Server.SetCreditLimit().
+	CreditLimit *big.Int `json:"credit_limit,omitempty"`
+
+	// Balances in additional currencies, see SetCurrencies().
+	Balances map[string]EncodedBalance `json:"balances,omitempty"`
+
+	// The number of decimal places the above integers are stored with, 0
+	// means the default of 2.
+	Decimals uint8 `json:"decimals,omitempty"`
+
+	// The webhook payload version, see Server.SetWebhookVersion().
+	WebhookVersion int `json:"webhook_version,omitempty"`
+
+	// The key used to sign webhook requests.
+	WebhookSecret string `json:"webhook_secret,omitempty"`
+
+	// Webhook endpoints, see Server.AddWebhook().
+	Webhooks []WebhookEndpoint `json:"webhooks,omitempty"`
 }
 
 func (self *Server) IsModified() bool {
@@ -374,9 +591,74 @@ func (self *Server) Encode() EncodedServer {
 	copy(history, self.history)
 	pendingTransactions := make([]Transaction, len(self.pendingTransactions))
 	copy(pendingTransactions, self.pendingTransactions)
+	var wallets map[string]*big.Int
+	if len(self.wallets) > 0 {
+		wallets = make(map[string]*big.Int, len(self.wallets))
+		for user, balance := range self.wallets {
+			wallets[user] = balance.Int()
+		}
+	}
+	var identities map[string]string
+	if len(self.identities) > 0 {
+		identities = make(map[string]string, len(self.identities))
+		for user, id := range self.identities {
+			identities[user] = id
+		}
+	}
+	var transactionLimit *big.Int
+	if !self.transactionLimit.IsNil() {
+		transactionLimit = self.transactionLimit.Int()
+	}
+	var creditLimit *big.Int
+	if self.creditLimit.GtZero() {
+		creditLimit = self.creditLimit.Int()
+	}
+	var balances map[string]EncodedBalance
+	if len(self.balances) > 0 {
+		balances = make(map[string]EncodedBalance, len(self.balances))
+		for currency, b := range self.balances {
+			balances[currency] = EncodedBalance{b.balance.Int(),
+				b.targetBalance.Int()}
+		}
+	}
 	return EncodedServer{0, self.Name, self.balance.Int(),
 		self.targetBalance.Int(), history, pendingTransactions, self.token,
-		self.WebhookURL}
+		self.WebhookURL, wallets, self.walletsEnabled, identities,
+		self.frozen, self.aliasOf, self.deletedAt, transactionLimit,
+		creditLimit, balances, encodedCurrencyDecimals(), self.webhookVersion,
+		self.webhookSecret, copyWebhooks(self.webhooks)}
+}
+
+// Returns an error if any of the server's amounts have more decimal places
+// than currency values are stored with (see SetCurrencyDecimals()).
+func (self *EncodedServer) CheckPrecision() error {
+	raw := []*big.Int{self.Balance, self.TargetBalance,
+		self.TransactionLimit, self.CreditLimit}
+	for _, balance := range self.Wallets {
+		raw = append(raw, balance)
+	}
+	for _, b := range self.Balances {
+		raw = append(raw, b.Balance, b.TargetBalance)
+	}
+	for _, n := range raw {
+		if !isRawRepresentable(n, self.Decimals) {
+			return fmt.Errorf("Server %q has amounts with %d decimal "+
+				"places, which can't be stored with currency_decimals set "+
+				"to %d.", self.Name, self.Decimals, GetCurrencyDecimals())
+		}
+	}
+	return nil
+}
+
+// Checks that every server in the database can be loaded with the current
+// currency precision without losing any decimal places.
+func CheckCurrencyPrecision(db Database) error {
+	if GetCurrencyDecimals() >= MaxCurrencyDecimals {
+		return nil
+	}
+	return db.ForEachEncoded(func(encodedServer *EncodedServer) error {
+		return encodedServer.CheckPrecision()
+	})
 }
 
 func (self *EncodedServer) Decode() *Server {
@@ -388,8 +670,8 @@ func (self *EncodedServer) Decode() *Server {
 	}
 
 	// Convert Balance and TargetBalance to Currency.
-	balance := CurrencyFromInt(self.Balance)
-	targetBalance := CurrencyFromInt(self.TargetBalance)
+	balance := currencyFromRaw(self.Balance, self.Decimals)
+	targetBalance := currencyFromRaw(self.TargetBalance, self.Decimals)
 
 	// Copy History and PendingTransactions.
 	history := make([]Transaction, len(self.History))
@@ -397,9 +679,46 @@ func (self *EncodedServer) Decode() *Server {
 	pendingTransactions := make([]Transaction, len(self.PendingTransactions))
 	copy(pendingTransactions, self.PendingTransactions)
 
+	// Convert wallet balances to Currency.
+	wallets := make(map[string]Currency, len(self.Wallets))
+	for user, balance := range self.Wallets {
+		wallets[user] = currencyFromRaw(balance, self.Decimals)
+	}
+
+	identities := make(map[string]string, len(self.Identities))
+	for user, id := range self.Identities {
+		identities[user] = id
+	}
+
+	var transactionLimit Currency
+	if self.TransactionLimit != nil {
+		transactionLimit = currencyFromRaw(self.TransactionLimit,
+			self.Decimals)
+	}
+
+	creditLimit := c0
+	if self.CreditLimit != nil {
+		creditLimit = currencyFromRaw(self.CreditLimit, self.Decimals)
+	}
+
+	var balances map[string]currencyBalance
+	if len(self.Balances) > 0 {
+		balances = make(map[string]currencyBalance, len(self.Balances))
+		for currency, b := range self.Balances {
+			balances[currency] = currencyBalance{
+				currencyFromRaw(b.Balance, self.Decimals),
+				currencyFromRaw(b.TargetBalance, self.Decimals),
+			}
+		}
+	}
+
 	return &Server{HomogeniseUsername(self.Name), self.Name, balance,
 		targetBalance, history, pendingTransactions, self.Token,
-		self.WebhookURL, new(sync.RWMutex), false}
+		self.WebhookURL, wallets, self.WalletsEnabled, identities,
+		self.Frozen, self.AliasOf, self.DeletedAt, transactionLimit,
+		creditLimit, balances, self.WebhookVersion, self.WebhookSecret,
+		copyWebhooks(self.Webhooks), new(sync.RWMutex), false, false, nil,
+		nil, nil, nil, nil, nil, ""}
 }
 
 // Summaries
@@ -411,39 +730,59 @@ type Summary struct {
 	History       []Transaction `json:"history"`
 	InterestRate  float64       `json:"interest_rate"`
 	TargetBalance Currency      `json:"target_balance"`
+
+	// The balance converted to the reference currency (if any).
+	ReferenceBalance *ReferenceValue `json:"reference_balance,omitempty"`
+
+	// The freeze mode if the server has been frozen by an administrator.
+	Frozen string `json:"frozen,omitempty"`
+
+	// The credit limit and the amount of credit used, see
+	// Server.SetCreditLimit().
+	CreditLimit Currency `json:"credit_limit"`
+	CreditUsed  Currency `json:"credit_used"`
+
+	// Balances in additional currencies.
+	Balances map[string]Currency `json:"balances,omitempty"`
 }
 
 func (self *Server) GetSummary() Summary {
+	creditUsed := self.GetCreditUsed()
+	balances := self.GetBalances()
+	if len(balances) == 0 {
+		balances = nil
+	}
 	self.lock.RLock()
 	defer self.lock.RUnlock()
 	return Summary{self.UID, self.Name, self.balance, self.balance.String(),
-		self.GetHistory(), 0, self.targetBalance}
+		self.GetHistory(), 0, self.targetBalance,
+		ConvertToReference(self.balance), self.frozen, self.creditLimit,
+		creditUsed, balances}
 }
 
-// Check an API token.
-// WARNING: This may leak the length of the stored token, however that is
-// probably already deducible by inspecting GenerateToken().
+// Check an API token against the stored hash (or plaintext token in older
+// databases, see HashPlaintextTokens()).
 func (self *Server) CheckToken(token string) bool {
-	if self.token == "" {
-		return false
-	}
-
-	return ConstantTimeCompare(self.token, token)
+	self.lock.RLock()
+	stored := self.token
+	self.lock.RUnlock()
+	return checkStoredToken(stored, token)
 }
 
 // Make a new server
-// The default target balance is currently ¤500,000.
-const DefaultTargetBalance int64 = 500000
-
 func NewServer(name string) *Server {
 	var server EncodedServer
 	server.Version = 0
 	server.Name = name
 	server.Balance = new(big.Int).SetInt64(0)
-	server.TargetBalance = new(big.Int).SetInt64(DefaultTargetBalance * 100)
-	server.Token = GenerateToken()
+	server.TargetBalance = GetDefaultTargetBalance().Int()
+	server.Decimals = encodedCurrencyDecimals()
+	token := GenerateToken()
+	server.Token = HashToken(token)
 
+	// The token can be shown once with GetNewToken().
 	res := server.Decode()
+	res.newToken = token
 	res.SetModified()
 	return res
 }
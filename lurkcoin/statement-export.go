@@ -0,0 +1,174 @@
+//
+// lurkcoin: OFX and QIF statements
+// Copyright © 2020 by luk3yx
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package lurkcoin
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// Supported ExportStatement formats.
+var StatementExportFormats = []string{"ofx", "qif"}
+
+// A transaction from the point of view of a single server.
+type statementEntry struct {
+	transaction *Transaction
+	amount      Currency
+	payee       string
+	memo        string
+}
+
+// Returns the transactions that changed server's balance. Payments between
+// users on the same server are skipped.
+func getStatementEntries(server string,
+	transactions []Transaction) []statementEntry {
+	uid := HomogeniseUsername(server)
+	var entries []statementEntry
+	for i := range transactions {
+		t := &transactions[i]
+		source := HomogeniseUsername(t.SourceServer) == uid
+		target := HomogeniseUsername(t.TargetServer) == uid
+		// Fees are already included in the amount of the original
+		// transaction.
+		if source == target || (source && t.FeeFor != "") {
+			continue
+		}
+
+		var entry statementEntry
+		entry.transaction = t
+		if target {
+			entry.amount = t.netAmount()
+			entry.payee = fmt.Sprintf("%s (%s)", t.Source, t.SourceServer)
+			entry.memo = "Payment to " + t.Target
+		} else {
+			entry.amount = t.Amount.Neg()
+			entry.payee = fmt.Sprintf("%s (%s)", t.Target, t.TargetServer)
+			entry.memo = "Payment from " + t.Source
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func xmlEscape(s string) string {
+	var builder strings.Builder
+	xml.EscapeText(&builder, []byte(s))
+	return builder.String()
+}
+
+// Truncates s to n characters.
+func truncate(s string, n int) string {
+	if r := []rune(s); len(r) > n {
+		return string(r[:n])
+	}
+	return s
+}
+
+const ofxTimeFormat = "20060102150405"
+
+// OFX requires an ISO 4217 currency code, XXX means "no currency".
+func exportOFX(w io.Writer, server string, balance Currency,
+	entries []statementEntry) error {
+	now := time.Now().UTC()
+	start, end := now, now
+	if len(entries) > 0 {
+		start = entries[0].transaction.GetTime().UTC()
+		end = entries[len(entries)-1].transaction.GetTime().UTC()
+	}
+
+	var b strings.Builder
+	b.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="no"?>` +
+		"\n" + `<?OFX OFXHEADER="200" VERSION="211" SECURITY="NONE" ` +
+		`OLDFILEUID="NONE" NEWFILEUID="NONE"?>` + "\n<OFX>\n")
+	fmt.Fprintf(&b, "<SIGNONMSGSRSV1><SONRS><STATUS><CODE>0</CODE>"+
+		"<SEVERITY>INFO</SEVERITY></STATUS><DTSERVER>%s</DTSERVER>"+
+		"<LANGUAGE>ENG</LANGUAGE></SONRS></SIGNONMSGSRSV1>\n",
+		now.Format(ofxTimeFormat))
+	fmt.Fprintf(&b, "<BANKMSGSRSV1><STMTTRNRS><TRNUID>0</TRNUID><STATUS>"+
+		"<CODE>0</CODE><SEVERITY>INFO</SEVERITY></STATUS>\n<STMTRS>"+
+		"<CURDEF>XXX</CURDEF><BANKACCTFROM><BANKID>lurkcoin</BANKID>"+
+		"<ACCTID>%s</ACCTID><ACCTTYPE>CHECKING</ACCTTYPE></BANKACCTFROM>\n"+
+		"<BANKTRANLIST><DTSTART>%s</DTSTART><DTEND>%s</DTEND>\n",
+		xmlEscape(truncate(HomogeniseUsername(server), 22)),
+		start.Format(ofxTimeFormat), end.Format(ofxTimeFormat))
+
+	for _, entry := range entries {
+		trnType := "CREDIT"
+		if entry.amount.LtZero() {
+			trnType = "DEBIT"
+		}
+		fmt.Fprintf(&b, "<STMTTRN><TRNTYPE>%s</TRNTYPE><DTPOSTED>%s"+
+			"</DTPOSTED><TRNAMT>%s</TRNAMT><FITID>%s</FITID><NAME>%s"+
+			"</NAME><MEMO>%s</MEMO></STMTTRN>\n",
+			trnType,
+			entry.transaction.GetTime().UTC().Format(ofxTimeFormat),
+			entry.amount.RawString(),
+			xmlEscape(entry.transaction.ID),
+			xmlEscape(truncate(entry.payee, 32)),
+			xmlEscape(truncate(entry.memo, 255)))
+	}
+
+	fmt.Fprintf(&b, "</BANKTRANLIST>\n<LEDGERBAL><BALAMT>%s</BALAMT>"+
+		"<DTASOF>%s</DTASOF></LEDGERBAL></STMTRS></STMTTRNRS>"+
+		"</BANKMSGSRSV1>\n</OFX>\n", balance.RawString(),
+		now.Format(ofxTimeFormat))
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// QIF is line based, so newlines are removed from fields.
+var qifReplacer = strings.NewReplacer("\r", " ", "\n", " ")
+
+func exportQIF(w io.Writer, entries []statementEntry) error {
+	var b strings.Builder
+	b.WriteString("!Type:Bank\n")
+	for _, entry := range entries {
+		fmt.Fprintf(&b, "D%s\nT%s\nN%s\nP%s\nM%s\n^\n",
+			entry.transaction.GetTime().Format("01/02/2006"),
+			entry.amount.RawString(),
+			qifReplacer.Replace(entry.transaction.ID),
+			qifReplacer.Replace(entry.payee),
+			qifReplacer.Replace(entry.memo))
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// Writes a statement of server's transactions to w in the specified format
+// (see StatementExportFormats). Amounts are in lurkcoins. balance is the
+// server's current balance and is only used by OFX.
+func ExportStatement(w io.Writer, server string, balance Currency,
+	transactions []Transaction, format string) error {
+	entries := getStatementEntries(server, transactions)
+	switch strings.ToLower(format) {
+	case "ofx":
+		if balance.IsNil() {
+			return errors.New("OFX statements require the server's balance")
+		}
+		return exportOFX(w, server, balance, entries)
+	case "qif":
+		return exportQIF(w, entries)
+	default:
+		return errors.New("Unknown statement format: " + format)
+	}
+}
@@ -0,0 +1,161 @@
+//
+// lurkcoin
+// Copyright © 2020 by luk3yx
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package lurkcoin
+
+import (
+	"github.com/luk3yx/lurkcoin-core/lurkcoin/metrics"
+	"math/big"
+	"sync"
+	"time"
+)
+
+// Aggregate statistics about the economy.
+type EconomyStats struct {
+	Servers             int      `json:"servers"`
+	TotalSupply         Currency `json:"total_supply"`
+	PendingTransactions int      `json:"pending_transactions"`
+
+	// The exchange rates (lurkcoins to local currency) of ¤1 are used here.
+	// Servers with fixed exchange rates are ignored.
+	MinExchangeRate *big.Float `json:"min_exchange_rate"`
+	MaxExchangeRate *big.Float `json:"max_exchange_rate"`
+}
+
+var c1 = CurrencyFromInt64(1)
+
+// Gets statistics for the entire database. This iterates over every server
+// and should not be called too often.
+func GetEconomyStats(db Database) (stats EconomyStats) {
+	stats.TotalSupply = c0
+	db.ForEachEncoded(func(encodedServer *EncodedServer) error {
+		if encodedServer.AliasOf != "" || encodedServer.DeletedAt != 0 {
+			return nil
+		}
+		server := encodedServer.Decode()
+		stats.Servers++
+		stats.TotalSupply = stats.TotalSupply.Add(server.GetBalance())
+		stats.PendingTransactions += len(server.GetPendingTransactions())
+
+		if server.GetTargetBalance().IsZero() {
+			return nil
+		}
+		_, rate := server.GetExchangeRate(c1, false)
+		if stats.MinExchangeRate == nil || rate.Cmp(stats.MinExchangeRate) < 0 {
+			stats.MinExchangeRate = rate
+		}
+		if stats.MaxExchangeRate == nil || rate.Cmp(stats.MaxExchangeRate) > 0 {
+			stats.MaxExchangeRate = rate
+		}
+		return nil
+	})
+	return
+}
+
+// Transaction metrics
+var transactionCount = metrics.NewCounterVec(
+	"lurkcoin_transactions_total",
+	"The number of transactions made since lurkcoin was started.",
+)
+
+var transactionVolume = metrics.NewCounterVec(
+	"lurkcoin_transaction_volume_total",
+	"The total amount of lurkcoins transferred since lurkcoin was started.",
+)
+
+var largestTransactionLock sync.Mutex
+var largestTransaction = c0
+
+var _ = metrics.NewGaugeFunc(
+	"lurkcoin_largest_transaction",
+	"The largest single transaction since lurkcoin was started.",
+	func() []metrics.Sample {
+		largestTransactionLock.Lock()
+		defer largestTransactionLock.Unlock()
+		f, _ := largestTransaction.Float().Float64()
+		return []metrics.Sample{{Value: f}}
+	},
+)
+
+func recordTransaction(transaction *Transaction) {
+	// Statistics are only kept for the primary currency.
+	if transaction.Currency != "" {
+		return
+	}
+	amount, _ := transaction.Amount.Float().Float64()
+	transactionCount.Inc()
+	transactionVolume.Add(amount)
+
+	recordRecentVolume(transaction.Amount)
+
+	largestTransactionLock.Lock()
+	defer largestTransactionLock.Unlock()
+	if transaction.Amount.Gt(largestTransaction) {
+		largestTransaction = transaction.Amount
+	}
+}
+
+// The number of hours that recent transaction volume is kept for.
+const RecentVolumeHours = 24
+
+// The number and total amount of transactions made in an hour.
+type TransactionVolume struct {
+	// The UNIX timestamp of the start of the hour.
+	Start        int64    `json:"start"`
+	Transactions int      `json:"transactions"`
+	Volume       Currency `json:"volume"`
+}
+
+func (self TransactionVolume) GetStart() time.Time {
+	return time.Unix(self.Start, 0)
+}
+
+// Recent transaction volume is kept in hourly buckets so that it can be
+// shown publicly without exposing individual transactions. This isn't saved,
+// so only transactions made since lurkcoin was started are counted.
+var recentVolumeLock sync.Mutex
+var recentVolume [RecentVolumeHours]TransactionVolume
+
+func recordRecentVolume(amount Currency) {
+	hour := time.Now().Unix() / 3600
+	recentVolumeLock.Lock()
+	defer recentVolumeLock.Unlock()
+	bucket := &recentVolume[hour%RecentVolumeHours]
+	if bucket.Start != hour*3600 {
+		*bucket = TransactionVolume{Start: hour * 3600, Volume: c0}
+	}
+	bucket.Transactions++
+	bucket.Volume = bucket.Volume.Add(amount)
+}
+
+// Returns the transaction volume of the last RecentVolumeHours hours
+// (including the current hour), oldest first.
+func GetRecentTransactionVolume() []TransactionVolume {
+	hour := time.Now().Unix() / 3600
+	res := make([]TransactionVolume, RecentVolumeHours)
+	recentVolumeLock.Lock()
+	defer recentVolumeLock.Unlock()
+	for i := range res {
+		h := hour - RecentVolumeHours + 1 + int64(i)
+		res[i] = recentVolume[h%RecentVolumeHours]
+		if res[i].Start != h*3600 {
+			res[i] = TransactionVolume{Start: h * 3600, Volume: c0}
+		}
+	}
+	return res
+}
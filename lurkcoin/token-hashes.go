@@ -0,0 +1,109 @@
+//
+// lurkcoin token hashes
+// Copyright © 2020 by luk3yx
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package lurkcoin
+
+import (
+	"crypto/hmac"
+	crypto_rand "crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+)
+
+// Only hashes of API tokens are stored so that tokens can't be taken from
+// the database or backups. Hashes are stored as
+// "hmac-sha256:<salt>:<hash>", where the hash is the HMAC-SHA256 of the token
+// with the salt as the key. Tokens generated by GenerateToken() never contain
+// colons, so older databases with plaintext tokens still work and can be
+// upgraded with HashPlaintextTokens().
+const tokenHashPrefix = "hmac-sha256:"
+
+func hashTokenWithSalt(token string, salt []byte) string {
+	mac := hmac.New(sha256.New, salt)
+	mac.Write([]byte(token))
+	return tokenHashPrefix + base64.RawURLEncoding.EncodeToString(salt) +
+		":" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Hashes a token with a new random salt.
+func HashToken(token string) string {
+	salt := make([]byte, 16)
+	if _, err := crypto_rand.Read(salt); err != nil {
+		panic(err)
+	}
+	return hashTokenWithSalt(token, salt)
+}
+
+// Returns true if stored is a token hash instead of a plaintext token.
+func IsHashedToken(stored string) bool {
+	return strings.HasPrefix(stored, tokenHashPrefix)
+}
+
+// Checks token against a stored hash (or plaintext token).
+func checkStoredToken(stored, token string) bool {
+	if stored == "" {
+		return false
+	} else if !IsHashedToken(stored) {
+		return ConstantTimeCompare(stored, token)
+	}
+
+	parts := strings.SplitN(stored[len(tokenHashPrefix):], ":", 2)
+	if len(parts) != 2 {
+		return false
+	}
+	salt, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return false
+	}
+	return ConstantTimeCompare(hashTokenWithSalt(token, salt), stored)
+}
+
+// Replaces a plaintext token with a hash, returns false if the token is
+// already hashed.
+func (self *Server) hashPlaintextToken() bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.token == "" || IsHashedToken(self.token) {
+		return false
+	}
+	self.token = HashToken(self.token)
+	self.modified = true
+	return true
+}
+
+// Hashes every plaintext token in the database (including those of deleted
+// servers) and returns the number of tokens hashed. The tokens keep working.
+func HashPlaintextTokens(db Database) (int, error) {
+	if IsReadOnly(db) {
+		return 0, ErrReadOnly
+	}
+	hashed := 0
+	err := forEachServerUID(db, func(uid string) error {
+		tr := BeginDbTransaction(db)
+		defer tr.Abort()
+		servers, ok, _ := tr.getServers([]string{uid}, false)
+		if ok && servers[0].hashPlaintextToken() {
+			hashed++
+			tr.Finish()
+		}
+		return nil
+	})
+	return hashed, err
+}
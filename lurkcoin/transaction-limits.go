@@ -0,0 +1,99 @@
+//
+// lurkcoin transaction limits
+// Copyright © 2020 by luk3yx
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package lurkcoin
+
+import (
+	"errors"
+	"sync"
+)
+
+// The highest transaction limit that can be set, 1e+11 so clients that parse
+// JSON numbers as 64-bit floats won't run into issues.
+var maxTransactionLimit = CurrencyFromInt64(100000000000)
+
+// The default transaction limit, this is 10,000 by default due to broken
+// exchange rate calculations.
+var transactionLimitLock sync.RWMutex
+var transactionLimit = CurrencyFromInt64(10000)
+
+func validateTransactionLimit(limit Currency) error {
+	if limit.IsNil() || !limit.GtZero() || limit.Gt(maxTransactionLimit) {
+		return errors.New("The transaction limit must be positive and at " +
+			"most " + maxTransactionLimit.String() + ".")
+	}
+	return nil
+}
+
+func GetTransactionLimit() Currency {
+	transactionLimitLock.RLock()
+	defer transactionLimitLock.RUnlock()
+	return transactionLimit
+}
+
+// Sets the default transaction limit, individual servers can override this
+// with Server.SetTransactionLimit().
+func SetTransactionLimit(limit Currency) error {
+	if err := validateTransactionLimit(limit); err != nil {
+		return err
+	}
+	transactionLimitLock.Lock()
+	defer transactionLimitLock.Unlock()
+	transactionLimit = limit
+	return nil
+}
+
+// Returns the server's transaction limit, this is the default transaction
+// limit unless it has been overridden.
+func (self *Server) GetTransactionLimit() Currency {
+	if limit, ok := self.GetTransactionLimitOverride(); ok {
+		return limit
+	}
+	return GetTransactionLimit()
+}
+
+// Returns the server's transaction limit and true if it has been overridden.
+func (self *Server) GetTransactionLimitOverride() (Currency, bool) {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	return self.transactionLimit, !self.transactionLimit.IsNil()
+}
+
+// Overrides the server's transaction limit. If limit is nil (the zero
+// Currency value), the default transaction limit is used again.
+func (self *Server) SetTransactionLimit(limit Currency) error {
+	if !limit.IsNil() {
+		if err := validateTransactionLimit(limit); err != nil {
+			return err
+		}
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.transactionLimit = limit
+	self.modified = true
+	self.queueSettingsEvent("transaction_limit")
+	return nil
+}
+
+// Like Server.GetTransactionLimit() but server may be nil.
+func transactionLimitOf(server *Server) Currency {
+	if server == nil {
+		return GetTransactionLimit()
+	}
+	return server.GetTransactionLimit()
+}
@@ -0,0 +1,152 @@
+//
+// lurkcoin transaction lookups
+// Copyright © 2020 by luk3yx
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package lurkcoin
+
+import (
+	"errors"
+	"time"
+)
+
+// Transaction statuses
+const (
+	// The transaction hasn't been acknowledged or rejected by the target
+	// server yet.
+	TransactionPending = "pending"
+
+	// The transaction has been acknowledged (or rejected without being
+	// reverted).
+	TransactionAcknowledged = "acknowledged"
+
+	// The transaction was rejected and the amount was sent back.
+	TransactionReverted = "reverted"
+)
+
+type TransactionStatus struct {
+	Transaction
+	Status string `json:"status"`
+
+	// The ID of the transaction that reverted this one (if any).
+	RevertedBy string `json:"reverted_by,omitempty"`
+}
+
+// Used to stop searching the journal.
+var errStopSearching = errors.New("stop searching")
+
+// Searches the journal for a transaction and any transaction that reverts
+// it. Journals that don't implement TransactionJournal are read from the
+// time in the transaction ID to the end.
+func searchJournal(j Journal, id string, t *Transaction,
+	revertedBy *string) error {
+	if tj, ok := j.(TransactionJournal); ok {
+		found, reversal, err := tj.FindTransaction(id)
+		if err != nil {
+			return err
+		}
+		if found != nil && t.ID == "" {
+			*t = *found
+		}
+		if reversal != "" {
+			*revertedBy = reversal
+		}
+		return nil
+	}
+
+	since, _, _ := ParseTransactionID(id)
+	err := j.ForEach(since, time.Time{}, func(entry *JournalEntry) error {
+		if entry.Type != JournalTransaction || entry.Transaction == nil {
+			return nil
+		}
+		if entry.Transaction.ID == id && t.ID == "" {
+			*t = *entry.Transaction
+		} else if entry.Transaction.Reverts == id {
+			*revertedBy = entry.Transaction.ID
+			return errStopSearching
+		}
+		return nil
+	})
+	if err == errStopSearching {
+		return nil
+	}
+	return err
+}
+
+// Looks up a transaction sent or received by the server with the specified
+// UID. Transactions that are no longer in the server's history or pending
+// transaction list can only be found if the journal is enabled. Returns nil
+// if the transaction can't be found.
+func LookupTransaction(db Database, uid, id string) (*TransactionStatus,
+	error) {
+	tr := BeginDbTransaction(db)
+	defer tr.Abort()
+	server, ok := tr.GetOneServer(uid)
+	if !ok {
+		return nil, nil
+	}
+
+	for _, t := range server.GetPendingTransactions() {
+		if t.ID == id {
+			return &TransactionStatus{t, TransactionPending, ""}, nil
+		}
+	}
+
+	// Reversals are always newer than the transaction they revert, and are
+	// added to the history of both the source and target servers.
+	var t Transaction
+	var revertedBy string
+	for _, t2 := range server.GetHistory() {
+		if t2.ID == id {
+			t = t2
+			break
+		} else if t2.Reverts == id {
+			revertedBy = t2.ID
+		}
+	}
+	tr.Abort()
+
+	if t.ID == "" || revertedBy == "" {
+		if j := GetJournal(); j != nil {
+			if err := searchJournal(j, id, &t, &revertedBy); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// Don't return transactions sent between other servers.
+	if t.ID == "" || (HomogeniseUsername(t.SourceServer) != uid &&
+		HomogeniseUsername(t.TargetServer) != uid) {
+		return nil, nil
+	}
+
+	if revertedBy != "" {
+		return &TransactionStatus{t, TransactionReverted, revertedBy}, nil
+	}
+
+	// Check whether the target server has acknowledged the transaction.
+	targetUID := HomogeniseUsername(t.TargetServer)
+	if targetUID != uid && t.Target != "" {
+		if target, ok := tr.GetOneServer(targetUID); ok {
+			for _, t2 := range target.GetPendingTransactions() {
+				if t2.ID == id {
+					return &TransactionStatus{t, TransactionPending, ""}, nil
+				}
+			}
+		}
+	}
+	return &TransactionStatus{t, TransactionAcknowledged, ""}, nil
+}
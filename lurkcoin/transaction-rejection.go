@@ -0,0 +1,154 @@
+//
+// lurkcoin transaction rejection
+// Copyright © 2020 by luk3yx
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package lurkcoin
+
+import "errors"
+
+// The result of rejecting a pending transaction.
+type RejectionResult struct {
+	// False if the transaction wasn't pending or couldn't be reverted, in
+	// which case it is still pending.
+	Rejected bool `json:"rejected"`
+
+	// The transaction that sent the amount back (if any).
+	Reversal *Transaction `json:"reversal,omitempty"`
+
+	// The error code if the transaction couldn't be rejected.
+	Error string `json:"error,omitempty"`
+}
+
+// Returns a copy of a pending transaction or nil if it isn't pending.
+func (self *Server) getPendingTransaction(id string) *Transaction {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	for _, transaction := range self.pendingTransactions {
+		if transaction.ID == id {
+			return &transaction
+		}
+	}
+	return nil
+}
+
+// Locks the server with the specified UID and the source servers of any of
+// the pending transactions being rejected. The servers have to be locked at
+// the same time to prevent deadlocks, so this retries if another transaction
+// is received in the meantime.
+func lockForRejection(db Database, uid string, ids []string,
+	logger *Logger) (*DatabaseTransaction, *Server, error) {
+	var sources []string
+	missing := make(map[string]bool)
+	for {
+		tr := BeginDbTransaction(db)
+		tr.SetLogger(logger)
+		servers, ok, badServer := tr.GetServers(append([]string{uid},
+			sources...)...)
+		if !ok {
+			tr.Abort()
+			badServer = HomogeniseUsername(badServer)
+			if badServer == uid || missing[badServer] {
+				return nil, nil, errors.New("ERR_SERVERNOTFOUND")
+			}
+
+			// The source server has been deleted.
+			missing[badServer] = true
+			for i, source := range sources {
+				if source == badServer {
+					sources = append(sources[:i], sources[i+1:]...)
+					break
+				}
+			}
+			continue
+		}
+
+		server := servers[0]
+		newSources := false
+		for _, id := range ids {
+			transaction := server.getPendingTransaction(id)
+			if transaction == nil || !transaction.Revertable {
+				continue
+			}
+			source := HomogeniseUsername(transaction.SourceServer)
+			if _, ok := tr.GetCachedServer(source); !ok && !missing[source] {
+				sources = append(sources, source)
+				newSources = true
+			}
+		}
+		if !newSources {
+			return tr, server, nil
+		}
+		tr.Abort()
+	}
+}
+
+// Rejects pending transactions sent to the server with the specified UID and
+// sends the received amount of revertable transactions back to their source
+// server. Transactions that can't be reverted (for example because the server
+// can no longer afford it) are left pending.
+func RejectTransactions(db Database, uid string, ids []string,
+	logger *Logger) (map[string]*RejectionResult, error) {
+	if IsReadOnly(db) {
+		return nil, ErrReadOnly
+	}
+
+	uid = HomogeniseUsername(uid)
+	tr, server, err := lockForRejection(db, uid, ids, logger)
+	if err != nil {
+		return nil, err
+	}
+	defer tr.Abort()
+
+	results := make(map[string]*RejectionResult, len(ids))
+	for _, id := range ids {
+		if results[id] != nil {
+			continue
+		}
+
+		transaction := server.getPendingTransaction(id)
+		if transaction == nil {
+			results[id] = &RejectionResult{
+				Error: "ERR_TRANSACTIONNOTFOUND",
+			}
+			continue
+		}
+
+		res := &RejectionResult{Rejected: true}
+		results[id] = res
+		source, ok := tr.GetCachedServer(transaction.SourceServer)
+		if transaction.Revertable && ok {
+			// To try and prevent exploits, the received amount is used and
+			// exchange rates are re-calculated.
+			// Note that the source and target get flipped here.
+			reversal, err := server.pay(transaction.Target,
+				transaction.Source, source, transaction.ReceivedAmount, true,
+				false, transaction.ID, nil, transaction.Currency)
+			if err != nil {
+				res.Rejected = false
+				res.Error, _, _ = LookupError(err.Error())
+				logger.Warning("Could not revert transaction",
+					"transaction_id", id, "error", err)
+				continue
+			}
+			res.Reversal = reversal
+		}
+		server.RemovePendingTransaction(id)
+	}
+
+	tr.Finish()
+	return results, nil
+}
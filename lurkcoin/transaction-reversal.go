@@ -0,0 +1,123 @@
+//
+// lurkcoin transaction reversal
+// Copyright © 2020 by luk3yx
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package lurkcoin
+
+import (
+	"errors"
+	"time"
+)
+
+// Returns true if a transaction that reverts id is in the server's history or
+// the journal.
+func (self *Server) hasBeenReverted(id string) (bool, error) {
+	for _, t := range self.GetHistory() {
+		if t.Reverts == id {
+			return true, nil
+		}
+	}
+
+	j := GetJournal()
+	if j == nil {
+		return false, nil
+	}
+	var t Transaction
+	var revertedBy string
+	err := searchJournal(j, id, &t, &revertedBy)
+	return revertedBy != "", err
+}
+
+// Reverts a revertable transaction received by the server with the specified
+// UID by sending the received amount back to its source server, even if it
+// has already been acknowledged. Only transactions made at or after since can
+// be reverted, a zero since allows all transactions to be reverted. The
+// transaction that sent the amount back is returned.
+func RevertTransaction(db Database, uid, id string, since time.Time,
+	logger *Logger) (*Transaction, error) {
+	if IsReadOnly(db) {
+		return nil, ErrReadOnly
+	}
+
+	uid = HomogeniseUsername(uid)
+	status, err := LookupTransaction(db, uid, id)
+	if err != nil {
+		return nil, err
+	} else if status == nil {
+		return nil, errors.New("ERR_TRANSACTIONNOTFOUND")
+	}
+
+	transaction := status.Transaction
+	if HomogeniseUsername(transaction.TargetServer) != uid ||
+		!transaction.Revertable || status.Status == TransactionReverted {
+		return nil, errors.New("ERR_CANNOTREVERT")
+	}
+	if transaction.GetTime().Before(since) {
+		return nil, errors.New("ERR_REVERTWINDOWEXPIRED")
+	}
+
+	// Pending transactions are rejected instead so that they're removed from
+	// the pending transaction list.
+	if status.Status == TransactionPending {
+		results, err := RejectTransactions(db, uid, []string{id}, logger)
+		if err != nil {
+			return nil, err
+		} else if res := results[id]; res.Error != "" {
+			return nil, errors.New(res.Error)
+		} else if res.Reversal == nil {
+			return nil, errors.New("ERR_CANNOTREVERT")
+		} else {
+			return res.Reversal, nil
+		}
+	}
+
+	tr := BeginDbTransaction(db)
+	defer tr.Abort()
+	tr.SetLogger(logger)
+	servers, ok, _ := tr.GetServers(uid, transaction.SourceServer)
+	if !ok {
+		return nil, errors.New("ERR_SOURCESERVERNOTFOUND")
+	}
+
+	// Make sure that the transaction wasn't reverted before the servers were
+	// locked.
+	if reverted, err := servers[0].hasBeenReverted(id); err != nil {
+		return nil, err
+	} else if reverted {
+		return nil, errors.New("ERR_CANNOTREVERT")
+	}
+
+	// Like with rejected transactions, the received amount is sent back and
+	// exchange rates are re-calculated. If the transaction was credited to a
+	// wallet, the amount is taken from that wallet.
+	var reversal *Transaction
+	if transaction.Target != "" && transaction.Currency == "" &&
+		servers[0].WalletsEnabled() {
+		reversal, err = servers[0].payFromWallet(transaction.Target,
+			transaction.Source, servers[1], transaction.ReceivedAmount, true,
+			false, id)
+	} else {
+		reversal, err = servers[0].pay(transaction.Target,
+			transaction.Source, servers[1], transaction.ReceivedAmount, true,
+			false, id, nil, transaction.Currency)
+	}
+	if err != nil {
+		return nil, err
+	}
+	tr.Finish()
+	return reversal, nil
+}
@@ -0,0 +1,155 @@
+//
+// lurkcoin transaction searches
+// Copyright © 2020 by luk3yx
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package lurkcoin
+
+import (
+	"errors"
+	"time"
+)
+
+// Transaction directions for TransactionFilter.
+const (
+	TransactionsSent     = "sent"
+	TransactionsReceived = "received"
+)
+
+// Filters for SearchTransactions, zero values match every transaction.
+type TransactionFilter struct {
+	Since, Until time.Time
+
+	// Only matches transactions sent to or received from this server.
+	Counterpart string
+
+	// TransactionsSent, TransactionsReceived or an empty string for both.
+	Direction string
+
+	// The minimum amount (in lurkcoins).
+	MinAmount Currency
+
+	// Only returns transactions made after the transaction with this ID,
+	// this is used to get the next page of results.
+	After string
+}
+
+// Returns true if transaction was sent or received by uid and matches the
+// filter.
+func (self *TransactionFilter) matches(uid string,
+	transaction *Transaction) bool {
+	t := transaction.GetTime()
+	if (!self.Since.IsZero() && t.Before(self.Since)) ||
+		(!self.Until.IsZero() && t.After(self.Until)) {
+		return false
+	}
+	if !self.MinAmount.IsNil() && transaction.Amount.Lt(self.MinAmount) {
+		return false
+	}
+
+	// Transactions between two users on the same server are both sent and
+	// received.
+	counterpart := HomogeniseUsername(self.Counterpart)
+	source := HomogeniseUsername(transaction.SourceServer)
+	target := HomogeniseUsername(transaction.TargetServer)
+	sent := source == uid && (counterpart == "" || target == counterpart)
+	received := target == uid && (counterpart == "" || source == counterpart)
+	switch self.Direction {
+	case TransactionsSent:
+		return sent
+	case TransactionsReceived:
+		return received
+	default:
+		return sent || received
+	}
+}
+
+// Used to stop iterating over the journal once enough transactions have
+// been found.
+var errEnoughTransactions = errors.New("enough transactions")
+
+// Returns up to limit transactions sent or received by the server with the
+// specified UID in chronological order, and true if there are more
+// transactions. If j is nil, the server's history is used instead, which
+// only has the last GetHistoryLength() transactions.
+func SearchTransactions(db Database, j Journal, uid string,
+	filter TransactionFilter, limit int) ([]Transaction, bool, error) {
+	since := filter.Since
+	var afterTime time.Time
+	if filter.After != "" {
+		var ok bool
+		afterTime, _, ok = ParseTransactionID(filter.After)
+		if !ok {
+			return nil, false, errors.New("ERR_INVALIDREQUEST")
+		}
+		if afterTime.After(since) {
+			since = afterTime
+		}
+	}
+
+	// Transactions made in the same second as the "after" transaction are
+	// skipped until it is found.
+	afterFound := filter.After == ""
+	var res []Transaction
+	more := false
+	add := func(transaction *Transaction) error {
+		if !afterFound {
+			if transaction.ID == filter.After {
+				afterFound = true
+				return nil
+			} else if !transaction.GetTime().After(afterTime) {
+				return nil
+			}
+		}
+		if !filter.matches(uid, transaction) {
+			return nil
+		}
+		if len(res) >= limit {
+			more = true
+			return errEnoughTransactions
+		}
+		res = append(res, *transaction)
+		return nil
+	}
+
+	if j == nil {
+		tr := BeginDbTransaction(db)
+		defer tr.Abort()
+		server, ok := tr.GetOneServer(uid)
+		if !ok {
+			return nil, false, errors.New("ERR_SERVERNOTFOUND")
+		}
+		history := server.GetHistory()
+		tr.Abort()
+		for i := len(history) - 1; i >= 0; i-- {
+			if add(&history[i]) != nil {
+				break
+			}
+		}
+		return res, more, nil
+	}
+
+	err := j.ForEach(since, filter.Until, func(entry *JournalEntry) error {
+		if entry.Type == JournalTransaction && entry.Transaction != nil {
+			return add(entry.Transaction)
+		}
+		return nil
+	})
+	if err != nil && err != errEnoughTransactions {
+		return nil, false, err
+	}
+	return res, more, nil
+}
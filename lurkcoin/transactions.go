@@ -22,6 +22,8 @@ import (
 	"fmt"
 	"math/big"
 	"math/rand"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -40,15 +42,47 @@ type Transaction struct {
 	// If true lurkcoin will attempt to revert the transaction if it is
 	// rejected. The transaction can still be rejected if this is false.
 	Revertable bool `json:"revertable"`
+
+	// The ID of the transaction that this transaction reverts (if any).
+	Reverts string `json:"reverts,omitempty"`
+
+	// The global IDs of the source and target users, if they are registered
+	// with the global username registry.
+	SourceID string `json:"source_id,omitempty"`
+	TargetID string `json:"target_id,omitempty"`
+
+	// The fee (in lurkcoins) deducted from the amount before it was sent to
+	// the target server, if any.
+	Fee *Currency `json:"fee,omitempty"`
+
+	// If this transaction credits a fee to the treasury server, this is the
+	// ID of the transaction the fee was charged on.
+	FeeFor string `json:"fee_for,omitempty"`
+
+	// The currency the transaction was made in, this is empty for the
+	// primary currency.
+	Currency string `json:"currency,omitempty"`
 }
 
 func (self Transaction) String() string {
+	amount := self.Amount.String()
+	if self.Currency != "" {
+		amount += " " + self.Currency
+	}
 	return fmt.Sprintf("[%s] %s (sent %s, received %s) - Transaction from %q"+
-		" on %q to %q on %q.", self.ID, self.Amount,
+		" on %q to %q on %q.", self.ID, amount,
 		self.SentAmount.RawString(), self.ReceivedAmount.RawString(),
 		self.Source, self.SourceServer, self.Target, self.TargetServer)
 }
 
+// Returns the amount (in lurkcoins) that the target server received.
+func (self Transaction) netAmount() Currency {
+	if self.Fee == nil {
+		return self.Amount
+	}
+	return self.Amount.Sub(*self.Fee)
+}
+
 // Get a time.Time object from the transaction's Time attribute.
 func (self Transaction) GetTime() time.Time {
 	return time.Unix(self.Time, 0)
@@ -97,9 +131,28 @@ func GenerateTransactionID() (string, int64) {
 	return fmt.Sprintf("T%X-%08X", t, id), t
 }
 
+// Decodes a transaction ID created by GenerateTransactionID(), returning the
+// time the transaction was made and the random part of the ID.
+func ParseTransactionID(id string) (time.Time, uint32, bool) {
+	parts := strings.SplitN(id, "-", 2)
+	if len(parts) != 2 || len(parts[0]) < 2 || parts[0][0] != 'T' ||
+		len(parts[1]) != 8 {
+		return time.Time{}, 0, false
+	}
+	t, err := strconv.ParseInt(parts[0][1:], 16, 64)
+	if err != nil {
+		return time.Time{}, 0, false
+	}
+	n, err := strconv.ParseUint(parts[1], 16, 32)
+	if err != nil {
+		return time.Time{}, 0, false
+	}
+	return time.Unix(t, 0), uint32(n), true
+}
+
 func MakeTransaction(source, sourceServer, target, targetServer string,
 	amount, sentAmount, receivedAmount Currency) Transaction {
 	id, time := GenerateTransactionID()
 	return Transaction{id, source, sourceServer, target, targetServer, amount,
-		sentAmount, receivedAmount, time, false}
+		sentAmount, receivedAmount, time, false, "", "", "", nil, "", ""}
 }
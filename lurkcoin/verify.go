@@ -0,0 +1,406 @@
+//
+// lurkcoin
+// Copyright © 2020 by luk3yx
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package lurkcoin
+
+import (
+	"fmt"
+	"math/big"
+	"sort"
+	"time"
+)
+
+// A problem found by VerifyDatabase().
+type Discrepancy struct {
+	// The server UID, empty if the problem isn't specific to a server.
+	Server  string `json:"server,omitempty"`
+	Problem string `json:"problem"`
+
+	// Warnings may be false positives.
+	Warning bool `json:"warning,omitempty"`
+}
+
+func (self Discrepancy) String() string {
+	res := self.Problem
+	if self.Warning {
+		res = "Warning: " + res
+	}
+	if self.Server != "" {
+		res = self.Server + ": " + res
+	}
+	return res
+}
+
+// Parses RawString() output without the rounding errors that ParseCurrency()
+// may introduce.
+func parseExactCurrency(s string) (Currency, bool) {
+	r, ok := new(big.Rat).SetString(s)
+	if !ok {
+		return Currency{}, false
+	}
+	r.Mul(r, new(big.Rat).SetInt(getPrecision().scale))
+	if !r.IsInt() {
+		return Currency{}, false
+	}
+	return Currency{new(big.Int).Set(r.Num())}, true
+}
+
+type serverVerifier struct {
+	discrepancies []Discrepancy
+	transactions  map[string]Transaction
+	foundIn       map[string]string
+
+	// Aliases of renamed servers, transactions made before a server was
+	// renamed have its old name.
+	aliases map[string]string
+}
+
+// Returns the UID of the server called name, following aliases.
+func (self *serverVerifier) resolve(name string) string {
+	uid := HomogeniseUsername(name)
+	for depth := 0; depth <= maxAliasDepth; depth++ {
+		target, ok := self.aliases[uid]
+		if !ok {
+			break
+		}
+		uid = target
+	}
+	return uid
+}
+
+// Loads aliases from db and checks that they all point to a server.
+func (self *serverVerifier) loadAliases(db Database) error {
+	uids := make(map[string]bool)
+	err := db.ForEachEncoded(func(encodedServer *EncodedServer) error {
+		uid := HomogeniseUsername(encodedServer.Name)
+		if encodedServer.AliasOf == "" {
+			uids[uid] = true
+		} else {
+			self.aliases[uid] = encodedServer.AliasOf
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for alias := range self.aliases {
+		if !uids[self.resolve(alias)] {
+			self.report(alias, "The alias does not point to a server.")
+		}
+	}
+	return nil
+}
+
+func (self *serverVerifier) report(server, format string, args ...interface{}) {
+	self.discrepancies = append(self.discrepancies,
+		Discrepancy{server, fmt.Sprintf(format, args...), false})
+}
+
+func (self *serverVerifier) warn(server, format string, args ...interface{}) {
+	self.discrepancies = append(self.discrepancies,
+		Discrepancy{server, fmt.Sprintf(format, args...), true})
+}
+
+func (self *serverVerifier) checkTransaction(server *Server,
+	transaction Transaction, pending bool) {
+	id := transaction.ID
+	t, _, ok := ParseTransactionID(id)
+	if !ok {
+		self.report(server.UID, "Transaction %q has an invalid ID.", id)
+	} else if t.Unix() != transaction.Time {
+		self.report(server.UID, "The time of transaction %q does not "+
+			"match its ID.", id)
+	}
+	if transaction.Amount.IsNil() || !transaction.Amount.GtZero() {
+		self.report(server.UID, "Transaction %q has an invalid amount.", id)
+	}
+
+	if pending {
+		if self.resolve(transaction.TargetServer) != server.UID {
+			self.report(server.UID, "Pending transaction %q is not sent to "+
+				"this server.", id)
+		}
+		return
+	}
+	if self.resolve(transaction.SourceServer) != server.UID &&
+		self.resolve(transaction.TargetServer) != server.UID {
+		self.report(server.UID, "Transaction %q in the history does not "+
+			"involve this server.", id)
+	}
+
+	// Both servers involved in a transaction should have the same record of
+	// it.
+	if other, exists := self.transactions[id]; !exists {
+		self.transactions[id] = transaction
+		self.foundIn[id] = server.UID
+	} else if other.String() != transaction.String() ||
+		other.Time != transaction.Time {
+		self.report(server.UID, "Transaction %q does not match the copy "+
+			"in %q's history.", id, self.foundIn[id])
+	}
+}
+
+// Checks a single server. Returns the balance calculated from the server's
+// history, or nil if the history is incomplete.
+func (self *serverVerifier) checkServer(server *Server) *Currency {
+	balance := server.GetBalance()
+	creditLimit := server.GetCreditLimit()
+	if balance.IsNil() || balance.Lt(creditLimit.Neg()) {
+		if creditLimit.IsZero() {
+			self.report(server.UID, "The balance (%s) is negative.", balance)
+		} else {
+			self.report(server.UID, "The balance (%s) exceeds the credit "+
+				"limit (%s).", balance, creditLimit)
+		}
+	}
+	if server.UID != HomogeniseUsername(server.Name) {
+		self.report(server.UID, "The server name %q does not match its UID.",
+			server.Name)
+	}
+
+	history := server.GetHistory()
+	seen := make(map[string]bool, len(history))
+	calculated := CurrencyFromInt64(0)
+	for i, transaction := range history {
+		if seen[transaction.ID] {
+			self.report(server.UID, "Transaction %q is in the history "+
+				"twice.", transaction.ID)
+		}
+		seen[transaction.ID] = true
+		if i > 0 && transaction.Time > history[i-1].Time {
+			self.report(server.UID, "The history is not in chronological "+
+				"order.")
+		}
+		self.checkTransaction(server, transaction, false)
+
+		// Only balances in the primary currency are checked.
+		if transaction.Currency != "" {
+			continue
+		}
+
+		// Payments a server sends to itself don't change its balance.
+		if self.resolve(transaction.TargetServer) == server.UID {
+			calculated = calculated.Add(transaction.netAmount())
+		}
+		if self.resolve(transaction.SourceServer) == server.UID {
+			calculated = calculated.Sub(transaction.Amount)
+		}
+	}
+
+	for _, transaction := range server.GetPendingTransactions() {
+		self.checkTransaction(server, transaction, true)
+	}
+
+	// Histories are truncated to GetHistoryLength() transactions, if there
+	// are fewer the history is complete. Histories may have been truncated
+	// to 10 transactions before the history length was increased.
+	length := GetHistoryLength()
+	if length > 10 {
+		length = 10
+	}
+	if len(history) >= length {
+		return nil
+	}
+	return &calculated
+}
+
+// Replays balance changes recorded in the journal. Servers that existed
+// before the journal was enabled are ignored.
+func (self *serverVerifier) replayJournal(j Journal) (map[string]Currency,
+	map[string]bool, error) {
+	balances := make(map[string]Currency)
+	deletedBalances := make(map[string]Currency)
+	adminChanged := make(map[string]bool)
+	err := j.ForEach(time.Time{}, time.Time{}, func(entry *JournalEntry) error {
+		switch entry.Type {
+		case JournalAdminAction:
+			uid := HomogeniseUsername(entry.Server)
+			switch entry.Action {
+			case "create_server":
+				balances[uid] = CurrencyFromInt64(0)
+			case "delete_server":
+				// Deleted servers may be undeleted later on.
+				if balance, ok := balances[uid]; ok {
+					deletedBalances[uid] = balance
+					delete(balances, uid)
+				}
+			case "undelete_server":
+				if balance, ok := deletedBalances[uid]; ok {
+					balances[uid] = balance
+					delete(deletedBalances, uid)
+				}
+			case "purge_server":
+				delete(deletedBalances, uid)
+			case "rename_server":
+				newUID := HomogeniseUsername(entry.Value)
+				if balance, ok := balances[uid]; ok {
+					balances[newUID] = balance
+					delete(balances, uid)
+				}
+				if adminChanged[uid] {
+					adminChanged[newUID] = true
+				}
+			case "set_balance":
+				adminChanged[uid] = true
+				if balance, ok := parseExactCurrency(entry.Value); ok {
+					balances[uid] = balance
+				} else {
+					self.report(uid, "Invalid balance %q in the journal.",
+						entry.Value)
+				}
+			}
+		case JournalTransaction:
+			t := entry.Transaction
+			if t == nil || t.Currency != "" {
+				return nil
+			}
+			source := HomogeniseUsername(t.SourceServer)
+			target := HomogeniseUsername(t.TargetServer)
+			// Fees are taken from the source server when the original
+			// transaction is made.
+			if balance, ok := balances[source]; ok && t.FeeFor == "" {
+				balances[source] = balance.Sub(t.Amount)
+			}
+			if balance, ok := balances[target]; ok {
+				balances[target] = balance.Add(t.netAmount())
+			}
+		}
+		return nil
+	})
+	return balances, adminChanged, err
+}
+
+// The expected balances of a server. HistoryBalance is nil if the server's
+// history is incomplete and JournalBalance is nil if the server was created
+// before the journal was enabled.
+type ServerAudit struct {
+	Server         string    `json:"server"`
+	Balance        Currency  `json:"balance"`
+	HistoryBalance *Currency `json:"history_balance,omitempty"`
+	JournalBalance *Currency `json:"journal_balance,omitempty"`
+
+	// True if the balance was changed on the admin pages.
+	AdminChanged bool `json:"admin_changed,omitempty"`
+}
+
+// Returns true if either of the expected balances doesn't match the balance.
+func (self ServerAudit) Mismatched() bool {
+	return (self.HistoryBalance != nil &&
+		!self.HistoryBalance.Eq(self.Balance)) ||
+		(self.JournalBalance != nil && !self.JournalBalance.Eq(self.Balance))
+}
+
+type AuditReport struct {
+	Servers       []ServerAudit `json:"servers"`
+	TotalBalance  Currency      `json:"total_balance"`
+	Discrepancies []Discrepancy `json:"discrepancies"`
+}
+
+// Checks the database for inconsistencies. If j is not nil, balances are
+// also reconciled against the journal.
+func VerifyDatabase(db Database, j Journal) ([]Discrepancy, error) {
+	report, err := AuditDatabase(db, j)
+	if err != nil {
+		return nil, err
+	}
+	return report.Discrepancies, nil
+}
+
+// Like VerifyDatabase, but also returns the expected balance of every server.
+func AuditDatabase(db Database, j Journal) (*AuditReport, error) {
+	verifier := &serverVerifier{
+		transactions: make(map[string]Transaction),
+		foundIn:      make(map[string]string),
+		aliases:      make(map[string]string),
+	}
+	if err := verifier.loadAliases(db); err != nil {
+		return nil, err
+	}
+
+	var journalBalances map[string]Currency
+	var adminChanged map[string]bool
+	if j != nil {
+		var err error
+		journalBalances, adminChanged, err = verifier.replayJournal(j)
+		if err != nil {
+			return nil, err
+		}
+
+		if fj, ok := j.(*FileJournal); ok {
+			report, err := fj.VerifyChain("")
+			if err != nil {
+				return nil, err
+			}
+			verifier.discrepancies = append(verifier.discrepancies,
+				report.Problems...)
+		}
+	}
+
+	report := &AuditReport{TotalBalance: CurrencyFromInt64(0)}
+	tr := BeginDbTransaction(db)
+	defer tr.Abort()
+	err := tr.ForEach(func(server *Server) error {
+		calculated := verifier.checkServer(server)
+		balance := server.GetBalance()
+		audit := ServerAudit{
+			Server:         server.Name,
+			Balance:        balance,
+			HistoryBalance: calculated,
+			AdminChanged:   adminChanged[server.UID],
+		}
+		if !balance.IsNil() {
+			report.TotalBalance = report.TotalBalance.Add(balance)
+		}
+
+		// Reconcile the balance with the history. Balances changed on the
+		// admin pages won't match the history, so this is only a warning
+		// unless the journal has every balance change since the server was
+		// created.
+		if calculated != nil && !adminChanged[server.UID] &&
+			!calculated.Eq(balance) {
+			msg := "The balance (%s) does not match the history (%s)."
+			if _, ok := journalBalances[server.UID]; ok {
+				verifier.report(server.UID, msg, balance, *calculated)
+			} else {
+				verifier.warn(server.UID, msg+" The balance may have been "+
+					"changed on the admin pages.", balance, *calculated)
+			}
+		}
+
+		if expected, ok := journalBalances[server.UID]; ok {
+			audit.JournalBalance = &expected
+			if !expected.Eq(balance) {
+				verifier.report(server.UID, "The balance (%s) does not "+
+					"match the journal (%s).", balance, expected)
+			}
+		}
+		report.Servers = append(report.Servers, audit)
+		return nil
+	}, false)
+	tr.Abort()
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(verifier.discrepancies, func(i, k int) bool {
+		return verifier.discrepancies[i].Server <
+			verifier.discrepancies[k].Server
+	})
+	report.Discrepancies = verifier.discrepancies
+	return report, nil
+}
@@ -0,0 +1,129 @@
+//
+// lurkcoin user wallets
+// Copyright © 2020 by luk3yx
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package lurkcoin
+
+import "errors"
+
+// Servers can have lurkcoin keep track of their users' balances. Wallet
+// balances are in lurkcoins and are part of the server's balance, so the
+// total of all wallets can never exceed it.
+
+// Returns true if payments to users on this server are credited to their
+// wallets instead of being added to the pending transaction list.
+func (self *Server) WalletsEnabled() bool {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	return self.walletsEnabled
+}
+
+// Enables or disables user wallets. Existing wallets are kept (and can still
+// be spent from) if wallets are disabled.
+func (self *Server) SetWalletsEnabled(enabled bool) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.walletsEnabled = enabled
+	self.modified = true
+	self.queueSettingsEvent("user_wallets")
+}
+
+// Gets the balance of a user's wallet, this is zero if the user doesn't have
+// a wallet.
+func (self *Server) GetWalletBalance(user string) Currency {
+	user, _ = PasteuriseUsername(user)
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	if balance, ok := self.wallets[user]; ok {
+		return balance
+	}
+	return CurrencyFromInt64(0)
+}
+
+// Returns the number of users with a wallet.
+func (self *Server) GetWalletCount() int {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	return len(self.wallets)
+}
+
+// Changes the balance of a user's wallet, returns false if the user can't
+// afford it. Empty wallets are removed.
+func (self *Server) changeWalletBal(user string, num Currency) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	newBalance := num
+	if balance, ok := self.wallets[user]; ok {
+		newBalance = balance.Add(num)
+	}
+	if newBalance.LtZero() {
+		return false
+	}
+
+	if self.wallets == nil {
+		self.wallets = make(map[string]Currency)
+	}
+	if newBalance.IsZero() {
+		delete(self.wallets, user)
+	} else {
+		self.wallets[user] = newBalance
+	}
+	self.modified = true
+	return true
+}
+
+// Credits a payment to a user's wallet if wallets are enabled.
+func (self *Server) creditWallet(user string, amount Currency) {
+	if user != "" && self.WalletsEnabled() {
+		self.changeWalletBal(user, amount)
+	}
+}
+
+// Sends a payment from a user's wallet.
+func (self *Server) PayFromWallet(source, target string,
+	targetServer *Server, sentAmount Currency,
+	localCurrency bool) (*Transaction, error) {
+	return self.payFromWallet(source, target, targetServer, sentAmount,
+		localCurrency, true, "")
+}
+
+func (self *Server) payFromWallet(source, target string,
+	targetServer *Server, sentAmount Currency, localCurrency bool,
+	revertable bool, reverts string) (*Transaction, error) {
+	source, _ = PasteuriseUsername(source)
+	if source == "" {
+		return nil, errors.New("ERR_INVALIDREQUEST")
+	}
+
+	// Make sure the user can afford the payment before sending it, pay()
+	// calculates the amount in lurkcoins the same way.
+	amount := sentAmount
+	if localCurrency {
+		amount, _ = self.GetExchangeRate(sentAmount, true)
+	}
+	if self.GetWalletBalance(source).Lt(amount) {
+		return nil, errors.New("ERR_CANNOTAFFORD")
+	}
+
+	transaction, err := self.pay(source, target, targetServer, sentAmount,
+		localCurrency, revertable, reverts, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	self.changeWalletBal(source, transaction.Amount.Neg())
+	return transaction, nil
+}
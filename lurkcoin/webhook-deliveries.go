@@ -0,0 +1,83 @@
+//
+// lurkcoin webhook delivery log
+// Copyright © 2020 by luk3yx
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package lurkcoin
+
+import (
+	"sync"
+	"time"
+)
+
+// The number of delivery attempts kept for each server. The log is only
+// kept in memory.
+const webhookDeliveryLogLength = 25
+
+// A single attempt to deliver a webhook request.
+type WebhookDelivery struct {
+	Time       int64  `json:"time"`
+	URL        string `json:"url"`
+	DeliveryID string `json:"delivery_id,omitempty"`
+	Attempt    int    `json:"attempt"`
+	StatusCode int    `json:"status_code,omitempty"`
+
+	// In seconds.
+	Latency float64 `json:"latency"`
+
+	// Network errors, or the reason the delivery was skipped.
+	Error string `json:"error,omitempty"`
+}
+
+func (self WebhookDelivery) GetTime() time.Time {
+	return time.Unix(self.Time, 0)
+}
+
+var webhookDeliveryLogLock sync.Mutex
+var webhookDeliveryLog = make(map[string][]WebhookDelivery)
+
+func recordWebhookDelivery(uid string, delivery WebhookDelivery) {
+	if uid == "" {
+		return
+	}
+	webhookDeliveryLogLock.Lock()
+	defer webhookDeliveryLogLock.Unlock()
+	log := append(webhookDeliveryLog[uid], delivery)
+	if len(log) > webhookDeliveryLogLength {
+		log = append([]WebhookDelivery(nil),
+			log[len(log)-webhookDeliveryLogLength:]...)
+	}
+	webhookDeliveryLog[uid] = log
+}
+
+// Returns recent webhook delivery attempts for a server, newest first.
+func GetWebhookDeliveries(uid string) []WebhookDelivery {
+	webhookDeliveryLogLock.Lock()
+	defer webhookDeliveryLogLock.Unlock()
+	log := webhookDeliveryLog[HomogeniseUsername(uid)]
+	res := make([]WebhookDelivery, len(log))
+	for i, delivery := range log {
+		res[len(log)-i-1] = delivery
+	}
+	return res
+}
+
+// Removes the delivery log of a deleted server.
+func clearWebhookDeliveries(uid string) {
+	webhookDeliveryLogLock.Lock()
+	defer webhookDeliveryLogLock.Unlock()
+	delete(webhookDeliveryLog, uid)
+}
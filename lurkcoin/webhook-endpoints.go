@@ -0,0 +1,238 @@
+//
+// lurkcoin webhook endpoints
+// Copyright © 2020 by luk3yx
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package lurkcoin
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+// Events that webhook endpoints can subscribe to.
+const (
+	WebhookEventTransaction      = "transaction"
+	WebhookEventBalance          = "balance"
+	WebhookEventTokenRegenerated = "token_regenerated"
+	WebhookEventSettings         = "settings"
+)
+
+var WebhookEvents = []string{WebhookEventTransaction, WebhookEventBalance,
+	WebhookEventTokenRegenerated, WebhookEventSettings}
+
+// The maximum number of webhook endpoints per server (not including the
+// webhook URL).
+const MaxWebhookEndpoints = 5
+
+// A webhook endpoint, unlike the webhook URL these receive version 1 requests
+// for every event they're subscribed to.
+type WebhookEndpoint struct {
+	ID     string   `json:"id"`
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+}
+
+func (self *WebhookEndpoint) subscribedTo(event string) bool {
+	for _, e := range self.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// Events are queued until the DatabaseTransaction is committed so that
+// aborted changes don't get sent, and so that several changes in the same
+// transaction only send one request per event.
+type queuedWebhookEvents struct {
+	transactions     []Transaction
+	balance          bool
+	tokenRegenerated bool
+	settings         []string
+}
+
+// Returns the queued events, or nil if the server has no webhook endpoints.
+// The server must be locked.
+func (self *Server) queuedWebhookEvents() *queuedWebhookEvents {
+	if len(self.webhooks) == 0 {
+		return nil
+	}
+	if self.webhookEvents == nil {
+		self.webhookEvents = &queuedWebhookEvents{}
+	}
+	return self.webhookEvents
+}
+
+// Records that a setting has changed. The server must be locked.
+func (self *Server) queueSettingsEvent(setting string) {
+	events := self.queuedWebhookEvents()
+	if events == nil {
+		return
+	}
+	for _, s := range events.settings {
+		if s == setting {
+			return
+		}
+	}
+	events.settings = append(events.settings, setting)
+}
+
+// Sends any queued events to the webhook endpoints (if save is true) and
+// clears them.
+func (self *Server) flushWebhookEvents(save bool) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	events := self.webhookEvents
+	self.webhookEvents = nil
+	if events == nil || !save || self.readOnly {
+		return
+	}
+
+	var payloads []webhookPayloadV1
+	if len(events.transactions) > 0 {
+		payloads = append(payloads, webhookPayloadV1{
+			Event:        WebhookEventTransaction,
+			Transactions: events.transactions,
+			PendingCount: len(self.pendingTransactions),
+		})
+	}
+	if events.balance {
+		balance := self.balance
+		var balances map[string]Currency
+		if len(self.balances) > 0 {
+			balances = make(map[string]Currency, len(self.balances))
+			for currency, b := range self.balances {
+				balances[currency] = b.balance
+			}
+		}
+		payloads = append(payloads, webhookPayloadV1{
+			Event:    WebhookEventBalance,
+			Balance:  &balance,
+			Balances: balances,
+		})
+	}
+	if events.tokenRegenerated {
+		payloads = append(payloads, webhookPayloadV1{
+			Event: WebhookEventTokenRegenerated,
+		})
+	}
+	if len(events.settings) > 0 {
+		payloads = append(payloads, webhookPayloadV1{
+			Event:    WebhookEventSettings,
+			Settings: events.settings,
+		})
+	}
+
+	for _, endpoint := range self.webhooks {
+		for _, payload := range payloads {
+			if !endpoint.subscribedTo(payload.Event) {
+				continue
+			}
+			payload.Version = 1
+			payload.DeliveryID = newWebhookDeliveryID()
+			payload.Server = self.Name
+			raw, err := json.Marshal(payload)
+			if err != nil {
+				continue
+			}
+			queueWebhook(webhookRequest{self.UID, endpoint.URL, raw,
+				payload.DeliveryID, self.webhookSecret})
+		}
+	}
+}
+
+func copyWebhooks(webhooks []WebhookEndpoint) []WebhookEndpoint {
+	if len(webhooks) == 0 {
+		return nil
+	}
+	res := make([]WebhookEndpoint, len(webhooks))
+	for i, endpoint := range webhooks {
+		res[i] = WebhookEndpoint{endpoint.ID, endpoint.URL,
+			append([]string(nil), endpoint.Events...)}
+	}
+	return res
+}
+
+// Returns a copy of the server's webhook endpoints.
+func (self *Server) GetWebhooks() []WebhookEndpoint {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	return copyWebhooks(self.webhooks)
+}
+
+// Validates a list of events and removes duplicates.
+func validateWebhookEvents(events []string) ([]string, bool) {
+	res := make([]string, 0, len(events))
+	seen := make(map[string]bool, len(events))
+	for _, event := range events {
+		valid := false
+		for _, e := range WebhookEvents {
+			valid = valid || e == event
+		}
+		if !valid {
+			return nil, false
+		}
+		if !seen[event] {
+			seen[event] = true
+			res = append(res, event)
+		}
+	}
+	return res, len(res) > 0
+}
+
+// Adds a webhook endpoint subscribed to events. A webhook secret is
+// generated if the server doesn't have one.
+func (self *Server) AddWebhook(webhookURL string,
+	events []string) (WebhookEndpoint, error) {
+	webhookURL, ok := ValidateWebhookURL(webhookURL)
+	if !ok {
+		return WebhookEndpoint{}, errors.New("ERR_INVALIDWEBHOOKURL")
+	}
+	events, ok = validateWebhookEvents(events)
+	if !ok {
+		return WebhookEndpoint{}, errors.New("ERR_INVALIDWEBHOOKEVENT")
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if len(self.webhooks) >= MaxWebhookEndpoints {
+		return WebhookEndpoint{}, errors.New("ERR_TOOMANYWEBHOOKS")
+	}
+	if self.webhookSecret == "" {
+		self.webhookSecret = generateWebhookSecret()
+	}
+	endpoint := WebhookEndpoint{randomHex(8), webhookURL, events}
+	self.webhooks = append(self.webhooks, endpoint)
+	self.modified = true
+	self.queueSettingsEvent("webhooks")
+	return endpoint, nil
+}
+
+// Removes a webhook endpoint, returns false if it doesn't exist.
+func (self *Server) RemoveWebhook(id string) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for i, endpoint := range self.webhooks {
+		if endpoint.ID == id {
+			self.webhooks = append(self.webhooks[:i], self.webhooks[i+1:]...)
+			self.modified = true
+			self.queueSettingsEvent("webhooks")
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,269 @@
+//
+// lurkcoin webhook URL restrictions
+// Copyright © 2020 by luk3yx
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package lurkcoin
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Restrictions on the webhook URLs that servers can use.
+type WebhookURLPolicy struct {
+	// If true, paths and query strings are kept instead of appending
+	// "/lurkcoin" to the path.
+	AllowAnyPath bool
+
+	// The allowed URL schemes, http and https if empty.
+	Schemes []string
+
+	// Hostnames, entries starting with "." also match subdomains. If
+	// AllowedHosts isn't empty, only those hosts can be used.
+	AllowedHosts []string
+	DeniedHosts  []string
+
+	// Blocks connections to loopback, private and link-local addresses.
+	BlockPrivateIPs bool
+
+	// Blocks connections to the addresses of this machine's network
+	// interfaces.
+	BlockOwnAddresses bool
+
+	// Additional networks (in CIDR notation) to block.
+	BlockedNetworks []string
+
+	blockedNetworks []*net.IPNet
+}
+
+var webhookURLPolicyLock sync.RWMutex
+
+// Private and own addresses are blocked unless SetWebhookURLPolicy() is
+// called with a policy that allows them.
+var webhookURLPolicy = WebhookURLPolicy{
+	BlockPrivateIPs:   true,
+	BlockOwnAddresses: true,
+}
+
+func GetWebhookURLPolicy() WebhookURLPolicy {
+	webhookURLPolicyLock.RLock()
+	defer webhookURLPolicyLock.RUnlock()
+	return webhookURLPolicy
+}
+
+func SetWebhookURLPolicy(policy WebhookURLPolicy) error {
+	policy.blockedNetworks = nil
+	for _, cidr := range policy.BlockedNetworks {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return err
+		}
+		policy.blockedNetworks = append(policy.blockedNetworks, network)
+	}
+	for i, scheme := range policy.Schemes {
+		scheme = strings.ToLower(scheme)
+		if scheme != "http" && scheme != "https" {
+			return errors.New("Unsupported webhook URL scheme: " + scheme)
+		}
+		policy.Schemes[i] = scheme
+	}
+	webhookURLPolicyLock.Lock()
+	defer webhookURLPolicyLock.Unlock()
+	webhookURLPolicy = policy
+	return nil
+}
+
+func (self *WebhookURLPolicy) allowsScheme(scheme string) bool {
+	if len(self.Schemes) == 0 {
+		return scheme == "http" || scheme == "https"
+	}
+	for _, s := range self.Schemes {
+		if s == scheme {
+			return true
+		}
+	}
+	return false
+}
+
+func hostMatches(host string, patterns []string) bool {
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		if host == pattern || host == strings.TrimPrefix(pattern, ".") ||
+			(strings.HasPrefix(pattern, ".") &&
+				strings.HasSuffix(host, pattern)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (self *WebhookURLPolicy) allowsHost(host string) bool {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if host == "" || hostMatches(host, self.DeniedHosts) {
+		return false
+	}
+	if len(self.AllowedHosts) > 0 && !hostMatches(host, self.AllowedHosts) {
+		return false
+	}
+	if self.BlockPrivateIPs &&
+		(host == "localhost" || strings.HasSuffix(host, ".localhost")) {
+		return false
+	}
+	if ip := net.ParseIP(host); ip != nil && self.blocksIP(ip) {
+		return false
+	}
+	return true
+}
+
+// Returns true if IP addresses have to be checked.
+func (self *WebhookURLPolicy) checksIPs() bool {
+	return self.BlockPrivateIPs || self.BlockOwnAddresses ||
+		len(self.blockedNetworks) > 0
+}
+
+func (self *WebhookURLPolicy) blocksIP(ip net.IP) bool {
+	if self.BlockPrivateIPs && isPrivateIP(ip) {
+		return true
+	}
+	for _, network := range self.blockedNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return self.BlockOwnAddresses && isOwnIP(ip)
+}
+
+var privateNetworks []*net.IPNet
+
+func init() {
+	for _, cidr := range []string{"0.0.0.0/8", "10.0.0.0/8",
+		"100.64.0.0/10", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7"} {
+		_, network, _ := net.ParseCIDR(cidr)
+		privateNetworks = append(privateNetworks, network)
+	}
+}
+
+func isPrivateIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsUnspecified() {
+		return true
+	}
+	for _, network := range privateNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if ip is assigned to one of this machine's network interfaces
+// (or is unspecified, which connects to this machine).
+func isOwnIP(ip net.IP) bool {
+	if ip.IsUnspecified() || ip.IsLoopback() {
+		return true
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if network, ok := addr.(*net.IPNet); ok && network.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+var errWebhookAddressBlocked = errors.New("Connections to this address " +
+	"are not allowed.")
+
+// Checks the address that webhook requests actually connect to, so that
+// hostnames can't resolve to private addresses.
+func webhookDialControl(_, address string, _ syscall.RawConn) error {
+	policy := GetWebhookURLPolicy()
+	if !policy.checksIPs() {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || policy.blocksIP(ip) {
+		return errWebhookAddressBlocked
+	}
+	return nil
+}
+
+// HTTP(S)_PROXY is ignored if any addresses are blocked, since
+// webhookDialControl would only see the proxy's address.
+func webhookProxy(req *http.Request) (*url.URL, error) {
+	policy := GetWebhookURLPolicy()
+	if policy.checksIPs() {
+		return nil, nil
+	}
+	return http.ProxyFromEnvironment(req)
+}
+
+// Resolves the host in a webhook URL (which should have been validated with
+// ValidateWebhookURL) and returns false if any of its addresses are blocked,
+// so that blocked URLs are rejected when they're set instead of failing
+// every delivery. Hosts that can't be resolved are allowed, since connections
+// are checked again when webhooks are sent.
+func CheckWebhookURLAddresses(webhookURL string) bool {
+	policy := GetWebhookURLPolicy()
+	if !policy.checksIPs() {
+		return true
+	}
+	u, err := url.Parse(webhookURL)
+	if err != nil {
+		return false
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, u.Hostname())
+	if err != nil {
+		return true
+	}
+	for _, addr := range addrs {
+		if policy.blocksIP(addr.IP) {
+			return false
+		}
+	}
+	return true
+}
+
+// Redirects must also be allowed by the policy.
+func checkWebhookRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return errors.New("Too many redirects.")
+	}
+	policy := GetWebhookURLPolicy()
+	if !policy.allowsScheme(req.URL.Scheme) ||
+		!policy.allowsHost(req.URL.Hostname()) {
+		return errWebhookAddressBlocked
+	}
+	return nil
+}
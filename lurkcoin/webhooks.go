@@ -0,0 +1,412 @@
+//
+// lurkcoin
+// Copyright © 2020 by luk3yx
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+
+package lurkcoin
+
+import (
+	"bytes"
+	"crypto/hmac"
+	crypto_rand "crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/luk3yx/lurkcoin-core/lurkcoin/metrics"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var webhookClient = &http.Client{
+	Timeout: time.Second * 5,
+	Transport: &http.Transport{
+		Proxy: webhookProxy,
+		DialContext: (&net.Dialer{
+			Timeout:   5 * time.Second,
+			KeepAlive: 30 * time.Second,
+			Control:   webhookDialControl,
+		}).DialContext,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   5 * time.Second,
+		ExpectContinueTimeout: time.Second,
+	},
+	CheckRedirect: checkWebhookRedirect,
+}
+
+// The number of attempts made to deliver a webhook before giving up.
+const webhookAttempts = 3
+
+// The newest webhook payload version.
+const MaxWebhookVersion = 1
+
+// Sent to servers using version 0 webhooks.
+var webhookPayloadV0 = []byte(`{"version": 0}`)
+
+type webhookPayloadV1 struct {
+	Version int    `json:"version"`
+	Event   string `json:"event"`
+
+	// A random ID that stays the same if the delivery is retried.
+	DeliveryID string `json:"delivery_id"`
+	Server     string `json:"server"`
+
+	// Transaction events
+	Transactions []Transaction `json:"transactions,omitempty"`
+	PendingCount int           `json:"pending_count,omitempty"`
+
+	// Balance events
+	Balance  *Currency           `json:"balance,omitempty"`
+	Balances map[string]Currency `json:"balances,omitempty"`
+
+	// The names of the settings that changed for settings events.
+	Settings []string `json:"settings,omitempty"`
+}
+
+func randomHex(n int) string {
+	raw := make([]byte, n)
+	if _, err := crypto_rand.Read(raw); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(raw)
+}
+
+func newWebhookDeliveryID() string {
+	return randomHex(16)
+}
+
+func generateWebhookSecret() string {
+	return randomHex(32)
+}
+
+// Webhook requests are signed with the server's webhook secret, the
+// X-Lurkcoin-Signature header is "sha256=" followed by the hex-encoded
+// HMAC-SHA256 of the X-Lurkcoin-Timestamp header (a Unix timestamp), a dot,
+// and the request body. Receivers should reject requests with timestamps
+// more than WebhookReplayWindow away from the current time so that old
+// requests can't be replayed.
+const WebhookSignatureHeader = "X-Lurkcoin-Signature"
+const WebhookTimestampHeader = "X-Lurkcoin-Timestamp"
+const WebhookReplayWindow = 5 * time.Minute
+
+func SignWebhookPayload(secret string, timestamp int64,
+	payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10) + "."))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Adds the timestamp and signature headers to a webhook request.
+func signWebhookRequest(req *http.Request, secret string, payload []byte) {
+	timestamp := time.Now().Unix()
+	req.Header.Set(WebhookTimestampHeader, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(WebhookSignatureHeader,
+		SignWebhookPayload(secret, timestamp, payload))
+}
+
+// A webhook request waiting to be delivered.
+type webhookRequest struct {
+	server     string
+	url        string
+	payload    []byte
+	deliveryID string
+	secret     string
+}
+
+// Returns the request sent to the webhook URL when transaction is added to
+// the pending transactions. The server must be locked.
+func (self *Server) webhookRequest(transaction Transaction) webhookRequest {
+	req := webhookRequest{server: self.UID, url: self.WebhookURL,
+		payload: webhookPayloadV0, secret: self.webhookSecret}
+	if self.webhookVersion < 1 {
+		return req
+	}
+	deliveryID := newWebhookDeliveryID()
+	payload, err := json.Marshal(webhookPayloadV1{
+		Version:      1,
+		Event:        WebhookEventTransaction,
+		DeliveryID:   deliveryID,
+		Server:       self.Name,
+		Transactions: []Transaction{transaction},
+		PendingCount: len(self.pendingTransactions),
+	})
+	if err == nil {
+		req.payload, req.deliveryID = payload, deliveryID
+	}
+	return req
+}
+
+var webhookDeliveries = metrics.NewCounterVec(
+	"lurkcoin_webhook_deliveries_total",
+	"The number of webhook deliveries, result is success, failure or skipped.",
+	"host", "result",
+)
+
+var webhookRetries = metrics.NewCounterVec(
+	"lurkcoin_webhook_retries_total",
+	"The number of times a webhook delivery has been retried.",
+	"host",
+)
+
+var webhookLatency = metrics.NewHistogramVec(
+	"lurkcoin_webhook_delivery_duration_seconds",
+	"The time taken for a webhook receiver to respond to a single request.",
+	nil,
+	"host",
+)
+
+// Sends a single request to the webhook and records it in the delivery log.
+// ok is true if the receiver responded with a 2xx status code, and retry is
+// true if the request failed and should be retried.
+func sendWebhookRequest(webhookURL, host string, r *webhookRequest,
+	attempt int) (retry, ok bool) {
+	delivery := WebhookDelivery{Time: time.Now().Unix(), URL: webhookURL,
+		DeliveryID: r.deliveryID, Attempt: attempt}
+	defer func() { recordWebhookDelivery(r.server, delivery) }()
+
+	req, err := http.NewRequest("POST", webhookURL,
+		bytes.NewReader(r.payload))
+	if err != nil {
+		delivery.Error = err.Error()
+		return false, false
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if r.secret != "" {
+		signWebhookRequest(req, r.secret, r.payload)
+	}
+	req.Header.Set("User-Agent", "lurkcoin/3.0")
+
+	start := time.Now()
+	res, err := webhookClient.Do(req)
+	delivery.Latency = time.Since(start).Seconds()
+	webhookLatency.Observe(delivery.Latency, host)
+	if err != nil {
+		delivery.Error = err.Error()
+		return true, false
+	}
+	res.Body.Close()
+	delivery.StatusCode = res.StatusCode
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return false, true
+	}
+
+	// Only retry server errors, the receiver probably won't change its mind
+	// about anything else.
+	return res.StatusCode >= 500, false
+}
+
+// If every attempt to deliver webhookCircuitThreshold webhooks to a host in a
+// row fails, deliveries to that host are skipped for webhookCircuitCooldown.
+const webhookCircuitThreshold = 5
+const webhookCircuitCooldown = 5 * time.Minute
+
+type webhookCircuit struct {
+	failures  int
+	openUntil time.Time
+}
+
+var webhookCircuitsLock sync.Mutex
+var webhookCircuits = make(map[string]*webhookCircuit)
+
+// Returns false if deliveries to host are currently paused.
+func webhookCircuitClosed(host string) bool {
+	webhookCircuitsLock.Lock()
+	defer webhookCircuitsLock.Unlock()
+	circuit, ok := webhookCircuits[host]
+	return !ok || time.Now().After(circuit.openUntil)
+}
+
+func recordWebhookResult(host string, success bool) {
+	webhookCircuitsLock.Lock()
+	defer webhookCircuitsLock.Unlock()
+	if success {
+		delete(webhookCircuits, host)
+		return
+	}
+
+	circuit, ok := webhookCircuits[host]
+	if !ok {
+		circuit = &webhookCircuit{}
+		webhookCircuits[host] = circuit
+	}
+	circuit.failures++
+	if circuit.failures >= webhookCircuitThreshold {
+		circuit.failures = 0
+		circuit.openUntil = time.Now().Add(webhookCircuitCooldown)
+		Notify(EventWebhookCircuitOpen, fmt.Sprintf("Webhook deliveries to "+
+			"%s have failed %d times in a row, deliveries to this host are "+
+			"paused for %s.", host, webhookCircuitThreshold,
+			webhookCircuitCooldown))
+	}
+}
+
+// The number of webhook deliveries that have been attempted and that have
+// failed since lurkcoin was started. Skipped deliveries aren't counted.
+var webhookDeliveryCount, webhookFailureCount uint64
+
+func GetWebhookDeliveryStats() (deliveries, failures uint64) {
+	return atomic.LoadUint64(&webhookDeliveryCount),
+		atomic.LoadUint64(&webhookFailureCount)
+}
+
+// The number of webhooks that are waiting to be delivered.
+var webhookQueueLength int64
+
+func GetWebhookQueueLength() int {
+	return int(atomic.LoadInt64(&webhookQueueLength))
+}
+
+// Goroutines that should finish before lurkcoin exits, such as webhook
+// deliveries and refunds of rejected transactions.
+var backgroundTasks sync.WaitGroup
+
+// Waits for background tasks to finish. Returns false if they haven't
+// finished after timeout.
+func WaitForBackgroundTasks(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		backgroundTasks.Wait()
+		close(done)
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// Delivers a webhook in a separate goroutine.
+func queueWebhook(req webhookRequest) {
+	atomic.AddInt64(&webhookQueueLength, 1)
+	backgroundTasks.Add(1)
+	go func() {
+		defer backgroundTasks.Done()
+		defer atomic.AddInt64(&webhookQueueLength, -1)
+		deliverWebhook(&req)
+	}()
+}
+
+// Delivers a webhook. This blocks until the delivery succeeds or every
+// attempt has failed.
+func deliverWebhook(req *webhookRequest) {
+	webhookURL, ok := ValidateWebhookURL(req.url)
+	if !ok {
+		recordWebhookDelivery(req.server, WebhookDelivery{
+			Time:       time.Now().Unix(),
+			URL:        req.url,
+			DeliveryID: req.deliveryID,
+			Error:      "Skipped, the webhook URL is not allowed.",
+		})
+		return
+	}
+	u, _ := url.Parse(webhookURL)
+	host := u.Host
+	if !webhookCircuitClosed(host) {
+		webhookDeliveries.Inc(host, "skipped")
+		recordWebhookDelivery(req.server, WebhookDelivery{
+			Time:       time.Now().Unix(),
+			URL:        webhookURL,
+			DeliveryID: req.deliveryID,
+			Error: "Skipped, deliveries to this host are paused after " +
+				"too many failures.",
+		})
+		return
+	}
+
+	atomic.AddUint64(&webhookDeliveryCount, 1)
+	for attempt := 1; attempt <= webhookAttempts; attempt++ {
+		if attempt > 1 {
+			webhookRetries.Inc(host)
+			time.Sleep(time.Duration(attempt-1) * time.Second)
+		}
+		retry, ok := sendWebhookRequest(webhookURL, host, req, attempt)
+		if ok {
+			webhookDeliveries.Inc(host, "success")
+			recordWebhookResult(host, true)
+			return
+		} else if !retry {
+			break
+		}
+	}
+	webhookDeliveries.Inc(host, "failure")
+	atomic.AddUint64(&webhookFailureCount, 1)
+	recordWebhookResult(host, false)
+}
+
+// The maximum size of responses to webhook verification requests.
+const maxWebhookVerificationResponse = 4096
+
+// Checks that the receiver at webhookURL is controlled by the server setting
+// it. A random challenge is sent to the webhook, and the receiver must
+// respond with the challenge (either as the entire response body or in the
+// "challenge" key of a JSON object). The challenge request uses the given
+// webhook version and is signed with secret if it isn't empty.
+func VerifyWebhookURL(webhookURL string, version int, secret string) error {
+	webhookURL, ok := ValidateWebhookURL(webhookURL)
+	if !ok {
+		return errors.New("ERR_INVALIDWEBHOOKURL")
+	}
+
+	challenge := GenerateToken()
+	body, _ := json.Marshal(map[string]interface{}{
+		"version":   version,
+		"challenge": challenge,
+	})
+	req, err := http.NewRequest("POST", webhookURL, bytes.NewReader(body))
+	if err != nil {
+		return errors.New("ERR_INVALIDWEBHOOKURL")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "lurkcoin/3.0")
+	if secret != "" {
+		signWebhookRequest(req, secret, body)
+	}
+
+	res, err := webhookClient.Do(req)
+	if err != nil {
+		return errors.New("ERR_WEBHOOKVERIFICATIONFAILED")
+	}
+	defer res.Body.Close()
+	raw, err := ioutil.ReadAll(io.LimitReader(res.Body,
+		maxWebhookVerificationResponse))
+	if err != nil || res.StatusCode < 200 || res.StatusCode > 299 {
+		return errors.New("ERR_WEBHOOKVERIFICATIONFAILED")
+	}
+
+	var p struct {
+		Challenge string `json:"challenge"`
+	}
+	if strings.TrimSpace(string(raw)) == challenge ||
+		(json.Unmarshal(raw, &p) == nil && p.Challenge == challenge) {
+		return nil
+	}
+	return errors.New("ERR_WEBHOOKVERIFICATIONFAILED")
+}
@@ -19,21 +19,67 @@
 package main
 
 import (
+	"flag"
 	"fmt"
+	"github.com/luk3yx/lurkcoin-core/lurkcoin"
 	"github.com/luk3yx/lurkcoin-core/lurkcoin/api"
 	"log"
 	"os"
 )
 
+// Writes the journal to stdout instead of starting the server.
+func exportJournal(config *api.Config, since, until, entryType string) {
+	j, err := api.OpenJournal(config)
+	if err != nil {
+		log.Fatal(err)
+	} else if j == nil {
+		log.Fatal("The journal is not enabled in the config file.")
+	}
+
+	sinceTime, err := api.ParseTimeFilter(since)
+	if err != nil {
+		log.Fatal(err)
+	}
+	untilTime, err := api.ParseTimeFilter(until)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = lurkcoin.ExportJournal(j, os.Stdout, sinceTime, untilTime, entryType)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
 func main() {
-	if len(os.Args) != 2 {
+	export := flag.Bool("export-journal", false,
+		"Write the journal to stdout as JSON lines and exit.")
+	since := flag.String("since", "",
+		"Only export journal entries made on or after this time.")
+	until := flag.String("until", "",
+		"Only export journal entries made on or before this time.")
+	entryType := flag.String("type", "",
+		`Only export journal entries of this type ("transaction" or "admin").`)
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(),
+			"Usage: %s [options] CONFIG\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 {
 		fmt.Println("This command takes exactly one argument.")
 		os.Exit(1)
 	}
 
-	config, err := api.LoadConfig(os.Args[1])
+	config, err := api.LoadConfig(flag.Arg(0))
 	if err != nil {
 		log.Fatal(err)
 	}
+
+	if *export {
+		exportJournal(config, *since, *until, *entryType)
+		return
+	}
 	api.StartServer(config)
 }